@@ -2,4 +2,7 @@ module com/lifenture/flash-mail-merge
 
 go 1.24.5
 
-require github.com/aws/aws-lambda-go v1.49.0
+require (
+	github.com/andybalholm/brotli v1.1.1
+	github.com/aws/aws-lambda-go v1.49.0
+)
@@ -0,0 +1,149 @@
+package docx
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CorePropertiesPart is the package part holding the core document properties
+const CorePropertiesPart = "docProps/core.xml"
+
+const (
+	corePropertiesContentType = "application/vnd.openxmlformats-package.core-properties+xml"
+	corePropertiesRelType     = "http://schemas.openxmlformats.org/package/2006/relationships/metadata/core-properties"
+)
+
+// coreNamespaces declares the prefixes used by the core property elements
+var coreNamespaces = []struct{ prefix, uri string }{
+	{"cp", "http://schemas.openxmlformats.org/package/2006/metadata/core-properties"},
+	{"dc", "http://purl.org/dc/elements/1.1/"},
+	{"dcterms", "http://purl.org/dc/terms/"},
+	{"xsi", "http://www.w3.org/2001/XMLSchema-instance"},
+}
+
+// CoreProperties maps the supported property names to their core.xml elements
+var CoreProperties = map[string]string{
+	"title":          "dc:title",
+	"subject":        "dc:subject",
+	"author":         "dc:creator",
+	"keywords":       "cp:keywords",
+	"description":    "dc:description",
+	"category":       "cp:category",
+	"lastModifiedBy": "cp:lastModifiedBy",
+	"created":        "dcterms:created",
+	"modified":       "dcterms:modified",
+}
+
+// isDateProperty reports whether the property holds a W3CDTF date
+func isDateProperty(name string) bool {
+	return name == "created" || name == "modified"
+}
+
+// ValidateCoreProperties checks property names and date values before they
+// are applied and reports every problem found
+func ValidateCoreProperties(props map[string]string) error {
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var problems []string
+	for _, name := range names {
+		if _, known := CoreProperties[name]; !known {
+			problems = append(problems, fmt.Sprintf("unknown property '%s'", name))
+			continue
+		}
+		if isDateProperty(name) && !isW3CDTF(props[name]) {
+			problems = append(problems, fmt.Sprintf("property '%s' must be an RFC 3339 timestamp or YYYY-MM-DD date", name))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// isW3CDTF reports whether the value is a timestamp or date Word accepts
+func isW3CDTF(value string) bool {
+	if _, err := time.Parse(time.RFC3339, value); err == nil {
+		return true
+	}
+	_, err := time.Parse("2006-01-02", value)
+	return err == nil
+}
+
+// SetCoreProperties writes the given properties into docProps/core.xml,
+// replacing existing values. The part is created and registered if the
+// document has none. Properties are validated with ValidateCoreProperties.
+func (d *DocxFile) SetCoreProperties(props map[string]string) error {
+	if len(props) == 0 {
+		return nil
+	}
+	if err := ValidateCoreProperties(props); err != nil {
+		return err
+	}
+
+	content := string(d.Files[CorePropertiesPart])
+	if !strings.Contains(content, "</cp:coreProperties>") {
+		content = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" + `<cp:coreProperties></cp:coreProperties>`
+		d.registerPackagePart(CorePropertiesPart, corePropertiesContentType, corePropertiesRelType, "rIdFlashMailMergeCore")
+	}
+	content = declareCoreNamespaces(content)
+
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		element := CoreProperties[name]
+		content = regexp.MustCompile(`(?s)<`+regexp.QuoteMeta(element)+`\b[^>]*?(?:/>|>.*?</`+regexp.QuoteMeta(element)+`>)`).ReplaceAllString(content, "")
+
+		attrs := ""
+		if isDateProperty(name) {
+			attrs = ` xsi:type="dcterms:W3CDTF"`
+		}
+		property := "<" + element + attrs + ">" + escapeText(props[name]) + "</" + element + ">"
+		content = strings.Replace(content, "</cp:coreProperties>", property+"</cp:coreProperties>", 1)
+	}
+
+	d.Files[CorePropertiesPart] = []byte(content)
+	return nil
+}
+
+// coreRootRegex matches the opening tag of the core properties root element
+var coreRootRegex = regexp.MustCompile(`<cp:coreProperties\b[^>]*>`)
+
+// declareCoreNamespaces adds the namespace declarations the core property
+// elements need to the root element, keeping existing declarations
+func declareCoreNamespaces(content string) string {
+	root := coreRootRegex.FindString(content)
+	if root == "" {
+		return content
+	}
+
+	var missing strings.Builder
+	for _, ns := range coreNamespaces {
+		if !strings.Contains(root, "xmlns:"+ns.prefix+"=") {
+			fmt.Fprintf(&missing, ` xmlns:%s="%s"`, ns.prefix, ns.uri)
+		}
+	}
+	if missing.Len() == 0 {
+		return content
+	}
+	return strings.Replace(content, root, strings.TrimSuffix(root, ">")+missing.String()+">", 1)
+}
+
+// escapeText escapes a value for use as XML character data
+func escapeText(s string) string {
+	s = strings.ReplaceAll(s, "&", "&amp;")
+	s = strings.ReplaceAll(s, "<", "&lt;")
+	s = strings.ReplaceAll(s, ">", "&gt;")
+	return s
+}
@@ -0,0 +1,71 @@
+package docx
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDocxFile_SetCoreProperties(t *testing.T) {
+	t.Run("creates and registers core.xml", func(t *testing.T) {
+		docx := &DocxFile{
+			Files: map[string][]byte{
+				"[Content_Types].xml": []byte(`<Types><Default Extension="xml" ContentType="application/xml"/></Types>`),
+				"_rels/.rels":         []byte(`<Relationships><Relationship Id="rId1" Type="officeDocument" Target="word/document.xml"/></Relationships>`),
+			},
+		}
+		if err := docx.SetCoreProperties(map[string]string{"title": "Letter for Jane & Co", "created": "2024-06-05T14:30:00Z"}); err != nil {
+			t.Fatalf("SetCoreProperties failed: %v", err)
+		}
+
+		content := string(docx.Files[CorePropertiesPart])
+		if !strings.Contains(content, "<dc:title>Letter for Jane &amp; Co</dc:title>") {
+			t.Errorf("title not written: %s", content)
+		}
+		if !strings.Contains(content, `<dcterms:created xsi:type="dcterms:W3CDTF">2024-06-05T14:30:00Z</dcterms:created>`) {
+			t.Errorf("created date not written: %s", content)
+		}
+		if !strings.Contains(content, `xmlns:dc="http://purl.org/dc/elements/1.1/"`) {
+			t.Errorf("namespaces not declared: %s", content)
+		}
+		if !strings.Contains(string(docx.Files["[Content_Types].xml"]), `PartName="/docProps/core.xml"`) {
+			t.Errorf("core properties part not registered in content types: %s", docx.Files["[Content_Types].xml"])
+		}
+		if !strings.Contains(string(docx.Files["_rels/.rels"]), `Target="docProps/core.xml"`) {
+			t.Errorf("core properties part not registered in relationships: %s", docx.Files["_rels/.rels"])
+		}
+	})
+
+	t.Run("replaces existing values", func(t *testing.T) {
+		docx := &DocxFile{
+			Files: map[string][]byte{
+				CorePropertiesPart: []byte(`<cp:coreProperties xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties" xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:title>Template</dc:title><dc:creator>Clerk</dc:creator><cp:keywords/></cp:coreProperties>`),
+			},
+		}
+		if err := docx.SetCoreProperties(map[string]string{"title": "Letter", "keywords": "invoice"}); err != nil {
+			t.Fatalf("SetCoreProperties failed: %v", err)
+		}
+
+		content := string(docx.Files[CorePropertiesPart])
+		if strings.Contains(content, "Template") || strings.Count(content, "<dc:title>") != 1 || !strings.Contains(content, "<dc:title>Letter</dc:title>") {
+			t.Errorf("title not replaced: %s", content)
+		}
+		if !strings.Contains(content, "<dc:creator>Clerk</dc:creator>") {
+			t.Errorf("unrelated property was lost: %s", content)
+		}
+		if strings.Contains(content, "<cp:keywords/>") || !strings.Contains(content, "<cp:keywords>invoice</cp:keywords>") {
+			t.Errorf("empty keywords not replaced: %s", content)
+		}
+	})
+
+	t.Run("invalid properties", func(t *testing.T) {
+		err := ValidateCoreProperties(map[string]string{"colour": "red", "created": "yesterday"})
+		if err == nil {
+			t.Fatal("expected an error for invalid properties")
+		}
+		for _, want := range []string{"unknown property 'colour'", "property 'created' must be"} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("expected error to contain %q, got %v", want, err)
+			}
+		}
+	})
+}
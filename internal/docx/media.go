@@ -0,0 +1,97 @@
+package docx
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MediaFolder holds the images and other media of the main document
+	MediaFolder = "word/media/"
+
+	documentRelsPart = "word/_rels/document.xml.rels"
+	imageRelType     = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/image"
+)
+
+var (
+	// mediaImageRegex captures the index of image parts such as
+	// word/media/image12.png, whatever their extension
+	mediaImageRegex = regexp.MustCompile(`^word/media/image(\d+)\.[^/]+$`)
+
+	// relationshipIndexRegex captures the index of rIdN relationship ids
+	relationshipIndexRegex = regexp.MustCompile(`<Relationship\b[^>]*\bId="rId(\d+)"`)
+)
+
+// imageContentTypes maps the image extensions Word embeds to their content type
+var imageContentTypes = map[string]string{
+	"png":  "image/png",
+	"jpeg": "image/jpeg",
+	"jpg":  "image/jpeg",
+	"gif":  "image/gif",
+	"bmp":  "image/bmp",
+	"tif":  "image/tiff",
+	"tiff": "image/tiff",
+	"svg":  "image/svg+xml",
+	"emf":  "image/x-emf",
+	"wmf":  "image/x-wmf",
+}
+
+// NextMediaPartName allocates the name of a new image part with the given
+// extension, e.g. word/media/image3.png. The index follows the highest index
+// of the existing image parts of any extension, so template media are never
+// overwritten and the same document always yields the same name.
+func (d *DocxFile) NextMediaPartName(extension string) string {
+	highest := 0
+	for name := range d.Files {
+		if match := mediaImageRegex.FindStringSubmatch(name); match != nil {
+			if index, err := strconv.Atoi(match[1]); err == nil && index > highest {
+				highest = index
+			}
+		}
+	}
+	return fmt.Sprintf("%simage%d.%s", MediaFolder, highest+1, strings.ToLower(strings.TrimPrefix(extension, ".")))
+}
+
+// AddImage stores an image as a new media part of the main document and
+// returns the part name and the id of the relationship from
+// word/document.xml, to be referenced by r:embed. The extension's content
+// type is declared if the package does not declare it yet.
+func (d *DocxFile) AddImage(content []byte, extension string) (partName, relID string, err error) {
+	extension = strings.ToLower(strings.TrimPrefix(extension, "."))
+	contentType, known := imageContentTypes[extension]
+	if !known {
+		return "", "", fmt.Errorf("unsupported image extension '%s'", extension)
+	}
+
+	partName = d.NextMediaPartName(extension)
+	d.Files[partName] = content
+
+	if contentTypes, exists := d.Files["[Content_Types].xml"]; exists && !strings.Contains(strings.ToLower(string(contentTypes)), `extension="`+extension+`"`) {
+		declaration := `<Default Extension="` + extension + `" ContentType="` + contentType + `"/>`
+		d.Files["[Content_Types].xml"] = []byte(strings.Replace(string(contentTypes), "</Types>", declaration+"</Types>", 1))
+	}
+
+	rels, exists := d.Files[documentRelsPart]
+	if !exists {
+		rels = []byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+			`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"></Relationships>`)
+	}
+	relID = nextRelationshipID(rels)
+	relationship := `<Relationship Id="` + relID + `" Type="` + imageRelType + `" Target="` + strings.TrimPrefix(partName, "word/") + `"/>`
+	d.Files[documentRelsPart] = []byte(strings.Replace(string(rels), "</Relationships>", relationship+"</Relationships>", 1))
+
+	return partName, relID, nil
+}
+
+// nextRelationshipID returns the rIdN id following the highest of a .rels part
+func nextRelationshipID(rels []byte) string {
+	highest := 0
+	for _, match := range relationshipIndexRegex.FindAllSubmatch(rels, -1) {
+		if index, err := strconv.Atoi(string(match[1])); err == nil && index > highest {
+			highest = index
+		}
+	}
+	return "rId" + strconv.Itoa(highest+1)
+}
@@ -0,0 +1,72 @@
+package docx
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDocxFile_AddImage(t *testing.T) {
+	newDocx := func() *DocxFile {
+		return &DocxFile{
+			Files: map[string][]byte{
+				"word/document.xml":     []byte("<document></document>"),
+				"word/media/image1.png": []byte("template image"),
+				"[Content_Types].xml":   []byte(`<Types><Default Extension="xml" ContentType="application/xml"/><Default Extension="png" ContentType="image/png"/></Types>`),
+				"word/_rels/document.xml.rels": []byte(`<Relationships>` +
+					`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+					`<Relationship Id="rId4" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/image" Target="media/image1.png"/>` +
+					`</Relationships>`),
+			},
+		}
+	}
+
+	t.Run("new image follows existing media", func(t *testing.T) {
+		docx := newDocx()
+		partName, relID, err := docx.AddImage([]byte("merged image"), "png")
+		if err != nil {
+			t.Fatalf("AddImage failed: %v", err)
+		}
+		if partName != "word/media/image2.png" || relID != "rId5" {
+			t.Errorf("expected word/media/image2.png with rId5, got %s with %s", partName, relID)
+		}
+		if string(docx.Files["word/media/image1.png"]) != "template image" || string(docx.Files[partName]) != "merged image" {
+			t.Error("expected the template image to be kept next to the new one")
+		}
+		if !strings.Contains(string(docx.Files["word/_rels/document.xml.rels"]), `Id="rId5" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/image" Target="media/image2.png"`) {
+			t.Errorf("image relationship not added: %s", docx.Files["word/_rels/document.xml.rels"])
+		}
+		if strings.Count(string(docx.Files["[Content_Types].xml"]), `Extension="png"`) != 1 {
+			t.Errorf("png content type should be declared once: %s", docx.Files["[Content_Types].xml"])
+		}
+	})
+
+	t.Run("indexes are shared across extensions", func(t *testing.T) {
+		docx := newDocx()
+		docx.Files["word/media/image7.jpeg"] = []byte("jpeg")
+		if name := docx.NextMediaPartName(".PNG"); name != "word/media/image8.png" {
+			t.Errorf("expected word/media/image8.png, got %s", name)
+		}
+
+		partName, _, err := docx.AddImage([]byte("gif"), "gif")
+		if err != nil || partName != "word/media/image8.gif" {
+			t.Fatalf("expected word/media/image8.gif, got %s (%v)", partName, err)
+		}
+		if !strings.Contains(string(docx.Files["[Content_Types].xml"]), `<Default Extension="gif" ContentType="image/gif"/>`) {
+			t.Errorf("gif content type not declared: %s", docx.Files["[Content_Types].xml"])
+		}
+	})
+
+	t.Run("document without media", func(t *testing.T) {
+		docx := &DocxFile{Files: map[string][]byte{"word/document.xml": []byte("<document></document>")}}
+		partName, relID, err := docx.AddImage([]byte("png"), "png")
+		if err != nil || partName != "word/media/image1.png" || relID != "rId1" {
+			t.Errorf("expected word/media/image1.png with rId1, got %s with %s (%v)", partName, relID, err)
+		}
+	})
+
+	t.Run("unsupported extension", func(t *testing.T) {
+		if _, _, err := newDocx().AddImage([]byte("data"), "exe"); err == nil {
+			t.Error("expected an error for an unsupported extension")
+		}
+	})
+}
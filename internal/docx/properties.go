@@ -0,0 +1,107 @@
+package docx
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// CustomPropertiesPart is the package part holding custom document properties
+	CustomPropertiesPart = "docProps/custom.xml"
+
+	// MergeMarkerProperty flags a document produced by this service
+	MergeMarkerProperty = "FlashMailMerge"
+
+	// MergeMarkerTimeProperty records when the document was merged
+	MergeMarkerTimeProperty = "FlashMailMergeMergedAt"
+
+	customPropertiesContentType = "application/vnd.openxmlformats-officedocument.custom-properties+xml"
+	customPropertiesRelType     = "http://schemas.openxmlformats.org/officeDocument/2006/relationships/custom-properties"
+
+	// customPropertyFormatID is the format id Word uses for user-defined properties
+	customPropertyFormatID = "{D5CDD505-2E9C-101B-9397-08002B2CF9AE}"
+)
+
+var (
+	// markerPropertyRegex matches the merge marker properties
+	markerPropertyRegex = regexp.MustCompile(`(?s)<property\b[^>]*\bname="(?:` + MergeMarkerProperty + `|` + MergeMarkerTimeProperty + `)"[^>]*>.*?</property>`)
+
+	// propertyIDRegex captures the pid of custom properties
+	propertyIDRegex = regexp.MustCompile(`\bpid="(\d+)"`)
+)
+
+// propertyValueRegex captures the value of a named custom property
+func propertyValueRegex(name string) *regexp.Regexp {
+	return regexp.MustCompile(`(?s)<property\b[^>]*\bname="` + regexp.QuoteMeta(name) + `"[^>]*>\s*<vt:\w+>(.*?)</vt:\w+>`)
+}
+
+// WasMerged reports whether the document carries the marker written by
+// SetMergeMarker, and when it was merged. The time is zero if unknown.
+func (d *DocxFile) WasMerged() (bool, time.Time) {
+	content, exists := d.Files[CustomPropertiesPart]
+	if !exists {
+		return false, time.Time{}
+	}
+
+	flag := propertyValueRegex(MergeMarkerProperty).FindSubmatch(content)
+	if flag == nil || strings.TrimSpace(string(flag[1])) != "true" {
+		return false, time.Time{}
+	}
+
+	var mergedAt time.Time
+	if value := propertyValueRegex(MergeMarkerTimeProperty).FindSubmatch(content); value != nil {
+		mergedAt, _ = time.Parse(time.RFC3339, strings.TrimSpace(string(value[1])))
+	}
+	return true, mergedAt
+}
+
+// SetMergeMarker records in the custom document properties that the document
+// was merged at the given time, replacing an earlier marker. The custom
+// properties part is created and registered if the document has none.
+func (d *DocxFile) SetMergeMarker(mergedAt time.Time) {
+	content, exists := d.Files[CustomPropertiesPart]
+	if !exists || !strings.Contains(string(content), "</Properties>") {
+		content = []byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+			`<Properties xmlns="http://schemas.openxmlformats.org/officeDocument/2006/custom-properties" xmlns:vt="http://schemas.openxmlformats.org/officeDocument/2006/docPropsVTypes"></Properties>`)
+		d.registerCustomProperties()
+	}
+	content = markerPropertyRegex.ReplaceAll(content, nil)
+
+	// Property ids must be unique and start at 2
+	pid := 1
+	for _, match := range propertyIDRegex.FindAllSubmatch(content, -1) {
+		if id, err := strconv.Atoi(string(match[1])); err == nil && id > pid {
+			pid = id
+		}
+	}
+
+	marker := fmt.Sprintf(`<property fmtid="%s" pid="%d" name="%s"><vt:bool>true</vt:bool></property>`+
+		`<property fmtid="%s" pid="%d" name="%s"><vt:filetime>%s</vt:filetime></property>`,
+		customPropertyFormatID, pid+1, MergeMarkerProperty,
+		customPropertyFormatID, pid+2, MergeMarkerTimeProperty, mergedAt.UTC().Format(time.RFC3339))
+
+	d.Files[CustomPropertiesPart] = []byte(strings.Replace(string(content), "</Properties>", marker+"</Properties>", 1))
+}
+
+// registerCustomProperties declares the custom properties part in the content
+// types and package relationships, unless already declared
+func (d *DocxFile) registerCustomProperties() {
+	d.registerPackagePart(CustomPropertiesPart, customPropertiesContentType, customPropertiesRelType, "rIdFlashMailMergeProps")
+}
+
+// registerPackagePart declares a package-level part in the content types and
+// package relationships, unless already declared
+func (d *DocxFile) registerPackagePart(partName, contentType, relType, relID string) {
+	if contentTypes, exists := d.Files["[Content_Types].xml"]; exists && !strings.Contains(string(contentTypes), `PartName="/`+partName+`"`) {
+		override := `<Override PartName="/` + partName + `" ContentType="` + contentType + `"/>`
+		d.Files["[Content_Types].xml"] = []byte(strings.Replace(string(contentTypes), "</Types>", override+"</Types>", 1))
+	}
+
+	if rels, exists := d.Files["_rels/.rels"]; exists && !strings.Contains(string(rels), partName+`"`) {
+		relationship := `<Relationship Id="` + relID + `" Type="` + relType + `" Target="` + partName + `"/>`
+		d.Files["_rels/.rels"] = []byte(strings.Replace(string(rels), "</Relationships>", relationship+"</Relationships>", 1))
+	}
+}
@@ -0,0 +1,67 @@
+package docx
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDocxFile_MergeMarker(t *testing.T) {
+	newDocx := func() *DocxFile {
+		return &DocxFile{
+			Files: map[string][]byte{
+				"word/document.xml":   []byte("<document></document>"),
+				"[Content_Types].xml": []byte(`<Types><Default Extension="xml" ContentType="application/xml"/></Types>`),
+				"_rels/.rels":         []byte(`<Relationships><Relationship Id="rId1" Type="officeDocument" Target="word/document.xml"/></Relationships>`),
+			},
+		}
+	}
+	mergedAt := time.Date(2024, 6, 5, 14, 30, 0, 0, time.UTC)
+
+	t.Run("unmarked document", func(t *testing.T) {
+		if merged, _ := newDocx().WasMerged(); merged {
+			t.Error("expected a fresh document not to be marked")
+		}
+	})
+
+	t.Run("marker on document without custom properties", func(t *testing.T) {
+		docx := newDocx()
+		docx.SetMergeMarker(mergedAt)
+
+		merged, at := docx.WasMerged()
+		if !merged || !at.Equal(mergedAt) {
+			t.Errorf("expected merged at %v, got %v at %v", mergedAt, merged, at)
+		}
+		if !strings.Contains(string(docx.Files["[Content_Types].xml"]), `PartName="/docProps/custom.xml"`) {
+			t.Errorf("custom properties part not registered in content types: %s", docx.Files["[Content_Types].xml"])
+		}
+		if !strings.Contains(string(docx.Files["_rels/.rels"]), `Target="docProps/custom.xml"`) {
+			t.Errorf("custom properties part not registered in relationships: %s", docx.Files["_rels/.rels"])
+		}
+	})
+
+	t.Run("marker keeps existing properties and replaces earlier marker", func(t *testing.T) {
+		docx := newDocx()
+		docx.Files[CustomPropertiesPart] = []byte(`<Properties xmlns:vt="vt"><property fmtid="{D5CDD505-2E9C-101B-9397-08002B2CF9AE}" pid="5" name="Client"><vt:lpwstr>ACME</vt:lpwstr></property></Properties>`)
+
+		docx.SetMergeMarker(mergedAt)
+		docx.SetMergeMarker(mergedAt.Add(time.Hour))
+
+		content := string(docx.Files[CustomPropertiesPart])
+		if !strings.Contains(content, `name="Client"`) {
+			t.Errorf("existing property was lost: %s", content)
+		}
+		if count := strings.Count(content, `name="FlashMailMerge"`); count != 1 {
+			t.Errorf("expected a single marker property, got %d: %s", count, content)
+		}
+		if strings.Contains(content, `pid="5" name="FlashMailMerge"`) || !strings.Contains(content, `pid="6"`) {
+			t.Errorf("marker property ids should follow existing ids: %s", content)
+		}
+		if _, at := docx.WasMerged(); !at.Equal(mergedAt.Add(time.Hour)) {
+			t.Errorf("expected the latest merge time, got %v", at)
+		}
+		if strings.Contains(string(docx.Files["_rels/.rels"]), "custom") {
+			t.Error("an existing custom properties part should not be registered again")
+		}
+	})
+}
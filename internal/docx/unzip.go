@@ -3,18 +3,44 @@ package docx
 import (
 	"archive/zip"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
+// maxPreallocSize bounds the buffer preallocated for a single archive entry
+const maxPreallocSize = 64 << 20
+
+// ErrEmptyDocument is returned when the document data holds no bytes
+var ErrEmptyDocument = errors.New("empty document")
+
 // DocxFile represents a DOCX file structure
 type DocxFile struct {
 	Files map[string][]byte
+
+	// Order lists the parts in the order of the archive they were read
+	// from, and Methods holds their compression method, so Rebuild can write
+	// them back the same way
+	Order   []string
+	Methods map[string]uint16
 }
 
 // UnzipDocx extracts the contents of a DOCX file from byte data
 func UnzipDocx(data []byte) (*DocxFile, error) {
+	return UnzipDocxParts(data, nil)
+}
+
+// UnzipDocxParts extracts the parts of a DOCX file for which keep returns
+// true. The other entries, such as media, are never decompressed. A nil keep
+// extracts every part.
+func UnzipDocxParts(data []byte, keep func(name string) bool) (*DocxFile, error) {
+	if len(data) == 0 {
+		return nil, ErrEmptyDocument
+	}
+
 	reader := bytes.NewReader(data)
 	zipReader, err := zip.NewReader(reader, int64(len(data)))
 	if err != nil {
@@ -22,11 +48,12 @@ func UnzipDocx(data []byte) (*DocxFile, error) {
 	}
 
 	docx := &DocxFile{
-		Files: make(map[string][]byte),
+		Files:   make(map[string][]byte),
+		Methods: make(map[string]uint16),
 	}
 
 	for _, file := range zipReader.File {
-		if file.FileInfo().IsDir() {
+		if file.FileInfo().IsDir() || (keep != nil && !keep(file.Name)) {
 			continue
 		}
 
@@ -35,12 +62,57 @@ func UnzipDocx(data []byte) (*DocxFile, error) {
 			return nil, fmt.Errorf("failed to read file %s: %w", file.Name, err)
 		}
 
+		if _, seen := docx.Files[file.Name]; !seen {
+			docx.Order = append(docx.Order, file.Name)
+		}
 		docx.Files[file.Name] = content
+		docx.Methods[file.Name] = file.Method
 	}
 
 	return docx, nil
 }
 
+// UnzipDocxReader extracts the contents of a DOCX file read from r. A ZIP
+// archive needs random access, so the archive is buffered once; sizeHint, when
+// positive, preallocates that buffer to avoid regrowing it.
+func UnzipDocxReader(r io.Reader, sizeHint int) (*DocxFile, error) {
+	return UnzipDocxPartsReader(r, sizeHint, nil)
+}
+
+// UnzipDocxPartsReader extracts the parts of a DOCX file read from r for
+// which keep returns true, buffering the archive like UnzipDocxReader
+func UnzipDocxPartsReader(r io.Reader, sizeHint int, keep func(name string) bool) (*DocxFile, error) {
+	var buf bytes.Buffer
+	if sizeHint > 0 {
+		buf.Grow(sizeHint + bytes.MinRead)
+	}
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, fmt.Errorf("failed to read document: %w", err)
+	}
+	return UnzipDocxParts(buf.Bytes(), keep)
+}
+
+// headerFooterPartRegex matches the header and footer parts of the document
+var headerFooterPartRegex = regexp.MustCompile(`^word/(?:header|footer)\d*\.xml$`)
+
+// IsDetectPart reports whether a part is needed to detect the fields of a
+// document: the main document with its headers and footers, the styles, the
+// extended properties and the content types. Media and other binary parts are
+// not.
+func IsDetectPart(name string) bool {
+	switch name {
+	case "word/document.xml", "word/styles.xml", "docProps/app.xml", "[Content_Types].xml":
+		return true
+	}
+	return IsHeaderFooterPart(name)
+}
+
+// IsHeaderFooterPart reports whether a part is a header or footer of the
+// document, e.g. word/header1.xml
+func IsHeaderFooterPart(name string) bool {
+	return headerFooterPartRegex.MatchString(name)
+}
+
 // readZipFile reads the content of a single file from the zip archive
 func readZipFile(file *zip.File) ([]byte, error) {
 	reader, err := file.Open()
@@ -49,13 +121,65 @@ func readZipFile(file *zip.File) ([]byte, error) {
 	}
 	defer reader.Close()
 
-	return io.ReadAll(reader)
+	// Presize from the header, capped since the declared size is untrusted
+	var buf bytes.Buffer
+	if size := file.UncompressedSize64; size < maxPreallocSize {
+		buf.Grow(int(size) + bytes.MinRead)
+	}
+	if _, err := buf.ReadFrom(reader); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// NotWordDocumentError is returned for an Office Open XML package of another
+// kind, such as a spreadsheet uploaded in place of a Word document
+type NotWordDocumentError struct {
+	// Kind names the package type, e.g. "spreadsheet" or "presentation"
+	Kind string
+}
+
+func (e *NotWordDocumentError) Error() string {
+	return fmt.Sprintf("uploaded file is a %s, not a Word document", e.Kind)
+}
+
+// packageKinds maps the content type prefixes of the main part of the other
+// Office Open XML packages to their kind
+var packageKinds = []struct {
+	contentType string
+	kind        string
+}{
+	{"application/vnd.openxmlformats-officedocument.spreadsheetml.", "spreadsheet"},
+	{"application/vnd.ms-excel.", "spreadsheet"},
+	{"application/vnd.openxmlformats-officedocument.presentationml.", "presentation"},
+	{"application/vnd.ms-powerpoint.", "presentation"},
+}
+
+// mainPartContentTypeRegex captures the content type of the main part of an
+// Office package, declared by an <Override> in [Content_Types].xml
+var mainPartContentTypeRegex = regexp.MustCompile(`ContentType="([^"]*\.main\+xml)"`)
+
+// CheckWordDocument returns a NotWordDocumentError when [Content_Types].xml
+// declares the main part of a spreadsheet or presentation. Packages without
+// content types are not rejected.
+func (d *DocxFile) CheckWordDocument() error {
+	for _, match := range mainPartContentTypeRegex.FindAllSubmatch(d.Files["[Content_Types].xml"], -1) {
+		for _, pkg := range packageKinds {
+			if strings.HasPrefix(string(match[1]), pkg.contentType) {
+				return &NotWordDocumentError{Kind: pkg.kind}
+			}
+		}
+	}
+	return nil
 }
 
 // GetDocumentXML returns the main document XML content
 func (d *DocxFile) GetDocumentXML() ([]byte, error) {
 	content, exists := d.Files["word/document.xml"]
 	if !exists {
+		if err := d.CheckWordDocument(); err != nil {
+			return nil, err
+		}
 		return nil, fmt.Errorf("document.xml not found in DOCX file")
 	}
 	return content, nil
@@ -70,6 +194,86 @@ func (d *DocxFile) GetContentTypes() ([]byte, error) {
 	return content, nil
 }
 
+// HasMailMergeSettings reports whether word/settings.xml contains a
+// <w:mailMerge> block, which makes Word ask to reconnect to a data source
+func (d *DocxFile) HasMailMergeSettings() bool {
+	content, exists := d.Files["word/settings.xml"]
+	if !exists {
+		return false
+	}
+	return strings.Contains(string(content), "<w:mailMerge>") || strings.Contains(string(content), "<w:mailMerge ")
+}
+
+var (
+	// relationshipIDRegex captures the Id of <Relationship> elements
+	relationshipIDRegex = regexp.MustCompile(`<Relationship\b[^>]*\bId="([^"]*)"`)
+
+	// relationshipReferenceRegex captures r:id, r:embed and r:link references
+	relationshipReferenceRegex = regexp.MustCompile(`\br:(?:id|embed|link)="([^"]*)"`)
+)
+
+// ValidateRelationships checks that the relationship IDs of the main document
+// are unique and that every relationship referenced from word/document.xml is
+// declared. It returns a warning for each problem found.
+func (d *DocxFile) ValidateRelationships() []string {
+	var warnings []string
+
+	declared := make(map[string]int)
+	for _, match := range relationshipIDRegex.FindAllSubmatch(d.Files["word/_rels/document.xml.rels"], -1) {
+		id := string(match[1])
+		declared[id]++
+		if declared[id] == 2 {
+			warnings = append(warnings, fmt.Sprintf("Relationship ID '%s' is declared more than once", id))
+		}
+	}
+
+	reported := make(map[string]bool)
+	for _, match := range relationshipReferenceRegex.FindAllSubmatch(d.Files["word/document.xml"], -1) {
+		id := string(match[1])
+		if declared[id] == 0 && !reported[id] {
+			reported[id] = true
+			warnings = append(warnings, fmt.Sprintf("Relationship ID '%s' referenced in document.xml is not declared", id))
+		}
+	}
+
+	return warnings
+}
+
+var (
+	// sectionPropertiesRegex matches <w:sectPr> elements but not <w:sectPrChange>
+	sectionPropertiesRegex = regexp.MustCompile(`<w:sectPr[\s/>]`)
+
+	// appPagesRegex captures the page count saved in docProps/app.xml
+	appPagesRegex = regexp.MustCompile(`<Pages>\s*(\d+)\s*</Pages>`)
+)
+
+// SectionCount returns the number of sections of the main document, counting
+// its <w:sectPr> elements. The previous properties kept inside a tracked
+// <w:sectPrChange> are not counted.
+func (d *DocxFile) SectionCount() int {
+	content := d.Files["word/document.xml"]
+	count := len(sectionPropertiesRegex.FindAllIndex(content, -1)) - strings.Count(string(content), "<w:sectPrChange")
+	if count < 0 {
+		return 0
+	}
+	return count
+}
+
+// EstimatedPageCount returns the page count Word saved in docProps/app.xml
+// when the document was last written, or 0 if unknown. The merge itself may
+// change the real page count.
+func (d *DocxFile) EstimatedPageCount() int {
+	match := appPagesRegex.FindSubmatch(d.Files["docProps/app.xml"])
+	if match == nil {
+		return 0
+	}
+	pages, err := strconv.Atoi(string(match[1]))
+	if err != nil {
+		return 0
+	}
+	return pages
+}
+
 // HasFile checks if a specific file exists in the DOCX archive
 func (d *DocxFile) HasFile(filename string) bool {
 	_, exists := d.Files[filename]
@@ -1,7 +1,12 @@
 package docx
 
 import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 
@@ -53,3 +58,232 @@ func TestDocxFile_IsValidDocx(t *testing.T) {
 		}
 	})
 }
+
+func TestDocxFile_HasMailMergeSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string][]byte
+		expected bool
+	}{
+		{
+			name:     "no settings part",
+			files:    map[string][]byte{"word/document.xml": []byte("<document></document>")},
+			expected: false,
+		},
+		{
+			name:     "settings without mail merge",
+			files:    map[string][]byte{"word/settings.xml": []byte(`<w:settings><w:mailMergeFieldsShaded/></w:settings>`)},
+			expected: false,
+		},
+		{
+			name:     "settings with mail merge",
+			files:    map[string][]byte{"word/settings.xml": []byte(`<w:settings><w:mailMerge><w:mainDocumentType w:val="formLetters"/></w:mailMerge></w:settings>`)},
+			expected: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docx := &DocxFile{Files: tt.files}
+			if docx.HasMailMergeSettings() != tt.expected {
+				t.Errorf("Expected HasMailMergeSettings() to be %v", tt.expected)
+			}
+		})
+	}
+}
+
+func TestUnzipDocxReader(t *testing.T) {
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	fileWriter, err := zipWriter.Create("word/document.xml")
+	if err != nil {
+		t.Fatalf("failed to create zip entry: %v", err)
+	}
+	fileWriter.Write([]byte("<w:document/>"))
+	zipWriter.Close()
+
+	for _, sizeHint := range []int{0, 10, buf.Len()} {
+		docx, err := UnzipDocxReader(bytes.NewReader(buf.Bytes()), sizeHint)
+		if err != nil {
+			t.Fatalf("unexpected error with size hint %d: %v", sizeHint, err)
+		}
+		if string(docx.Files["word/document.xml"]) != "<w:document/>" {
+			t.Errorf("unexpected document content with size hint %d: %s", sizeHint, docx.Files["word/document.xml"])
+		}
+	}
+
+	t.Run("read error", func(t *testing.T) {
+		readErr := errors.New("boom")
+		_, err := UnzipDocxReader(iotest.ErrReader(readErr), 0)
+		if !errors.Is(err, readErr) {
+			t.Errorf("expected wrapped read error, got %v", err)
+		}
+	})
+}
+
+func TestUnzipDocxParts(t *testing.T) {
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	for _, name := range []string{"[Content_Types].xml", "word/document.xml", "word/header1.xml", "word/footer2.xml", "word/styles.xml", "word/media/image1.png", "word/embeddings/oleObject1.bin", "word/headers.xml"} {
+		fileWriter, err := zipWriter.Create(name)
+		if err != nil {
+			t.Fatalf("failed to create zip entry: %v", err)
+		}
+		fileWriter.Write([]byte("content of " + name))
+	}
+	zipWriter.Close()
+
+	docx, err := UnzipDocxParts(buf.Bytes(), IsDetectPart)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, name := range []string{"[Content_Types].xml", "word/document.xml", "word/header1.xml", "word/footer2.xml", "word/styles.xml"} {
+		if string(docx.Files[name]) != "content of "+name {
+			t.Errorf("expected %s to be extracted, got %q", name, docx.Files[name])
+		}
+	}
+	for _, name := range []string{"word/media/image1.png", "word/embeddings/oleObject1.bin", "word/headers.xml"} {
+		if docx.HasFile(name) {
+			t.Errorf("expected %s to be skipped", name)
+		}
+	}
+
+	all, err := UnzipDocxParts(buf.Bytes(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(all.Files) != 8 {
+		t.Errorf("expected all 8 parts without a filter, got %d", len(all.Files))
+	}
+}
+
+func TestDocxFile_CheckWordDocument(t *testing.T) {
+	contentTypes := func(mainType string) []byte {
+		return []byte(`<Types><Default Extension="xml" ContentType="application/xml"/>` +
+			`<Override PartName="/main.xml" ContentType="` + mainType + `"/></Types>`)
+	}
+	tests := []struct {
+		name  string
+		files map[string][]byte
+		kind  string
+	}{
+		{
+			name:  "word document",
+			files: map[string][]byte{"[Content_Types].xml": contentTypes("application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml"), "word/document.xml": []byte("<w:document/>")},
+		},
+		{
+			name:  "no content types",
+			files: map[string][]byte{"word/document.xml": []byte("<w:document/>")},
+		},
+		{
+			name:  "spreadsheet",
+			files: map[string][]byte{"[Content_Types].xml": contentTypes("application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"), "xl/workbook.xml": []byte("<workbook/>")},
+			kind:  "spreadsheet",
+		},
+		{
+			name:  "presentation",
+			files: map[string][]byte{"[Content_Types].xml": contentTypes("application/vnd.openxmlformats-officedocument.presentationml.presentation.main+xml")},
+			kind:  "presentation",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docx := &DocxFile{Files: tt.files}
+			err := docx.CheckWordDocument()
+			if tt.kind == "" {
+				if err != nil {
+					t.Errorf("expected no error, got %v", err)
+				}
+				return
+			}
+
+			var notWord *NotWordDocumentError
+			if !errors.As(err, &notWord) || notWord.Kind != tt.kind {
+				t.Fatalf("expected NotWordDocumentError of kind %s, got %v", tt.kind, err)
+			}
+			if want := "uploaded file is a " + tt.kind + ", not a Word document"; err.Error() != want {
+				t.Errorf("expected message %q, got %q", want, err.Error())
+			}
+			if _, err := docx.GetDocumentXML(); !errors.As(err, &notWord) {
+				t.Errorf("expected GetDocumentXML to report the package kind, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDocxFile_ValidateRelationships(t *testing.T) {
+	newDocx := func(rels, document string) *DocxFile {
+		return &DocxFile{
+			Files: map[string][]byte{
+				"word/document.xml":            []byte(document),
+				"word/_rels/document.xml.rels": []byte(rels),
+			},
+		}
+	}
+	rels := `<Relationships><Relationship Id="rId1" Type="styles" Target="styles.xml"/><Relationship Id="rId2" Type="image" Target="media/image1.png"/></Relationships>`
+
+	t.Run("consistent relationships", func(t *testing.T) {
+		docx := newDocx(rels, `<w:document><w:hyperlink r:id="rId1"/><a:blip r:embed="rId2"/></w:document>`)
+		if warnings := docx.ValidateRelationships(); len(warnings) != 0 {
+			t.Errorf("expected no warnings, got %v", warnings)
+		}
+	})
+
+	t.Run("dangling reference", func(t *testing.T) {
+		docx := newDocx(rels, `<w:document><w:hyperlink r:id="rId9"/><w:hyperlink r:id="rId9"/></w:document>`)
+		warnings := docx.ValidateRelationships()
+		if len(warnings) != 1 || !strings.Contains(warnings[0], "'rId9'") {
+			t.Errorf("expected one warning for rId9, got %v", warnings)
+		}
+	})
+
+	t.Run("duplicate ID", func(t *testing.T) {
+		duplicated := `<Relationships><Relationship Id="rId1" Target="styles.xml"/><Relationship Id="rId1" Target="numbering.xml"/><Relationship Id="rId1" Target="theme.xml"/></Relationships>`
+		docx := newDocx(duplicated, `<w:document><w:hyperlink r:id="rId1"/></w:document>`)
+		warnings := docx.ValidateRelationships()
+		if len(warnings) != 1 || !strings.Contains(warnings[0], "'rId1' is declared more than once") {
+			t.Errorf("expected one duplicate warning for rId1, got %v", warnings)
+		}
+	})
+}
+
+func TestUnzipDocxEmpty(t *testing.T) {
+	if _, err := UnzipDocx(nil); !errors.Is(err, ErrEmptyDocument) {
+		t.Errorf("Expected ErrEmptyDocument, got %v", err)
+	}
+	if _, err := UnzipDocxReader(strings.NewReader(""), 0); !errors.Is(err, ErrEmptyDocument) {
+		t.Errorf("Expected ErrEmptyDocument from reader, got %v", err)
+	}
+}
+
+func TestDocxFile_SectionAndPageCount(t *testing.T) {
+	t.Run("two sections", func(t *testing.T) {
+		docx := &DocxFile{Files: map[string][]byte{
+			"word/document.xml": []byte(`<w:document><w:body>` +
+				`<w:p><w:pPr><w:sectPr><w:type w:val="nextPage"/></w:sectPr></w:pPr></w:p>` +
+				`<w:p/>` +
+				`<w:sectPr><w:pgSz w:w="12240"/><w:sectPrChange w:id="1"><w:sectPr/></w:sectPrChange></w:sectPr>` +
+				`</w:body></w:document>`),
+		}}
+		if count := docx.SectionCount(); count != 2 {
+			t.Errorf("expected 2 sections, got %d", count)
+		}
+		if pages := docx.EstimatedPageCount(); pages != 0 {
+			t.Errorf("expected unknown page count without app.xml, got %d", pages)
+		}
+	})
+
+	t.Run("app.xml pages", func(t *testing.T) {
+		docx := &DocxFile{Files: map[string][]byte{
+			"word/document.xml": []byte(`<w:document><w:body><w:sectPr/></w:body></w:document>`),
+			"docProps/app.xml":  []byte(`<Properties><Template>Normal.dotm</Template><Pages>3</Pages><Words>412</Words></Properties>`),
+		}}
+		if count := docx.SectionCount(); count != 1 {
+			t.Errorf("expected 1 section, got %d", count)
+		}
+		if pages := docx.EstimatedPageCount(); pages != 3 {
+			t.Errorf("expected 3 pages, got %d", pages)
+		}
+	})
+}
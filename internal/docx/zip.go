@@ -1,2 +1,73 @@
 package docx
 
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// contentTypesPart is written first in a rebuilt archive, as Word does and as
+// strict consumers expect
+const contentTypesPart = "[Content_Types].xml"
+
+// Rebuild writes the parts of the DOCX file as a ZIP archive. Parts read by
+// UnzipDocx keep their original order and compression method, so unchanged
+// parts round-trip as they were; parts added since follow in name order and
+// are compressed. [Content_Types].xml always comes first.
+func (d *DocxFile) Rebuild() ([]byte, error) {
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+
+	for _, name := range d.entryOrder() {
+		method, known := d.Methods[name]
+		if !known {
+			method = zip.Deflate
+		}
+
+		fileWriter, err := zipWriter.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if err != nil {
+			zipWriter.Close()
+			return nil, fmt.Errorf("failed to create file %s in ZIP: %w", name, err)
+		}
+		if _, err := fileWriter.Write(d.Files[name]); err != nil {
+			zipWriter.Close()
+			return nil, fmt.Errorf("failed to write content for file %s: %w", name, err)
+		}
+	}
+
+	if err := zipWriter.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close ZIP writer: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// entryOrder lists the parts in the order they are written: the content
+// types, the parts in their recorded order and then the new parts by name
+func (d *DocxFile) entryOrder() []string {
+	order := make([]string, 0, len(d.Files))
+	written := make(map[string]bool, len(d.Files))
+	add := func(name string) {
+		if _, exists := d.Files[name]; exists && !written[name] {
+			written[name] = true
+			order = append(order, name)
+		}
+	}
+
+	add(contentTypesPart)
+	for _, name := range d.Order {
+		add(name)
+	}
+
+	var added []string
+	for name := range d.Files {
+		if !written[name] {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+	for _, name := range added {
+		add(name)
+	}
+	return order
+}
@@ -0,0 +1,114 @@
+package docx
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// zipEntries lists the names and compression methods of an archive's entries
+func zipEntries(t *testing.T, data []byte) ([]string, []uint16) {
+	t.Helper()
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("Failed to read archive: %v", err)
+	}
+	var names []string
+	var methods []uint16
+	for _, file := range reader.File {
+		names = append(names, file.Name)
+		methods = append(methods, file.Method)
+	}
+	return names, methods
+}
+
+func TestRebuildRoundTripsSample(t *testing.T) {
+	samplePath := filepath.Join("..", "..", "tests", "data", "sample.docx")
+	original, err := os.ReadFile(samplePath)
+	if os.IsNotExist(err) {
+		t.Skip("Sample DOCX file not found, skipping test")
+	}
+	if err != nil {
+		t.Fatalf("Failed to read sample DOCX file: %v", err)
+	}
+
+	doc, err := UnzipDocx(original)
+	if err != nil {
+		t.Fatalf("UnzipDocx failed: %v", err)
+	}
+	rebuilt, err := doc.Rebuild()
+	if err != nil {
+		t.Fatalf("Rebuild failed: %v", err)
+	}
+
+	wantNames, wantMethods := zipEntries(t, original)
+	gotNames, gotMethods := zipEntries(t, rebuilt)
+	if !reflect.DeepEqual(gotNames, wantNames) {
+		t.Errorf("Entry order = %v, want %v", gotNames, wantNames)
+	}
+	if !reflect.DeepEqual(gotMethods, wantMethods) {
+		t.Errorf("Compression methods = %v, want %v", gotMethods, wantMethods)
+	}
+
+	roundTripped, err := UnzipDocx(rebuilt)
+	if err != nil {
+		t.Fatalf("UnzipDocx of the rebuilt archive failed: %v", err)
+	}
+	if !reflect.DeepEqual(roundTripped.Files, doc.Files) {
+		t.Error("Part contents changed in the round trip")
+	}
+}
+
+func TestRebuildEntryOrder(t *testing.T) {
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	for _, entry := range []struct {
+		name   string
+		method uint16
+	}{
+		{"word/document.xml", zip.Deflate},
+		{"word/media/image1.png", zip.Store},
+		{"[Content_Types].xml", zip.Store},
+		{"_rels/.rels", zip.Deflate},
+		{"docProps/app.xml", zip.Deflate},
+	} {
+		file, err := writer.CreateHeader(&zip.FileHeader{Name: entry.name, Method: entry.method})
+		if err != nil {
+			t.Fatalf("Failed to add %s: %v", entry.name, err)
+		}
+		file.Write([]byte("<" + entry.name + ">"))
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close archive: %v", err)
+	}
+
+	doc, err := UnzipDocx(buf.Bytes())
+	if err != nil {
+		t.Fatalf("UnzipDocx failed: %v", err)
+	}
+	if want := []string{"word/document.xml", "word/media/image1.png", "[Content_Types].xml", "_rels/.rels", "docProps/app.xml"}; !reflect.DeepEqual(doc.Order, want) {
+		t.Errorf("Order = %v, want %v", doc.Order, want)
+	}
+
+	// Added parts follow by name, removed ones are left out
+	doc.Files["word/settings.xml"] = []byte("<settings/>")
+	doc.Files["customXml/item1.xml"] = []byte("<item/>")
+	delete(doc.Files, "docProps/app.xml")
+
+	rebuilt, err := doc.Rebuild()
+	if err != nil {
+		t.Fatalf("Rebuild failed: %v", err)
+	}
+	names, methods := zipEntries(t, rebuilt)
+	wantNames := []string{"[Content_Types].xml", "word/document.xml", "word/media/image1.png", "_rels/.rels", "customXml/item1.xml", "word/settings.xml"}
+	wantMethods := []uint16{zip.Store, zip.Deflate, zip.Store, zip.Deflate, zip.Deflate, zip.Deflate}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("Entry order = %v, want %v", names, wantNames)
+	}
+	if !reflect.DeepEqual(methods, wantMethods) {
+		t.Errorf("Compression methods = %v, want %v", methods, wantMethods)
+	}
+}
@@ -2,15 +2,174 @@ package fields
 
 import (
 	"encoding/xml"
+	"fmt"
 	"strings"
 	"time"
 	"com/lifenture/flash-mail-merge/internal/docx"
 )
 
-// Extract extracts field names from a DOCX document XML string
-func Extract(documentXML string) ([]string, error) {
-	decoder := xml.NewDecoder(strings.NewReader(documentXML))
+// Extract extracts field names from a DOCX document XML string. Names are
+// given without the DefaultRequiredMarker of required fields. Text elements
+// holding a whole placeholder with one of the delimiters, such as
+// {{FirstName}}, are reported as fields as well.
+func Extract(documentXML string, delimiters ...Delimiters) ([]string, error) {
+	result := extract(documentXML, DefaultRequiredMarker, delimiters)
+	return result.fieldNames, nil
+}
+
+// Instructions returns the instruction text of every simple and complex field
+// of a DOCX document XML string, including fields that are not MERGEFIELDs
+func Instructions(documentXML string) []string {
+	return extract(documentXML, DefaultRequiredMarker, nil).instructions
+}
+
+// styleIDs holds the paragraph and character style ids in effect at a point
+// of the document
+type styleIDs struct {
+	paragraph string
+	character string
+}
+
+// extraction is the outcome of walking a document XML
+type extraction struct {
+	// fieldNames lists the distinct MERGEFIELD names
+	fieldNames []string
+
+	// prompts lists the FILLIN prompts in document order
+	prompts []FillInPrompt
+
+	// styles maps each field name to the styles at its first occurrence
+	styles map[string]styleIDs
+
+	// instructions lists the instruction of every field, in the order the
+	// fields end
+	instructions []string
+
+	// switches maps each field name to the type and format inferred from
+	// the \@ or \# switch of its first occurrence having one
+	switches map[string]fieldSwitches
+
+	// required holds the names of the fields marked required by any of
+	// their occurrences
+	required map[string]bool
+
+	// fieldInstructions maps each field name to the instruction of its
+	// first occurrence, as written in the document
+	fieldInstructions map[string]string
+
+	// positions maps each field name to the position of its first
+	// occurrence, with the text of its paragraph as context
+	positions map[string]FieldPosition
+
+	// repeated holds the names of the fields whose every occurrence is
+	// inside a repeating section
+	repeated map[string]bool
+
+	// controlTags lists the distinct tags of the repeating section and
+	// checkbox content controls outside repeating sections
+	controlTags []string
+}
+
+// contentControl holds the properties of an enclosing <w:sdt> element
+type contentControl struct {
+	tag       string
+	repeating bool // a repeating section, filled from an array
+	checkbox  bool
+	inContent bool // the walk is past the properties, in <w:sdtContent>
+}
+
+// extract walks the document XML and collects the distinct MERGEFIELD names,
+// the FILLIN prompts and the styles in effect at each field. Names ending in
+// requiredMarker are recorded without it, as required fields. Text elements
+// that are a whole placeholder with one of the delimiters are recorded as
+// fields without an instruction.
+//
+// The position of a field spans its fldSimple element, its complex field from
+// the begin to the end marker, or the <w:t> element of its placeholder. A
+// field nested in another takes the position of the outer one.
+func extract(documentXML, requiredMarker string, delimiters []Delimiters) extraction {
+	tracker := newPositionTracker(documentXML)
+	decoder := xml.NewTokenDecoder(tracker)
 	fieldNames := make(map[string]struct{})
+	result := extraction{
+		styles:            make(map[string]styleIDs),
+		switches:          make(map[string]fieldSwitches),
+		required:          make(map[string]bool),
+		fieldInstructions: make(map[string]string),
+		positions:         make(map[string]FieldPosition),
+		repeated:          make(map[string]bool),
+	}
+
+	// The complex field walk consumes its own tokens, so the styles seen at a
+	// field's begin marker stay in effect until the field is recorded. The
+	// same holds for the position where the outermost field starts; the
+	// fields recorded since wait in unended for the offset where it ends.
+	var current styleIDs
+	var fieldStart FieldPosition
+	var unended []string
+	var controls []contentControl
+	controlTags := make(map[string]bool)
+	simpleDepth := 0
+	inRepeatingSection := func() bool {
+		for _, control := range controls {
+			if control.repeating && control.inContent {
+				return true
+			}
+		}
+		return false
+	}
+	startField := func() {
+		if simpleDepth == 0 {
+			fieldStart = tracker.position()
+		}
+	}
+	endField := func() {
+		if simpleDepth > 0 {
+			return
+		}
+		for _, name := range unended {
+			position := result.positions[name]
+			position.EndOffset = int(tracker.offset())
+			result.positions[name] = position
+		}
+		unended = unended[:0]
+	}
+	addName := func(name, instr string) {
+		name, required := RequiredFieldName(NormalizeFieldName(name), requiredMarker)
+		if required || hasRequiredSwitch(instr) {
+			result.required[name] = true
+		}
+		if _, seen := fieldNames[name]; !seen {
+			result.styles[name] = current
+			result.fieldInstructions[name] = instr
+			result.positions[name] = fieldStart
+			unended = append(unended, name)
+		} else if result.fieldInstructions[name] == "" {
+			// A placeholder seen first leaves the instruction to the field
+			result.fieldInstructions[name] = instr
+		}
+		if _, seen := fieldNames[name]; !seen || !inRepeatingSection() {
+			result.repeated[name] = inRepeatingSection()
+		}
+		fieldNames[name] = struct{}{}
+		if _, inferred := result.switches[name]; !inferred {
+			if switches, ok := parseFieldSwitches(instr); ok {
+				result.switches[name] = switches
+			}
+		}
+	}
+	addInstruction := func(instr, formName string) {
+		result.instructions = append(result.instructions, instr)
+		name := MergeFieldName(instr)
+		if name == "" {
+			name = FormTextName(instr, formName)
+		}
+		if name != "" {
+			addName(name, instr)
+		} else if prompt, ok := parseFillIn(instr); ok {
+			result.prompts = append(result.prompts, prompt)
+		}
+	}
 
 	for {
 		tok, err := decoder.Token()
@@ -20,103 +179,412 @@ func Extract(documentXML string) ([]string, error) {
 
 		switch token := tok.(type) {
 		case xml.StartElement:
-			name := token.Name.Local
-
-			// Check for simple fields
-			if name == "fldSimple" {
-				for _, attr := range token.Attr {
-					if attr.Name.Local == "instr" && strings.Contains(attr.Value, "MERGEFIELD") {
-						parts := strings.Fields(attr.Value)
-						if len(parts) > 1 {
-							fieldName := parts[1]
-							fieldNames[fieldName] = struct{}{}
-						}
+			switch token.Name.Local {
+			case "p":
+				current = styleIDs{}
+			case "r":
+				current.character = ""
+			case "pStyle":
+				current.paragraph = attrValue(token, "val")
+			case "rStyle":
+				current.character = attrValue(token, "val")
+			case "t":
+				// Check for text placeholders such as {{FirstName}}
+				if len(delimiters) > 0 {
+					startField()
+					var text string
+					decoder.DecodeElement(&text, &token)
+					if name, ok := PlaceholderName(text, delimiters); ok {
+						addName(name, "")
 					}
+					endField()
 				}
-			}
-
-			// Check for complex fields
-			if name == "fldChar" {
+			case "sdt":
+				controls = append(controls, contentControl{})
+			case "tag", "repeatingSection", "checkbox":
+				// Properties of the innermost content control
+				if len(controls) == 0 || controls[len(controls)-1].inContent {
+					break
+				}
+				control := &controls[len(controls)-1]
+				switch token.Name.Local {
+				case "tag":
+					control.tag = attrValue(token, "val")
+				case "repeatingSection":
+					control.repeating = true
+				case "checkbox":
+					control.checkbox = true
+				}
+			case "sdtContent":
+				// The merge fills the controls outside repeating sections
+				// from the data key their tag names
+				if len(controls) == 0 {
+					break
+				}
+				control := &controls[len(controls)-1]
+				if (control.repeating || control.checkbox) && control.tag != "" && !inRepeatingSection() && !controlTags[control.tag] {
+					controlTags[control.tag] = true
+					result.controlTags = append(result.controlTags, control.tag)
+				}
+				control.inContent = true
+			case "fldSimple":
+				// Check for simple fields
+				startField()
+				simpleDepth++
+				addSimpleField(token, addInstruction)
+			case "fldChar":
+				// Check for complex fields
 				fieldType, found := getFieldCharType(token)
 				if found && fieldType == "begin" {
-					str, ok := extractComplexField(decoder)
-					if ok {
-						fieldNames[str] = struct{}{}
-					}
+					startField()
+					extractComplexField(decoder, addInstruction)
+					endField()
+				}
+			}
+		case xml.EndElement:
+			switch token.Name.Local {
+			case "p":
+				current = styleIDs{}
+			case "r":
+				current.character = ""
+			case "fldSimple":
+				simpleDepth--
+				endField()
+			case "sdt":
+				if len(controls) > 0 {
+					controls = controls[:len(controls)-1]
 				}
 			}
 		}
 	}
 
 	// Convert fieldNames map to a slice
-	uniqueFieldNames := make([]string, 0, len(fieldNames))
+	result.fieldNames = make([]string, 0, len(fieldNames))
 	for name := range fieldNames {
-		uniqueFieldNames = append(uniqueFieldNames, name)
+		result.fieldNames = append(result.fieldNames, name)
 	}
 
-	return uniqueFieldNames, nil
+	// Describe each field by the text of its paragraph
+	for name, position := range result.positions {
+		position.Context = tracker.paragraphText(position.NodeIndex)
+		result.positions[name] = position
+	}
+
+	return result
+}
+
+// DefaultDocumentName names the source document of a field set when the
+// caller gives no name
+const DefaultDocumentName = "document.docx"
+
+const (
+	// DefaultRequiredMarker ends the names of required fields, as in Email*,
+	// unless the extract options set another marker
+	DefaultRequiredMarker = "*"
+
+	// RequiredSwitch marks a MERGEFIELD as required, as in MERGEFIELD Email \req
+	RequiredSwitch = `\req`
+)
+
+// ExtractOptions controls how extracted fields are populated
+type ExtractOptions struct {
+	// DefaultFieldType is assigned to fields without type information, i.e.
+	// without a \@ date or \# number switch. An empty value means
+	// FieldTypeString.
+	DefaultFieldType FieldType
+
+	// ResolveStyles records on each field the paragraph and character styles
+	// in effect where it first appears, resolved against styles.xml
+	ResolveStyles bool
+
+	// DocumentName names the source document in the field set, for logging
+	// and reporting. An empty value means DefaultDocumentName.
+	DocumentName string
+
+	// RequiredMarker is the suffix of the field names of required fields,
+	// as in Email*; it is not part of the extracted name. An empty value
+	// means DefaultRequiredMarker. Fields with the RequiredSwitch are
+	// required as well.
+	RequiredMarker string
+
+	// Delimiters lists the delimiters of the text placeholders reported as
+	// fields besides the MERGEFIELDs, e.g. BraceDelimiters for {{FirstName}}.
+	// With none, only fields are extracted.
+	Delimiters []Delimiters
 }
 
 // ExtractFields extracts merge fields from the given DOCX document
 func ExtractFields(doc *docx.DocxFile) (*MergeFieldSet, error) {
+	return ExtractFieldsWithOptions(doc, ExtractOptions{})
+}
+
+// ExtractFieldsWithOptions extracts merge fields from the given DOCX document
+// using the provided extraction options
+func ExtractFieldsWithOptions(doc *docx.DocxFile, opts ExtractOptions) (*MergeFieldSet, error) {
+	defaultType := opts.DefaultFieldType
+	if defaultType == "" {
+		defaultType = FieldTypeString
+	}
+	if !defaultType.IsValid() {
+		return nil, fmt.Errorf("invalid default field type '%s'", defaultType)
+	}
+
+	documentName := strings.TrimSpace(opts.DocumentName)
+	if documentName == "" {
+		documentName = DefaultDocumentName
+	}
+
 	docContent, err := doc.GetDocumentXML()
 	if err != nil {
 		return nil, err
 	}
 
-	// Get field names using the Extract function
-	fieldNames, err := Extract(string(docContent))
-	if err != nil {
-		return nil, err
+	// Get field names and FILLIN prompts from the document
+	requiredMarker := strings.TrimSpace(opts.RequiredMarker)
+	if requiredMarker == "" {
+		requiredMarker = DefaultRequiredMarker
+	}
+	extracted := extract(string(docContent), requiredMarker, opts.Delimiters)
+
+	var sheet styleSheet
+	if opts.ResolveStyles {
+		sheet = parseStyles(doc.Files[StylesPart])
 	}
 
 	// Convert field names to MergeField structs
-	fields := make([]MergeField, len(fieldNames))
-	for i, name := range fieldNames {
+	fields := make([]MergeField, len(extracted.fieldNames))
+	for i, name := range extracted.fieldNames {
 		fields[i] = MergeField{
-			Name:     name,
-			Type:     FieldTypeString,
-			Required: false,
+			Name:               name,
+			Type:               defaultType,
+			Required:           extracted.required[name],
+			Position:           extracted.positions[name],
+			Instruction:        extracted.fieldInstructions[name],
+			InRepeatingSection: extracted.repeated[name],
+		}
+		// A \@ or \# switch tells the type better than the default
+		if switches, ok := extracted.switches[name]; ok {
+			fields[i].Type = switches.fieldType
+			fields[i].Format = switches.format
+		}
+		if opts.ResolveStyles {
+			styles := extracted.styles[name]
+			fields[i].Styles = sheet.resolve(styles.paragraph, styles.character)
 		}
 	}
 
 	return &MergeFieldSet{
-		Fields:       fields,
-		ExtractedAt:  time.Now(),
-		TotalFields:  len(fields),
-		DocumentName: "document.docx",
+		Fields:             fields,
+		ExtractedAt:        time.Now(),
+		TotalFields:        len(fields),
+		DocumentName:       documentName,
+		Prompts:            extracted.prompts,
+		ContentControlTags: extracted.controlTags,
 	}, nil
 }
 
-// Extract text from complex field
-func extractComplexField(decoder *xml.Decoder) (string, bool) {
-	var name string
+// addSimpleField records the field instruction of a fldSimple element
+func addSimpleField(token xml.StartElement, addInstruction func(instr, formName string)) {
+	for _, attr := range token.Attr {
+		if attr.Name.Local == "instr" {
+			addInstruction(attr.Value, "")
+		}
+	}
+}
+
+// formFieldData holds the <w:ffData> of a legacy form field
+type formFieldData struct {
+	Name struct {
+		Val string `xml:"val,attr"`
+	} `xml:"name"`
+}
+
+// extractComplexField walks the tokens of a complex field up to its matching
+// "end" marker. The instruction may be split over several instrText runs, so
+// it is accumulated before the field name is parsed. Fields nested before the
+// end marker (a MERGEFIELD inside an IF, or a field in a nested table cell
+// reached before a cell-spanning field closes) are reported as well instead of
+// terminating the walk early. Legacy form fields carry their name in the
+// <w:ffData> of the begin marker, which is read before the instruction.
+func extractComplexField(decoder *xml.Decoder, addInstruction func(instr, formName string)) {
+	var instr strings.Builder
+	var formData formFieldData
+	defer func() {
+		addInstruction(instr.String(), formData.Name.Val)
+	}()
+
 	for {
 		tok, err := decoder.Token()
 		if err != nil {
+			return
+		}
+		token, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch token.Name.Local {
+		case "instrText":
+			var value string
+			decoder.DecodeElement(&value, &token)
+			instr.WriteString(value)
+		case "ffData":
+			decoder.DecodeElement(&formData, &token)
+		case "fldSimple":
+			addSimpleField(token, addInstruction)
+		case "fldChar":
+			fieldType, found := getFieldCharType(token)
+			if !found {
+				continue
+			}
+			switch fieldType {
+			case "begin":
+				extractComplexField(decoder, addInstruction)
+			case "end":
+				return
+			}
+		}
+	}
+}
+
+// mergeFieldArgSwitches are the MERGEFIELD switches followed by an argument:
+// the \b and \f text, and the \* format, \@ date and \# numeric pictures
+var mergeFieldArgSwitches = map[string]bool{`\b`: true, `\f`: true, `\*`: true, `\@`: true, `\#`: true}
+
+// formatKeywords are the arguments of the \* switch. Word sometimes writes
+// them without the switch, so they are never taken for the field name when
+// the instruction holds another name.
+var formatKeywords = map[string]bool{
+	"MERGEFORMAT": true, "CHARFORMAT": true,
+	"UPPER": true, "LOWER": true, "FIRSTCAP": true, "CAPS": true,
+}
+
+// MergeFieldName returns the field name of a MERGEFIELD instruction, or an
+// empty string if the instruction is not a MERGEFIELD. The name need not
+// follow MERGEFIELD directly: switches and their arguments are skipped, so
+// MERGEFIELD \* Upper FirstName yields FirstName. Quoted names may contain
+// spaces.
+func MergeFieldName(instr string) string {
+	tokens := splitInstruction(instr)
+	start := -1
+	for i, token := range tokens {
+		if strings.EqualFold(token, "MERGEFIELD") {
+			start = i + 1
 			break
 		}
-		switch token := tok.(type) {
-		case xml.StartElement:
-			if token.Name.Local == "instrText" {
-				var value string
-				decoder.DecodeElement(&value, &token)
-				if strings.Contains(value, "MERGEFIELD") {
-					parts := strings.Fields(value)
-					if len(parts) > 1 {
-						name = parts[1]
-					}
-				}
-			} else if token.Name.Local == "fldChar" {
-				// Check if this is the end of the field
-				fieldType, found := getFieldCharType(token)
-				if found && fieldType == "end" {
-					return name, name != ""
-				}
+	}
+	if start < 0 {
+		return ""
+	}
+
+	keyword := ""
+	for i := start; i < len(tokens); i++ {
+		token := tokens[i]
+		switch {
+		case strings.HasPrefix(token, `\`):
+			// \*Upper carries its argument in the same token
+			if mergeFieldArgSwitches[token] {
+				i++
+			}
+		case formatKeywords[strings.ToUpper(token)]:
+			if keyword == "" {
+				keyword = token
 			}
+		default:
+			return token
 		}
 	}
-	return "", false
+	return keyword
+}
+
+// RequiredFieldName returns a field name without the required marker ending
+// it, e.g. Email for Email* with the marker "*", and reports whether the
+// marker was there. A name made only of the marker is returned unchanged.
+func RequiredFieldName(name, marker string) (string, bool) {
+	if marker == "" {
+		return name, false
+	}
+	base, found := strings.CutSuffix(name, marker)
+	base = strings.TrimSpace(base)
+	if !found || base == "" {
+		return name, false
+	}
+	return base, true
+}
+
+// hasRequiredSwitch reports whether a MERGEFIELD instruction carries the
+// RequiredSwitch
+func hasRequiredSwitch(instr string) bool {
+	if MergeFieldName(instr) == "" {
+		return false
+	}
+	for _, token := range splitInstruction(instr) {
+		if strings.EqualFold(token, RequiredSwitch) {
+			return true
+		}
+	}
+	return false
+}
+
+// FormTextName returns the name of a legacy FORMTEXT text form field, which is
+// the bookmark name given in its <w:ffData>, or an empty string if the
+// instruction is not a FORMTEXT or the field has no name
+func FormTextName(instr, formName string) string {
+	tokens := splitInstruction(instr)
+	if len(tokens) == 0 || !strings.EqualFold(tokens[0], "FORMTEXT") {
+		return ""
+	}
+	return strings.TrimSpace(formName)
+}
+
+// parseFillIn parses a FILLIN instruction such as FILLIN "Your name?" \d "Jane"
+// and reports false if the instruction is not a FILLIN field
+func parseFillIn(instr string) (FillInPrompt, bool) {
+	tokens := splitInstruction(instr)
+	if len(tokens) == 0 || !strings.EqualFold(tokens[0], "FILLIN") {
+		return FillInPrompt{}, false
+	}
+
+	var prompt FillInPrompt
+	for i := 1; i < len(tokens); i++ {
+		switch {
+		case strings.EqualFold(tokens[i], `\d`) && i+1 < len(tokens):
+			i++
+			prompt.DefaultValue = tokens[i]
+		case strings.HasPrefix(tokens[i], `\`):
+			// Other switches such as \o take no argument
+		case prompt.Prompt == "":
+			prompt.Prompt = tokens[i]
+		}
+	}
+	return prompt, true
+}
+
+// splitInstruction splits a field instruction into words, keeping quoted
+// arguments together without their quotes
+func splitInstruction(instr string) []string {
+	var tokens []string
+	var current strings.Builder
+	inQuotes, hasToken := false, false
+	for _, r := range instr {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			hasToken = true
+		case !inQuotes && (r == ' ' || r == '\t' || r == '\n' || r == '\r'):
+			if hasToken {
+				tokens = append(tokens, current.String())
+				current.Reset()
+				hasToken = false
+			}
+		default:
+			current.WriteRune(r)
+			hasToken = true
+		}
+	}
+	if hasToken {
+		tokens = append(tokens, current.String())
+	}
+	return tokens
 }
 
 // Get field char type
@@ -111,6 +111,117 @@ func TestExtract(t *testing.T) {
 			expectedFields: []string{"FirstName"},
 			expectError:    false,
 		},
+		{
+			name: "fields in nested table cells",
+			documentXML: `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+    <w:body>
+        <w:tbl>
+            <w:tr>
+                <w:tc>
+                    <w:p>
+                        <w:fldSimple w:instr=" MERGEFIELD  Outer  \* MERGEFORMAT ">
+                            <w:r><w:t>«Outer»</w:t></w:r>
+                        </w:fldSimple>
+                    </w:p>
+                    <w:tbl>
+                        <w:tr>
+                            <w:tc>
+                                <w:p>
+                                    <w:r><w:fldChar w:fldCharType="begin"/></w:r>
+                                    <w:r><w:instrText> MERGEFIELD  InnerFirst </w:instrText></w:r>
+                                    <w:r><w:fldChar w:fldCharType="separate"/></w:r>
+                                    <w:r><w:t>«InnerFirst»</w:t></w:r>
+                                    <w:r><w:fldChar w:fldCharType="end"/></w:r>
+                                </w:p>
+                            </w:tc>
+                            <w:tc>
+                                <w:p>
+                                    <w:r><w:fldChar w:fldCharType="begin"/></w:r>
+                                    <w:r><w:instrText> MERGEFIELD  InnerSecond </w:instrText></w:r>
+                                    <w:r><w:fldChar w:fldCharType="separate"/></w:r>
+                                    <w:r><w:t>«InnerSecond»</w:t></w:r>
+                                    <w:r><w:fldChar w:fldCharType="end"/></w:r>
+                                </w:p>
+                            </w:tc>
+                        </w:tr>
+                    </w:tbl>
+                </w:tc>
+            </w:tr>
+        </w:tbl>
+    </w:body>
+</w:document>`,
+			expectedFields: []string{"Outer", "InnerFirst", "InnerSecond"},
+			expectError:    false,
+		},
+		{
+			name: "complex field spanning nested table cells",
+			documentXML: `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+    <w:body>
+        <w:tbl>
+            <w:tr>
+                <w:tc>
+                    <w:p>
+                        <w:r><w:fldChar w:fldCharType="begin"/></w:r>
+                        <w:r><w:instrText> MERGEFIELD  Spanning </w:instrText></w:r>
+                        <w:r><w:fldChar w:fldCharType="separate"/></w:r>
+                    </w:p>
+                    <w:tbl>
+                        <w:tr>
+                            <w:tc>
+                                <w:p>
+                                    <w:r><w:fldChar w:fldCharType="begin"/></w:r>
+                                    <w:r><w:instrText> MERGEFIELD  Nested </w:instrText></w:r>
+                                    <w:r><w:fldChar w:fldCharType="separate"/></w:r>
+                                    <w:r><w:t>«Nested»</w:t></w:r>
+                                    <w:r><w:fldChar w:fldCharType="end"/></w:r>
+                                </w:p>
+                                <w:p>
+                                    <w:fldSimple w:instr=" MERGEFIELD  NestedSimple ">
+                                        <w:r><w:t>«NestedSimple»</w:t></w:r>
+                                    </w:fldSimple>
+                                </w:p>
+                            </w:tc>
+                        </w:tr>
+                    </w:tbl>
+                    <w:p>
+                        <w:r><w:t>«Spanning»</w:t></w:r>
+                        <w:r><w:fldChar w:fldCharType="end"/></w:r>
+                    </w:p>
+                </w:tc>
+                <w:tc>
+                    <w:p>
+                        <w:r><w:fldChar w:fldCharType="begin"/></w:r>
+                        <w:r><w:instrText> MERGEFIELD  After </w:instrText></w:r>
+                        <w:r><w:fldChar w:fldCharType="end"/></w:r>
+                    </w:p>
+                </w:tc>
+            </w:tr>
+        </w:tbl>
+    </w:body>
+</w:document>`,
+			expectedFields: []string{"Spanning", "Nested", "NestedSimple", "After"},
+			expectError:    false,
+		},
+		{
+			name: "complex field instruction split across runs",
+			documentXML: `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+    <w:body>
+        <w:p>
+            <w:r><w:fldChar w:fldCharType="begin"/></w:r>
+            <w:r><w:instrText xml:space="preserve"> MERGEFIELD </w:instrText></w:r>
+            <w:r><w:instrText>Phone</w:instrText></w:r>
+            <w:r><w:fldChar w:fldCharType="separate"/></w:r>
+            <w:r><w:t>«Phone»</w:t></w:r>
+            <w:r><w:fldChar w:fldCharType="end"/></w:r>
+        </w:p>
+    </w:body>
+</w:document>`,
+			expectedFields: []string{"Phone"},
+			expectError:    false,
+		},
 		{
 			name: "no merge fields",
 			documentXML: `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
@@ -213,3 +324,500 @@ func TestExtractFromSampleDocx(t *testing.T) {
 		t.Errorf("Expected 20 fields, got %d", len(fields))
 	}
 }
+
+func TestExtractFieldsWithDefaultFieldType(t *testing.T) {
+	doc := &docx.DocxFile{
+		Files: map[string][]byte{
+			"word/document.xml": []byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+    <w:body>
+        <w:p>
+            <w:fldSimple w:instr=" MERGEFIELD  Quantity ">
+                <w:t>«Quantity»</w:t>
+            </w:fldSimple>
+            <w:fldSimple w:instr=" MERGEFIELD  UnitPrice ">
+                <w:t>«UnitPrice»</w:t>
+            </w:fldSimple>
+        </w:p>
+    </w:body>
+</w:document>`),
+		},
+	}
+
+	t.Run("defaults to string", func(t *testing.T) {
+		fieldSet, err := ExtractFields(doc)
+		if err != nil {
+			t.Fatalf("ExtractFields failed: %v", err)
+		}
+		for _, field := range fieldSet.Fields {
+			if field.Type != FieldTypeString {
+				t.Errorf("Expected field '%s' to default to %s, got %s", field.Name, FieldTypeString, field.Type)
+			}
+		}
+	})
+
+	t.Run("default propagates to all fields", func(t *testing.T) {
+		fieldSet, err := ExtractFieldsWithOptions(doc, ExtractOptions{DefaultFieldType: FieldTypeNumber})
+		if err != nil {
+			t.Fatalf("ExtractFieldsWithOptions failed: %v", err)
+		}
+		if len(fieldSet.Fields) != 2 {
+			t.Fatalf("Expected 2 fields, got %d", len(fieldSet.Fields))
+		}
+		for _, field := range fieldSet.Fields {
+			if field.Type != FieldTypeNumber {
+				t.Errorf("Expected field '%s' to have type %s, got %s", field.Name, FieldTypeNumber, field.Type)
+			}
+		}
+
+		// The default type drives validation
+		result := fieldSet.Validate(MergeData{"Quantity": float64(3), "UnitPrice": 9.99})
+		if !result.Valid {
+			t.Errorf("Expected numeric values to be valid, got errors: %v", result.Errors)
+		}
+
+		result = fieldSet.Validate(MergeData{"Quantity": "three"})
+		if result.Valid {
+			t.Error("Expected string value to be invalid for a number field")
+		}
+		if len(result.Errors) != 1 {
+			t.Errorf("Expected 1 error, got %d: %v", len(result.Errors), result.Errors)
+		}
+	})
+
+	t.Run("invalid default type", func(t *testing.T) {
+		_, err := ExtractFieldsWithOptions(doc, ExtractOptions{DefaultFieldType: FieldType("decimal")})
+		if err == nil {
+			t.Error("Expected error for invalid default field type")
+		}
+	})
+}
+
+func TestExtractFieldsFillInPrompts(t *testing.T) {
+	doc := &docx.DocxFile{
+		Files: map[string][]byte{
+			"word/document.xml": []byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+    <w:body>
+        <w:p>
+            <w:fldSimple w:instr=" MERGEFIELD  FirstName ">
+                <w:r><w:t>«FirstName»</w:t></w:r>
+            </w:fldSimple>
+            <w:fldSimple w:instr=" FILLIN &quot;Reason for the visit?&quot; \o ">
+                <w:r><w:t>checkup</w:t></w:r>
+            </w:fldSimple>
+        </w:p>
+        <w:p>
+            <w:r><w:fldChar w:fldCharType="begin"/></w:r>
+            <w:r><w:instrText xml:space="preserve"> FILLIN "Which </w:instrText></w:r>
+            <w:r><w:instrText xml:space="preserve">department?" \d "Sales" </w:instrText></w:r>
+            <w:r><w:fldChar w:fldCharType="separate"/></w:r>
+            <w:r><w:t>Sales</w:t></w:r>
+            <w:r><w:fldChar w:fldCharType="end"/></w:r>
+        </w:p>
+    </w:body>
+</w:document>`),
+		},
+	}
+
+	fieldSet, err := ExtractFields(doc)
+	if err != nil {
+		t.Fatalf("ExtractFields failed: %v", err)
+	}
+
+	// FILLIN fields are not merge fields
+	if len(fieldSet.Fields) != 1 || fieldSet.Fields[0].Name != "FirstName" {
+		t.Errorf("Expected only the FirstName merge field, got %+v", fieldSet.Fields)
+	}
+
+	expected := []FillInPrompt{
+		{Prompt: "Reason for the visit?"},
+		{Prompt: "Which department?", DefaultValue: "Sales"},
+	}
+	if !reflect.DeepEqual(fieldSet.Prompts, expected) {
+		t.Errorf("Prompts = %+v, want %+v", fieldSet.Prompts, expected)
+	}
+}
+
+func TestExtractFieldsResolveStyles(t *testing.T) {
+	doc := &docx.DocxFile{
+		Files: map[string][]byte{
+			"word/document.xml": []byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+    <w:body>
+        <w:p>
+            <w:pPr><w:pStyle w:val="Heading1"/></w:pPr>
+            <w:r><w:rPr><w:rStyle w:val="Strong"/></w:rPr><w:fldChar w:fldCharType="begin"/></w:r>
+            <w:r><w:instrText xml:space="preserve"> MERGEFIELD Title </w:instrText></w:r>
+            <w:r><w:fldChar w:fldCharType="separate"/></w:r>
+            <w:r><w:t>«Title»</w:t></w:r>
+            <w:r><w:fldChar w:fldCharType="end"/></w:r>
+        </w:p>
+        <w:p>
+            <w:r><w:rPr><w:rStyle w:val="Strong"/></w:rPr><w:t>Dear </w:t></w:r>
+            <w:fldSimple w:instr=" MERGEFIELD Name "><w:r><w:t>«Name»</w:t></w:r></w:fldSimple>
+        </w:p>
+    </w:body>
+</w:document>`),
+			"word/styles.xml": []byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:styles xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+    <w:style w:type="paragraph" w:default="1" w:styleId="Normal"><w:name w:val="Normal"/></w:style>
+    <w:style w:type="paragraph" w:styleId="Heading1"><w:name w:val="heading 1"/></w:style>
+    <w:style w:type="character" w:styleId="Strong"><w:name w:val="Strong"/></w:style>
+</w:styles>`),
+		},
+	}
+
+	fieldSet, err := ExtractFieldsWithOptions(doc, ExtractOptions{ResolveStyles: true})
+	if err != nil {
+		t.Fatalf("ExtractFieldsWithOptions failed: %v", err)
+	}
+
+	expected := map[string]*FieldStyles{
+		"Title": {
+			Paragraph: &StyleRef{ID: "Heading1", Name: "heading 1"},
+			Character: &StyleRef{ID: "Strong", Name: "Strong"},
+		},
+		// The paragraph sets no style and the preceding run's style does not carry over
+		"Name": {
+			Paragraph: &StyleRef{ID: "Normal", Name: "Normal"},
+		},
+	}
+	for name, want := range expected {
+		field := fieldSet.GetFieldByName(name)
+		if field == nil {
+			t.Fatalf("Field %s not extracted", name)
+		}
+		if !reflect.DeepEqual(field.Styles, want) {
+			t.Errorf("Styles of %s = %+v, want %+v", name, field.Styles, want)
+		}
+	}
+
+	// Styles are only resolved on request
+	fieldSet, err = ExtractFields(doc)
+	if err != nil {
+		t.Fatalf("ExtractFields failed: %v", err)
+	}
+	for _, field := range fieldSet.Fields {
+		if field.Styles != nil {
+			t.Errorf("Field %s should have no styles without ResolveStyles", field.Name)
+		}
+	}
+}
+
+func TestMergeFieldName(t *testing.T) {
+	tests := []struct {
+		instr    string
+		expected string
+	}{
+		{` MERGEFIELD  FirstName  \* MERGEFORMAT `, "FirstName"},
+		{` MERGEFIELD \* Upper FirstName `, "FirstName"},
+		{` MERGEFIELD \* MERGEFORMAT FirstName `, "FirstName"},
+		{` MERGEFIELD \*Upper FirstName `, "FirstName"},
+		{` MERGEFIELD \@ "d MMMM yyyy" StartDate `, "StartDate"},
+		{` MERGEFIELD \b "Dear " \f ", " FirstName `, "FirstName"},
+		{` MERGEFIELD MERGEFORMAT Upper FirstName `, "FirstName"},
+		{` MERGEFIELD \m Upper `, "Upper"},
+		{` MERGEFIELD "First Name" \* Caps `, "First Name"},
+		{` mergefield FirstName `, "FirstName"},
+		{` MERGEFIELD \* Upper `, ""},
+		{` MERGEFIELD `, ""},
+		{` FILLIN "Your name?" `, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.instr, func(t *testing.T) {
+			if name := MergeFieldName(tt.instr); name != tt.expected {
+				t.Errorf("MergeFieldName(%q) = %q, want %q", tt.instr, name, tt.expected)
+			}
+		})
+	}
+}
+
+func TestExtractMergeFieldWithLeadingSwitch(t *testing.T) {
+	documentXML := `<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+    <w:body>
+        <w:p>
+            <w:fldSimple w:instr=" MERGEFIELD \* Upper FirstName ">
+                <w:r><w:t>«FirstName»</w:t></w:r>
+            </w:fldSimple>
+            <w:r><w:fldChar w:fldCharType="begin"/></w:r>
+            <w:r><w:instrText xml:space="preserve"> MERGEFIELD \* Lower LastName </w:instrText></w:r>
+            <w:r><w:fldChar w:fldCharType="separate"/></w:r>
+            <w:r><w:t>«LastName»</w:t></w:r>
+            <w:r><w:fldChar w:fldCharType="end"/></w:r>
+        </w:p>
+    </w:body>
+</w:document>`
+
+	names, err := Extract(documentXML)
+	if err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"FirstName", "LastName"}) {
+		t.Errorf("Extract = %v, want [FirstName LastName]", names)
+	}
+}
+
+func TestExtractFormTextField(t *testing.T) {
+	documentXML := `<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+    <w:body>
+        <w:p>
+            <w:bookmarkStart w:id="0" w:name="Comments"/>
+            <w:r><w:fldChar w:fldCharType="begin"><w:ffData><w:name w:val="Comments"/><w:enabled/><w:calcOnExit w:val="0"/><w:textInput><w:default w:val="No comments"/></w:textInput></w:ffData></w:fldChar></w:r>
+            <w:r><w:instrText xml:space="preserve"> FORMTEXT </w:instrText></w:r>
+            <w:r><w:fldChar w:fldCharType="separate"/></w:r>
+            <w:r><w:t>No comments</w:t></w:r>
+            <w:r><w:fldChar w:fldCharType="end"/></w:r>
+            <w:bookmarkEnd w:id="0"/>
+            <w:r><w:fldChar w:fldCharType="begin"><w:ffData><w:name w:val="Agree"/><w:checkBox><w:default w:val="0"/></w:checkBox></w:ffData></w:fldChar></w:r>
+            <w:r><w:instrText xml:space="preserve"> FORMCHECKBOX </w:instrText></w:r>
+            <w:r><w:fldChar w:fldCharType="end"/></w:r>
+            <w:r><w:fldChar w:fldCharType="begin"><w:ffData><w:enabled/></w:ffData></w:fldChar></w:r>
+            <w:r><w:instrText xml:space="preserve"> FORMTEXT </w:instrText></w:r>
+            <w:r><w:fldChar w:fldCharType="end"/></w:r>
+        </w:p>
+    </w:body>
+</w:document>`
+
+	names, err := Extract(documentXML)
+	if err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+	// Check boxes and unnamed form fields are not merge fields
+	if !reflect.DeepEqual(names, []string{"Comments"}) {
+		t.Errorf("Extract = %v, want [Comments]", names)
+	}
+}
+
+func TestExtractFieldsRequiredFields(t *testing.T) {
+	doc := &docx.DocxFile{
+		Files: map[string][]byte{
+			"word/document.xml": []byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+    <w:body>
+        <w:p>
+            <w:fldSimple w:instr=" MERGEFIELD Email* ">
+                <w:r><w:t>«Email*»</w:t></w:r>
+            </w:fldSimple>
+            <w:r><w:fldChar w:fldCharType="begin"/></w:r>
+            <w:r><w:instrText xml:space="preserve"> MERGEFIELD LastName \req \* MERGEFORMAT </w:instrText></w:r>
+            <w:r><w:fldChar w:fldCharType="separate"/></w:r>
+            <w:r><w:t>«LastName»</w:t></w:r>
+            <w:r><w:fldChar w:fldCharType="end"/></w:r>
+            <w:fldSimple w:instr=" MERGEFIELD Phone! ">
+                <w:r><w:t>«Phone!»</w:t></w:r>
+            </w:fldSimple>
+            <w:fldSimple w:instr=" MERGEFIELD Nickname ">
+                <w:r><w:t>«Nickname»</w:t></w:r>
+            </w:fldSimple>
+        </w:p>
+        <w:p>
+            <w:fldSimple w:instr=" MERGEFIELD Email ">
+                <w:r><w:t>«Email»</w:t></w:r>
+            </w:fldSimple>
+        </w:p>
+    </w:body>
+</w:document>`),
+		},
+	}
+
+	required := func(fieldSet *MergeFieldSet) map[string]bool {
+		result := make(map[string]bool, len(fieldSet.Fields))
+		for _, field := range fieldSet.Fields {
+			result[field.Name] = field.Required
+		}
+		return result
+	}
+
+	t.Run("default marker and switch", func(t *testing.T) {
+		fieldSet, err := ExtractFields(doc)
+		if err != nil {
+			t.Fatalf("ExtractFields failed: %v", err)
+		}
+		// Email* and Email are one field, required by its marked occurrence
+		expected := map[string]bool{"Email": true, "LastName": true, "Phone!": false, "Nickname": false}
+		if got := required(fieldSet); !reflect.DeepEqual(got, expected) {
+			t.Errorf("Required = %v, want %v", got, expected)
+		}
+
+		// Validate enforces the required fields
+		result := fieldSet.Validate(MergeData{"Nickname": "Jo"})
+		sort.Strings(result.MissingFields)
+		if expected := []string{"Email", "LastName"}; !reflect.DeepEqual(result.MissingFields, expected) {
+			t.Errorf("MissingFields = %v, want %v", result.MissingFields, expected)
+		}
+	})
+
+	t.Run("configured marker", func(t *testing.T) {
+		fieldSet, err := ExtractFieldsWithOptions(doc, ExtractOptions{RequiredMarker: "!"})
+		if err != nil {
+			t.Fatalf("ExtractFieldsWithOptions failed: %v", err)
+		}
+		expected := map[string]bool{"Email*": false, "Email": false, "LastName": true, "Phone": true, "Nickname": false}
+		if got := required(fieldSet); !reflect.DeepEqual(got, expected) {
+			t.Errorf("Required = %v, want %v", got, expected)
+		}
+	})
+
+	t.Run("no convention", func(t *testing.T) {
+		names, err := Extract(`<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body><w:p>` +
+			`<w:fldSimple w:instr=" MERGEFIELD FirstName \* Upper "><w:r><w:t>«FirstName»</w:t></w:r></w:fldSimple>` +
+			`<w:fldSimple w:instr=" MERGEFIELD * "><w:r><w:t>«*»</w:t></w:r></w:fldSimple>` +
+			`</w:p></w:body></w:document>`)
+		if err != nil {
+			t.Fatalf("Extract failed: %v", err)
+		}
+		sort.Strings(names)
+		// A name made only of the marker is kept as it is
+		if expected := []string{"*", "FirstName"}; !reflect.DeepEqual(names, expected) {
+			t.Errorf("Extract = %v, want %v", names, expected)
+		}
+	})
+}
+
+func TestExtractFieldsInstructions(t *testing.T) {
+	doc := &docx.DocxFile{
+		Files: map[string][]byte{
+			"word/document.xml": []byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+    <w:body>
+        <w:p>
+            <w:fldSimple w:instr=" MERGEFIELD FirstName \* Upper ">
+                <w:r><w:t>«FirstName»</w:t></w:r>
+            </w:fldSimple>
+            <w:r><w:fldChar w:fldCharType="begin"/></w:r>
+            <w:r><w:instrText xml:space="preserve"> MERGEFIELD Total </w:instrText></w:r>
+            <w:r><w:instrText xml:space="preserve">\# "0.00" </w:instrText></w:r>
+            <w:r><w:fldChar w:fldCharType="separate"/></w:r>
+            <w:r><w:t>«Total»</w:t></w:r>
+            <w:r><w:fldChar w:fldCharType="end"/></w:r>
+        </w:p>
+        <w:p>
+            <w:fldSimple w:instr=" MERGEFIELD FirstName ">
+                <w:r><w:t>«FirstName»</w:t></w:r>
+            </w:fldSimple>
+        </w:p>
+    </w:body>
+</w:document>`),
+		},
+	}
+
+	fieldSet, err := ExtractFields(doc)
+	if err != nil {
+		t.Fatalf("ExtractFields failed: %v", err)
+	}
+
+	// The first occurrence gives the instruction, with split instrText runs
+	// joined
+	expected := map[string]string{
+		"FirstName": ` MERGEFIELD FirstName \* Upper `,
+		"Total":     ` MERGEFIELD Total \# "0.00" `,
+	}
+	for name, instruction := range expected {
+		field := fieldSet.GetFieldByName(name)
+		if field == nil {
+			t.Fatalf("Field %s not extracted", name)
+		}
+		if field.Instruction != instruction {
+			t.Errorf("Instruction of %s = %q, want %q", name, field.Instruction, instruction)
+		}
+	}
+}
+
+func TestExtractFieldsCollapsesWhitespace(t *testing.T) {
+	doc := &docx.DocxFile{
+		Files: map[string][]byte{
+			"word/document.xml": []byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+    <w:body>
+        <w:p>
+            <w:fldSimple w:instr=" MERGEFIELD &quot;First  Name&quot; ">
+                <w:r><w:t>«First  Name»</w:t></w:r>
+            </w:fldSimple>
+            <w:fldSimple w:instr=" MERGEFIELD &quot;First Name&quot; ">
+                <w:r><w:t>«First Name»</w:t></w:r>
+            </w:fldSimple>
+        </w:p>
+    </w:body>
+</w:document>`),
+		},
+	}
+
+	fieldSet, err := ExtractFields(doc)
+	if err != nil {
+		t.Fatalf("ExtractFields failed: %v", err)
+	}
+	if fieldSet.TotalFields != 1 || fieldSet.Fields[0].Name != "First Name" {
+		t.Fatalf("Expected a single First Name field, got %+v", fieldSet.Fields)
+	}
+
+	result := fieldSet.Validate(MergeData{"First  Name": "Jane"})
+	if !result.Valid || len(result.UnusedDataKeys) != 0 {
+		t.Errorf("Expected the double-spaced key to match the field, got %+v", result)
+	}
+}
+
+func TestExtractFieldsContentControlTags(t *testing.T) {
+	checkbox := func(tag string) string {
+		return `<w:sdt><w:sdtPr><w:tag w:val="` + tag + `"/><w14:checkbox><w14:checked w14:val="0"/></w14:checkbox></w:sdtPr>` +
+			`<w:sdtContent><w:r><w:t>☐</w:t></w:r></w:sdtContent></w:sdt>`
+	}
+	doc := &docx.DocxFile{
+		Files: map[string][]byte{
+			"word/document.xml": []byte(`<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>` +
+				`<w:p>` + checkbox("Subscribed") + `</w:p>` +
+				`<w:sdt><w:sdtPr><w:tag w:val="Items"/><w15:repeatingSection/></w:sdtPr><w:sdtContent>` +
+				`<w:sdt><w:sdtPr><w15:repeatingSectionItem/></w:sdtPr><w:sdtContent>` +
+				`<w:p>` + checkbox("Shipped") + `</w:p>` +
+				`<w:sdt><w:sdtPr><w:tag w:val="Item"/></w:sdtPr><w:sdtContent><w:p><w:r><w:t>Item</w:t></w:r></w:p></w:sdtContent></w:sdt>` +
+				`</w:sdtContent></w:sdt>` +
+				`</w:sdtContent></w:sdt>` +
+				`<w:sdt><w:sdtPr><w:tag w:val="Notes"/></w:sdtPr><w:sdtContent><w:p><w:r><w:t>Notes</w:t></w:r></w:p></w:sdtContent></w:sdt>` +
+				`</w:body></w:document>`),
+		},
+	}
+
+	fieldSet, err := ExtractFields(doc)
+	if err != nil {
+		t.Fatalf("ExtractFields failed: %v", err)
+	}
+	// The controls inside the section take their tags from the items, and
+	// plain text controls are not filled by tag
+	if expected := []string{"Subscribed", "Items"}; !reflect.DeepEqual(fieldSet.ContentControlTags, expected) {
+		t.Errorf("ContentControlTags = %v, want %v", fieldSet.ContentControlTags, expected)
+	}
+}
+
+func TestExtractFieldsInRepeatingSection(t *testing.T) {
+	mergeField := func(name string) string {
+		return `<w:p><w:fldSimple w:instr=" MERGEFIELD ` + name + ` "><w:r><w:t>«` + name + `»</w:t></w:r></w:fldSimple></w:p>`
+	}
+	doc := &docx.DocxFile{
+		Files: map[string][]byte{
+			"word/document.xml": []byte(`<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>` +
+				mergeField("Name") + mergeField("Total") +
+				`<w:sdt><w:sdtPr><w:tag w:val="Items"/><w15:repeatingSection/></w:sdtPr><w:sdtContent>` +
+				`<w:sdt><w:sdtPr><w15:repeatingSectionItem/></w:sdtPr><w:sdtContent>` +
+				mergeField("Item") + mergeField("Total") +
+				`</w:sdtContent></w:sdt>` +
+				`</w:sdtContent></w:sdt>` +
+				`</w:body></w:document>`),
+		},
+	}
+
+	fieldSet, err := ExtractFields(doc)
+	if err != nil {
+		t.Fatalf("ExtractFields failed: %v", err)
+	}
+	repeated := make(map[string]bool, len(fieldSet.Fields))
+	for _, field := range fieldSet.Fields {
+		repeated[field.Name] = field.InRepeatingSection
+	}
+	// Total also appears outside the section
+	expected := map[string]bool{"Name": false, "Total": false, "Item": true}
+	if !reflect.DeepEqual(repeated, expected) {
+		t.Errorf("InRepeatingSection = %v, want %v", repeated, expected)
+	}
+}
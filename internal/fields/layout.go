@@ -0,0 +1,112 @@
+package fields
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ErrInvalidDateLayout is returned for date formats that are neither Go
+// layouts nor translatable YYYY-MM-DD style patterns
+var ErrInvalidDateLayout = errors.New("invalid date format")
+
+var (
+	// layoutProbeTimes differ in every component a Go layout can render, so a
+	// layout formatting both to the same text has no date or time element
+	layoutProbeTimes = [2]time.Time{
+		time.Date(2006, time.January, 2, 15, 4, 5, 0, time.UTC),
+		time.Date(2017, time.November, 23, 8, 39, 47, 0, time.FixedZone("CET", 3600)),
+	}
+
+	// patternTokenRegex matches the runs of pattern letters of YYYY-MM-DD
+	// style date formats, as used by Word and most date libraries
+	patternTokenRegex = regexp.MustCompile(`y+|Y+|M+|d+|D+|H+|h+|m+|s+`)
+)
+
+// patternTokens maps the pattern letter runs to Go layout elements. M is the
+// month and m the minute; d and D are both the day.
+var patternTokens = map[string]string{
+	"yyyy": "2006", "YYYY": "2006", "yy": "06", "YY": "06",
+	"MMMM": "January", "MMM": "Jan", "MM": "01", "M": "1",
+	"dddd": "Monday", "ddd": "Mon", "dd": "02", "d": "2",
+	"DDDD": "Monday", "DDD": "Mon", "DD": "02", "D": "2",
+	"HH": "15", "H": "15", "hh": "03", "h": "3",
+	"mm": "04", "m": "4", "ss": "05", "s": "5",
+}
+
+// DateLayout returns the Go layout of a date format. Go layouts, written with
+// the reference date 2006-01-02 15:04:05, are returned unchanged; patterns
+// such as YYYY-MM-DD or dd.MM.yyyy are translated. Anything else is rejected
+// with ErrInvalidDateLayout, since Go would render it as literal text.
+func DateLayout(format string) (string, error) {
+	layout, problem := dateLayout(format)
+	if problem != "" {
+		return "", fmt.Errorf("%w: %s", ErrInvalidDateLayout, problem)
+	}
+	return layout, nil
+}
+
+// dateLayout returns the Go layout of a date format, or describes why the
+// format is invalid
+func dateLayout(format string) (string, string) {
+	if hasLayoutElements(format) {
+		return format, ""
+	}
+
+	// Only formats made of pattern letters and separators are translated, so
+	// words such as "today" are not mistaken for a pattern
+	notGoLayout := fmt.Sprintf("'%s' is not a Go layout; write it with the reference date 2006-01-02 15:04:05, e.g. \"02.01.2006\" for DD.MM.YYYY", format)
+	if strings.IndexFunc(patternTokenRegex.ReplaceAllString(format, ""), unicode.IsLetter) >= 0 {
+		return "", notGoLayout
+	}
+
+	unknown := ""
+	translated := patternTokenRegex.ReplaceAllStringFunc(format, func(token string) string {
+		element, ok := patternTokens[token]
+		if !ok && unknown == "" {
+			unknown = token
+		}
+		return element
+	})
+	if unknown != "" {
+		return "", fmt.Sprintf("'%s' has the unsupported pattern '%s'; write it as a Go layout with the reference date 2006-01-02 15:04:05", format, unknown)
+	}
+	if !hasLayoutElements(translated) {
+		return "", notGoLayout
+	}
+	return translated, ""
+}
+
+// hasLayoutElements reports whether a Go layout renders any date or time
+// element, rather than only literal text
+func hasLayoutElements(layout string) bool {
+	return strings.TrimSpace(layout) != "" && layoutProbeTimes[0].Format(layout) != layoutProbeTimes[1].Format(layout)
+}
+
+// NormalizeDateFormats checks the DateFormat of every field and replaces
+// translatable patterns such as YYYY-MM-DD with their Go layout. It reports
+// every invalid format, so a bad layout is rejected before any merge rather
+// than rendered as garbage.
+func (mfs *MergeFieldSet) NormalizeDateFormats() error {
+	var problems []string
+	for i := range mfs.Fields {
+		format := mfs.Fields[i].Format
+		if format == nil || format.DateFormat == "" {
+			continue
+		}
+		layout, problem := dateLayout(format.DateFormat)
+		if problem != "" {
+			problems = append(problems, fmt.Sprintf("field '%s': %s", mfs.Fields[i].Name, problem))
+			continue
+		}
+		format.DateFormat = layout
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidDateLayout, strings.Join(problems, "; "))
+	}
+	return nil
+}
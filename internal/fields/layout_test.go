@@ -0,0 +1,67 @@
+package fields
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDateLayout(t *testing.T) {
+	tests := []struct {
+		format   string
+		expected string
+		errText  string
+	}{
+		{format: "2006-01-02", expected: "2006-01-02"},
+		{format: "January 2, 2006", expected: "January 2, 2006"},
+		{format: "02.01.2006 15:04", expected: "02.01.2006 15:04"},
+		{format: "YYYY-MM-DD", expected: "2006-01-02"},
+		{format: "dd.MM.yyyy", expected: "02.01.2006"},
+		{format: "MMMM d, yyyy", expected: "January 2, 2006"},
+		{format: "dddd, DD/MM/YY HH:mm:ss", expected: "Monday, 02/01/06 15:04:05"},
+		{format: "YYY-MM-DD", errText: "unsupported pattern 'YYY'"},
+		{format: "today", errText: "'today' is not a Go layout; write it with the reference date 2006-01-02"},
+		{format: "   ", errText: "is not a Go layout"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			layout, err := DateLayout(tt.format)
+			if tt.errText != "" {
+				if !errors.Is(err, ErrInvalidDateLayout) || !strings.Contains(err.Error(), tt.errText) {
+					t.Errorf("expected an invalid date format error containing %q, got %v", tt.errText, err)
+				}
+				return
+			}
+			if err != nil || layout != tt.expected {
+				t.Errorf("expected layout %q, got %q (%v)", tt.expected, layout, err)
+			}
+		})
+	}
+
+	layout, _ := DateLayout("YYYY-MM-DD")
+	if got := time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC).Format(layout); got != "2024-03-01" {
+		t.Errorf("expected the translated layout to render 2024-03-01, got %s", got)
+	}
+}
+
+func TestMergeFieldSet_NormalizeDateFormats(t *testing.T) {
+	fieldSet := &MergeFieldSet{Fields: []MergeField{
+		{Name: "StartDate", Type: FieldTypeDate, Format: &FieldFormat{DateFormat: "YYYY-MM-DD"}},
+		{Name: "EndDate", Type: FieldTypeDate, Format: &FieldFormat{DateFormat: "2006-01-02"}},
+		{Name: "Name", Type: FieldTypeString},
+	}}
+	if err := fieldSet.NormalizeDateFormats(); err != nil {
+		t.Fatalf("NormalizeDateFormats failed: %v", err)
+	}
+	if fieldSet.Fields[0].Format.DateFormat != "2006-01-02" {
+		t.Errorf("expected YYYY-MM-DD to be translated, got %q", fieldSet.Fields[0].Format.DateFormat)
+	}
+
+	fieldSet.Fields[1].Format.DateFormat = "the date"
+	err := fieldSet.NormalizeDateFormats()
+	if !errors.Is(err, ErrInvalidDateLayout) || !strings.Contains(err.Error(), "field 'EndDate'") {
+		t.Errorf("expected an error naming EndDate, got %v", err)
+	}
+}
@@ -1,14 +1,45 @@
 package fields
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
 
 // normalize standardizes field names for consistent comparison
 func normalize(s string) string {
-	return strings.ToLower(s)
+	return strings.ToLower(NormalizeFieldName(s))
+}
+
+// NormalizeFieldName collapses each run of whitespace in a field name to a
+// single space and trims the ends, so «First  Name» and a MERGEFIELD
+// "First Name" name the same field
+func NormalizeFieldName(name string) string {
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// FallbackSeparator separates the alternatives of a fallback chain such as
+// «Nickname|FirstName», which the merge fills from the first alternative
+// with data
+const FallbackSeparator = "|"
+
+// FallbackAlternatives returns the trimmed, non-empty alternatives of a
+// fallback chain, or the name alone if it is not a chain
+func FallbackAlternatives(name string) []string {
+	if !strings.Contains(name, FallbackSeparator) {
+		return []string{name}
+	}
+	var alternatives []string
+	for _, alternative := range strings.Split(name, FallbackSeparator) {
+		if alternative = strings.TrimSpace(alternative); alternative != "" {
+			alternatives = append(alternatives, alternative)
+		}
+	}
+	return alternatives
 }
 
 // MergeField represents a merge field found in a document
@@ -30,6 +61,22 @@ type MergeField struct {
 	
 	// Format specifies formatting options for the field
 	Format *FieldFormat `json:"format,omitempty"`
+	
+	// Constraints specifies additional validation rules for the field value
+	Constraints *FieldConstraints `json:"constraints,omitempty"`
+	
+	// Styles holds the styles in effect where the field first appears; only
+	// resolved on request
+	Styles *FieldStyles `json:"styles,omitempty"`
+
+	// Instruction is the field instruction where the field first appears,
+	// as written in the document, e.g. " MERGEFIELD Total \# 0.00 "
+	Instruction string `json:"instruction,omitempty"`
+
+	// InRepeatingSection is set when every occurrence of the field is inside
+	// a repeating section content control, whose items are filled from the
+	// elements of an array rather than the top-level data
+	InRepeatingSection bool `json:"in_repeating_section,omitempty"`
 }
 
 // FieldType represents the data type of a merge field
@@ -45,32 +92,60 @@ const (
 	FieldTypeUnknown  FieldType = "unknown"
 )
 
+// FieldTypes returns the known FieldType values
+func FieldTypes() []FieldType {
+	return []FieldType{
+		FieldTypeString, FieldTypeNumber, FieldTypeDate, FieldTypeBoolean,
+		FieldTypeImage, FieldTypeTable, FieldTypeUnknown,
+	}
+}
+
+// IsValid reports whether the field type is one of the known FieldType values
+func (t FieldType) IsValid() bool {
+	switch t {
+	case FieldTypeString, FieldTypeNumber, FieldTypeDate, FieldTypeBoolean,
+		FieldTypeImage, FieldTypeTable, FieldTypeUnknown:
+		return true
+	}
+	return false
+}
+
 // FieldPosition represents the location of a field in the document
 type FieldPosition struct {
-	// XMLPath is the path to the field in the XML structure
+	// XMLPath is the path to the field in the XML structure, e.g.
+	// /w:document[1]/w:body[1]/w:p[2]/w:fldSimple[1]
 	XMLPath string `json:"xml_path"`
 	
-	// NodeIndex is the index of the node containing the field
+	// NodeIndex is the zero-based index of the paragraph containing the
+	// field, in document order
 	NodeIndex int `json:"node_index"`
 	
-	// StartOffset is the character offset where the field starts
+	// StartOffset is the byte offset in the document XML where the field starts
 	StartOffset int `json:"start_offset"`
 	
-	// EndOffset is the character offset where the field ends
+	// EndOffset is the byte offset in the document XML where the field ends
 	EndOffset int `json:"end_offset"`
 	
 	// Page number (if determinable)
 	Page int `json:"page,omitempty"`
+
+	// Context is the text of the paragraph containing the field
+	Context string `json:"context,omitempty"`
 }
 
 // FieldFormat contains formatting options for a field
 type FieldFormat struct {
-	// DateFormat for date fields (e.g., "2006-01-02", "January 2, 2006")
+	// DateFormat for date fields (e.g., "2006-01-02", "January 2, 2006"); a
+	// pattern such as "DD.MM.YYYY" is translated by NormalizeDateFormats
 	DateFormat string `json:"date_format,omitempty"`
 	
 	// NumberFormat for number fields (e.g., "currency", "percentage")
 	NumberFormat string `json:"number_format,omitempty"`
 	
+	// CurrencySymbol written before "currency" values, such as the € of a
+	// \# "€#,##0.00" picture, unless the merge options set one
+	CurrencySymbol string `json:"currency_symbol,omitempty"`
+	
 	// TextTransform for string fields (e.g., "uppercase", "lowercase", "title")
 	TextTransform string `json:"text_transform,omitempty"`
 	
@@ -79,6 +154,19 @@ type FieldFormat struct {
 	
 	// Suffix to add after the field value
 	Suffix string `json:"suffix,omitempty"`
+	
+	// Locale overrides the document locale for the number and date
+	// formatting of this field (e.g. "de-DE")
+	Locale string `json:"locale,omitempty"`
+}
+
+// FieldConstraints contains additional validation rules for a field
+type FieldConstraints struct {
+	// MustBeFuture requires a date field to be later than today
+	MustBeFuture bool `json:"must_be_future,omitempty"`
+	
+	// NotWeekend requires a date field to fall on a weekday
+	NotWeekend bool `json:"not_weekend,omitempty"`
 }
 
 // MergeFieldSet represents a collection of merge fields
@@ -95,11 +183,38 @@ type MergeFieldSet struct {
 	// TotalFields is the count of fields found
 	TotalFields int `json:"total_fields"`
 	
+	// Prompts lists the FILLIN fields of the document. They are not merged,
+	// but their prompt text describes what the user is asked to enter.
+	Prompts []FillInPrompt `json:"prompts,omitempty"`
+	
+	// RequireAll treats every field as required during validation,
+	// regardless of its Required flag
+	RequireAll bool `json:"require_all,omitempty"`
+
+	// FailFast stops validation at the first error instead of collecting
+	// every problem
+	FailFast bool `json:"fail_fast,omitempty"`
+	
+	// ContentControlTags lists the tags of the repeating section and
+	// checkbox content controls outside repeating sections; the merge fills
+	// them from the data key their tag names
+	ContentControlTags []string `json:"content_control_tags,omitempty"`
+	
 	// normalizedFieldMap is a cached map for fast case-insensitive field lookups
 	// Maps normalized field names to MergeField pointers
 	normalizedFieldMap map[string]*MergeField `json:"-"`
 }
 
+// FillInPrompt represents a FILLIN field, which prompts for a value when the
+// document is updated
+type FillInPrompt struct {
+	// Prompt is the text shown to the user
+	Prompt string `json:"prompt"`
+	
+	// DefaultValue is the default response given with the \d switch
+	DefaultValue string `json:"default_value,omitempty"`
+}
+
 // MergeData represents the data to be merged into fields
 type MergeData map[string]interface{}
 
@@ -116,6 +231,12 @@ type ValidationResult struct {
 	
 	// MissingFields lists required fields that are missing
 	MissingFields []string `json:"missing_fields,omitempty"`
+
+	// FieldErrors maps each field with an invalid value to the reason
+	FieldErrors map[string]string `json:"-"`
+
+	// UnusedDataKeys lists the data keys that match no field, sorted
+	UnusedDataKeys []string `json:"-"`
 }
 
 // String returns a string representation of the merge field
@@ -124,11 +245,12 @@ func (mf MergeField) String() string {
 }
 
 
-// GetRequiredFields returns only the required fields from the set
+// GetRequiredFields returns only the required fields from the set, or every
+// field when RequireAll is set
 func (mfs MergeFieldSet) GetRequiredFields() []MergeField {
 	var required []MergeField
 	for _, field := range mfs.Fields {
-		if field.Required {
+		if field.Required || mfs.RequireAll {
 			required = append(required, field)
 		}
 	}
@@ -159,18 +281,29 @@ func (mfs *MergeFieldSet) HasField(name string) bool {
 }
 
 // Validate checks if the provided merge data is valid for this field set.
-// Extra keys in the data that don't match any field are silently ignored.
+// Extra keys in the data that don't match any field are not validated; they
+// are listed in UnusedDataKeys for information only.
 // Warnings in the result only come from duplicate-key detection performed in main.go.
+// With FailFast set, validation returns after the first error: required
+// fields are checked first, then the data values in key order, and the
+// UnusedDataKeys of the result may be incomplete.
 func (mfs *MergeFieldSet) Validate(data MergeData) ValidationResult {
 	result := ValidationResult{
-		Valid:         true,
-		Errors:        []string{},
-		Warnings:      []string{},
-		MissingFields: []string{},
+		Valid:          true,
+		Errors:         []string{},
+		Warnings:       []string{},
+		MissingFields:  []string{},
+		FieldErrors:    map[string]string{},
+		UnusedDataKeys: []string{},
 	}
 
-	// Check required fields
+	// Check required fields; a field with a DefaultValue is filled by the
+	// merge when the data lacks it, and a field inside repeating sections
+	// takes its value from array elements, not the top-level data
 	for _, field := range mfs.GetRequiredFields() {
+		if field.DefaultValue != nil || field.InRepeatingSection {
+			continue
+		}
 		// Check if field exists using normalized name matching
 		found := false
 		normalizedFieldName := normalize(field.Name)
@@ -180,33 +313,135 @@ func (mfs *MergeFieldSet) Validate(data MergeData) ValidationResult {
 				break
 			}
 		}
+		if !found && strings.Contains(field.Name, SubFieldSeparator) {
+			_, found = data.Lookup(field.Name)
+		}
+		if !found && strings.Contains(field.Name, FallbackSeparator) {
+			// A fallback chain is filled by any of its alternatives
+			for _, alternative := range FallbackAlternatives(field.Name) {
+				if _, found = data.Lookup(alternative); found {
+					break
+				}
+			}
+		}
 		if !found {
 			result.Valid = false
 			result.MissingFields = append(result.MissingFields, field.Name)
 			result.Errors = append(result.Errors, fmt.Sprintf("Required field '%s' is missing", field.Name))
+			if mfs.FailFast {
+				return result
+			}
 		}
 	}
 
-	// Validate data types and formats
-	for fieldName, value := range data {
+	// Validate data types and formats. The missing required fields stay
+	// first, in document order; the value errors after them are sorted by
+	// field name and then message, so the same data always gives the same
+	// errors in the same order.
+	requiredErrors := len(result.Errors)
+	dataKeys := make([]string, 0, len(data))
+	for fieldName := range data {
+		dataKeys = append(dataKeys, fieldName)
+	}
+	sort.Strings(dataKeys)
+
+	for _, fieldName := range dataKeys {
+		value := data[fieldName]
 		field := mfs.GetFieldByName(fieldName)
 		if field == nil {
-			continue   // silently ignore data keys not present in template
+			// An object merged through sub-field placeholders such as
+			// «Address.street» is validated member by member
+			if _, isObject := AsObject(value); isObject {
+				if subFields := mfs.subFields(fieldName); len(subFields) > 0 {
+					if !mfs.validateSubFields(data, subFields, &result) && mfs.FailFast {
+						return result
+					}
+					continue
+				}
+			}
+			if !mfs.bindsDataKey(fieldName) {
+				result.UnusedDataKeys = append(result.UnusedDataKeys, fieldName)
+			}
+			continue // data keys not present in template are not validated
 		}
 
-		if err := validateFieldValue(field, value); err != nil {
+		err := ObjectValueError(field.Name, value)
+		if err == nil {
+			err = validateFieldValue(field, value, field.Required || mfs.RequireAll)
+		}
+		if err != nil {
 			result.Valid = false
 			result.Errors = append(result.Errors, fmt.Sprintf("Invalid value for field '%s': %s", fieldName, err.Error()))
+			result.FieldErrors[field.Name] = err.Error()
+			if mfs.FailFast {
+				return result
+			}
 		}
 	}
 
+	// Every value error reads "Invalid value for field '<name>': <reason>"
+	sort.Strings(result.Errors[requiredErrors:])
+	sort.Strings(result.UnusedDataKeys)
+
 	return result
 }
 
-// validateFieldValue validates a single field value against its type
-func validateFieldValue(field *MergeField, value interface{}) error {
+// bindsDataKey reports whether the merge reads a data key that names no
+// field: an alternative of a fallback chain such as «Nickname|FirstName», or
+// the tag of a content control listed in ContentControlTags
+func (mfs *MergeFieldSet) bindsDataKey(key string) bool {
+	normalizedKey := normalize(key)
+	for _, tag := range mfs.ContentControlTags {
+		if normalize(tag) == normalizedKey {
+			return true
+		}
+	}
+	for _, field := range mfs.Fields {
+		if !strings.Contains(field.Name, FallbackSeparator) {
+			continue
+		}
+		for _, alternative := range FallbackAlternatives(field.Name) {
+			if normalize(alternative) == normalizedKey {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateSubFields validates the members of an object value merged through
+// sub-field placeholders; members without a placeholder are not validated.
+// It reports whether all members are valid, stopping at the first invalid
+// one with FailFast set.
+func (mfs *MergeFieldSet) validateSubFields(data MergeData, subFields []*MergeField, result *ValidationResult) bool {
+	valid := true
+	for _, field := range subFields {
+		value, found := data.Lookup(field.Name)
+		if !found {
+			continue
+		}
+		err := ObjectValueError(field.Name, value)
+		if err == nil {
+			err = validateFieldValue(field, value, field.Required || mfs.RequireAll)
+		}
+		if err != nil {
+			result.Valid = false
+			result.Errors = append(result.Errors, fmt.Sprintf("Invalid value for field '%s': %s", field.Name, err.Error()))
+			result.FieldErrors[field.Name] = err.Error()
+			valid = false
+			if mfs.FailFast {
+				return false
+			}
+		}
+	}
+	return valid
+}
+
+// validateFieldValue validates a single field value against its type; a nil
+// value is only accepted for a field that is not required
+func validateFieldValue(field *MergeField, value interface{}, required bool) error {
 	if value == nil {
-		if field.Required {
+		if required {
 			return fmt.Errorf("field is required but value is nil")
 		}
 		return nil
@@ -219,22 +454,27 @@ func validateFieldValue(field *MergeField, value interface{}) error {
 		}
 	case FieldTypeNumber:
 		switch value.(type) {
-		case int, int64, float64, float32:
-			// Valid number types
+		case int, int64, float64, float32, json.Number:
+			// Valid number types; json.Number when numbers are kept as strings
 		default:
 			return fmt.Errorf("expected number, got %T", value)
 		}
+		return NonFiniteError(value)
 	case FieldTypeDate:
+		var date time.Time
 		switch v := value.(type) {
 		case string:
-			if _, err := time.Parse("2006-01-02", v); err != nil {
+			parsed, err := time.Parse("2006-01-02", v)
+			if err != nil {
 				return fmt.Errorf("invalid date format: %s", err.Error())
 			}
+			date = parsed
 		case time.Time:
-			// Valid
+			date = v
 		default:
 			return fmt.Errorf("expected date string or time.Time, got %T", value)
 		}
+		return validateDateConstraints(field.Constraints, date)
 	case FieldTypeBoolean:
 		if _, ok := value.(bool); !ok {
 			return fmt.Errorf("expected boolean, got %T", value)
@@ -244,16 +484,136 @@ func validateFieldValue(field *MergeField, value interface{}) error {
 	return nil
 }
 
+// NonFiniteError reports a number value that is infinite or NaN, such as
+// 1e400 kept as a json.Number, which has no meaningful text in a document.
+// It returns nil for finite numbers and values of other types.
+func NonFiniteError(value interface{}) error {
+	var f float64
+	switch v := value.(type) {
+	case float64:
+		f = v
+	case float32:
+		f = float64(v)
+	case json.Number:
+		// Out of range numbers parse to ±Inf with an error
+		f, _ = strconv.ParseFloat(v.String(), 64)
+	default:
+		return nil
+	}
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return fmt.Errorf("number must be finite, got %v", value)
+	}
+	return nil
+}
 
-// ToLower converts all string values to lowercase
-func (md MergeData) ToLower() MergeData {
+// now returns the current time; replaced in tests
+var now = time.Now
+
+// validateDateConstraints checks a date value against the field constraints
+func validateDateConstraints(constraints *FieldConstraints, date time.Time) error {
+	if constraints == nil {
+		return nil
+	}
+
+	if constraints.MustBeFuture {
+		year, month, day := now().In(date.Location()).Date()
+		today := time.Date(year, month, day, 0, 0, 0, 0, date.Location())
+		if date.Before(today.AddDate(0, 0, 1)) {
+			return fmt.Errorf("date %s must be in the future", date.Format("2006-01-02"))
+		}
+	}
+
+	if constraints.NotWeekend {
+		if weekday := date.Weekday(); weekday == time.Saturday || weekday == time.Sunday {
+			return fmt.Errorf("date %s falls on a %s", date.Format("2006-01-02"), weekday)
+		}
+	}
+
+	return nil
+}
+
+// Transform applies fn to all string values and returns the result
+func (md MergeData) Transform(fn func(string) string) MergeData {
 	result := make(MergeData)
 	for key, value := range md {
 		if str, ok := value.(string); ok {
-			result[key] = strings.ToLower(str)
+			result[key] = fn(str)
 		} else {
 			result[key] = value
 		}
 	}
 	return result
 }
+
+// ToLower converts all string values to lowercase
+func (md MergeData) ToLower() MergeData {
+	return md.Transform(strings.ToLower)
+}
+
+// ToUpper converts all string values to uppercase
+func (md MergeData) ToUpper() MergeData {
+	return md.Transform(strings.ToUpper)
+}
+
+// valueTransforms maps the names accepted by ApplyTransforms to their functions
+var valueTransforms = map[string]func(string) string{
+	"trim":      strings.TrimSpace,
+	"uppercase": strings.ToUpper,
+	"lowercase": strings.ToLower,
+}
+
+// IsValidTransform reports whether name is a known value transform
+func IsValidTransform(name string) bool {
+	_, ok := valueTransforms[name]
+	return ok
+}
+
+// ApplyFieldMapping renames data keys to the template fields they fill, given
+// a mapping of field names to data keys such as {"FirstName": "cust_first"}.
+// Keys are matched like Lookup, so customer.first selects an object member.
+// The value of a mapped key takes precedence over a key named after the
+// field; fields the mapping leaves out, or whose key has no value, keep
+// matching their own name.
+func (md MergeData) ApplyFieldMapping(mapping map[string]string) MergeData {
+	if len(mapping) == 0 {
+		return md
+	}
+
+	mapped := make(MergeData, len(mapping))
+	for field, key := range mapping {
+		if value, found := md.Lookup(key); found {
+			mapped[field] = value
+		}
+	}
+
+	result := make(MergeData, len(md)+len(mapped))
+	for key, value := range md {
+		result[key] = value
+	}
+	// Mapped keys are consumed, so they are not reported as unused
+	for field := range mapped {
+		if key, found := matchKey(md, mapping[field]); found {
+			delete(result, key)
+		}
+	}
+	for field, value := range mapped {
+		if key, found := matchKey(result, field); found {
+			delete(result, key)
+		}
+		result[field] = value
+	}
+	return result
+}
+
+// ApplyTransforms applies the named transforms, in order, to all string values
+func (md MergeData) ApplyTransforms(names []string) (MergeData, error) {
+	result := md
+	for _, name := range names {
+		fn, ok := valueTransforms[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown value transform '%s'", name)
+		}
+		result = result.Transform(fn)
+	}
+	return result, nil
+}
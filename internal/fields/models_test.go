@@ -1,6 +1,10 @@
 package fields
 
 import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -54,6 +58,38 @@ func TestMergeFieldSet_Validate_NoWarningsForUnknownFields(t *testing.T) {
 	if len(result.MissingFields) != 0 {
 		t.Errorf("Expected no missing fields, but got: %v", result.MissingFields)
 	}
+
+	// The unknown key is reported for information only
+	if len(result.UnusedDataKeys) != 1 || result.UnusedDataKeys[0] != "unknown_field" {
+		t.Errorf("Expected unused data key 'unknown_field', got: %v", result.UnusedDataKeys)
+	}
+}
+
+func TestMergeFieldSet_Validate_UnusedDataKeys(t *testing.T) {
+	fieldSet := MergeFieldSet{
+		Fields: []MergeField{
+			{Name: "Nickname|FirstName", Type: FieldTypeString},
+			{Name: "City", Type: FieldTypeString},
+		},
+		TotalFields:        2,
+		ContentControlTags: []string{"Items", "Subscribed"},
+	}
+	mergeData := MergeData{
+		"firstname":  "Jane",
+		"City":       "Berlin",
+		"items":      []interface{}{map[string]interface{}{"Item": "pen"}},
+		"Subscribed": true,
+		"Extra":      "unused",
+	}
+
+	// Fallback alternatives and content control tags are read by the merge
+	result := fieldSet.Validate(mergeData)
+	if !result.Valid {
+		t.Fatalf("Expected validation to be valid, got errors: %v", result.Errors)
+	}
+	if expected := []string{"Extra"}; !reflect.DeepEqual(result.UnusedDataKeys, expected) {
+		t.Errorf("UnusedDataKeys = %v, want %v", result.UnusedDataKeys, expected)
+	}
 }
 
 func TestMergeFieldSet_Validate_RequiredFieldMissing(t *testing.T) {
@@ -106,6 +142,162 @@ func TestMergeFieldSet_Validate_RequiredFieldMissing(t *testing.T) {
 	}
 }
 
+func TestMergeFieldSet_Validate_RequireAll(t *testing.T) {
+	fieldSet := MergeFieldSet{
+		Fields: []MergeField{
+			{Name: "FirstName", Type: FieldTypeString},
+			{Name: "LastName", Type: FieldTypeString},
+			{Name: "City", Type: FieldTypeString},
+			{Name: "Country", Type: FieldTypeString},
+		},
+		TotalFields: 4,
+	}
+	mergeData := MergeData{"firstname": "Jane"}
+
+	// Without the policy, optional fields may be absent
+	if result := fieldSet.Validate(mergeData); !result.Valid {
+		t.Fatalf("Expected valid result without RequireAll, got errors: %v", result.Errors)
+	}
+
+	fieldSet.RequireAll = true
+	result := fieldSet.Validate(mergeData)
+	if result.Valid {
+		t.Error("Expected validation to be invalid with RequireAll")
+	}
+	if expected := []string{"LastName", "City", "Country"}; !reflect.DeepEqual(result.MissingFields, expected) {
+		t.Errorf("Expected missing fields %v, got %v", expected, result.MissingFields)
+	}
+
+	// A nil value does not fill a field either
+	mergeData = MergeData{"FirstName": "Jane", "LastName": "Doe", "City": "Berlin", "Country": nil}
+	result = fieldSet.Validate(mergeData)
+	if _, ok := result.FieldErrors["Country"]; result.Valid || !ok {
+		t.Errorf("Expected a nil value for Country to be rejected, got field errors %v", result.FieldErrors)
+	}
+}
+
+func TestMergeFieldSet_Validate_RequireAllFallbacksAndRepeatingSections(t *testing.T) {
+	fieldSet := MergeFieldSet{
+		Fields: []MergeField{
+			{Name: "Nickname|FirstName", Type: FieldTypeString},
+			{Name: "Item", Type: FieldTypeString, InRepeatingSection: true},
+		},
+		TotalFields: 2,
+		RequireAll:  true,
+	}
+
+	// Any alternative fills a fallback chain, and the fields of repeating
+	// sections are filled from array elements
+	result := fieldSet.Validate(MergeData{"firstname": "Jane", "Items": []interface{}{map[string]interface{}{"Item": "pen"}}})
+	if !result.Valid || len(result.MissingFields) != 0 {
+		t.Errorf("Expected validation to be valid, got missing fields %v and errors %v", result.MissingFields, result.Errors)
+	}
+
+	result = fieldSet.Validate(MergeData{"LastName": "Doe"})
+	if expected := []string{"Nickname|FirstName"}; result.Valid || !reflect.DeepEqual(result.MissingFields, expected) {
+		t.Errorf("Expected missing fields %v, got %v", expected, result.MissingFields)
+	}
+}
+
+func TestMergeFieldSet_Validate_FailFast(t *testing.T) {
+	fieldSet := MergeFieldSet{
+		Fields: []MergeField{
+			{Name: "FirstName", Type: FieldTypeString, Required: true},
+			{Name: "Amount", Type: FieldTypeNumber},
+			{Name: "DueDate", Type: FieldTypeDate},
+		},
+		TotalFields: 3,
+	}
+	// A missing required field and two invalid values
+	mergeData := MergeData{"Amount": "abc", "DueDate": "not a date"}
+
+	result := fieldSet.Validate(mergeData)
+	if len(result.Errors) != 3 {
+		t.Fatalf("Expected all 3 errors by default, got %d: %v", len(result.Errors), result.Errors)
+	}
+
+	fieldSet.FailFast = true
+	result = fieldSet.Validate(mergeData)
+	if result.Valid {
+		t.Error("Expected validation to be invalid in fail-fast mode")
+	}
+	if len(result.Errors) != 1 {
+		t.Fatalf("Expected 1 error in fail-fast mode, got %d: %v", len(result.Errors), result.Errors)
+	}
+	if expected := []string{"FirstName"}; !reflect.DeepEqual(result.MissingFields, expected) {
+		t.Errorf("Expected missing fields %v, got %v", expected, result.MissingFields)
+	}
+	if len(result.FieldErrors) != 0 {
+		t.Errorf("Expected no field errors after the first error, got %v", result.FieldErrors)
+	}
+
+	// Data values are checked in key order once the required fields are present
+	mergeData["FirstName"] = "Jane"
+	result = fieldSet.Validate(mergeData)
+	if len(result.Errors) != 1 {
+		t.Fatalf("Expected 1 error in fail-fast mode, got %d: %v", len(result.Errors), result.Errors)
+	}
+	if _, ok := result.FieldErrors["Amount"]; !ok || len(result.FieldErrors) != 1 {
+		t.Errorf("Expected only the Amount error, got field errors %v", result.FieldErrors)
+	}
+}
+
+func TestMergeFieldSet_Validate_RequiredFieldWithDefault(t *testing.T) {
+	fieldSet := MergeFieldSet{
+		Fields: []MergeField{
+			{Name: "FirstName", Type: FieldTypeString, Required: true},
+			{Name: "City", Type: FieldTypeString, Required: true, DefaultValue: "Springfield"},
+		},
+		TotalFields: 2,
+	}
+
+	result := fieldSet.Validate(MergeData{"FirstName": "Jane"})
+	if !result.Valid {
+		t.Errorf("A required field with a default should not be missing, got errors: %v", result.Errors)
+	}
+
+	result = fieldSet.Validate(MergeData{})
+	if expected := []string{"FirstName"}; !reflect.DeepEqual(result.MissingFields, expected) {
+		t.Errorf("Expected missing fields %v, got %v", expected, result.MissingFields)
+	}
+}
+
+func TestMergeFieldSet_Validate_ErrorOrder(t *testing.T) {
+	fieldSet := MergeFieldSet{
+		Fields: []MergeField{
+			{Name: "Zip", Type: FieldTypeString, Required: true},
+			{Name: "Address.zip", Type: FieldTypeNumber},
+			{Name: "Address.city", Type: FieldTypeNumber},
+			{Name: "Email", Type: FieldTypeString, Required: true},
+			{Name: "Total", Type: FieldTypeNumber},
+			{Name: "Active", Type: FieldTypeBoolean},
+		},
+		TotalFields: 6,
+	}
+	data := MergeData{
+		"Total":   "lots",
+		"Active":  "maybe",
+		"Address": map[string]interface{}{"zip": "AB1", "city": "Springfield"},
+	}
+
+	// Missing required fields come first in document order, then the value
+	// errors by field name
+	expected := []string{
+		"Required field 'Zip' is missing",
+		"Required field 'Email' is missing",
+		"Invalid value for field 'Active': expected boolean, got string",
+		"Invalid value for field 'Address.city': expected number, got string",
+		"Invalid value for field 'Address.zip': expected number, got string",
+		"Invalid value for field 'Total': expected number, got string",
+	}
+	for i := 0; i < 20; i++ {
+		result := fieldSet.Validate(data)
+		if !reflect.DeepEqual(result.Errors, expected) {
+			t.Fatalf("Run %d: errors = %q, want %q", i, result.Errors, expected)
+		}
+	}
+}
+
 func TestMergeFieldSet_Validate_ValidData(t *testing.T) {
 	// Build a MergeFieldSet with mixed field types
 	fieldSet := MergeFieldSet{
@@ -207,3 +399,247 @@ func TestMergeFieldSet_Validate_InvalidDataType(t *testing.T) {
 		t.Errorf("Expected no warnings, but got: %v", result.Warnings)
 	}
 }
+
+func TestMergeFieldSet_Validate_NonFiniteNumbers(t *testing.T) {
+	fieldSet := MergeFieldSet{
+		Fields:      []MergeField{{Name: "Amount", Type: FieldTypeNumber}},
+		TotalFields: 1,
+	}
+
+	tests := []struct {
+		name  string
+		value interface{}
+		valid bool
+	}{
+		{"positive infinity", math.Inf(1), false},
+		{"negative infinity", math.Inf(-1), false},
+		{"NaN", math.NaN(), false},
+		{"out of range json.Number", json.Number("1e400"), false},
+		{"float32 infinity", float32(math.Inf(1)), false},
+		{"finite float", 1234.5, true},
+		{"finite json.Number", json.Number("1e300"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := fieldSet.Validate(MergeData{"Amount": tt.value})
+			if result.Valid != tt.valid {
+				t.Fatalf("Expected valid=%v, got %v with errors %v", tt.valid, result.Valid, result.Errors)
+			}
+			if !tt.valid && !strings.Contains(result.FieldErrors["Amount"], "number must be finite") {
+				t.Errorf("Expected a finiteness error, got %q", result.FieldErrors["Amount"])
+			}
+		})
+	}
+}
+
+func TestMergeFieldSet_Validate_DateConstraints(t *testing.T) {
+	// Pin the clock to a Wednesday so the constraints are deterministic
+	originalNow := now
+	now = func() time.Time { return time.Date(2024, 6, 5, 15, 30, 0, 0, time.UTC) }
+	defer func() { now = originalNow }()
+
+	tests := []struct {
+		name        string
+		constraints *FieldConstraints
+		value       interface{}
+		expectValid bool
+	}{
+		{"past date fails mustBeFuture", &FieldConstraints{MustBeFuture: true}, "2024-06-01", false},
+		{"today fails mustBeFuture", &FieldConstraints{MustBeFuture: true}, "2024-06-05", false},
+		{"tomorrow passes mustBeFuture", &FieldConstraints{MustBeFuture: true}, "2024-06-06", true},
+		{"saturday fails notWeekend", &FieldConstraints{NotWeekend: true}, "2024-06-08", false},
+		{"sunday time fails notWeekend", &FieldConstraints{NotWeekend: true}, time.Date(2024, 6, 9, 10, 0, 0, 0, time.UTC), false},
+		{"monday passes both", &FieldConstraints{MustBeFuture: true, NotWeekend: true}, "2024-06-10", true},
+		{"no constraints", nil, "2024-06-08", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fieldSet := MergeFieldSet{
+				Fields: []MergeField{
+					{
+						Name:        "due_date",
+						Type:        FieldTypeDate,
+						Constraints: tt.constraints,
+					},
+				},
+				TotalFields: 1,
+			}
+
+			result := fieldSet.Validate(MergeData{"due_date": tt.value})
+
+			if result.Valid != tt.expectValid {
+				t.Errorf("Expected valid=%v, got %v with errors: %v", tt.expectValid, result.Valid, result.Errors)
+			}
+			if !tt.expectValid && result.FieldErrors["due_date"] == "" {
+				t.Errorf("Expected a field error for due_date, got: %v", result.FieldErrors)
+			}
+		})
+	}
+}
+
+func TestMergeData_ApplyTransforms(t *testing.T) {
+	mergeData := MergeData{
+		"name":  "  jane doe ",
+		"city":  "springfield\t",
+		"count": 3,
+	}
+
+	// Chain trim then uppercase
+	result, err := mergeData.ApplyTransforms([]string{"trim", "uppercase"})
+	if err != nil {
+		t.Fatalf("ApplyTransforms failed: %v", err)
+	}
+	if result["name"] != "JANE DOE" || result["city"] != "SPRINGFIELD" {
+		t.Errorf("Unexpected transformed values: %v", result)
+	}
+	if result["count"] != 3 {
+		t.Errorf("Non-string values should be left unchanged, got %v", result["count"])
+	}
+
+	// The original data is not modified
+	if mergeData["name"] != "  jane doe " {
+		t.Errorf("ApplyTransforms should not modify the receiver, got %q", mergeData["name"])
+	}
+
+	// No transforms leaves the data as is
+	if result, err := mergeData.ApplyTransforms(nil); err != nil || result["name"] != "  jane doe " {
+		t.Errorf("Expected unchanged data without transforms, got %v (%v)", result, err)
+	}
+
+	if _, err := mergeData.ApplyTransforms([]string{"trim", "reverse"}); err == nil {
+		t.Error("Expected an error for an unknown transform")
+	}
+}
+
+func TestMergeData_ApplyFieldMapping(t *testing.T) {
+	mergeData := MergeData{
+		"cust_first": "Jane",
+		"FirstName":  "ignored",
+		"LastName":   "Doe",
+		"customer":   map[string]interface{}{"city": "Springfield"},
+	}
+
+	result := mergeData.ApplyFieldMapping(map[string]string{
+		"FirstName": "cust_first",
+		"City":      "customer.city",
+		"Email":     "cust_email",
+	})
+
+	// A mapped key fills the differently named field and takes precedence
+	if result["FirstName"] != "Jane" {
+		t.Errorf("Expected FirstName from cust_first, got %v", result["FirstName"])
+	}
+	if result["City"] != "Springfield" {
+		t.Errorf("Expected City from customer.city, got %v", result["City"])
+	}
+
+	// Mapped keys are consumed
+	if _, exists := result["cust_first"]; exists {
+		t.Errorf("Expected cust_first to be consumed, got %v", result)
+	}
+
+	// Unmapped fields and mappings without a value keep direct matching
+	if result["LastName"] != "Doe" {
+		t.Errorf("Expected unmapped LastName to be kept, got %v", result["LastName"])
+	}
+	if _, exists := result["Email"]; exists {
+		t.Errorf("Expected no Email for a missing data key, got %v", result["Email"])
+	}
+
+	// The original data is not modified
+	if mergeData["FirstName"] != "ignored" || mergeData["cust_first"] != "Jane" {
+		t.Errorf("ApplyFieldMapping should not modify the receiver, got %v", mergeData)
+	}
+
+	// Mapped fields validate against the template
+	fieldSet := &MergeFieldSet{Fields: []MergeField{{Name: "FirstName", Type: FieldTypeString, Required: true}}}
+	if validation := fieldSet.Validate(MergeData{"cust_first": "Jane"}.ApplyFieldMapping(map[string]string{"FirstName": "cust_first"})); !validation.Valid {
+		t.Errorf("Expected mapped data to be valid, got errors: %v", validation.Errors)
+	}
+}
+
+func TestMergeFieldSet_Validate_ObjectValues(t *testing.T) {
+	address := map[string]interface{}{"street": "1 Main St", "city": "Springfield", "zip": 12345.0}
+
+	t.Run("object without sub-field placeholders", func(t *testing.T) {
+		fieldSet := MergeFieldSet{Fields: []MergeField{{Name: "Address", Type: FieldTypeString}}}
+		result := fieldSet.Validate(MergeData{"Address": address})
+
+		if result.Valid {
+			t.Fatal("Expected an object value for a scalar field to be invalid")
+		}
+		expected := "Invalid value for field 'Address': value is an object, which cannot be merged as a single value; use sub-field placeholders such as «Address.city»"
+		if !reflect.DeepEqual(result.Errors, []string{expected}) {
+			t.Errorf("Errors = %v, want [%s]", result.Errors, expected)
+		}
+		if _, exists := result.FieldErrors["Address"]; !exists {
+			t.Errorf("Expected a field error for Address, got %v", result.FieldErrors)
+		}
+	})
+
+	t.Run("object merged through sub-field placeholders", func(t *testing.T) {
+		fieldSet := MergeFieldSet{Fields: []MergeField{
+			{Name: "Address.street", Type: FieldTypeString, Required: true},
+			{Name: "address.City", Type: FieldTypeString, Required: true},
+		}}
+		result := fieldSet.Validate(MergeData{"Address": address})
+
+		if !result.Valid {
+			t.Errorf("Expected valid result, got errors: %v", result.Errors)
+		}
+		if len(result.UnusedDataKeys) != 0 {
+			t.Errorf("Object merged through sub-fields should not be unused, got %v", result.UnusedDataKeys)
+		}
+	})
+
+	t.Run("sub-field values are validated", func(t *testing.T) {
+		fieldSet := MergeFieldSet{Fields: []MergeField{
+			{Name: "Address.zip", Type: FieldTypeString},
+			{Name: "Address.country", Type: FieldTypeString, Required: true},
+		}}
+		result := fieldSet.Validate(MergeData{"Address": address})
+
+		if result.Valid {
+			t.Fatal("Expected invalid result")
+		}
+		if !reflect.DeepEqual(result.MissingFields, []string{"Address.country"}) {
+			t.Errorf("MissingFields = %v, want [Address.country]", result.MissingFields)
+		}
+		if result.FieldErrors["Address.zip"] != "expected string, got float64" {
+			t.Errorf("Expected a type error for Address.zip, got %v", result.FieldErrors)
+		}
+	})
+}
+
+func TestMergeData_Lookup(t *testing.T) {
+	data := MergeData{
+		"Name":     "Jane",
+		"Zip Code": "12345",
+		"a.b":      "flat key",
+		"Customer": map[string]interface{}{"Address": map[string]interface{}{"City": "Springfield"}},
+	}
+
+	tests := []struct {
+		name     string
+		expected interface{}
+		found    bool
+	}{
+		{name: "name", expected: "Jane", found: true},
+		{name: "zip  code", expected: "12345", found: true},
+		{name: "a.b", expected: "flat key", found: true},
+		{name: "customer.address.city", expected: "Springfield", found: true},
+		{name: "Customer.Address.Zip", found: false},
+		{name: "Name.first", found: false},
+		{name: "Missing", found: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, found := data.Lookup(tt.name)
+			if found != tt.found || (found && value != tt.expected) {
+				t.Errorf("Lookup(%q) = %v, %v; want %v, %v", tt.name, value, found, tt.expected, tt.found)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package fields
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SubFieldSeparator joins an object field and a member name in sub-field
+// placeholders such as «Address.street»
+const SubFieldSeparator = "."
+
+// Lookup returns the value of a field, matching keys case-insensitively and
+// regardless of repeated whitespace. A name such as Address.street that is
+// not itself a key selects the member of an object value, at any depth.
+func (d MergeData) Lookup(name string) (interface{}, bool) {
+	if value, found := lookupKey(d, name); found {
+		return value, true
+	}
+	if !strings.Contains(name, SubFieldSeparator) {
+		return nil, false
+	}
+
+	var value interface{} = d
+	for _, member := range strings.Split(name, SubFieldSeparator) {
+		object, isObject := AsObject(value)
+		if !isObject {
+			return nil, false
+		}
+		if value, isObject = lookupKey(object, member); !isObject {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// lookupKey returns the value of a key, matched exactly first and then
+// case-insensitively with whitespace collapsed
+func lookupKey(object map[string]interface{}, key string) (interface{}, bool) {
+	if candidate, found := matchKey(object, key); found {
+		return object[candidate], true
+	}
+	return nil, false
+}
+
+// matchKey returns the key of an object that lookupKey matches for a key
+func matchKey(object map[string]interface{}, key string) (string, bool) {
+	if _, exists := object[key]; exists {
+		return key, true
+	}
+	key = NormalizeFieldName(key)
+	for candidate := range object {
+		if strings.EqualFold(NormalizeFieldName(candidate), key) {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// AsObject returns a value decoded from a JSON object as a map
+func AsObject(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return v, true
+	case MergeData:
+		return v, true
+	}
+	return nil, false
+}
+
+// ObjectValueError reports a JSON object given for a field that is merged as
+// a single value, naming a sub-field placeholder that would merge one of its
+// members instead. It returns nil for any other value.
+func ObjectValueError(name string, value interface{}) error {
+	object, isObject := AsObject(value)
+	if !isObject {
+		return nil
+	}
+
+	members := make([]string, 0, len(object))
+	for member := range object {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	example := "member"
+	if len(members) > 0 {
+		example = members[0]
+	}
+	return fmt.Errorf("value is an object, which cannot be merged as a single value; use sub-field placeholders such as «%s%s%s»", name, SubFieldSeparator, example)
+}
+
+// subFields returns the fields naming members of an object field, e.g.
+// Address.street and Address.city for Address
+func (mfs *MergeFieldSet) subFields(name string) []*MergeField {
+	prefix := normalize(name + SubFieldSeparator)
+	var subFields []*MergeField
+	for i := range mfs.Fields {
+		if strings.HasPrefix(normalize(mfs.Fields[i].Name), prefix) {
+			subFields = append(subFields, &mfs.Fields[i])
+		}
+	}
+	return subFields
+}
@@ -0,0 +1,86 @@
+package fields
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Delimiters are the opening and closing marks of a text placeholder, such
+// as « and » in «FirstName»
+type Delimiters struct {
+	Open  string
+	Close string
+}
+
+var (
+	// ChevronDelimiters mark the «FieldName» placeholders Word shows for
+	// merge fields
+	ChevronDelimiters = Delimiters{Open: "«", Close: "»"}
+
+	// BraceDelimiters mark the {{FieldName}} placeholders written by
+	// templating tools
+	BraceDelimiters = Delimiters{Open: "{{", Close: "}}"}
+)
+
+// Placeholder syntaxes, each selecting the delimiters of text placeholders
+const (
+	SyntaxChevrons = "chevrons"
+	SyntaxBraces   = "braces"
+	SyntaxBoth     = "both"
+)
+
+// SyntaxDelimiters returns the delimiters of a placeholder syntax: «Field»
+// for SyntaxChevrons, {{Field}} for SyntaxBraces and both for SyntaxBoth. An
+// empty syntax means SyntaxChevrons; an unknown one reports false.
+func SyntaxDelimiters(syntax string) ([]Delimiters, bool) {
+	switch strings.ToLower(strings.TrimSpace(syntax)) {
+	case "", SyntaxChevrons:
+		return []Delimiters{ChevronDelimiters}, true
+	case SyntaxBraces:
+		return []Delimiters{BraceDelimiters}, true
+	case SyntaxBoth:
+		return []Delimiters{ChevronDelimiters, BraceDelimiters}, true
+	}
+	return nil, false
+}
+
+// Pattern returns a regular expression matching a placeholder with the
+// delimiters and capturing its name, which may hold any character but those
+// of the closing delimiter
+func (d Delimiters) Pattern() string {
+	var excluded strings.Builder
+	for _, r := range d.Close {
+		excluded.WriteString(regexp.QuoteMeta(string(r)))
+	}
+	return regexp.QuoteMeta(d.Open) + "([^" + excluded.String() + "]+)" + regexp.QuoteMeta(d.Close)
+}
+
+// wholePlaceholderRegexes caches the *regexp.Regexp matching a whole
+// placeholder by Delimiters, so each syntax is compiled once per process
+var wholePlaceholderRegexes sync.Map
+
+// wholePlaceholderRegex returns the regex matching a text that is a whole
+// placeholder with the delimiters
+func wholePlaceholderRegex(d Delimiters) *regexp.Regexp {
+	if cached, ok := wholePlaceholderRegexes.Load(d); ok {
+		return cached.(*regexp.Regexp)
+	}
+	cached, _ := wholePlaceholderRegexes.LoadOrStore(d, regexp.MustCompile("^"+d.Pattern()+"$"))
+	return cached.(*regexp.Regexp)
+}
+
+// PlaceholderName returns the field name of a text that is a whole
+// placeholder with one of the delimiters, e.g. FirstName for {{FirstName}}
+func PlaceholderName(text string, delimiters []Delimiters) (string, bool) {
+	for _, d := range delimiters {
+		match := wholePlaceholderRegex(d).FindStringSubmatch(text)
+		if match == nil {
+			continue
+		}
+		if name := strings.TrimSpace(match[1]); name != "" {
+			return name, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,101 @@
+package fields
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"com/lifenture/flash-mail-merge/internal/docx"
+)
+
+func TestPlaceholderName(t *testing.T) {
+	both, ok := SyntaxDelimiters(SyntaxBoth)
+	if !ok {
+		t.Fatal("Expected the both syntax to be known")
+	}
+
+	tests := []struct {
+		text     string
+		expected string
+		found    bool
+	}{
+		{text: "«FirstName»", expected: "FirstName", found: true},
+		{text: "{{LastName}}", expected: "LastName", found: true},
+		{text: "{{ City }}", expected: "City", found: true},
+		{text: "{{}}", found: false},
+		{text: "{{a}} and {{b}}", found: false},
+		{text: "Dear {{Name}}", found: false},
+		{text: "{Name}", found: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			name, found := PlaceholderName(tt.text, both)
+			if name != tt.expected || found != tt.found {
+				t.Errorf("PlaceholderName(%q) = %q, %v; want %q, %v", tt.text, name, found, tt.expected, tt.found)
+			}
+		})
+	}
+
+	if _, found := PlaceholderName("{{Name}}", []Delimiters{ChevronDelimiters}); found {
+		t.Error("Expected braces not to match the chevron syntax")
+	}
+	if _, ok := SyntaxDelimiters("angle"); ok {
+		t.Error("Expected an unknown syntax to be rejected")
+	}
+}
+
+func TestExtractFieldsPlaceholderSyntax(t *testing.T) {
+	doc := &docx.DocxFile{
+		Files: map[string][]byte{
+			"word/document.xml": []byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+    <w:body>
+        <w:p>
+            <w:fldSimple w:instr=" MERGEFIELD Title ">
+                <w:r><w:t>«Title»</w:t></w:r>
+            </w:fldSimple>
+            <w:r><w:t>«FirstName»</w:t></w:r>
+            <w:r><w:t>{{LastName}}</w:t></w:r>
+            <w:r><w:t>{{Email*}}</w:t></w:r>
+        </w:p>
+    </w:body>
+</w:document>`),
+		},
+	}
+
+	tests := []struct {
+		syntax   string
+		expected []string
+	}{
+		{syntax: "", expected: []string{"Title"}},
+		{syntax: SyntaxChevrons, expected: []string{"FirstName", "Title"}},
+		{syntax: SyntaxBraces, expected: []string{"Email", "LastName", "Title"}},
+		{syntax: SyntaxBoth, expected: []string{"Email", "FirstName", "LastName", "Title"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.syntax, func(t *testing.T) {
+			var opts ExtractOptions
+			if tt.syntax != "" {
+				opts.Delimiters, _ = SyntaxDelimiters(tt.syntax)
+			}
+			fieldSet, err := ExtractFieldsWithOptions(doc, opts)
+			if err != nil {
+				t.Fatalf("ExtractFieldsWithOptions failed: %v", err)
+			}
+			var names []string
+			for _, field := range fieldSet.Fields {
+				names = append(names, field.Name)
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, tt.expected) {
+				t.Errorf("Fields = %v, want %v", names, tt.expected)
+			}
+		})
+	}
+
+	// A placeholder keeps the required marker of field names
+	fieldSet, _ := ExtractFieldsWithOptions(doc, ExtractOptions{Delimiters: []Delimiters{BraceDelimiters}})
+	if field := fieldSet.GetFieldByName("Email"); field == nil || !field.Required || field.Instruction != "" {
+		t.Errorf("Expected Email to be a required field without instruction, got %+v", field)
+	}
+}
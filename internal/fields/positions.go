@@ -0,0 +1,133 @@
+package fields
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// positionTracker passes the tokens of a document XML to the extraction walk
+// and follows where they are: the element path, the byte offset of the last
+// token and the paragraphs with their text. Every token goes through it,
+// including those consumed by DecodeElement and the complex field walk.
+type positionTracker struct {
+	decoder *xml.Decoder
+
+	// start is the byte offset where the last token starts
+	start int64
+
+	// path holds the open elements, outermost first
+	path []pathStep
+
+	// prefixes maps namespace URLs to the prefixes declared for them
+	prefixes map[string]string
+
+	// paragraphs holds the text of each paragraph in document order, and
+	// open the indices of the open paragraphs, innermost last
+	paragraphs []*strings.Builder
+	open       []int
+
+	// inText counts the open <w:t> elements
+	inText int
+}
+
+// pathStep is an open element of the path: its name, its one-based index
+// among the siblings of that name, and the number of children seen by name
+type pathStep struct {
+	name     string
+	index    int
+	children map[string]int
+}
+
+func newPositionTracker(documentXML string) *positionTracker {
+	return &positionTracker{
+		decoder:  xml.NewDecoder(strings.NewReader(documentXML)),
+		prefixes: make(map[string]string),
+	}
+}
+
+// Token returns the next token of the document and records where it is
+func (t *positionTracker) Token() (xml.Token, error) {
+	start := t.decoder.InputOffset()
+	tok, err := t.decoder.Token()
+	if err != nil {
+		return tok, err
+	}
+	t.start = start
+
+	switch token := tok.(type) {
+	case xml.StartElement:
+		for _, attr := range token.Attr {
+			if attr.Name.Space == "xmlns" {
+				t.prefixes[attr.Value] = attr.Name.Local
+			}
+		}
+		name := token.Name.Local
+		if prefix := t.prefixes[token.Name.Space]; prefix != "" {
+			name = prefix + ":" + name
+		}
+		index := 1
+		if n := len(t.path); n > 0 {
+			parent := &t.path[n-1]
+			if parent.children == nil {
+				parent.children = make(map[string]int)
+			}
+			parent.children[name]++
+			index = parent.children[name]
+		}
+		t.path = append(t.path, pathStep{name: name, index: index})
+
+		switch token.Name.Local {
+		case "p":
+			t.open = append(t.open, len(t.paragraphs))
+			t.paragraphs = append(t.paragraphs, &strings.Builder{})
+		case "t":
+			t.inText++
+		}
+	case xml.EndElement:
+		if len(t.path) > 0 {
+			t.path = t.path[:len(t.path)-1]
+		}
+		switch token.Name.Local {
+		case "p":
+			if len(t.open) > 0 {
+				t.open = t.open[:len(t.open)-1]
+			}
+		case "t":
+			t.inText--
+		}
+	case xml.CharData:
+		if t.inText > 0 && len(t.open) > 0 {
+			t.paragraphs[t.open[len(t.open)-1]].Write(token)
+		}
+	}
+	return tok, nil
+}
+
+// offset returns the byte offset the decoder has read up to
+func (t *positionTracker) offset() int64 {
+	return t.decoder.InputOffset()
+}
+
+// position describes where the last token is: the path of its element, the
+// index of the innermost open paragraph, or -1 outside paragraphs, and its
+// start offset
+func (t *positionTracker) position() FieldPosition {
+	var path strings.Builder
+	for _, step := range t.path {
+		fmt.Fprintf(&path, "/%s[%d]", step.name, step.index)
+	}
+	paragraph := -1
+	if len(t.open) > 0 {
+		paragraph = t.open[len(t.open)-1]
+	}
+	return FieldPosition{XMLPath: path.String(), NodeIndex: paragraph, StartOffset: int(t.start)}
+}
+
+// paragraphText returns the text of a paragraph by its index
+func (t *positionTracker) paragraphText(index int) string {
+	if index < 0 || index >= len(t.paragraphs) {
+		return ""
+	}
+	return t.paragraphs[index].String()
+}
@@ -0,0 +1,93 @@
+package fields
+
+import (
+	"strings"
+	"testing"
+
+	"com/lifenture/flash-mail-merge/internal/docx"
+)
+
+func TestExtractFieldsPositions(t *testing.T) {
+	documentXML := `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>` +
+		`<w:p><w:r><w:t xml:space="preserve">Dear </w:t></w:r><w:fldSimple w:instr=" MERGEFIELD FirstName "><w:r><w:t>«FirstName»</w:t></w:r></w:fldSimple><w:r><w:t>,</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t xml:space="preserve">Name: </w:t></w:r><w:r><w:fldChar w:fldCharType="begin"/></w:r><w:r><w:instrText> MERGEFIELD LastName </w:instrText></w:r>` +
+		`<w:r><w:fldChar w:fldCharType="separate"/></w:r><w:r><w:t>«LastName»</w:t></w:r><w:r><w:fldChar w:fldCharType="end"/></w:r></w:p>` +
+		`<w:tbl><w:tr><w:tc><w:p><w:r><w:t xml:space="preserve">Code </w:t></w:r><w:r><w:t>{{Code}}</w:t></w:r></w:p></w:tc></w:tr></w:tbl>` +
+		`<w:p><w:fldSimple w:instr=" MERGEFIELD FirstName "><w:r><w:t>«FirstName»</w:t></w:r></w:fldSimple></w:p>` +
+		`</w:body></w:document>`
+	doc := &docx.DocxFile{Files: map[string][]byte{"word/document.xml": []byte(documentXML)}}
+
+	fieldSet, err := ExtractFieldsWithOptions(doc, ExtractOptions{Delimiters: []Delimiters{ChevronDelimiters, BraceDelimiters}})
+	if err != nil {
+		t.Fatalf("ExtractFieldsWithOptions failed: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		xmlPath     string
+		nodeIndex   int
+		prefix      string
+		suffix      string
+		placeholder string
+		context     string
+	}{
+		{
+			name:        "FirstName",
+			xmlPath:     "/w:document[1]/w:body[1]/w:p[1]/w:fldSimple[1]",
+			nodeIndex:   0,
+			prefix:      "<w:fldSimple",
+			suffix:      "</w:fldSimple>",
+			placeholder: "«FirstName»",
+			context:     "Dear «FirstName»,",
+		},
+		{
+			name:        "LastName",
+			xmlPath:     "/w:document[1]/w:body[1]/w:p[2]/w:r[2]/w:fldChar[1]",
+			nodeIndex:   1,
+			prefix:      `<w:fldChar w:fldCharType="begin"/>`,
+			suffix:      `<w:fldChar w:fldCharType="end"/>`,
+			placeholder: "«LastName»",
+			context:     "Name: «LastName»",
+		},
+		{
+			name:        "Code",
+			xmlPath:     "/w:document[1]/w:body[1]/w:tbl[1]/w:tr[1]/w:tc[1]/w:p[1]/w:r[2]/w:t[1]",
+			nodeIndex:   2,
+			prefix:      "<w:t>",
+			suffix:      "</w:t>",
+			placeholder: "{{Code}}",
+			context:     "Code {{Code}}",
+		},
+	}
+
+	previousEnd := 0
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			field := fieldSet.GetFieldByName(tt.name)
+			if field == nil {
+				t.Fatalf("Field %s not extracted", tt.name)
+			}
+			position := field.Position
+			if position.XMLPath != tt.xmlPath {
+				t.Errorf("XMLPath = %q, want %q", position.XMLPath, tt.xmlPath)
+			}
+			if position.NodeIndex != tt.nodeIndex {
+				t.Errorf("NodeIndex = %d, want %d", position.NodeIndex, tt.nodeIndex)
+			}
+			if position.Context != tt.context {
+				t.Errorf("Context = %q, want %q", position.Context, tt.context)
+			}
+
+			// The first occurrence is reported, after the previous field
+			if position.StartOffset < previousEnd || position.EndOffset <= position.StartOffset || position.EndOffset > len(documentXML) {
+				t.Fatalf("Offsets %d-%d are not monotonic after %d", position.StartOffset, position.EndOffset, previousEnd)
+			}
+			previousEnd = position.EndOffset
+			span := documentXML[position.StartOffset:position.EndOffset]
+			if !strings.HasPrefix(span, tt.prefix) || !strings.HasSuffix(span, tt.suffix) || !strings.Contains(span, tt.placeholder) {
+				t.Errorf("Expected the offsets to span the field, got %q", span)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package fields
+
+import (
+	"encoding/xml"
+	"strings"
+)
+
+// StylesPart is the package part holding the style definitions
+const StylesPart = "word/styles.xml"
+
+// StyleRef identifies a style by its id and, when styles.xml defines it,
+// its display name
+type StyleRef struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+// FieldStyles records the styles in effect where a field first appears
+type FieldStyles struct {
+	// Paragraph is the paragraph style (<w:pStyle>), or the document's default
+	// paragraph style when the paragraph sets none
+	Paragraph *StyleRef `json:"paragraph,omitempty"`
+
+	// Character is the character style (<w:rStyle>) of the field's run
+	Character *StyleRef `json:"character,omitempty"`
+}
+
+// styleSheet holds the style names and defaults read from styles.xml
+type styleSheet struct {
+	names            map[string]string
+	defaultParagraph string
+}
+
+// parseStyles reads the style definitions of a styles.xml part. Malformed
+// content yields the styles read so far.
+func parseStyles(stylesXML []byte) styleSheet {
+	sheet := styleSheet{names: make(map[string]string)}
+	decoder := xml.NewDecoder(strings.NewReader(string(stylesXML)))
+
+	var current string
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			return sheet
+		}
+		token, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch token.Name.Local {
+		case "style":
+			current = attrValue(token, "styleId")
+			if attrValue(token, "type") == "paragraph" && attrValue(token, "default") == "1" {
+				sheet.defaultParagraph = current
+			}
+		case "name":
+			if current != "" {
+				sheet.names[current] = attrValue(token, "val")
+			}
+		}
+	}
+}
+
+// resolve builds the styles in effect for the given style ids
+func (s styleSheet) resolve(paragraphStyle, characterStyle string) *FieldStyles {
+	if paragraphStyle == "" {
+		paragraphStyle = s.defaultParagraph
+	}
+	styles := &FieldStyles{}
+	if paragraphStyle != "" {
+		styles.Paragraph = &StyleRef{ID: paragraphStyle, Name: s.names[paragraphStyle]}
+	}
+	if characterStyle != "" {
+		styles.Character = &StyleRef{ID: characterStyle, Name: s.names[characterStyle]}
+	}
+	return styles
+}
+
+// attrValue returns the value of the attribute with the given local name
+func attrValue(token xml.StartElement, name string) string {
+	for _, attr := range token.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,107 @@
+package fields
+
+import (
+	"regexp"
+	"strings"
+)
+
+// numberFormatCurrency is the FieldFormat.NumberFormat inferred from \#
+// pictures with a currency symbol
+const numberFormatCurrency = "currency"
+
+// wordDatePictureRegex matches the elements of a Word \@ date picture: quoted
+// literal text, the AM/PM marker and the runs of pattern letters
+var wordDatePictureRegex = regexp.MustCompile(`'[^']*'|AM/PM|am/pm|A/P|a/p|y+|Y+|M+|d+|D+|H+|h+|m+|s+|S+`)
+
+// wordDatePictures maps the elements of Word date pictures to Go layout
+// elements. Word reads y, d and s in either case; M is the month and m the
+// minute, H the 24-hour and h the 12-hour clock.
+var wordDatePictures = map[string]string{
+	"yyyy": "2006", "YYYY": "2006", "yy": "06", "YY": "06",
+	"MMMM": "January", "MMM": "Jan", "MM": "01", "M": "1",
+	"dddd": "Monday", "ddd": "Mon", "dd": "02", "d": "2",
+	"DDDD": "Monday", "DDD": "Mon", "DD": "02", "D": "2",
+	"HH": "15", "H": "15", "hh": "03", "h": "3",
+	"mm": "04", "m": "4", "ss": "05", "s": "5", "SS": "05", "S": "5",
+	"AM/PM": "PM", "am/pm": "pm",
+}
+
+// currencySymbols mark a \# number picture as a currency amount
+var currencySymbols = []string{"$", "€", "£", "¥"}
+
+// fieldSwitches holds the type and format inferred from the formatting
+// switches of a MERGEFIELD instruction
+type fieldSwitches struct {
+	fieldType FieldType
+	format    *FieldFormat
+}
+
+// parseFieldSwitches infers the type and format of a MERGEFIELD from its \@
+// date-time picture or \# numeric picture, e.g. \@ "MMMM d, yyyy" gives a
+// date field with the layout "January 2, 2006" and \# "$#,##0.00" a currency
+// number field. It reports false for instructions with neither switch.
+func parseFieldSwitches(instr string) (fieldSwitches, bool) {
+	tokens := splitInstruction(instr)
+	for i, token := range tokens {
+		if !strings.HasPrefix(token, `\@`) && !strings.HasPrefix(token, `\#`) {
+			continue
+		}
+		// \@"d MMMM" carries its picture in the same token
+		picture := token[2:]
+		if picture == "" && i+1 < len(tokens) {
+			picture = tokens[i+1]
+		}
+
+		if strings.HasPrefix(token, `\@`) {
+			result := fieldSwitches{fieldType: FieldTypeDate}
+			if layout, ok := WordDateLayout(picture); ok {
+				result.format = &FieldFormat{DateFormat: layout}
+			}
+			return result, true
+		}
+		return fieldSwitches{fieldType: FieldTypeNumber, format: wordNumberFormat(picture)}, true
+	}
+	return fieldSwitches{}, false
+}
+
+// WordDateLayout translates a Word date-time picture such as "MMMM d, yyyy"
+// or "dd.MM.yyyy HH:mm" to a Go layout. Text in single quotes is kept
+// literally. It reports false for pictures with unknown elements, or with
+// literal text Go would read as a layout element.
+func WordDateLayout(picture string) (string, bool) {
+	valid := true
+	layout := wordDatePictureRegex.ReplaceAllStringFunc(picture, func(element string) string {
+		if strings.HasPrefix(element, "'") {
+			literal := strings.Trim(element, "'")
+			if hasLayoutElements(literal) {
+				valid = false
+			}
+			return literal
+		}
+		translated, ok := wordDatePictures[element]
+		if !ok {
+			valid = false
+		}
+		return translated
+	})
+	if !valid || !hasLayoutElements(layout) {
+		return "", false
+	}
+	return layout, true
+}
+
+// wordNumberFormat returns the format of a Word numeric picture: a picture
+// with a currency symbol such as "€#,##0.00" is a currency written with that
+// symbol. Other pictures give no format; a Word percentage such as "0%"
+// appends the sign to the value as given, while the percentage NumberFormat
+// scales it.
+func wordNumberFormat(picture string) *FieldFormat {
+	// A picture such as "#,##0.00;(#,##0.00)" has a section per sign
+	picture, _, _ = strings.Cut(picture, ";")
+	for _, symbol := range currencySymbols {
+		if strings.Contains(picture, symbol) {
+			return &FieldFormat{NumberFormat: numberFormatCurrency, CurrencySymbol: symbol}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package fields
+
+import (
+	"testing"
+	"time"
+
+	"com/lifenture/flash-mail-merge/internal/docx"
+)
+
+func TestWordDateLayout(t *testing.T) {
+	tests := []struct {
+		picture  string
+		expected string
+		rendered string
+	}{
+		{picture: "MMMM d, yyyy", expected: "January 2, 2006", rendered: "March 7, 2024"},
+		{picture: "d MMMM yyyy", expected: "2 January 2006", rendered: "7 March 2024"},
+		{picture: "dd.MM.yyyy", expected: "02.01.2006", rendered: "07.03.2024"},
+		{picture: "M/d/yyyy", expected: "1/2/2006", rendered: "3/7/2024"},
+		{picture: "MM/dd/yy", expected: "01/02/06", rendered: "03/07/24"},
+		{picture: "yyyy-MM-dd", expected: "2006-01-02", rendered: "2024-03-07"},
+		{picture: "dddd, MMMM d, yyyy", expected: "Monday, January 2, 2006", rendered: "Thursday, March 7, 2024"},
+		{picture: "ddd, d MMM yy", expected: "Mon, 2 Jan 06", rendered: "Thu, 7 Mar 24"},
+		{picture: "HH:mm", expected: "15:04", rendered: "14:05"},
+		{picture: "h:mm AM/PM", expected: "3:04 PM", rendered: "2:05 PM"},
+		{picture: "dd.MM.yyyy HH:mm:ss", expected: "02.01.2006 15:04:05", rendered: "07.03.2024 14:05:09"},
+		{picture: "d 'of' MMMM", expected: "2 of January", rendered: "7 of March"},
+		{picture: "DD/MM/YYYY", expected: "02/01/2006", rendered: "07/03/2024"},
+	}
+
+	date := time.Date(2024, time.March, 7, 14, 5, 9, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.picture, func(t *testing.T) {
+			layout, ok := WordDateLayout(tt.picture)
+			if !ok || layout != tt.expected {
+				t.Fatalf("WordDateLayout(%q) = %q, %v; want %q", tt.picture, layout, ok, tt.expected)
+			}
+			if got := date.Format(layout); got != tt.rendered {
+				t.Errorf("Expected the layout to render %q, got %q", tt.rendered, got)
+			}
+		})
+	}
+
+	for _, picture := range []string{"", "yyy", "h:mm A/P", "'Monday' d", "today"} {
+		if layout, ok := WordDateLayout(picture); ok {
+			t.Errorf("Expected %q not to translate, got %q", picture, layout)
+		}
+	}
+}
+
+func TestExtractFieldsInfersTypeFromSwitches(t *testing.T) {
+	doc := &docx.DocxFile{
+		Files: map[string][]byte{
+			"word/document.xml": []byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+    <w:body>
+        <w:p>
+            <w:fldSimple w:instr=" MERGEFIELD DueDate \@ &quot;MMMM d, yyyy&quot; \* MERGEFORMAT ">
+                <w:r><w:t>«DueDate»</w:t></w:r>
+            </w:fldSimple>
+            <w:r><w:fldChar w:fldCharType="begin"/></w:r>
+            <w:r><w:instrText xml:space="preserve"> MERGEFIELD Total \# "$#,##0.00" </w:instrText></w:r>
+            <w:r><w:fldChar w:fldCharType="separate"/></w:r>
+            <w:r><w:t>«Total»</w:t></w:r>
+            <w:r><w:fldChar w:fldCharType="end"/></w:r>
+            <w:fldSimple w:instr=" MERGEFIELD EuroTotal \# &quot;€#,##0.00&quot; ">
+                <w:r><w:t>«EuroTotal»</w:t></w:r>
+            </w:fldSimple>
+            <w:fldSimple w:instr=" MERGEFIELD PoundTotal \# &quot;£#,##0.00;(£#,##0.00)&quot; ">
+                <w:r><w:t>«PoundTotal»</w:t></w:r>
+            </w:fldSimple>
+            <w:fldSimple w:instr=" MERGEFIELD Quantity \# 0 ">
+                <w:r><w:t>«Quantity»</w:t></w:r>
+            </w:fldSimple>
+            <w:fldSimple w:instr=" MERGEFIELD SignedAt \@&quot;d 'at' h:mm A/P&quot; ">
+                <w:r><w:t>«SignedAt»</w:t></w:r>
+            </w:fldSimple>
+            <w:fldSimple w:instr=" MERGEFIELD Name \* Upper ">
+                <w:r><w:t>«Name»</w:t></w:r>
+            </w:fldSimple>
+        </w:p>
+    </w:body>
+</w:document>`),
+		},
+	}
+
+	fieldSet, err := ExtractFields(doc)
+	if err != nil {
+		t.Fatalf("ExtractFields failed: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		fieldType    FieldType
+		dateFormat   string
+		numberFormat string
+		symbol       string
+	}{
+		{name: "DueDate", fieldType: FieldTypeDate, dateFormat: "January 2, 2006"},
+		{name: "Total", fieldType: FieldTypeNumber, numberFormat: "currency", symbol: "$"},
+		{name: "EuroTotal", fieldType: FieldTypeNumber, numberFormat: "currency", symbol: "€"},
+		{name: "PoundTotal", fieldType: FieldTypeNumber, numberFormat: "currency", symbol: "£"},
+		{name: "Quantity", fieldType: FieldTypeNumber},
+		// A picture that does not translate still tells the type
+		{name: "SignedAt", fieldType: FieldTypeDate},
+		{name: "Name", fieldType: FieldTypeString},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			field := fieldSet.GetFieldByName(tt.name)
+			if field == nil {
+				t.Fatalf("Field %s not extracted", tt.name)
+			}
+			if field.Type != tt.fieldType {
+				t.Errorf("Type = %s, want %s", field.Type, tt.fieldType)
+			}
+			var dateFormat, numberFormat, symbol string
+			if field.Format != nil {
+				dateFormat, numberFormat, symbol = field.Format.DateFormat, field.Format.NumberFormat, field.Format.CurrencySymbol
+			}
+			if dateFormat != tt.dateFormat || numberFormat != tt.numberFormat || symbol != tt.symbol {
+				t.Errorf("Format = %q/%q/%q, want %q/%q/%q", dateFormat, numberFormat, symbol, tt.dateFormat, tt.numberFormat, tt.symbol)
+			}
+		})
+	}
+
+	// Switches take precedence over the default type
+	fieldSet, err = ExtractFieldsWithOptions(doc, ExtractOptions{DefaultFieldType: FieldTypeBoolean})
+	if err != nil {
+		t.Fatalf("ExtractFieldsWithOptions failed: %v", err)
+	}
+	if field := fieldSet.GetFieldByName("DueDate"); field == nil || field.Type != FieldTypeDate {
+		t.Errorf("Expected DueDate to stay a date field, got %+v", field)
+	}
+	if field := fieldSet.GetFieldByName("Name"); field == nil || field.Type != FieldTypeBoolean {
+		t.Errorf("Expected Name to get the default type, got %+v", field)
+	}
+}
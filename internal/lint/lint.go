@@ -0,0 +1,214 @@
+package lint
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"com/lifenture/flash-mail-merge/internal/docx"
+	"com/lifenture/flash-mail-merge/internal/fields"
+)
+
+// Severity ranks how a lint issue affects the merge
+type Severity string
+
+const (
+	// SeverityError marks problems that make fields fail to merge
+	SeverityError Severity = "error"
+
+	// SeverityWarning marks constructs that merge, but possibly not as expected
+	SeverityWarning Severity = "warning"
+)
+
+// Names of the template checks
+const (
+	CheckSplitField           = "split_field"
+	CheckOrphanChevron        = "orphan_chevron"
+	CheckUnsupportedFieldType = "unsupported_field_type"
+	CheckRelationships        = "relationships"
+	CheckTrackedChanges       = "tracked_changes"
+)
+
+// Issue is one problem found in a template
+type Issue struct {
+	Check    string   `json:"check"`
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+	Field    string   `json:"field,omitempty"`
+}
+
+// Report aggregates the issues of a template
+type Report struct {
+	// Mergeable is false when any issue has error severity
+	Mergeable bool `json:"mergeable"`
+
+	// Errors and Warnings count the issues per severity
+	Errors   int `json:"errors"`
+	Warnings int `json:"warnings"`
+
+	// Issues lists the problems found, grouped by check
+	Issues []Issue `json:"issues"`
+}
+
+// unsupportedFieldTypes are the mail merge field types the service does not
+// evaluate; their results stay as last updated in Word
+var unsupportedFieldTypes = map[string]bool{
+	"ASK": true, "DATABASE": true, "FILLIN": true, "IF": true, "MERGEREC": true,
+	"MERGESEQ": true, "NEXT": true, "NEXTIF": true, "SET": true, "SKIPIF": true,
+}
+
+var (
+	// paragraphRegex matches a paragraph element, excluding <w:pPr>
+	paragraphRegex = regexp.MustCompile(`(?s)<w:p[ >].*?</w:p>`)
+
+	// textRegex captures the content of <w:t> elements
+	textRegex = regexp.MustCompile(`(?s)<w:t(?:\s[^>]*)?>(.*?)</w:t>`)
+
+	// trackedChangeRegex matches revision marks of tracked changes
+	trackedChangeRegex = regexp.MustCompile(`<w:(?:ins|del|moveFrom|moveTo|rPrChange|pPrChange|sectPrChange|tblPrChange|trPrChange|tcPrChange|numberingChange)\b`)
+
+	// xmlUnescaper decodes the entities used in text content
+	xmlUnescaper = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&quot;", `"`, "&apos;", "'", "&amp;", "&")
+)
+
+// Template checks a template for constructs that prevent or disturb a merge:
+// placeholders split across runs, unbalanced chevrons, field types that are
+// not merged, broken relationships and tracked changes
+func Template(doc *docx.DocxFile) (*Report, error) {
+	documentXML, err := doc.GetDocumentXML()
+	if err != nil {
+		return nil, err
+	}
+	content := string(documentXML)
+
+	var issues []Issue
+	issues = append(issues, checkPlaceholders(content)...)
+	issues = append(issues, checkFieldTypes(content)...)
+	for _, warning := range doc.ValidateRelationships() {
+		issues = append(issues, Issue{Check: CheckRelationships, Severity: SeverityWarning, Message: warning})
+	}
+	if count := len(trackedChangeRegex.FindAllStringIndex(content, -1)); count > 0 {
+		issues = append(issues, Issue{
+			Check:    CheckTrackedChanges,
+			Severity: SeverityWarning,
+			Message:  fmt.Sprintf("Document contains %d tracked change(s); accept or reject them before merging", count),
+		})
+	}
+
+	report := &Report{Issues: issues}
+	if report.Issues == nil {
+		report.Issues = []Issue{}
+	}
+	for _, issue := range issues {
+		switch issue.Severity {
+		case SeverityError:
+			report.Errors++
+		case SeverityWarning:
+			report.Warnings++
+		}
+	}
+	report.Mergeable = report.Errors == 0
+	return report, nil
+}
+
+// checkPlaceholders reports «field» placeholders whose text spans several
+// <w:t> elements, which the merge rejoins with the formatting of their first
+// run, and chevrons without a partner within their paragraph
+func checkPlaceholders(documentXML string) []Issue {
+	var issues []Issue
+	for _, paragraph := range paragraphRegex.FindAllString(documentXML, -1) {
+		var text []textChar
+		for i, match := range textRegex.FindAllStringSubmatch(paragraph, -1) {
+			for _, r := range xmlUnescaper.Replace(match[1]) {
+				text = append(text, textChar{r: r, element: i})
+			}
+		}
+
+		open := -1
+		for i, c := range text {
+			switch c.r {
+			case '«':
+				if open >= 0 {
+					issues = append(issues, orphanChevron("«", paragraphText(text[open:i])))
+				}
+				open = i
+			case '»':
+				if open < 0 {
+					issues = append(issues, orphanChevron("»", ""))
+					continue
+				}
+				if text[open].element != c.element {
+					name := strings.TrimSpace(paragraphText(text[open+1 : i]))
+					issues = append(issues, Issue{
+						Check:    CheckSplitField,
+						Severity: SeverityWarning,
+						Message:  fmt.Sprintf("Placeholder «%s» is split across several text runs; it is merged with the formatting of its first run", name),
+						Field:    name,
+					})
+				}
+				open = -1
+			}
+		}
+		if open >= 0 {
+			issues = append(issues, orphanChevron("«", paragraphText(text[open:])))
+		}
+	}
+	return issues
+}
+
+// textChar is a rune of paragraph text with the index of the <w:t> element
+// it came from
+type textChar struct {
+	r       rune
+	element int
+}
+
+// paragraphText returns the text of a slice of paragraph characters
+func paragraphText(chars []textChar) string {
+	var b strings.Builder
+	for _, c := range chars {
+		b.WriteRune(c.r)
+	}
+	return b.String()
+}
+
+// orphanChevron reports a chevron without its partner
+func orphanChevron(chevron, context string) Issue {
+	message := fmt.Sprintf("Unmatched '%s' in paragraph text", chevron)
+	if context != "" {
+		message += fmt.Sprintf(" near %q", context)
+	}
+	return Issue{Check: CheckOrphanChevron, Severity: SeverityError, Message: message}
+}
+
+// checkFieldTypes reports the field types that are present but not merged,
+// once per type
+func checkFieldTypes(documentXML string) []Issue {
+	counts := make(map[string]int)
+	for _, instr := range fields.Instructions(documentXML) {
+		tokens := strings.Fields(instr)
+		if len(tokens) == 0 {
+			continue
+		}
+		if fieldType := strings.ToUpper(tokens[0]); unsupportedFieldTypes[fieldType] {
+			counts[fieldType]++
+		}
+	}
+
+	types := make([]string, 0, len(counts))
+	for fieldType := range counts {
+		types = append(types, fieldType)
+	}
+	sort.Strings(types)
+
+	issues := make([]Issue, 0, len(types))
+	for _, fieldType := range types {
+		issues = append(issues, Issue{
+			Check:    CheckUnsupportedFieldType,
+			Severity: SeverityWarning,
+			Message:  fmt.Sprintf("Document contains %d %s field(s), which are not merged", counts[fieldType], fieldType),
+		})
+	}
+	return issues
+}
@@ -0,0 +1,82 @@
+package lint
+
+import (
+	"strings"
+	"testing"
+
+	"com/lifenture/flash-mail-merge/internal/docx"
+)
+
+// lintDocument wraps a document body into a DocxFile and lints it
+func lintDocument(t *testing.T, body string) *Report {
+	t.Helper()
+	doc := &docx.DocxFile{Files: map[string][]byte{
+		"word/document.xml": []byte(`<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>` + body + `</w:body></w:document>`),
+	}}
+	report, err := Template(doc)
+	if err != nil {
+		t.Fatalf("Template failed: %v", err)
+	}
+	return report
+}
+
+func TestTemplateSplitFieldAndOrphanChevron(t *testing.T) {
+	report := lintDocument(t,
+		`<w:p><w:r><w:t>Dear «First</w:t></w:r><w:r><w:rPr><w:b/></w:rPr><w:t>Name»,</w:t></w:r></w:p>`+
+			`<w:p><w:r><w:t>Total: «Amount due</w:t></w:r></w:p>`+
+			`<w:p><w:r><w:t>«City»</w:t></w:r></w:p>`)
+
+	if report.Mergeable {
+		t.Error("expected template with errors not to be mergeable")
+	}
+	if report.Errors != 1 || report.Warnings != 1 {
+		t.Fatalf("expected 1 error and 1 warning, got %d and %d: %+v", report.Errors, report.Warnings, report.Issues)
+	}
+
+	split := report.Issues[0]
+	if split.Check != CheckSplitField || split.Severity != SeverityWarning || split.Field != "FirstName" {
+		t.Errorf("unexpected split field issue: %+v", split)
+	}
+	orphan := report.Issues[1]
+	if orphan.Check != CheckOrphanChevron || !strings.Contains(orphan.Message, "«Amount due") {
+		t.Errorf("unexpected orphan chevron issue: %+v", orphan)
+	}
+}
+
+func TestTemplateOrphanClosingChevron(t *testing.T) {
+	report := lintDocument(t, `<w:p><w:r><w:t>Total »</w:t></w:r></w:p>`)
+
+	if len(report.Issues) != 1 || report.Issues[0].Check != CheckOrphanChevron {
+		t.Fatalf("expected one orphan chevron issue, got %+v", report.Issues)
+	}
+}
+
+func TestTemplateWarnings(t *testing.T) {
+	report := lintDocument(t,
+		`<w:p><w:fldSimple w:instr=" IF «Amount» &gt; 0 &quot;due&quot; "><w:r><w:t>due</w:t></w:r></w:fldSimple></w:p>`+
+			`<w:p><w:ins w:id="1" w:author="A"><w:r><w:t>«Name»</w:t></w:r></w:ins></w:p>`)
+
+	if !report.Mergeable {
+		t.Error("expected template with warnings only to be mergeable")
+	}
+	checks := make(map[string]bool)
+	for _, issue := range report.Issues {
+		if issue.Severity != SeverityWarning {
+			t.Errorf("expected warning severity, got %+v", issue)
+		}
+		checks[issue.Check] = true
+	}
+	for _, check := range []string{CheckUnsupportedFieldType, CheckTrackedChanges} {
+		if !checks[check] {
+			t.Errorf("expected a %s issue, got %+v", check, report.Issues)
+		}
+	}
+}
+
+func TestTemplateClean(t *testing.T) {
+	report := lintDocument(t, `<w:p><w:r><w:t>Hello «Name»</w:t></w:r></w:p>`)
+
+	if !report.Mergeable || len(report.Issues) != 0 {
+		t.Errorf("expected clean report, got %+v", report)
+	}
+}
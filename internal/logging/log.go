@@ -1,6 +1,7 @@
 package logging
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math/rand"
@@ -26,6 +27,9 @@ const (
 // Logger provides structured logging with level support
 type Logger struct {
 	level LogLevel
+
+	// prefix is written before every message, e.g. "[correlation-id] "
+	prefix string
 }
 
 // Global logger instance
@@ -53,6 +57,21 @@ func NewLogger() *Logger {
 	return &Logger{level: level}
 }
 
+// WithCorrelationID returns a logger with the same level that prefixes every
+// message with the correlation ID of a request, so the interleaved lines of
+// concurrent invocations can be told apart
+func (l *Logger) WithCorrelationID(id string) *Logger {
+	if id == "" {
+		return l
+	}
+	return &Logger{level: l.level, prefix: "[" + id + "] "}
+}
+
+// printf writes a message with its level tag and the logger prefix
+func (l *Logger) printf(tag, format string, args ...interface{}) {
+	log.Print(tag + l.prefix + fmt.Sprintf(format, args...))
+}
+
 // IsDebugEnabled returns true if debug logging is enabled
 func (l *Logger) IsDebugEnabled() bool {
 	return l.level <= DEBUG
@@ -61,31 +80,36 @@ func (l *Logger) IsDebugEnabled() bool {
 // Debug logs debug messages (only if debug is enabled)
 func (l *Logger) Debug(format string, args ...interface{}) {
 	if l.level <= DEBUG {
-		log.Printf("[DEBUG] "+format, args...)
+		l.printf("[DEBUG] ", format, args...)
 	}
 }
 
 // Info logs info messages
 func (l *Logger) Info(format string, args ...interface{}) {
 	if l.level <= INFO {
-		log.Printf("[INFO] "+format, args...)
+		l.printf("[INFO] ", format, args...)
 	}
 }
 
 // Warn logs warning messages
 func (l *Logger) Warn(format string, args ...interface{}) {
 	if l.level <= WARN {
-		log.Printf("[WARN] "+format, args...)
+		l.printf("[WARN] ", format, args...)
 	}
 }
 
 // Error logs error messages (always shown)
 func (l *Logger) Error(format string, args ...interface{}) {
 	if l.level <= ERROR {
-		log.Printf("[ERROR] "+format, args...)
+		l.printf("[ERROR] ", format, args...)
 	}
 }
 
+// Default returns the default logger, used by the package-level functions
+func Default() *Logger {
+	return defaultLogger
+}
+
 // Package-level convenience functions using the default logger
 func IsDebugEnabled() bool {
 	return defaultLogger.IsDebugEnabled()
@@ -107,12 +131,33 @@ func Error(format string, args ...interface{}) {
 	defaultLogger.Error(format, args...)
 }
 
-// generateUUID creates a random UUID for correlation
-func generateUUID() string {
-	return fmt.Sprintf("%08x-%04x-%04x-%04x-%12x",
+// WithCorrelationID returns a logger prefixing every message with the
+// correlation ID, at the level of the default logger
+func WithCorrelationID(id string) *Logger {
+	return defaultLogger.WithCorrelationID(id)
+}
+
+type loggerKey struct{}
+
+// NewContext returns a copy of ctx carrying the logger of a request
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, or the default logger
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok && l != nil {
+		return l
+	}
+	return defaultLogger
+}
+
+// GenerateUUID creates a random version 4 UUID for correlation
+func GenerateUUID() string {
+	return fmt.Sprintf("%08x-%04x-%04x-%04x-%012x",
 		rand.Uint32(),
 		rand.Uint32()&0xffff,
-		rand.Uint32()&0xffff|0x4000,
+		rand.Uint32()&0x0fff|0x4000,
 		rand.Uint32()&0x3fff|0x8000,
 		rand.Uint64()&0xffffffffffff)
 }
@@ -0,0 +1,77 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureLogs redirects the standard logger to a buffer for the test
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var logs bytes.Buffer
+	flags := log.Flags()
+	log.SetOutput(&logs)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	})
+	return &logs
+}
+
+func TestLoggerWithCorrelationID(t *testing.T) {
+	logs := captureLogs(t)
+
+	logger := (&Logger{level: DEBUG}).WithCorrelationID("req-42")
+	logger.Debug("debug %d", 1)
+	logger.Info("info %s", "two")
+	logger.Warn("warn")
+	logger.Error("error 100%%")
+
+	want := "[DEBUG] [req-42] debug 1\n" +
+		"[INFO] [req-42] info two\n" +
+		"[WARN] [req-42] warn\n" +
+		"[ERROR] [req-42] error 100%\n"
+	if logs.String() != want {
+		t.Errorf("Unexpected log output:\n%s\nwant:\n%s", logs.String(), want)
+	}
+
+	// The level of the logger is kept
+	logs.Reset()
+	(&Logger{level: WARN}).WithCorrelationID("req-43").Info("hidden")
+	if logs.Len() != 0 {
+		t.Errorf("Expected info to be filtered at WARN, got %q", logs.String())
+	}
+
+	// An empty ID adds no prefix
+	logs.Reset()
+	(&Logger{level: INFO}).WithCorrelationID("").Info("plain")
+	if logs.String() != "[INFO] plain\n" {
+		t.Errorf("Expected no prefix without an ID, got %q", logs.String())
+	}
+}
+
+func TestLoggerFromContext(t *testing.T) {
+	logs := captureLogs(t)
+
+	// Without a logger the context gives the default logger
+	if FromContext(context.Background()) != defaultLogger {
+		t.Error("Expected the default logger for a context without one")
+	}
+
+	ctx := NewContext(context.Background(), WithCorrelationID("req-44"))
+	FromContext(ctx).Error("failed")
+	if logs.String() != "[ERROR] [req-44] failed\n" {
+		t.Errorf("Expected the context logger's prefix, got %q", logs.String())
+	}
+
+	// The package-level functions are unchanged
+	logs.Reset()
+	Error("failed")
+	if strings.Contains(logs.String(), "req-44") || logs.String() != "[ERROR] failed\n" {
+		t.Errorf("Expected an unprefixed line, got %q", logs.String())
+	}
+}
@@ -0,0 +1,130 @@
+package merge
+
+import (
+	"bytes"
+	"path"
+	"regexp"
+	"strings"
+
+	"com/lifenture/flash-mail-merge/internal/docx"
+)
+
+// maxAltChunkDepth bounds recursion through nested or cyclic alt chunks
+const maxAltChunkDepth = 5
+
+var (
+	// altChunkRegex captures the relationship id of <w:altChunk> elements
+	altChunkRegex = regexp.MustCompile(`<w:altChunk\b[^>]*\br:id="([^"]+)"`)
+
+	// relationshipRegex matches a <Relationship> element of a .rels part
+	relationshipRegex = regexp.MustCompile(`<Relationship\b[^>]*>`)
+
+	// relationshipAttrRegex captures the attributes of a <Relationship> element
+	relationshipAttrRegex = regexp.MustCompile(`\b(Id|Target|TargetMode)="([^"]*)"`)
+)
+
+// mergeAltChunks merges the placeholders of the OOXML sub-documents imported
+// by <w:altChunk> elements of the given part. Embedded .docx packages and
+// WordprocessingML XML parts are merged recursively; other chunk types such as
+// HTML, RTF or plain text are left untouched.
+func (r *fieldReplacer) mergeAltChunks(doc *docx.DocxFile, partName string, depth int) {
+	if depth >= maxAltChunkDepth {
+		r.log.Warn("Alt chunk nesting deeper than %d levels in %s, not merged", maxAltChunkDepth, partName)
+		return
+	}
+
+	refs := altChunkRegex.FindAllSubmatch(doc.Files[partName], -1)
+	if len(refs) == 0 {
+		return
+	}
+
+	targets := relationshipTargets(doc.Files[relsPartName(partName)])
+	for _, ref := range refs {
+		target, found := targets[string(ref[1])]
+		if !found {
+			r.log.Warn("Alt chunk relationship '%s' not found for %s", ref[1], partName)
+			continue
+		}
+
+		chunkPart := resolvePartName(partName, target)
+		content, exists := doc.Files[chunkPart]
+		if !exists {
+			r.log.Warn("Alt chunk part %s not found", chunkPart)
+			continue
+		}
+
+		switch {
+		case bytes.HasPrefix(content, []byte("PK")):
+			merged, ok := r.mergeEmbeddedDocx(content, depth+1)
+			if !ok {
+				continue
+			}
+			doc.Files[chunkPart] = merged
+		case bytes.Contains(content, []byte("<w:body")):
+			doc.Files[chunkPart] = []byte(r.mergeDocumentXML(string(content)))
+			r.mergeAltChunks(doc, chunkPart, depth+1)
+		default:
+			r.log.Debug("Skipping non-OOXML alt chunk %s", chunkPart)
+			continue
+		}
+		r.log.Debug("Merged alt chunk %s", chunkPart)
+	}
+}
+
+// mergeEmbeddedDocx merges an embedded .docx package and returns the rebuilt
+// archive. It reports false when the package cannot be read or rebuilt.
+func (r *fieldReplacer) mergeEmbeddedDocx(content []byte, depth int) ([]byte, bool) {
+	embedded, err := docx.UnzipDocx(content)
+	if err != nil {
+		r.log.Warn("Failed to read embedded alt chunk document: %v", err)
+		return nil, false
+	}
+
+	documentXML, err := embedded.GetDocumentXML()
+	if err != nil {
+		r.log.Warn("Embedded alt chunk is not a Word document: %v", err)
+		return nil, false
+	}
+
+	embedded.Files["word/document.xml"] = []byte(r.mergeDocumentXML(string(documentXML)))
+	r.mergeAltChunks(embedded, "word/document.xml", depth)
+
+	merged, err := rebuildDocxArchive(embedded, r.log)
+	if err != nil {
+		r.log.Warn("Failed to rebuild embedded alt chunk document: %v", err)
+		return nil, false
+	}
+	return merged, true
+}
+
+// relationshipTargets maps the ids of the internal relationships of a .rels
+// part to their targets
+func relationshipTargets(rels []byte) map[string]string {
+	targets := make(map[string]string)
+	for _, element := range relationshipRegex.FindAll(rels, -1) {
+		attrs := make(map[string]string)
+		for _, attr := range relationshipAttrRegex.FindAllSubmatch(element, -1) {
+			attrs[string(attr[1])] = string(attr[2])
+		}
+		if attrs["TargetMode"] == "External" || attrs["Id"] == "" {
+			continue
+		}
+		targets[attrs["Id"]] = unescapeXML(attrs["Target"])
+	}
+	return targets
+}
+
+// relsPartName returns the relationships part of a package part, e.g.
+// word/_rels/document.xml.rels for word/document.xml
+func relsPartName(partName string) string {
+	return path.Join(path.Dir(partName), "_rels", path.Base(partName)+".rels")
+}
+
+// resolvePartName resolves a relationship target against the part that
+// declares it. Targets starting with "/" are relative to the package root.
+func resolvePartName(partName, target string) string {
+	if strings.HasPrefix(target, "/") {
+		return strings.TrimPrefix(path.Clean(target), "/")
+	}
+	return path.Join(path.Dir(partName), target)
+}
@@ -0,0 +1,204 @@
+package merge
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"com/lifenture/flash-mail-merge/internal/docx"
+	"com/lifenture/flash-mail-merge/internal/fields"
+)
+
+// ManifestFilename is the name of the manifest entry of a batch archive
+const ManifestFilename = "manifest.json"
+
+var (
+	// filenamePlaceholderRegex matches the «Field» placeholders of an output
+	// filename pattern
+	filenamePlaceholderRegex = regexp.MustCompile(`«([^»]+)»`)
+
+	// unsafeFilenameRegex matches the characters that are not allowed in
+	// archive entry names on common file systems, including path separators
+	unsafeFilenameRegex = regexp.MustCompile(`[/\\:*?"<>|\x00-\x1f]`)
+)
+
+// BatchEntry describes one record of a batch merge
+type BatchEntry struct {
+	// Record is the zero-based index of the record in the request
+	Record int `json:"record"`
+
+	// Filename is the archive entry holding the merged document; empty when
+	// the record was not merged
+	Filename string `json:"filename,omitempty"`
+
+	// RequestedFilename is the filename the record resolved to when it was
+	// shared with other records and the entry was renamed to stay unique
+	RequestedFilename string `json:"requestedFilename,omitempty"`
+
+	// Skipped lists the fields that had no data available
+	Skipped []string `json:"skippedFields"`
+
+	// Errors lists the validation errors that prevented the merge
+	Errors []string `json:"errors,omitempty"`
+
+	// Document is the merged DOCX; nil when the record was not merged
+	Document []byte `json:"-"`
+}
+
+// BatchRowResult is the outcome of merging one row of a batch
+type BatchRowResult struct {
+	// Result is the merged document and its outcome; nil when the row
+	// failed to merge
+	Result *Result
+
+	// Err is the error that stopped the row from merging
+	Err error
+}
+
+// PerformMergeBatch merges each row of data into the same document with the
+// same options, so the document is unzipped and its fields extracted once
+// for the whole batch. Every row is merged from the unchanged template, and
+// a row that fails to merge reports its error in its result without
+// affecting the other rows.
+func PerformMergeBatch(doc *docx.DocxFile, rows []fields.MergeData, opts Options) []BatchRowResult {
+	logger := opts.logger()
+	results := make([]BatchRowResult, len(rows))
+	for i, data := range rows {
+		result, err := PerformMergeWithOptions(doc, data, opts)
+		if err != nil {
+			logger.Warn("Row %d of the batch not merged: %v", i, err)
+		}
+		results[i] = BatchRowResult{Result: result, Err: err}
+	}
+	return results
+}
+
+// BatchManifest describes the contents of a batch archive
+type BatchManifest struct {
+	Documents []BatchEntry `json:"documents"`
+}
+
+// BatchFilename resolves an output filename pattern such as «LastName».docx
+// against the merge data of a record. Placeholders without data resolve to
+// nothing, characters not allowed in filenames are replaced with an
+// underscore and the name is given the .docx extension. It returns "" when
+// the pattern is empty or resolves to no name.
+func BatchFilename(pattern string, data fields.MergeData) string {
+	name := filenamePlaceholderRegex.ReplaceAllStringFunc(pattern, func(placeholder string) string {
+		value, _ := lookupValue(data, placeholder[len("«"):len(placeholder)-len("»")])
+		return value
+	})
+	name = unsafeFilenameRegex.ReplaceAllString(name, "_")
+	if strings.EqualFold(path.Ext(name), ".docx") {
+		name = name[:len(name)-len(".docx")]
+	}
+	name = strings.Trim(name, " .")
+	if name == "" {
+		return ""
+	}
+	return name + ".docx"
+}
+
+// uniqueFilenames names the merged entries of a batch so that no two share a
+// name, compared case-insensitively as most file systems extracting the
+// archive do. Entries without a filename are named after their record
+// number. Records sharing a filename, or resolving to the manifest's, are
+// numbered in record order with a suffix such as Smith_1.docx and
+// Smith_2.docx, skipping names already in use, and keep the shared name as
+// their RequestedFilename.
+func uniqueFilenames(entries []BatchEntry) {
+	counts := map[string]int{strings.ToLower(ManifestFilename): 1}
+	for i := range entries {
+		if entries[i].Document == nil {
+			continue
+		}
+		if entries[i].Filename == "" {
+			entries[i].Filename = fmt.Sprintf("record_%d.docx", entries[i].Record+1)
+		}
+		counts[strings.ToLower(entries[i].Filename)]++
+	}
+
+	taken := make(map[string]bool, len(counts))
+	for name := range counts {
+		taken[name] = true
+	}
+	suffixes := make(map[string]int)
+	for i := range entries {
+		name := entries[i].Filename
+		if entries[i].Document == nil || counts[strings.ToLower(name)] == 1 {
+			continue
+		}
+		ext := path.Ext(name)
+		stem := strings.TrimSuffix(name, ext)
+		key := strings.ToLower(name)
+		for {
+			suffixes[key]++
+			candidate := fmt.Sprintf("%s_%d%s", stem, suffixes[key], ext)
+			if !taken[strings.ToLower(candidate)] {
+				taken[strings.ToLower(candidate)] = true
+				entries[i].Filename = candidate
+				entries[i].RequestedFilename = name
+				break
+			}
+		}
+	}
+}
+
+// BuildBatchArchive packages the merged documents of a batch into a single
+// ZIP archive together with a manifest describing every record. Entries
+// without a document appear in the manifest only. Merged entries are named
+// as described for uniqueFilenames, so every entry name is unique.
+func BuildBatchArchive(entries []BatchEntry) ([]byte, *BatchManifest, error) {
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+
+	entries = append([]BatchEntry(nil), entries...)
+	uniqueFilenames(entries)
+
+	manifest := &BatchManifest{Documents: make([]BatchEntry, 0, len(entries))}
+	for _, entry := range entries {
+		if entry.Document != nil {
+			fileWriter, err := zipWriter.Create(entry.Filename)
+			if err != nil {
+				zipWriter.Close()
+				return nil, nil, fmt.Errorf("failed to create file %s in ZIP: %w", entry.Filename, err)
+			}
+			if _, err := fileWriter.Write(entry.Document); err != nil {
+				zipWriter.Close()
+				return nil, nil, fmt.Errorf("failed to write content for file %s: %w", entry.Filename, err)
+			}
+		} else {
+			entry.Filename = ""
+			entry.RequestedFilename = ""
+		}
+		if entry.Skipped == nil {
+			entry.Skipped = []string{}
+		}
+		entry.Document = nil
+		manifest.Documents = append(manifest.Documents, entry)
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		zipWriter.Close()
+		return nil, nil, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	fileWriter, err := zipWriter.Create(ManifestFilename)
+	if err != nil {
+		zipWriter.Close()
+		return nil, nil, fmt.Errorf("failed to create file %s in ZIP: %w", ManifestFilename, err)
+	}
+	if _, err := fileWriter.Write(manifestJSON); err != nil {
+		zipWriter.Close()
+		return nil, nil, fmt.Errorf("failed to write content for file %s: %w", ManifestFilename, err)
+	}
+
+	if err := zipWriter.Close(); err != nil {
+		return nil, nil, fmt.Errorf("failed to close ZIP writer: %w", err)
+	}
+	return buf.Bytes(), manifest, nil
+}
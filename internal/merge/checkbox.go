@@ -0,0 +1,121 @@
+package merge
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Default checkbox glyphs Word uses when a checkbox declares no states
+const (
+	defaultCheckedGlyph   = "2612" // ☒
+	defaultUncheckedGlyph = "2610" // ☐
+)
+
+var (
+	// sdtPropertiesRegex matches the properties of a content control
+	sdtPropertiesRegex = regexp.MustCompile(`(?s)<w:sdtPr\b[^>]*>.*?</w:sdtPr>`)
+
+	// sdtTagRegex captures the tag of a content control
+	sdtTagRegex = regexp.MustCompile(`<w:tag\s+w:val="([^"]*)"`)
+
+	// checkboxRegex detects checkbox content controls (w:checkbox or w14:checkbox)
+	checkboxRegex = regexp.MustCompile(`<\w+:checkbox\b`)
+
+	// checkedRegex matches the checked state element and captures its prefix
+	checkedRegex = regexp.MustCompile(`<(\w+):checked\b[^>]*/>`)
+
+	// checkedStateRegex and uncheckedStateRegex capture the glyph code points
+	checkedStateRegex   = regexp.MustCompile(`<\w+:checkedState\b[^>]*\bval="([0-9A-Fa-f]+)"`)
+	uncheckedStateRegex = regexp.MustCompile(`<\w+:uncheckedState\b[^>]*\bval="([0-9A-Fa-f]+)"`)
+
+	// sdtContentRegex matches the content following the control properties
+	sdtContentRegex = regexp.MustCompile(`(?s)^\s*(?:<w:sdtEndPr\b[^>]*/>\s*|<w:sdtEndPr\b[^>]*>.*?</w:sdtEndPr>\s*)?<w:sdtContent\b[^>]*>.*?</w:sdtContent>`)
+)
+
+// replaceCheckboxes sets the checked state and displayed glyph of checkbox
+// content controls whose tag names a field with a boolean value. Checkboxes
+// without data keep their template state.
+func (r *fieldReplacer) replaceCheckboxes(documentXML string) string {
+	matches := sdtPropertiesRegex.FindAllStringIndex(documentXML, -1)
+	if len(matches) == 0 {
+		return documentXML
+	}
+
+	var result strings.Builder
+	last := 0
+	for _, match := range matches {
+		if match[0] < last {
+			continue
+		}
+		properties := documentXML[match[0]:match[1]]
+		if !checkboxRegex.MatchString(properties) {
+			continue
+		}
+		tag := sdtTagRegex.FindStringSubmatch(properties)
+		if tag == nil {
+			continue
+		}
+		fieldName := unescapeXML(tag[1])
+		value, found := lookupValue(r.data, fieldName)
+		if !found {
+			continue
+		}
+		checked, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			r.log.Warn("Checkbox '%s' ignored: value '%s' is not a boolean", fieldName, value)
+			continue
+		}
+
+		content := sdtContentRegex.FindStringIndex(documentXML[match[1]:])
+		if content == nil {
+			continue
+		}
+		contentEnd := match[1] + content[1]
+		r.resolve(fieldName)
+
+		result.WriteString(documentXML[last:match[0]])
+		result.WriteString(setCheckboxState(properties, checked))
+		result.WriteString(setCheckboxGlyph(documentXML[match[1]:contentEnd], properties, checked))
+		last = contentEnd
+		r.log.Debug("Checkbox '%s' set to %t", fieldName, checked)
+	}
+	result.WriteString(documentXML[last:])
+
+	return result.String()
+}
+
+// setCheckboxState updates the checked element of the control properties
+func setCheckboxState(properties string, checked bool) string {
+	state := "0"
+	if checked {
+		state = "1"
+	}
+	return checkedRegex.ReplaceAllString(properties, `<${1}:checked ${1}:val="`+state+`"/>`)
+}
+
+// setCheckboxGlyph replaces the text of the rendered checkbox with the glyph
+// of the new state
+func setCheckboxGlyph(content, properties string, checked bool) string {
+	stateRegex, code := uncheckedStateRegex, defaultUncheckedGlyph
+	if checked {
+		stateRegex, code = checkedStateRegex, defaultCheckedGlyph
+	}
+	if match := stateRegex.FindStringSubmatch(properties); match != nil {
+		code = match[1]
+	}
+	codePoint, err := strconv.ParseUint(code, 16, 32)
+	if err != nil {
+		return content
+	}
+
+	glyph := string(rune(codePoint))
+	replaced := false
+	return runTextRegex.ReplaceAllStringFunc(content, func(run string) string {
+		if replaced {
+			return runTextRegex.ReplaceAllString(run, "${1}</w:t>")
+		}
+		replaced = true
+		return runTextRegex.ReplaceAllString(run, "${1}"+escapeXML(glyph)+"</w:t>")
+	})
+}
@@ -0,0 +1,121 @@
+package merge
+
+import (
+	"bytes"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"com/lifenture/flash-mail-merge/internal/docx"
+)
+
+const contentTypesPart = "[Content_Types].xml"
+
+var (
+	// relationshipTypeRegex captures the Type of a <Relationship> element
+	relationshipTypeRegex = regexp.MustCompile(`\bType="([^"]*)"`)
+
+	// defaultContentTypeRegex captures the extension of <Default> content types
+	defaultContentTypeRegex = regexp.MustCompile(`<Default\b[^>]*\bExtension="([^"]*)"[^>]*/>`)
+)
+
+// compactPackage removes the image relationships no longer referenced by the
+// part that declares them, then the media parts no longer targeted by any
+// relationship, together with their content type declarations. It is
+// deliberately conservative: a relationship id appearing anywhere in its part
+// keeps the relationship, and only parts under word/media/ are ever removed.
+// It returns the removed parts, sorted.
+func compactPackage(doc *docx.DocxFile) []string {
+	targeted := make(map[string]bool)
+	for relsPart, rels := range doc.Files {
+		if !strings.HasSuffix(relsPart, ".rels") {
+			continue
+		}
+
+		source, exists := doc.Files[relsSourcePartName(relsPart)]
+		rels = relationshipRegex.ReplaceAllFunc(rels, func(element []byte) []byte {
+			attrs := make(map[string]string)
+			for _, attr := range relationshipAttrRegex.FindAllSubmatch(element, -1) {
+				attrs[string(attr[1])] = string(attr[2])
+			}
+			if exists && isImageRelationship(element) && !referencesID(source, attrs["Id"]) {
+				return nil
+			}
+			if attrs["TargetMode"] != "External" {
+				targeted[resolvePartName(relsSourcePartName(relsPart), unescapeXML(attrs["Target"]))] = true
+			}
+			return element
+		})
+		doc.Files[relsPart] = rels
+	}
+
+	var removed []string
+	for name := range doc.Files {
+		if strings.HasPrefix(name, docx.MediaFolder) && !targeted[name] {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+	for _, name := range removed {
+		delete(doc.Files, name)
+	}
+
+	if len(removed) > 0 {
+		doc.Files[contentTypesPart] = removeContentTypes(doc, removed)
+	}
+	return removed
+}
+
+// relsSourcePartName returns the part whose relationships a .rels part holds,
+// e.g. word/document.xml for word/_rels/document.xml.rels. The package
+// relationships _rels/.rels have no source part and yield "".
+func relsSourcePartName(relsPart string) string {
+	base := strings.TrimSuffix(path.Base(relsPart), ".rels")
+	dir := path.Dir(path.Dir(relsPart))
+	if base == "" || dir == "." {
+		return base
+	}
+	return path.Join(dir, base)
+}
+
+// isImageRelationship reports whether a <Relationship> element targets an image
+func isImageRelationship(element []byte) bool {
+	match := relationshipTypeRegex.FindSubmatch(element)
+	return match != nil && bytes.HasSuffix(match[1], []byte("/relationships/image"))
+}
+
+// referencesID reports whether a part mentions a relationship id as the
+// value of any attribute
+func referencesID(part []byte, id string) bool {
+	return id == "" ||
+		bytes.Contains(part, []byte(`"`+id+`"`)) ||
+		bytes.Contains(part, []byte(`'`+id+`'`))
+}
+
+// removeContentTypes drops the overrides of the removed parts from the
+// content types, and the defaults of extensions no remaining part uses
+func removeContentTypes(doc *docx.DocxFile, removed []string) []byte {
+	contentTypes := doc.Files[contentTypesPart]
+	for _, name := range removed {
+		overrideRegex := regexp.MustCompile(`<Override\b[^>]*\bPartName="/` + regexp.QuoteMeta(name) + `"[^>]*/>`)
+		contentTypes = overrideRegex.ReplaceAll(contentTypes, nil)
+	}
+
+	usedExtensions := make(map[string]bool)
+	for name := range doc.Files {
+		usedExtensions[strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))] = true
+	}
+	removedExtensions := make(map[string]bool)
+	for _, name := range removed {
+		removedExtensions[strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))] = true
+	}
+
+	return defaultContentTypeRegex.ReplaceAllFunc(contentTypes, func(element []byte) []byte {
+		extension := strings.ToLower(string(defaultContentTypeRegex.FindSubmatch(element)[1]))
+		if removedExtensions[extension] && !usedExtensions[extension] {
+			return nil
+		}
+		return element
+	})
+}
@@ -0,0 +1,176 @@
+package merge
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"com/lifenture/flash-mail-merge/internal/fields"
+)
+
+// complexFieldMarkerRegex matches the field characters of complex fields and
+// the text of their instructions
+var complexFieldMarkerRegex = regexp.MustCompile(`(?s)<w:fldChar\b[^>]*?\bw:fldCharType="(begin|separate|end)"[^>]*>|<w:instrText\b[^>]*?(?:/>|>(.*?)</w:instrText>)`)
+
+// formFieldNameRegex captures the name in the <w:ffData> of a legacy form
+// field's begin marker
+var formFieldNameRegex = regexp.MustCompile(`<w:name\s+w:val="([^"]*)"`)
+
+// complexField is a field built from <w:fldChar> begin, separate and end
+// markers, located by byte offsets into the document XML
+type complexField struct {
+	instr strings.Builder
+
+	// formName is the bookmark name of a legacy form field
+	formName string
+
+	// separate is the offset just past the separate marker, or -1 for a
+	// field without one; end is the offset of the end marker
+	separate, end int
+
+	// nested is set for a field holding another field in its result
+	nested bool
+}
+
+// fieldEdit replaces the XML between two offsets
+type fieldEdit struct {
+	start, end int
+	text       string
+}
+
+// replaceComplexFields replaces the displayed result of MERGEFIELD complex
+// fields, whose instruction sits in <w:instrText> runs between the begin and
+// separate markers and whose result runs between the separate and end
+// markers. The value goes into the first text element of the result and any
+// further text elements are emptied, so the result runs keep their
+// formatting. Legacy FORMTEXT form fields are filled the same way, matching
+// their bookmark name to the data, so their default text gives way to the
+// value. Fields holding other fields in their result are left alone.
+func (r *fieldReplacer) replaceComplexFields(documentXML string) string {
+	if !strings.Contains(documentXML, "<w:fldChar") {
+		return documentXML
+	}
+
+	// Pair the markers, accumulating each instruction from its own runs only:
+	// a MERGEFIELD nested in an IF instruction is a field of its own
+	var open []*complexField
+	var closed []*complexField
+	for _, match := range complexFieldMarkerRegex.FindAllStringSubmatchIndex(documentXML, -1) {
+		if match[2] < 0 {
+			if len(open) > 0 && open[len(open)-1].separate < 0 && match[4] >= 0 {
+				open[len(open)-1].instr.WriteString(unescapeXML(documentXML[match[4]:match[5]]))
+			}
+			continue
+		}
+
+		switch documentXML[match[2]:match[3]] {
+		case "begin":
+			if len(open) > 0 && open[len(open)-1].separate >= 0 {
+				open[len(open)-1].nested = true
+			}
+			field := &complexField{separate: -1}
+			if tag := documentXML[match[0]:match[1]]; !strings.HasSuffix(tag, "/>") {
+				if end := strings.Index(documentXML[match[1]:], "</w:fldChar>"); end >= 0 {
+					if name := formFieldNameRegex.FindStringSubmatch(documentXML[match[1] : match[1]+end]); name != nil {
+						field.formName = unescapeXML(name[1])
+					}
+				}
+			}
+			open = append(open, field)
+		case "separate":
+			if len(open) > 0 {
+				open[len(open)-1].separate = match[1]
+			}
+		case "end":
+			if len(open) == 0 {
+				continue
+			}
+			field := open[len(open)-1]
+			open = open[:len(open)-1]
+			field.end = match[0]
+			closed = append(closed, field)
+		}
+	}
+
+	var edits []fieldEdit
+	for _, field := range closed {
+		if field.nested {
+			continue
+		}
+		fieldName := fields.MergeFieldName(field.instr.String())
+		if fieldName == "" {
+			fieldName = fields.FormTextName(field.instr.String(), field.formName)
+		}
+		if fieldName == "" {
+			continue
+		}
+		if edit, ok := r.complexFieldEdit(documentXML, field, fieldName); ok {
+			edits = append(edits, edit)
+		}
+	}
+	if len(edits) == 0 {
+		return documentXML
+	}
+
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+	var result strings.Builder
+	last := 0
+	for _, edit := range edits {
+		result.WriteString(documentXML[last:edit.start])
+		result.WriteString(edit.text)
+		last = edit.end
+	}
+	result.WriteString(documentXML[last:])
+	return result.String()
+}
+
+// complexFieldEdit resolves a MERGEFIELD complex field and returns the edit
+// writing its value. A field without result text gets a new run holding the
+// value, after its separate marker or, lacking one, with a separate marker
+// before its end marker.
+func (r *fieldReplacer) complexFieldEdit(documentXML string, field *complexField, fieldName string) (fieldEdit, bool) {
+	// Find where the value goes before resolving the field, so a field that
+	// cannot be written is not counted as merged
+	var content string
+	hasText := false
+	insertAt := -1
+	if field.separate >= 0 {
+		content = documentXML[field.separate:field.end]
+		hasText = runTextRegex.MatchString(content)
+		if at := strings.Index(content, "</w:r>"); !hasText && at >= 0 {
+			// After the run holding the separate marker
+			insertAt = field.separate + at + len("</w:r>")
+		}
+	} else if starts := runStartRegex.FindAllStringIndex(documentXML[:field.end], -1); len(starts) > 0 {
+		// Before the run holding the end marker
+		insertAt = starts[len(starts)-1][0]
+	}
+	if !hasText && insertAt < 0 {
+		return fieldEdit{}, false
+	}
+
+	value, found := r.resolve(fieldName)
+	if !found {
+		return fieldEdit{}, false
+	}
+	escaped := r.markMerged(runTabs(r.expressionLineBreaks(fieldName, escapeXML(value))))
+	valueRun := "<w:r><w:t>" + escaped + "</w:t></w:r>"
+
+	if field.separate < 0 {
+		valueRun = `<w:r><w:fldChar w:fldCharType="separate"/></w:r>` + valueRun
+	}
+	if !hasText {
+		return fieldEdit{start: insertAt, end: insertAt, text: valueRun}, true
+	}
+
+	first := true
+	content = runTextRegex.ReplaceAllStringFunc(content, func(text string) string {
+		openTag := runTextRegex.FindStringSubmatch(text)[1]
+		if first {
+			first = false
+			return openTag + escaped + "</w:t>"
+		}
+		return openTag + "</w:t>"
+	})
+	return fieldEdit{start: field.separate, end: field.end, text: content}, true
+}
@@ -0,0 +1,74 @@
+package merge
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrTooManyConcurrentMerges is returned when the concurrency limit is reached
+// and the limit mode is LimitFail
+var ErrTooManyConcurrentMerges = errors.New("too many concurrent merges")
+
+// LimitMode selects what happens to a merge started past the concurrency limit
+type LimitMode int
+
+const (
+	// LimitBlock waits until a running merge finishes
+	LimitBlock LimitMode = iota
+
+	// LimitFail returns ErrTooManyConcurrentMerges immediately
+	LimitFail
+)
+
+var (
+	concurrencyMu sync.Mutex
+
+	// mergeSlots holds one token per running merge; nil means unlimited
+	mergeSlots chan struct{}
+
+	limitMode LimitMode
+)
+
+// SetMaxConcurrent bounds the number of merges running at the same time in
+// this process. A limit of zero or less removes the bound. Merges already
+// running keep counting against the limit that was set when they started.
+func SetMaxConcurrent(n int) {
+	concurrencyMu.Lock()
+	defer concurrencyMu.Unlock()
+
+	if n <= 0 {
+		mergeSlots = nil
+		return
+	}
+	mergeSlots = make(chan struct{}, n)
+}
+
+// SetLimitMode configures whether merges past the concurrency limit block or fail
+func SetLimitMode(mode LimitMode) {
+	concurrencyMu.Lock()
+	defer concurrencyMu.Unlock()
+
+	limitMode = mode
+}
+
+// acquireMergeSlot reserves a merge slot and returns the function releasing it
+func acquireMergeSlot() (func(), error) {
+	concurrencyMu.Lock()
+	slots, mode := mergeSlots, limitMode
+	concurrencyMu.Unlock()
+
+	if slots == nil {
+		return func() {}, nil
+	}
+
+	if mode == LimitFail {
+		select {
+		case slots <- struct{}{}:
+		default:
+			return nil, ErrTooManyConcurrentMerges
+		}
+	} else {
+		slots <- struct{}{}
+	}
+	return func() { <-slots }, nil
+}
@@ -0,0 +1,316 @@
+package merge
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"com/lifenture/flash-mail-merge/internal/docx"
+)
+
+// Store item ids Word uses to bind content controls to the built-in document
+// properties, e.g. the Title and Subject controls of the Quick Parts menu
+const (
+	coreStoreItemID     = "{6C3C8BC8-F283-45AE-878A-BAB7291924A1}"
+	extendedStoreItemID = "{6668398D-A668-4E3E-A5EB-62B293D839F1}"
+	extendedPropsPart   = "docProps/app.xml"
+)
+
+// errBoundNodeNotFound is returned when the XPath of a binding selects nothing
+var errBoundNodeNotFound = errors.New("bound node not found")
+
+var (
+	// dataBindingRegex matches the data binding of a content control
+	dataBindingRegex = regexp.MustCompile(`<w:dataBinding\b[^>]*/?>`)
+
+	// dataBindingAttrRegex captures the attributes of a <w:dataBinding>
+	dataBindingAttrRegex = regexp.MustCompile(`w:(xpath|storeItemID|prefixMappings)="([^"]*)"`)
+
+	// sdtAliasRegex captures the title of a content control
+	sdtAliasRegex = regexp.MustCompile(`<w:alias\s+w:val="([^"]*)"`)
+
+	// customXMLPropsRegex matches the properties parts of custom XML data
+	customXMLPropsRegex = regexp.MustCompile(`^customXml/itemProps(\d+)\.xml$`)
+
+	// itemIDRegex captures the store item id declared by a properties part
+	itemIDRegex = regexp.MustCompile(`\bitemID="([^"]*)"`)
+
+	// xpathStepRegex matches the steps of the XPaths Word writes for
+	// bindings, such as ns0:title[1]
+	xpathStepRegex = regexp.MustCompile(`^(?:[\w.-]+:)?([\w.-]+)(?:\[(\d+)\])?$`)
+)
+
+// dataBinding is a merged value to write to the XML data a content control is
+// bound to
+type dataBinding struct {
+	field       string
+	storeItemID string
+	xpath       string
+	value       string
+}
+
+// xpathStep is one step of a binding XPath: the n-th child element with the
+// given local name
+type xpathStep struct {
+	name  string
+	index int
+}
+
+// replaceDataBindings fills the content controls bound to document properties
+// or custom XML data through <w:dataBinding>. A control matches a field by its
+// tag, its title, or the name of the bound element, e.g. "title" for the
+// document title. The displayed text is replaced here and the bound value
+// recorded, so updateDataStores can write it to the data Word shows on open.
+func (r *fieldReplacer) replaceDataBindings(documentXML string) string {
+	if !strings.Contains(documentXML, "<w:dataBinding") {
+		return documentXML
+	}
+
+	var result strings.Builder
+	last := 0
+	for {
+		sdt, found := nextSdt(documentXML, last)
+		if !found {
+			break
+		}
+		result.WriteString(documentXML[last:sdt.start])
+		element := documentXML[sdt.start:sdt.end]
+		last = sdt.end
+
+		binding := dataBindingRegex.FindString(sdt.properties)
+		if binding == "" {
+			// Bound controls may sit inside other controls
+			if strings.Contains(sdt.content, "<w:dataBinding") {
+				element = element[:sdt.contentAt] + r.replaceDataBindings(sdt.content) + element[sdt.contentAt+len(sdt.content):]
+			}
+			result.WriteString(element)
+			continue
+		}
+		result.WriteString(r.bindDataBoundControl(element, sdt, binding))
+	}
+	result.WriteString(documentXML[last:])
+
+	return result.String()
+}
+
+// bindDataBoundControl fills one bound content control whose field has merge
+// data. Controls without data keep their text and bound value.
+func (r *fieldReplacer) bindDataBoundControl(element string, sdt sdtElement, binding string) string {
+	attrs := make(map[string]string)
+	for _, attr := range dataBindingAttrRegex.FindAllStringSubmatch(binding, -1) {
+		attrs[attr[1]] = unescapeXML(attr[2])
+	}
+
+	fieldName := r.dataBindingField(sdt.properties, attrs["xpath"])
+	if fieldName == "" {
+		return element
+	}
+	value, found := r.resolve(fieldName)
+	if !found {
+		return element
+	}
+
+	r.dataBindings = append(r.dataBindings, dataBinding{
+		field:       fieldName,
+		storeItemID: attrs["storeItemID"],
+		xpath:       attrs["xpath"],
+		value:       value,
+	})
+
+	properties := showingPlaceholderRegex.ReplaceAllString(sdt.properties, "")
+	content := setContentText(sdt.content, value)
+	propsAt := strings.Index(element, sdt.properties)
+	return element[:propsAt] + properties + element[propsAt+len(sdt.properties):sdt.contentAt] + content + element[sdt.contentAt+len(sdt.content):]
+}
+
+// dataBindingField returns the first of the control's tag, its title and the
+// bound element name that has merge data, or "" if none has
+func (r *fieldReplacer) dataBindingField(properties, xpath string) string {
+	var candidates []string
+	if tag := sdtTagRegex.FindStringSubmatch(properties); tag != nil {
+		candidates = append(candidates, unescapeXML(tag[1]))
+	}
+	if alias := sdtAliasRegex.FindStringSubmatch(properties); alias != nil {
+		candidates = append(candidates, unescapeXML(alias[1]))
+	}
+	if steps, err := parseBindingXPath(xpath); err == nil {
+		candidates = append(candidates, steps[len(steps)-1].name)
+	}
+
+	for _, candidate := range candidates {
+		if _, found := lookupValue(r.data, candidate); found {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// updateDataStores writes the values of the bound content controls to the
+// parts holding their data: docProps/core.xml for the core document
+// properties, docProps/app.xml for the extended ones, and the customXml item
+// whose properties declare the store item id otherwise. A binding that cannot
+// be written is logged and leaves its data unchanged; Word then shows the old
+// value once it refreshes the control.
+func (r *fieldReplacer) updateDataStores(doc *docx.DocxFile) {
+	for _, binding := range r.dataBindings {
+		part, found := dataStorePart(doc, binding.storeItemID)
+		if !found {
+			r.log.Warn("Data binding of '%s' ignored: no data part for store item %s", binding.field, binding.storeItemID)
+			continue
+		}
+
+		steps, err := parseBindingXPath(binding.xpath)
+		if err == nil {
+			var updated []byte
+			if updated, err = setBoundValue(doc.Files[part], steps, binding.value); err == nil {
+				doc.Files[part] = updated
+				r.log.Debug("Data binding of '%s' written to %s", binding.field, part)
+				continue
+			}
+		}
+		r.log.Warn("Data binding of '%s' ignored: cannot update %s at %s: %v", binding.field, part, binding.xpath, err)
+	}
+}
+
+// dataStorePart returns the part holding the data of a store item
+func dataStorePart(doc *docx.DocxFile, storeItemID string) (string, bool) {
+	switch strings.ToUpper(storeItemID) {
+	case coreStoreItemID:
+		return docx.CorePropertiesPart, doc.HasFile(docx.CorePropertiesPart)
+	case extendedStoreItemID:
+		return extendedPropsPart, doc.HasFile(extendedPropsPart)
+	}
+
+	var propsParts []string
+	for name := range doc.Files {
+		if customXMLPropsRegex.MatchString(name) {
+			propsParts = append(propsParts, name)
+		}
+	}
+	sort.Strings(propsParts)
+
+	for _, propsPart := range propsParts {
+		itemID := itemIDRegex.FindSubmatch(doc.Files[propsPart])
+		if itemID == nil || !strings.EqualFold(string(itemID[1]), storeItemID) {
+			continue
+		}
+		part := customXMLDataPart(doc, propsPart)
+		return part, doc.HasFile(part)
+	}
+	return "", false
+}
+
+// customXMLDataPart returns the custom XML item that declares a properties
+// part in its relationships, falling back to the item with the same index,
+// e.g. customXml/item1.xml for customXml/itemProps1.xml
+func customXMLDataPart(doc *docx.DocxFile, propsPart string) string {
+	target := []byte(`Target="` + path.Base(propsPart) + `"`)
+	for name, rels := range doc.Files {
+		if strings.HasPrefix(name, "customXml/_rels/") && bytes.Contains(rels, target) {
+			return relsSourcePartName(name)
+		}
+	}
+	index := customXMLPropsRegex.FindStringSubmatch(propsPart)[1]
+	return "customXml/item" + index + ".xml"
+}
+
+// parseBindingXPath parses the absolute element paths Word writes for
+// bindings, such as /ns1:coreProperties[1]/ns0:title[1]. Namespace prefixes
+// are ignored and elements matched by local name; predicates other than a
+// position, attributes and functions are not supported.
+func parseBindingXPath(xpath string) ([]xpathStep, error) {
+	if !strings.HasPrefix(xpath, "/") || len(xpath) == 1 {
+		return nil, fmt.Errorf("unsupported XPath '%s'", xpath)
+	}
+
+	var steps []xpathStep
+	for _, part := range strings.Split(xpath[1:], "/") {
+		match := xpathStepRegex.FindStringSubmatch(part)
+		if match == nil {
+			return nil, fmt.Errorf("unsupported XPath step '%s'", part)
+		}
+		index := 1
+		if match[2] != "" {
+			index, _ = strconv.Atoi(match[2])
+		}
+		steps = append(steps, xpathStep{name: match[1], index: index})
+	}
+	return steps, nil
+}
+
+// setBoundValue replaces the text of the element selected by the steps. The
+// element must hold only text, so bindings to structured data are rejected
+// rather than flattened.
+func setBoundValue(content []byte, steps []xpathStep, value string) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+
+	// siblings counts the child elements by local name at each open depth;
+	// matched is the number of leading steps matched by the open elements
+	siblings := []map[string]int{{}}
+	matched, depth := 0, 0
+	var elementStart, contentStart int64 = -1, -1
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil, errBoundNodeNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if contentStart >= 0 {
+				return nil, fmt.Errorf("bound element <%s> has child elements", steps[len(steps)-1].name)
+			}
+			siblings[depth][t.Name.Local]++
+			if matched == depth && depth < len(steps) &&
+				steps[depth].name == t.Name.Local && steps[depth].index == siblings[depth][t.Name.Local] {
+				matched++
+				if matched == len(steps) {
+					elementStart, contentStart = offset, decoder.InputOffset()
+				}
+			}
+			depth++
+			siblings = append(siblings[:depth], map[string]int{})
+
+		case xml.EndElement:
+			depth--
+			if contentStart >= 0 {
+				return replaceElementText(content, elementStart, contentStart, offset, value), nil
+			}
+			if matched > depth {
+				matched = depth
+			}
+		}
+	}
+}
+
+// replaceElementText replaces the content of an element, expanding a
+// self-closing element into a start and an end tag
+func replaceElementText(content []byte, elementStart, contentStart, contentEnd int64, value string) []byte {
+	startTag := string(content[elementStart:contentStart])
+	var b bytes.Buffer
+	b.Write(content[:elementStart])
+	if strings.HasSuffix(startTag, "/>") {
+		name := strings.FieldsFunc(startTag[1:], func(c rune) bool {
+			return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '/' || c == '>'
+		})[0]
+		b.WriteString(strings.TrimRight(strings.TrimSuffix(startTag, "/>"), " \t\r\n") + ">")
+		b.WriteString(escapeXML(value))
+		b.WriteString("</" + name + ">")
+	} else {
+		b.WriteString(startTag)
+		b.WriteString(escapeXML(value))
+	}
+	b.Write(content[contentEnd:])
+	return b.Bytes()
+}
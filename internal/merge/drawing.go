@@ -0,0 +1,65 @@
+package merge
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"com/lifenture/flash-mail-merge/internal/docx"
+)
+
+// diagramPartPrefix is the folder of the SmartArt data and drawing parts
+const diagramPartPrefix = "word/diagrams/"
+
+var (
+	// drawingTextRegex captures the opening tag and content of DrawingML
+	// <a:t> text elements
+	drawingTextRegex = regexp.MustCompile(`(?s)(<a:t(?:\s[^>]*)?>)(.*?)</a:t>`)
+
+	// drawingPlaceholderRegex captures the «field» placeholders of a text
+	drawingPlaceholderRegex = regexp.MustCompile(`«([^«»]+)»`)
+)
+
+// mergeDrawingText replaces «field» placeholders in the DrawingML text of the
+// main document and of the SmartArt parts. Unlike WordprocessingML runs, an
+// <a:t> commonly mixes a placeholder with other text, so every placeholder in
+// the element is replaced.
+func (r *fieldReplacer) mergeDrawingText(doc *docx.DocxFile) {
+	parts := []string{"word/document.xml"}
+	var diagrams []string
+	for name := range doc.Files {
+		if strings.HasPrefix(name, diagramPartPrefix) && strings.HasSuffix(name, ".xml") {
+			diagrams = append(diagrams, name)
+		}
+	}
+	sort.Strings(diagrams)
+	parts = append(parts, diagrams...)
+
+	for _, part := range parts {
+		content, exists := doc.Files[part]
+		if !exists || !strings.Contains(string(content), "<a:t") {
+			continue
+		}
+		doc.Files[part] = []byte(r.replaceDrawingText(normalizeChevronEntities(string(content))))
+		r.log.Debug("Processed DrawingML text in %s", part)
+	}
+}
+
+// replaceDrawingText replaces the placeholders inside <a:t> elements. Values
+// are escaped as XML character data, which is all DrawingML text requires.
+func (r *fieldReplacer) replaceDrawingText(xml string) string {
+	return drawingTextRegex.ReplaceAllStringFunc(xml, func(match string) string {
+		parts := drawingTextRegex.FindStringSubmatch(match)
+		openTag, text := parts[1], parts[2]
+
+		text = drawingPlaceholderRegex.ReplaceAllStringFunc(text, func(placeholder string) string {
+			fieldName := strings.TrimSpace(unescapeXML(placeholder[len("«") : len(placeholder)-len("»")]))
+			value, found := r.resolve(fieldName)
+			if !found {
+				return placeholder
+			}
+			return escapeXML(value)
+		})
+		return openTag + text + "</a:t>"
+	})
+}
@@ -0,0 +1,396 @@
+package merge
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"com/lifenture/flash-mail-merge/internal/fields"
+)
+
+// maxExpressionDepth bounds the nesting of function calls in a placeholder
+const maxExpressionDepth = 8
+
+// lineBreakText ends the text element of a run, breaks the line and opens a
+// new text element in the same run, keeping its formatting
+const lineBreakText = `</w:t><w:br/><w:t xml:space="preserve">`
+
+// expressionRegex recognizes placeholders shaped like a function call, such
+// as «upper(FirstName)», and captures the function name and the whitespace
+// before the parenthesis
+var expressionRegex = regexp.MustCompile(`^([A-Za-z_]\w*)(\s*)\(`)
+
+// isExpression reports whether a placeholder holds a function call. A name
+// directly followed by "(" is a call, so a misspelt function such as
+// «uper(FirstName)» fails to parse instead of merging as a field. With
+// whitespace before the parenthesis only known functions are called, since
+// field names may contain parentheses too: «Price (USD)» is a field.
+func isExpression(fieldName string) bool {
+	match := expressionRegex.FindStringSubmatch(fieldName)
+	if match == nil || !strings.HasSuffix(fieldName, ")") {
+		return false
+	}
+	if match[2] == "" {
+		return true
+	}
+	_, known := expressionFunctions[strings.ToLower(match[1])]
+	return known
+}
+
+// evaluatesExpression reports whether the replacer evaluates a placeholder as
+// an expression: a call of a known function, unless the merge data has a key
+// named like the placeholder itself
+func (r *fieldReplacer) evaluatesExpression(fieldName string) bool {
+	if !isExpression(fieldName) {
+		return false
+	}
+	_, literal := lookupRawValue(r.data, fields.NormalizeFieldName(fieldName))
+	return !literal
+}
+
+// ExpressionErrors parses the placeholder expressions of a document XML and
+// maps each one that does not parse, such as a call of an unknown function,
+// to the reason. A placeholder the data has as a key is merged as a field,
+// not parsed.
+func ExpressionErrors(documentXML string, data fields.MergeData) map[string]string {
+	errs := make(map[string]string)
+	for _, name := range placeholderNames(documentXML) {
+		if !isExpression(name) {
+			continue
+		}
+		if _, literal := lookupRawValue(data, fields.NormalizeFieldName(name)); literal {
+			continue
+		}
+		if _, err := parseExpression(name); err != nil {
+			errs[name] = err.Error()
+		}
+	}
+	return errs
+}
+
+// exprValue is the result of evaluating an expression. A field reference
+// without merge data evaluates to a value that is not found.
+type exprValue struct {
+	value string
+	found bool
+}
+
+// exprFunction is a function callable from placeholders. A variadic
+// function takes at least arity arguments.
+type exprFunction struct {
+	arity    int
+	variadic bool
+	eval     func(args []exprValue) (exprValue, error)
+}
+
+// expressionFunctions is the complete function set of placeholder
+// expressions. Functions only transform their arguments, so evaluating a
+// template cannot reach anything but the merge data.
+var expressionFunctions = map[string]exprFunction{
+	// upper(x) uppercases x
+	"upper": {arity: 1, eval: func(args []exprValue) (exprValue, error) {
+		return exprValue{value: strings.ToUpper(args[0].value), found: args[0].found}, nil
+	}},
+
+	// lower(x) lowercases x
+	"lower": {arity: 1, eval: func(args []exprValue) (exprValue, error) {
+		return exprValue{value: strings.ToLower(args[0].value), found: args[0].found}, nil
+	}},
+
+	// default(x, y) is x, or y when x is missing or empty
+	"default": {arity: 2, eval: func(args []exprValue) (exprValue, error) {
+		if args[0].found && args[0].value != "" {
+			return args[0], nil
+		}
+		return args[1], nil
+	}},
+
+	// date(x, layout) formats the date x, given as 2006-01-02 or RFC 3339,
+	// with a Go layout such as "January 2, 2006" or a pattern such as
+	// "DD.MM.YYYY"
+	"date": {arity: 2, eval: func(args []exprValue) (exprValue, error) {
+		if !args[0].found || !args[1].found {
+			return exprValue{}, nil
+		}
+		layout, err := fields.DateLayout(args[1].value)
+		if err != nil {
+			return exprValue{}, fmt.Errorf("date: %w", err)
+		}
+		date, err := time.Parse("2006-01-02", args[0].value)
+		if err != nil {
+			if date, err = time.Parse(time.RFC3339, args[0].value); err != nil {
+				return exprValue{}, fmt.Errorf("date: cannot parse '%s' as a date", args[0].value)
+			}
+		}
+		return exprValue{value: date.Format(layout), found: true}, nil
+	}},
+
+	// block(x, y, ...) puts each non-empty value on its own line, so an
+	// address without a second line does not leave a blank one
+	"block": {arity: 1, variadic: true, eval: func(args []exprValue) (exprValue, error) {
+		var lines []string
+		for _, arg := range args {
+			if line := strings.TrimSpace(arg.value); arg.found && line != "" {
+				lines = append(lines, line)
+			}
+		}
+		return exprValue{value: strings.Join(lines, "\n"), found: true}, nil
+	}},
+}
+
+// exprNode is a parsed expression: a function call, a field reference or a
+// string literal
+type exprNode struct {
+	function string
+	args     []*exprNode
+
+	field string
+
+	literal   string
+	isLiteral bool
+}
+
+// parseExpression parses a placeholder expression. The grammar is strict:
+//
+//	expr    = call | literal | field
+//	call    = name "(" [ expr { "," expr } ] ")"
+//	literal = '"' { char | '\"' | '\\' } '"'
+//
+// Unknown functions, wrong argument counts and trailing text are rejected.
+// Literals may also use the curly quotes Word substitutes when typing.
+func parseExpression(input string) (*exprNode, error) {
+	p := &exprParser{input: input}
+	node, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.pos < len(p.input) {
+		return nil, fmt.Errorf("unexpected '%s' at position %d", p.input[p.pos:], p.pos)
+	}
+	return node, nil
+}
+
+// exprParser is a recursive descent parser over an expression
+type exprParser struct {
+	input string
+	pos   int
+}
+
+// parseExpr parses one expression at the given call nesting depth
+func (p *exprParser) parseExpr(depth int) (*exprNode, error) {
+	if depth > maxExpressionDepth {
+		return nil, fmt.Errorf("expression nested deeper than %d calls", maxExpressionDepth)
+	}
+	p.skipSpaces()
+	if p.pos >= len(p.input) {
+		return nil, fmt.Errorf("missing argument at end of expression")
+	}
+
+	if closing, ok := p.openQuote(); ok {
+		return p.parseLiteral(closing)
+	}
+
+	// A name followed by "(" is a call, anything else up to the next
+	// separator a field reference
+	start := p.pos
+	for p.pos < len(p.input) && !strings.ContainsRune(",()\"“”", p.peek()) {
+		p.advance()
+	}
+	name := strings.TrimSpace(p.input[start:p.pos])
+	if name == "" {
+		return nil, fmt.Errorf("missing argument at position %d", start)
+	}
+	if p.pos >= len(p.input) || p.peek() != '(' {
+		return &exprNode{field: name}, nil
+	}
+
+	function, known := expressionFunctions[strings.ToLower(name)]
+	if !known {
+		return nil, fmt.Errorf("unknown function '%s'", name)
+	}
+	p.advance()
+
+	node := &exprNode{function: strings.ToLower(name)}
+	p.skipSpaces()
+	if p.pos < len(p.input) && p.peek() == ')' {
+		p.advance()
+	} else {
+		for {
+			arg, err := p.parseExpr(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			node.args = append(node.args, arg)
+
+			p.skipSpaces()
+			if p.pos >= len(p.input) {
+				return nil, fmt.Errorf("missing ')' after arguments of %s", name)
+			}
+			separator := p.peek()
+			p.advance()
+			if separator == ')' {
+				break
+			}
+			if separator != ',' {
+				return nil, fmt.Errorf("unexpected '%c' in arguments of %s", separator, name)
+			}
+		}
+	}
+
+	if function.variadic && len(node.args) < function.arity {
+		return nil, fmt.Errorf("%s expects at least %d argument(s), got %d", name, function.arity, len(node.args))
+	}
+	if !function.variadic && len(node.args) != function.arity {
+		return nil, fmt.Errorf("%s expects %d argument(s), got %d", name, function.arity, len(node.args))
+	}
+	return node, nil
+}
+
+// openQuote consumes an opening quote and returns its closing quote
+func (p *exprParser) openQuote() (rune, bool) {
+	switch p.peek() {
+	case '"':
+		p.advance()
+		return '"', true
+	case '“':
+		p.advance()
+		return '”', true
+	}
+	return 0, false
+}
+
+// parseLiteral parses the rest of a string literal after its opening quote
+func (p *exprParser) parseLiteral(closing rune) (*exprNode, error) {
+	var b strings.Builder
+	for p.pos < len(p.input) {
+		c := p.peek()
+		p.advance()
+		switch {
+		case c == closing:
+			return &exprNode{literal: b.String(), isLiteral: true}, nil
+		case c == '\\' && p.pos < len(p.input):
+			b.WriteRune(p.peek())
+			p.advance()
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return nil, fmt.Errorf("unterminated string literal")
+}
+
+// peek returns the rune at the current position
+func (p *exprParser) peek() rune {
+	r, _ := utf8.DecodeRuneInString(p.input[p.pos:])
+	return r
+}
+
+// advance moves past the rune at the current position
+func (p *exprParser) advance() {
+	_, size := utf8.DecodeRuneInString(p.input[p.pos:])
+	p.pos += size
+}
+
+// skipSpaces moves past whitespace
+func (p *exprParser) skipSpaces() {
+	for p.pos < len(p.input) && unicode.IsSpace(p.peek()) {
+		p.advance()
+	}
+}
+
+// evaluate computes the value of an expression. Field references are looked
+// up in the merge data, then in the template defaults and fallback sources.
+func (r *fieldReplacer) evaluate(node *exprNode) (exprValue, error) {
+	switch {
+	case node.isLiteral:
+		return exprValue{value: node.literal, found: true}, nil
+	case node.function == "":
+		if IsSecretField(node.field) {
+			return exprValue{}, fmt.Errorf("secret field '%s' cannot be used in expressions", node.field)
+		}
+		if raw, found := lookupRawValue(r.data, node.field); found {
+			if err := expressionValueError(node.field, raw); err != nil {
+				return exprValue{}, err
+			}
+		}
+		if value, found := lookupValue(r.data, node.field); found {
+			return exprValue{value: value, found: true}, nil
+		}
+		value, _, found := r.fallbackValue(node.field)
+		return exprValue{value: value, found: found}, nil
+	}
+
+	args := make([]exprValue, len(node.args))
+	for i, arg := range node.args {
+		value, err := r.evaluate(arg)
+		if err != nil {
+			return exprValue{}, err
+		}
+		args[i] = value
+	}
+	return expressionFunctions[node.function].eval(args)
+}
+
+// expressionValueError rejects the object and array values of merge data,
+// which have no single text to pass to expression functions
+func expressionValueError(name string, value interface{}) error {
+	if _, isObject := fields.AsObject(value); isObject {
+		return fmt.Errorf("field '%s' is an object, which cannot be used in expressions", name)
+	}
+	if kind := reflect.ValueOf(value).Kind(); kind == reflect.Slice || kind == reflect.Array {
+		return fmt.Errorf("field '%s' is an array, which cannot be used in expressions", name)
+	}
+	return nil
+}
+
+// resolveExpression evaluates a placeholder expression and records its
+// outcome like resolve does for a field. An expression that does not parse
+// or fails to evaluate gets an error outcome and is skipped like a field
+// without data: strict merges fail on it and stripUnresolved removes it.
+func (r *fieldReplacer) resolveExpression(expression string) (string, bool) {
+	r.processedFields[expression] = true
+
+	node, err := parseExpression(unescapeXML(expression))
+	var result exprValue
+	if err == nil {
+		result, err = r.evaluate(node)
+	}
+	if err != nil {
+		r.log.Warn("Invalid expression «%s»: %v", expression, err)
+		if !contains(r.skipped, expression) {
+			r.skipped = append(r.skipped, expression)
+		}
+		r.recordOutcome(FieldOutcome{Name: expression, Status: FieldStatusError, Reason: err.Error()})
+		return "", r.opts.StripUnresolved
+	}
+
+	if !result.found {
+		if !contains(r.skipped, expression) {
+			r.log.Debug("Expression skipped: '%s' (no data available)", expression)
+			r.skipped = append(r.skipped, expression)
+		}
+		r.recordOutcome(FieldOutcome{Name: expression, Status: FieldStatusSkipped, Reason: "no data available"})
+		return "", r.opts.StripUnresolved
+	}
+
+	r.log.Debug("Expression evaluated: '%s' -> '%s'", expression, result.value)
+	if !contains(r.resolved, expression) {
+		r.resolved = append(r.resolved, expression)
+	}
+	r.recordOutcome(FieldOutcome{Name: expression, Status: FieldStatusResolved, Value: result.value})
+	r.replacedCounts[expression]++
+	return result.value, true
+}
+
+// expressionLineBreaks renders the line feeds of an escaped expression result
+// as line breaks within the run holding it
+func (r *fieldReplacer) expressionLineBreaks(fieldName, escaped string) string {
+	if !r.evaluatesExpression(fieldName) {
+		return escaped
+	}
+	return strings.ReplaceAll(escaped, "\n", lineBreakText)
+}
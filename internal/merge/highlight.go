@@ -0,0 +1,145 @@
+package merge
+
+import (
+	"regexp"
+	"strings"
+)
+
+// mergedMarker tags merged text until the enclosing runs are restyled.
+// NUL cannot occur in XML, so the marker never collides with document text.
+const mergedMarker = "\x00"
+
+// highlightProperty is the run property marking merged content
+const highlightProperty = `<w:highlight w:val="yellow"/>`
+
+var (
+	// runStartRegex matches a run opening tag; <w:rPr> and <w:rStyle> are
+	// excluded by the character class following "w:r"
+	runStartRegex = regexp.MustCompile(`<w:r[ >/]`)
+
+	// existingHighlightRegex matches a highlight already set on the run
+	existingHighlightRegex = regexp.MustCompile(`<w:highlight\b[^>]*/>`)
+
+	// shadingRegex matches the shading of a run, such as the gray background
+	// of form field results
+	shadingRegex = regexp.MustCompile(`<w:shd\b[^>]*/>`)
+
+	// afterHighlightRegex matches the first run property the schema orders
+	// after <w:highlight>
+	afterHighlightRegex = regexp.MustCompile(`<w:(?:u|effect|bdr|shd|fitText|vertAlign|rtl|cs|em|lang|eastAsianLayout|specVanish|oMath|rPrChange)\b`)
+)
+
+// markMerged tags a merged value when an option restyles the merged runs,
+// and tags the field replaced when empty paragraphs are removed
+func (r *fieldReplacer) markMerged(escaped string) string {
+	if r.opts.RemoveEmptyParagraphs {
+		escaped = replacedMarker + escaped
+	}
+	if !r.opts.HighlightMerged && !r.opts.RemoveFieldShading {
+		return escaped
+	}
+	return mergedMarker + escaped
+}
+
+// restyleMergedRuns updates the properties of every run holding a value
+// tagged by markMerged and removes the tags: highlight adds a yellow
+// highlight, replacing an existing one, and removeShading strips the run's
+// shading. The run keeps its other formatting.
+func restyleMergedRuns(documentXML string, highlight, removeShading bool) string {
+	if !strings.Contains(documentXML, mergedMarker) {
+		return documentXML
+	}
+
+	var result strings.Builder
+	last := 0
+	for {
+		next := strings.Index(documentXML[last:], mergedMarker)
+		if next < 0 {
+			break
+		}
+		marker := last + next
+
+		// The nearest run opening before the value is the run holding it
+		runStart := -1
+		for _, loc := range runStartRegex.FindAllStringIndex(documentXML[last:marker], -1) {
+			runStart = last + loc[0]
+		}
+		if runStart < 0 {
+			result.WriteString(documentXML[last:marker])
+			last = marker + len(mergedMarker)
+			continue
+		}
+		openEnd := runStart + strings.Index(documentXML[runStart:], ">") + 1
+		if strings.HasSuffix(documentXML[runStart:openEnd], "/>") {
+			result.WriteString(documentXML[last:marker])
+			last = marker + len(mergedMarker)
+			continue
+		}
+
+		result.WriteString(documentXML[last:openEnd])
+		rest := documentXML[openEnd:marker]
+		properties, length := leadingRunProperties(rest)
+		if removeShading {
+			properties = withoutShading(properties)
+		}
+		if highlight {
+			result.WriteString(withHighlight(properties))
+		} else if properties != "" {
+			result.WriteString("<w:rPr>" + properties + "</w:rPr>")
+		}
+		rest = rest[length:]
+		result.WriteString(rest)
+		last = marker + len(mergedMarker)
+	}
+	result.WriteString(documentXML[last:])
+
+	return result.String()
+}
+
+// leadingRunProperties returns the content and length of the <w:rPr> element
+// at the start of a run's content. A tracked formatting change nests a
+// previous <w:rPr> inside <w:rPrChange>, which is skipped when looking for the
+// closing tag.
+func leadingRunProperties(content string) (string, int) {
+	if strings.HasPrefix(content, "<w:rPr/>") {
+		return "", len("<w:rPr/>")
+	}
+	if !strings.HasPrefix(content, "<w:rPr>") {
+		return "", 0
+	}
+
+	from := len("<w:rPr>")
+	end := strings.Index(content, "</w:rPr>")
+	if change := strings.Index(content, "<w:rPrChange"); change >= 0 && change < end {
+		if changeEnd := strings.Index(content[change:], "</w:rPrChange>"); changeEnd >= 0 {
+			if next := strings.Index(content[change+changeEnd:], "</w:rPr>"); next >= 0 {
+				end = change + changeEnd + next
+			}
+		}
+	}
+	if end < 0 {
+		return "", 0
+	}
+	return content[from:end], end + len("</w:rPr>")
+}
+
+// withHighlight returns run properties holding the highlight in schema order
+func withHighlight(properties string) string {
+	properties = existingHighlightRegex.ReplaceAllString(properties, "")
+	if loc := afterHighlightRegex.FindStringIndex(properties); loc != nil {
+		properties = properties[:loc[0]] + highlightProperty + properties[loc[0]:]
+	} else {
+		properties += highlightProperty
+	}
+	return "<w:rPr>" + properties + "</w:rPr>"
+}
+
+// withoutShading removes the shading from run properties. The properties
+// recorded by a tracked formatting change are left as they were.
+func withoutShading(properties string) string {
+	current, change := properties, ""
+	if at := strings.Index(properties, "<w:rPrChange"); at >= 0 {
+		current, change = properties[:at], properties[at:]
+	}
+	return shadingRegex.ReplaceAllString(current, "") + change
+}
@@ -0,0 +1,134 @@
+package merge
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"com/lifenture/flash-mail-merge/internal/fields"
+)
+
+// localeFormat holds the number and date conventions of a locale
+type localeFormat struct {
+	decimalSeparator  string
+	groupSeparator    string
+	defaultDateLayout string
+}
+
+// locales maps the supported locale tags, in lowercase, to their conventions
+var locales = map[string]localeFormat{
+	"en-us": {decimalSeparator: ".", groupSeparator: ",", defaultDateLayout: "01/02/2006"},
+	"en-gb": {decimalSeparator: ".", groupSeparator: ",", defaultDateLayout: "02/01/2006"},
+	"de-de": {decimalSeparator: ",", groupSeparator: ".", defaultDateLayout: "02.01.2006"},
+	"de-ch": {decimalSeparator: ".", groupSeparator: "'", defaultDateLayout: "02.01.2006"},
+	"fr-fr": {decimalSeparator: ",", groupSeparator: " ", defaultDateLayout: "02/01/2006"},
+	"es-es": {decimalSeparator: ",", groupSeparator: ".", defaultDateLayout: "02/01/2006"},
+	"it-it": {decimalSeparator: ",", groupSeparator: ".", defaultDateLayout: "02/01/2006"},
+	"nl-nl": {decimalSeparator: ",", groupSeparator: ".", defaultDateLayout: "02-01-2006"},
+	"pl-pl": {decimalSeparator: ",", groupSeparator: " ", defaultDateLayout: "02.01.2006"},
+}
+
+// lookupLocale returns the conventions of a locale tag such as "de-DE",
+// matched case-insensitively and accepting "_" as separator
+func lookupLocale(tag string) (localeFormat, bool) {
+	format, ok := locales[strings.ToLower(strings.ReplaceAll(tag, "_", "-"))]
+	return format, ok
+}
+
+// IsValidLocale reports whether tag is a supported locale
+func IsValidLocale(tag string) bool {
+	_, ok := lookupLocale(tag)
+	return ok
+}
+
+// localize formats the value of a number or date field for the locale of the
+// field's Format, falling back to the document locale of the options, and
+// applies the NumberFormat of number fields. Values of other fields, and
+// values that do not parse, are returned unchanged.
+func (r *fieldReplacer) localize(fieldName, value string) string {
+	if r.opts.FieldSet == nil {
+		return value
+	}
+	field := r.opts.FieldSet.GetFieldByName(fieldName)
+	if field == nil {
+		return value
+	}
+
+	tag := r.opts.Locale
+	if field.Format != nil && field.Format.Locale != "" {
+		tag = field.Format.Locale
+	}
+	locale, ok := lookupLocale(tag)
+
+	// A NumberFormat applies with or without a locale, grouping like en-US
+	// by default
+	if field.Type == fields.FieldTypeNumber && field.Format != nil && field.Format.NumberFormat != "" {
+		if !ok {
+			locale, _ = lookupLocale(defaultNumberLocale)
+		}
+		return formatNumberValue(field.Format, value, locale, r.opts.CurrencySymbol)
+	}
+	if !ok {
+		return value
+	}
+
+	switch field.Type {
+	case fields.FieldTypeNumber:
+		return locale.formatNumber(value)
+	case fields.FieldTypeDate:
+		layout := locale.defaultDateLayout
+		if field.Format != nil && field.Format.DateFormat != "" {
+			layout = field.Format.DateFormat
+		}
+		if date, err := time.Parse("2006-01-02", value); err == nil {
+			return date.Format(layout)
+		}
+	}
+	return value
+}
+
+var (
+	// plainNumberRegex matches decimal numbers without exponent or grouping
+	plainNumberRegex = regexp.MustCompile(`^[+-]?[0-9]+(\.[0-9]+)?$`)
+
+	// exponentNumberRegex matches numbers in exponent notation, as formatValue
+	// renders large non-integer floats
+	exponentNumberRegex = regexp.MustCompile(`^[+-]?[0-9]+(\.[0-9]+)?[eE][+-]?[0-9]+$`)
+)
+
+// formatNumber rewrites a decimal number with the locale's decimal separator
+// and thousands grouping, keeping its digits. Numbers in exponent notation
+// are written out in full first.
+func (l localeFormat) formatNumber(value string) string {
+	if exponentNumberRegex.MatchString(value) {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return value
+		}
+		value = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	if !plainNumberRegex.MatchString(value) {
+		return value
+	}
+
+	sign := ""
+	if strings.HasPrefix(value, "-") || strings.HasPrefix(value, "+") {
+		sign, value = value[:1], value[1:]
+	}
+	integer, fraction, hasFraction := strings.Cut(value, ".")
+
+	var b strings.Builder
+	b.WriteString(sign)
+	for i, digit := range integer {
+		if i > 0 && (len(integer)-i)%3 == 0 {
+			b.WriteString(l.groupSeparator)
+		}
+		b.WriteRune(digit)
+	}
+	if hasFraction {
+		b.WriteString(l.decimalSeparator)
+		b.WriteString(fraction)
+	}
+	return b.String()
+}
@@ -1,41 +1,75 @@
 package merge
 
 import (
-	"archive/zip"
-	"bytes"
 	"fmt"
+	"math"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"com/lifenture/flash-mail-merge/internal/docx"
 	"com/lifenture/flash-mail-merge/internal/fields"
 	"com/lifenture/flash-mail-merge/internal/logging"
+	"com/lifenture/flash-mail-merge/internal/tracing"
 )
 
 // PerformMerge performs mail merge on a DOCX document with the provided data
 func PerformMerge(doc *docx.DocxFile, data fields.MergeData) (mergedDoc []byte, skipped []string, err error) {
-	logging.Debug("Starting mail merge with %d available data fields", len(data))
+	result, err := PerformMergeWithOptions(doc, data, Options{})
+	if err != nil {
+		return nil, nil, err
+	}
+	return result.Document, result.Skipped, nil
+}
+
+// PerformMergeWithOptions performs mail merge on a DOCX document with the
+// provided data, applying the optional merge behavior in opts
+func PerformMergeWithOptions(doc *docx.DocxFile, data fields.MergeData, opts Options) (*Result, error) {
+	logger := opts.logger()
+	// Respect the in-process concurrency limit
+	release, err := acquireMergeSlot()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	logger.Debug("Starting mail merge with %d available data fields", len(data))
+
+	// Reject date formats Go cannot render before touching the document
+	if opts.FieldSet != nil {
+		if err := opts.FieldSet.NormalizeDateFormats(); err != nil {
+			return nil, err
+		}
+	}
 
 	// Get the document XML content
 	documentXML, err := doc.GetDocumentXML()
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to get document XML: %w", err)
+		return nil, fmt.Errorf("failed to get document XML: %w", err)
 	}
-	logging.Debug("Retrieved document XML content (%d bytes)", len(documentXML))
+	logger.Debug("Retrieved document XML content (%d bytes)", len(documentXML))
+
+	// Strip a byte order mark, which the output omits unless PreserveBOM
+	// asks for it back
+	inputXML, hadBOM := strings.CutPrefix(string(documentXML), utf8BOM)
 
 	// Replace field values in the document XML
-	updatedXML, skippedFields, err := replaceFieldValues(string(documentXML), data)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to replace field values: %w", err)
-	}
-	logging.Debug("Field replacement completed - processed fields with %d skipped", len(skippedFields))
-	if len(skippedFields) > 0 {
-		logging.Debug("Skipped fields: %v", skippedFields)
+	replaceSpan := tracing.Start(tracing.SpanReplace, opts.CorrelationID)
+	replacer := newFieldReplacer(data, opts)
+	updatedXML := replacer.mergeDocumentXML(inputXML)
+	if hadBOM && opts.PreserveBOM {
+		updatedXML = utf8BOM + updatedXML
 	}
 
 	// Create a new DOCX file with the updated document XML
 	updatedDoc := &docx.DocxFile{
-		Files: make(map[string][]byte),
+		Files:   make(map[string][]byte),
+		Order:   doc.Order,
+		Methods: doc.Methods,
 	}
 
 	// Copy all files from the original document
@@ -44,107 +78,711 @@ func PerformMerge(doc *docx.DocxFile, data fields.MergeData) (mergedDoc []byte,
 		updatedDoc.Files[filename] = content
 		fileCount++
 	}
-	logging.Debug("Copied %d files from original document to updated document", fileCount)
+	logger.Debug("Copied %d files from original document to updated document", fileCount)
 
 	// Replace the document XML with the updated version
 	updatedDoc.Files["word/document.xml"] = []byte(updatedXML)
-	logging.Debug("Updated document XML content (%d bytes)", len(updatedXML))
+	logger.Debug("Updated document XML content (%d bytes)", len(updatedXML))
+
+	// Merge sub-documents imported through <w:altChunk>
+	replacer.mergeAltChunks(updatedDoc, "word/document.xml", 0)
+
+	// Merge the headers and footers, leaving any that fail unchanged
+	replacer.mergeHeadersFooters(updatedDoc)
+
+	// Merge placeholders in SmartArt and drawing canvas text
+	if opts.MergeDrawingText {
+		replacer.mergeDrawingText(updatedDoc)
+	}
+
+	// Write the values of bound content controls to the data they display
+	replacer.updateDataStores(updatedDoc)
+
+	if replacer.err != nil {
+		replaceSpan.RecordError(replacer.err)
+		replaceSpan.End()
+		return nil, replacer.err
+	}
+
+	skippedFields := replacer.skipped
+	replaceSpan.SetAttribute("resolved", len(replacer.resolved))
+	replaceSpan.SetAttribute("skipped", len(skippedFields))
+	replaceSpan.End()
+	logger.Debug("Field replacement completed - processed fields with %d skipped", len(skippedFields))
+	if len(skippedFields) > 0 {
+		logger.Debug("Skipped fields: %v", skippedFields)
+		if opts.Strict {
+			return nil, &UnfilledFieldsError{Fields: skippedFields}
+		}
+	}
+
+	// Mark the document so a later request can detect a double merge. A
+	// partial output leaves the marker out, so that only the parts changed by
+	// the merge itself are returned.
+	if !opts.PartialOutput {
+		updatedDoc.SetMergeMarker(time.Now())
+	}
+
+	// Apply the requested title, author and other core properties
+	if err := updatedDoc.SetCoreProperties(opts.DocumentProperties); err != nil {
+		return nil, fmt.Errorf("failed to set document properties: %w", err)
+	}
+
+	// Strip stale data source settings that would prompt on open
+	if opts.RemoveMailMergeSettings && removeMailMergeSettings(updatedDoc) {
+		logger.Debug("Removed mail merge settings from %s", settingsPart)
+	}
+
+	// Drop media and relationships the merged document no longer uses
+	if opts.Compact {
+		if removed := compactPackage(updatedDoc); len(removed) > 0 {
+			logger.Debug("Compacted document, removed parts: %v", removed)
+		}
+	}
+
+	result := &Result{
+		Resolved:       replacer.resolved,
+		Defaulted:      replacer.defaulted,
+		Skipped:        skippedFields,
+		ReplacedCounts: replacer.replacedCounts,
+		Outcomes:       replacer.outcomes,
+		PartErrors:     replacer.partErrors,
+	}
+
+	// Return the changed parts instead of rebuilding the archive
+	if opts.PartialOutput {
+		result.ChangedParts, result.AddedParts, result.RemovedParts = diffParts(doc, updatedDoc)
+		logger.Debug("Partial output: %d changed, %d added, %d removed parts", len(result.ChangedParts), len(result.AddedParts), len(result.RemovedParts))
+		return result, nil
+	}
 
 	// Rebuild the DOCX (ZIP) archive
-	logging.Debug("Starting ZIP archive rebuild")
-	mergedBytes, err := rebuildDocxArchive(updatedDoc)
+	logger.Debug("Starting ZIP archive rebuild")
+	rebuildSpan := tracing.Start(tracing.SpanRebuild, opts.CorrelationID)
+	mergedBytes, err := rebuildDocxArchive(updatedDoc, logger)
 	if err != nil {
-		logging.Error("ZIP rebuild failed: %v", err)
-		return nil, nil, fmt.Errorf("failed to rebuild DOCX archive: %w", err)
+		rebuildSpan.RecordError(err)
+		rebuildSpan.End()
+		logger.Error("ZIP rebuild failed: %v", err)
+		return nil, fmt.Errorf("failed to rebuild DOCX archive: %w", err)
+	}
+	rebuildSpan.SetAttribute("bytes", len(mergedBytes))
+	rebuildSpan.End()
+	logger.Debug("ZIP rebuild successful - generated %d bytes", len(mergedBytes))
+
+	// Refuse to hand a huge payload back to the caller
+	if err := checkOutputSize(len(mergedBytes), opts); err != nil {
+		logger.Error("Merged document rejected: %v", err)
+		return nil, err
+	}
+
+	result.Document = mergedBytes
+	return result, nil
+}
+
+// fieldReplacer carries the state shared by the field replacement passes
+// over a document
+type fieldReplacer struct {
+	data fields.MergeData
+	opts Options
+	log  *logging.Logger
+
+	// processedFields records every field name encountered so far
+	processedFields map[string]bool
+
+	// replacedCounts counts the replaced occurrences of each field across
+	// all passes; every occurrence is replaced by exactly one pass
+	replacedCounts map[string]int
+
+	// resolved, defaulted and skipped list the distinct fields filled from
+	// data, filled with their default value, and left without data, in
+	// document order
+	resolved  []string
+	defaulted []string
+	skipped   []string
+
+	// outcomes records the first resolution of each field
+	outcomes []FieldOutcome
+
+	// partErrors lists the parts left unchanged because they failed to merge
+	partErrors []PartError
+
+	// expansions counts the items of the expanded repeating sections
+	expansions int
+
+	// dataBindings lists the values of the bound content controls, to be
+	// written to the document properties and custom XML data
+	dataBindings []dataBinding
+
+	// err records the first error that fails the whole merge
+	err error
+}
+
+// utf8BOM is the UTF-8 byte order mark some tools write before the XML
+// declaration of a part
+const utf8BOM = "\ufeff"
+
+var (
+	// simpleFieldRegex matches <w:fldSimple> elements, self-closing or with content
+	simpleFieldRegex = regexp.MustCompile(`(?s)<w:fldSimple\b([^>]*?)(/>|>(.*?)</w:fldSimple>)`)
+
+	// instrAttrRegex captures the field instruction of a <w:fldSimple>
+	instrAttrRegex = regexp.MustCompile(`w:instr="([^"]*)"`)
+
+	// runTextRegex captures the opening tag and content of <w:t> elements
+	runTextRegex = regexp.MustCompile(`(?s)(<w:t(?:\s[^>]*)?>)(.*?)</w:t>`)
+
+	// openChevronEntityRegex and closeChevronEntityRegex match character
+	// references to « and », such as &#171; and &#xBB;
+	openChevronEntityRegex  = regexp.MustCompile(`&#(?:0*171|[xX]0*[aA][bB]);`)
+	closeChevronEntityRegex = regexp.MustCompile(`&#(?:0*187|[xX]0*[bB][bB]);`)
+)
+
+// normalizeChevronEntities replaces character references to « and » with the
+// literal characters, so placeholders written as &#171;Name&#187; are matched
+// like «Name»
+func normalizeChevronEntities(xml string) string {
+	if !strings.Contains(xml, "&#") {
+		return xml
 	}
-	logging.Debug("ZIP rebuild successful - generated %d bytes", len(mergedBytes))
+	xml = openChevronEntityRegex.ReplaceAllLiteralString(xml, "«")
+	return closeChevronEntityRegex.ReplaceAllLiteralString(xml, "»")
+}
 
-	return mergedBytes, skippedFields, nil
+// newFieldReplacer creates a replacer for the given merge data and options
+func newFieldReplacer(data fields.MergeData, opts Options) *fieldReplacer {
+	return &fieldReplacer{
+		data:            data,
+		opts:            opts,
+		log:             opts.logger(),
+		processedFields: make(map[string]bool),
+		replacedCounts:  make(map[string]int),
+	}
 }
 
 // replaceFieldValues replaces merge fields in the XML with actual values
 func replaceFieldValues(documentXML string, data fields.MergeData) (string, []string, error) {
-	var skipped []string
-	processedFields := make(map[string]bool)
+	replacer := newFieldReplacer(data, Options{})
+	result := replacer.replaceAll(documentXML)
+	return result, replacer.skipped, nil
+}
 
-	// Process the XML to replace merge fields
-	result := documentXML
+// ReplaceFieldValues merges a bare WordprocessingML part such as
+// word/document.xml, without a DOCX package around it, and returns the merged
+// XML and the fields left without data. Only the field replacement runs: no
+// part outside the given XML is read or written.
+func ReplaceFieldValues(documentXML string, data fields.MergeData) (string, []string, error) {
+	return replaceFieldValues(documentXML, data)
+}
+
+// replaceAll runs all replacement passes over the document XML. The passes
+// share the replacer state, so a field appearing both as a fldSimple and as a
+// bare «placeholder» is filled everywhere and each occurrence counted once.
+func (r *fieldReplacer) replaceAll(documentXML string) string {
+	// Spell out entity-encoded chevrons so their placeholders are found
+	documentXML = normalizeChevronEntities(documentXML)
+
+	// Rejoin placeholders Word split across runs so they are found
+	documentXML = coalesceSplitPlaceholders(documentXML)
+
+	// Expand repeating section content controls bound to array data
+	r.log.Debug("Processing repeating sections")
+	result := r.replaceRepeatingSections(documentXML)
+
+	// Toggle checkbox content controls tagged with a boolean field
+	r.log.Debug("Processing checkbox content controls")
+	result = r.replaceCheckboxes(result)
+
+	// Fill content controls bound to document properties or custom XML data
+	r.log.Debug("Processing data-bound content controls")
+	result = r.replaceDataBindings(result)
+
+	// Replace the result text of <w:fldSimple w:instr="MERGEFIELD ..."> fields
+	r.log.Debug("Processing simple fields")
+	result = r.replaceSimpleFields(result)
+
+	// Replace the result text between the separate and end markers of
+	// MERGEFIELD complex fields
+	r.log.Debug("Processing complex fields")
+	result = r.replaceComplexFields(result)
 
 	// Find and replace all merge fields by looking for <w:t>«fieldname»</w:t> pattern
-	logging.Debug("Processing merge fields")
-	result, fieldSkipped := replaceFields(result, data, processedFields)
-	skipped = append(skipped, fieldSkipped...)
-	logging.Debug("Field processing completed: %d fields skipped", len(fieldSkipped))
+	r.log.Debug("Processing merge fields")
+	result = r.replaceFields(result)
+	r.log.Debug("Field processing completed: %d fields skipped", len(r.skipped))
+
+	r.log.Debug("Total fields processed: %d, Total fields skipped: %d", len(r.processedFields), len(r.skipped))
+	return result
+}
+
+// lineEndingReplacer converts CRLF and lone CR line endings to LF
+var lineEndingReplacer = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+// mergeDocumentXML replaces the fields of one WordprocessingML part and applies
+// the XML clean-up options
+func (r *fieldReplacer) mergeDocumentXML(xml string) string {
+	xml = r.replaceAll(xml)
+
+	// Make the merged values stand out for proofing, or drop their shading
+	if r.opts.HighlightMerged || r.opts.RemoveFieldShading {
+		xml = restyleMergedRuns(xml, r.opts.HighlightMerged, r.opts.RemoveFieldShading)
+	}
+
+	// Drop paragraphs that only held fields which merged to nothing
+	if r.opts.RemoveEmptyParagraphs {
+		var removed int
+		xml, removed = removeEmptyParagraphs(xml)
+		r.log.Debug("Removed %d empty paragraphs", removed)
+	}
 
-	logging.Debug("Total fields processed: %d, Total fields skipped: %d", len(processedFields), len(skipped))
-	return result, skipped, nil
+	if r.opts.NormalizeLineEndings {
+		xml = lineEndingReplacer.Replace(xml)
+	}
+	return xml
 }
 
-// replaceFields handles all merge fields by looking for <w:t>«fieldname»</w:t> pattern
-func replaceFields(documentXML string, data fields.MergeData, processedFields map[string]bool) (string, []string) {
-	var skipped []string
+// resolve looks up the value for one occurrence of a field and records the
+// outcome. A found value is counted as replaced, so callers must substitute it.
+// With StripUnresolved, a skipped field is found with an empty value so its
+// placeholder is removed, but it is not counted.
+func (r *fieldReplacer) resolve(fieldName string) (string, bool) {
+	// Evaluate function calls such as «upper(FirstName)»
+	if r.evaluatesExpression(fieldName) {
+		return r.resolveExpression(fieldName)
+	}
 
-	// Simple regex to find <w:t>«fieldname»</w:t> patterns
-	fieldRegex := regexp.MustCompile(`<w:t[^>]*>«([^»]+)»</w:t>`)
+	// «First  Name» merges the First Name value
+	fieldName = r.unmarkedName(fields.NormalizeFieldName(fieldName))
+	r.processedFields[fieldName] = true
+
+	// An object value has no single text; its members merge through
+	// sub-field placeholders. Infinite and NaN numbers have no text either.
+	if raw, found := lookupRawValue(r.data, fieldName); found {
+		err := fields.ObjectValueError(fieldName, raw)
+		if err == nil {
+			err = fields.NonFiniteError(raw)
+		}
+		if err != nil {
+			r.log.Warn("Field '%s' not merged: %v", fieldName, err)
+			r.recordOutcome(FieldOutcome{Name: fieldName, Status: FieldStatusError, Reason: err.Error()})
+			return "", false
+		}
+	}
+
+	// Try to get the value from merge data (case-insensitive)
+	if value, found := lookupValue(r.data, fieldName); found {
+		value = r.localize(fieldName, value)
+		if r.opts.MatchPlaceholderCase && !IsSecretField(fieldName) {
+			value = matchPlaceholderCase(fieldName, value)
+		}
+		value = r.transformText(fieldName, value)
+		value = r.affix(fieldName, value)
+		r.log.Debug("Field replacement: '%s' -> '%s'", fieldName, displayValue(fieldName, value))
+		if !contains(r.resolved, fieldName) {
+			r.resolved = append(r.resolved, fieldName)
+		}
+		r.recordOutcome(FieldOutcome{Name: fieldName, Status: FieldStatusResolved, Value: displayValue(fieldName, value)})
+		r.replacedCounts[fieldName]++
+		return value, true
+	}
+
+	// Fall back to the template's default value, then to the fallback sources
+	if value, reason, found := r.fallbackValue(fieldName); found {
+		value = r.localize(fieldName, value)
+		if r.opts.MatchPlaceholderCase && !IsSecretField(fieldName) {
+			value = matchPlaceholderCase(fieldName, value)
+		}
+		value = r.transformText(fieldName, value)
+		value = r.affix(fieldName, value)
+		r.log.Debug("Field default: '%s' -> '%s'", fieldName, displayValue(fieldName, value))
+		if !contains(r.defaulted, fieldName) {
+			r.defaulted = append(r.defaulted, fieldName)
+		}
+		r.recordOutcome(FieldOutcome{Name: fieldName, Status: FieldStatusDefault, Value: displayValue(fieldName, value), Reason: reason})
+		r.replacedCounts[fieldName]++
+		return value, true
+	}
+
+	// Field not found in data, add to skipped list
+	if !contains(r.skipped, fieldName) {
+		r.log.Debug("Field skipped: '%s' (no data available)", fieldName)
+		r.skipped = append(r.skipped, fieldName)
+	}
+	r.recordOutcome(FieldOutcome{Name: fieldName, Status: FieldStatusSkipped, Reason: "no data available"})
+	return "", r.opts.StripUnresolved
+}
+
+// unmarkedName returns a field name without the marker of required fields,
+// so «Email*» merges the Email value, unless the merge data has a key for
+// the marked name itself
+func (r *fieldReplacer) unmarkedName(fieldName string) string {
+	marker := r.opts.RequiredMarker
+	if marker == "" {
+		marker = fields.DefaultRequiredMarker
+	}
+	name, marked := fields.RequiredFieldName(fieldName, marker)
+	if !marked {
+		return fieldName
+	}
+	if _, found := lookupRawValue(r.data, fieldName); found {
+		return fieldName
+	}
+	return name
+}
+
+// redactedValue stands for the value of a secret field in logs and outcomes
+const redactedValue = "[redacted]"
+
+// displayValue returns the value of a field as shown in logs and outcomes
+func displayValue(fieldName, value string) string {
+	if IsSecretField(fieldName) {
+		return redactedValue
+	}
+	return value
+}
+
+// fallbackValue returns the value of a field without merge data and the
+// reason it was used: the template default takes precedence over the
+// fallback sources, which are consulted in order
+func (r *fieldReplacer) fallbackValue(fieldName string) (string, string, bool) {
+	if value, found := r.defaultValue(fieldName); found {
+		return value, "no data provided, default value used", true
+	}
+	var field *fields.MergeField
+	if r.opts.FieldSet != nil {
+		field = r.opts.FieldSet.GetFieldByName(fieldName)
+	}
+	for _, source := range r.opts.FallbackSources {
+		if value, found := source.Lookup(fieldName, field); found {
+			return value, "no data provided, value from " + source.Name() + " used", true
+		}
+	}
+	return "", "", false
+}
+
+// defaultValue returns the DefaultValue of a field from the options' field set
+func (r *fieldReplacer) defaultValue(fieldName string) (string, bool) {
+	if r.opts.FieldSet == nil {
+		return "", false
+	}
+	field := r.opts.FieldSet.GetFieldByName(fieldName)
+	if field == nil || field.DefaultValue == nil {
+		return "", false
+	}
+	return formatValue(field.DefaultValue), true
+}
+
+// recordOutcome keeps the first outcome recorded for each field
+func (r *fieldReplacer) recordOutcome(outcome FieldOutcome) {
+	for _, existing := range r.outcomes {
+		if existing.Name == outcome.Name {
+			return
+		}
+	}
+	r.outcomes = append(r.outcomes, outcome)
+}
+
+// replaceSimpleFields replaces the displayed result of MERGEFIELD fldSimple
+// elements. The value goes into the first text element of the field result
+// and any further text elements are emptied; the field's runs and their
+// formatting are kept.
+func (r *fieldReplacer) replaceSimpleFields(documentXML string) string {
+	return simpleFieldRegex.ReplaceAllStringFunc(documentXML, func(match string) string {
+		parts := simpleFieldRegex.FindStringSubmatch(match)
+		attrs, content := parts[1], parts[3]
+
+		instr := instrAttrRegex.FindStringSubmatch(attrs)
+		if instr == nil {
+			return match
+		}
+		fieldName := fields.MergeFieldName(unescapeXML(instr[1]))
+		if fieldName == "" {
+			return match
+		}
+
+		value, found := r.resolve(fieldName)
+		if !found {
+			return match
+		}
+		escaped := r.markMerged(runTabs(r.expressionLineBreaks(fieldName, escapeXML(value))))
+
+		// A field without a cached result gets a new run holding the value
+		if parts[2] == "/>" || !runTextRegex.MatchString(content) {
+			return "<w:fldSimple" + attrs + "><w:r><w:t>" + escaped + "</w:t></w:r>" + content + "</w:fldSimple>"
+		}
+
+		first := true
+		content = runTextRegex.ReplaceAllStringFunc(content, func(text string) string {
+			openTag := runTextRegex.FindStringSubmatch(text)[1]
+			if first {
+				first = false
+				return openTag + escaped + "</w:t>"
+			}
+			return openTag + "</w:t>"
+		})
+		return "<w:fldSimple" + attrs + ">" + content + "</w:fldSimple>"
+	})
+}
+
+// replaceFields handles all merge fields by looking for <w:t>«fieldname»</w:t>
+// patterns, or the placeholders of the delimiters in the options
+func (r *fieldReplacer) replaceFields(documentXML string) string {
+	delimiters := r.opts.Delimiters
+	if len(delimiters) == 0 {
+		delimiters = []fields.Delimiters{fields.ChevronDelimiters}
+	}
+	for _, d := range delimiters {
+		documentXML = r.replacePlaceholders(documentXML, d)
+	}
+	return documentXML
+}
+
+// placeholderRegexes caches the *regexp.Regexp of placeholderRegex by
+// fields.Delimiters, so each syntax is compiled once per process
+var placeholderRegexes sync.Map
+
+// placeholderRegex returns the regex matching the <w:t> elements that hold a
+// whole placeholder with the delimiters, including text wrapped in a CDATA
+// section: <w:t><![CDATA[«fieldname»]]></w:t>
+func placeholderRegex(d fields.Delimiters) *regexp.Regexp {
+	if cached, ok := placeholderRegexes.Load(d); ok {
+		return cached.(*regexp.Regexp)
+	}
+	pattern := d.Pattern()
+	compiled := regexp.MustCompile(`<w:t[^>]*>(?:` + pattern + `|<!\[CDATA\[` + pattern + `\]\]>)</w:t>`)
+	cached, _ := placeholderRegexes.LoadOrStore(d, compiled)
+	return cached.(*regexp.Regexp)
+}
+
+// replacePlaceholders replaces the <w:t> elements holding a whole placeholder
+// with the delimiters, such as <w:t>{{fieldname}}</w:t>
+func (r *fieldReplacer) replacePlaceholders(documentXML string, d fields.Delimiters) string {
+	fieldRegex := placeholderRegex(d)
 
 	// Count matches
 	matches := fieldRegex.FindAllStringSubmatch(documentXML, -1)
-	logging.Debug("Detected %d field placeholders in document", len(matches))
+	r.log.Debug("Detected %d %s%s field placeholders in document", len(matches), d.Open, d.Close)
 
 	// Replace each match
-	result := fieldRegex.ReplaceAllStringFunc(documentXML, func(match string) string {
+	return fieldRegex.ReplaceAllStringFunc(documentXML, func(match string) string {
 		// Extract field name from the match
-		fieldNameRegex := regexp.MustCompile(`«([^»]+)»`)
-		fieldNameMatch := fieldNameRegex.FindStringSubmatch(match)
-		if len(fieldNameMatch) < 2 {
+		fieldNameMatch := fieldRegex.FindStringSubmatch(match)
+		if len(fieldNameMatch) < 3 {
 			return match // Return original if we can't extract field name
 		}
 
-		fieldName := strings.TrimSpace(fieldNameMatch[1])
+		rawName, inCDATA := fieldNameMatch[1], false
+		if rawName == "" {
+			rawName, inCDATA = fieldNameMatch[2], true
+		}
+		fieldName := strings.TrimSpace(rawName)
 
-		// Skip if already processed
-		if processedFields[fieldName] {
+		value, found := r.resolve(fieldName)
+		if !found {
+			// Return the original field
 			return match
 		}
-		processedFields[fieldName] = true
 
-		// Try to get the value from merge data (case-insensitive)
-		value, found := getCaseInsensitiveValue(data, fieldName)
-		if found {
-			logging.Debug("Field replacement: '%s' -> '%s'", fieldName, value)
-			// Replace the content inside <w:t> with the value
-			replacement := strings.Replace(match, "«"+fieldName+"»", escapeXML(value), 1)
-			return replacement
+		// Replace the content inside <w:t> with the value, escaped for
+		// the kind of text node that holds the placeholder
+		escaped := runTabs(r.expressionLineBreaks(fieldName, escapeXML(value)))
+		if inCDATA {
+			escaped = escapeCDATA(value)
 		}
+		replacement := strings.Replace(match, d.Open+rawName+d.Close, r.markMerged(escaped), 1)
+		return replacement
+	})
+}
 
-		// Field not found in data, add to skipped list
-		if !contains(skipped, fieldName) {
-			logging.Debug("Field skipped: '%s' (no data available)", fieldName)
-			skipped = append(skipped, fieldName)
+// getCaseInsensitiveValue performs case-insensitive lookup in merge data,
+// descending into object values for sub-field names such as Address.street
+func getCaseInsensitiveValue(data fields.MergeData, fieldName string) (string, bool) {
+	value, found := data.Lookup(fieldName)
+	if !found {
+		return "", false
+	}
+	// Never write Inf or NaN into a document; resolve reports the field
+	if fields.NonFiniteError(value) != nil {
+		return "", false
+	}
+	return formatValue(value), true
+}
+
+// formatValue renders a merge data value as text. JSON numbers decode to
+// float64, so integer-valued floats are written out in full instead of with
+// an exponent (1234567890123 rather than 1.234567890123e+12).
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case float64:
+		if v == math.Trunc(v) && !math.IsInf(v, 0) {
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+	case float32:
+		if f := float64(v); f == math.Trunc(f) && !math.IsInf(f, 0) {
+			return strconv.FormatFloat(f, 'f', -1, 32)
 		}
+	}
+	return fmt.Sprintf("%v", value)
+}
 
-		// Return the original field
-		return match
-	})
+// fallbackSeparator separates the alternatives of a fallback chain such as
+// «PreferredName|FirstName»
+const fallbackSeparator = fields.FallbackSeparator
 
-	return result, skipped
+// lookupValue resolves a field name, or each alternative of a fallback chain
+// from left to right, to the first value present in the merge data
+func lookupValue(data fields.MergeData, fieldName string) (string, bool) {
+	if value, found := getCaseInsensitiveValue(data, fieldName); found || !strings.Contains(fieldName, fallbackSeparator) {
+		return value, found
+	}
+
+	for _, alternative := range strings.Split(fieldName, fallbackSeparator) {
+		alternative = strings.TrimSpace(alternative)
+		if alternative == "" {
+			continue
+		}
+		if value, found := getCaseInsensitiveValue(data, alternative); found {
+			return value, true
+		}
+	}
+	return "", false
 }
 
-// getCaseInsensitiveValue performs case-insensitive lookup in merge data
-func getCaseInsensitiveValue(data fields.MergeData, fieldName string) (string, bool) {
-	// Try exact match first
-	if value, exists := data[fieldName]; exists {
-		return fmt.Sprintf("%v", value), true
+// FallbackChainWarnings reports the fallback chains of a document XML that
+// name an alternative more than once, such as «A|A» or «Name|Nick|name».
+// Alternatives are matched case-insensitively like merge data keys, so the
+// repeat can never be reached: without aliases, this is the only way a chain
+// can loop back on itself, and it indicates an authoring error.
+func FallbackChainWarnings(documentXML string) []string {
+	var warnings []string
+	reported := make(map[string]bool)
+	for _, name := range placeholderNames(documentXML) {
+		if !strings.Contains(name, fallbackSeparator) || reported[name] {
+			continue
+		}
+		reported[name] = true
+
+		seen := make(map[string]bool)
+		for _, alternative := range strings.Split(name, fallbackSeparator) {
+			key := strings.ToLower(strings.TrimSpace(alternative))
+			if key == "" {
+				continue
+			}
+			if seen[key] {
+				warnings = append(warnings, fmt.Sprintf("Fallback chain «%s» references '%s' more than once; the repeated alternative is never used", name, strings.TrimSpace(alternative)))
+				break
+			}
+			seen[key] = true
+		}
 	}
+	return warnings
+}
 
-	// Try case-insensitive match
-	for key, value := range data {
-		if strings.EqualFold(key, fieldName) {
-			return fmt.Sprintf("%v", value), true
+// placeholderNames lists the names a document XML merges: MERGEFIELD names
+// and the text of «placeholders» in runs, unescaped
+func placeholderNames(documentXML string) []string {
+	documentXML = normalizeChevronEntities(documentXML)
+
+	names, _ := fields.Extract(documentXML)
+	for _, text := range runTextRegex.FindAllStringSubmatch(documentXML, -1) {
+		for _, placeholder := range drawingPlaceholderRegex.FindAllStringSubmatch(text[2], -1) {
+			names = append(names, strings.TrimSpace(unescapeXML(placeholder[1])))
 		}
 	}
+	return names
+}
 
-	return "", false
+// matchPlaceholderCase applies the casing of the placeholder name to the value:
+// an all-uppercase name uppercases the value, an all-lowercase name lowercases
+// it and a capitalized name title-cases it. Other values are left unchanged.
+func matchPlaceholderCase(fieldName, value string) string {
+	hasUpper, hasLower := false, false
+	for _, r := range fieldName {
+		hasUpper = hasUpper || unicode.IsUpper(r)
+		hasLower = hasLower || unicode.IsLower(r)
+	}
+
+	switch {
+	case hasUpper && !hasLower:
+		return strings.ToUpper(value)
+	case hasLower && !hasUpper:
+		return strings.ToLower(value)
+	case hasUpper:
+		if first, _ := utf8.DecodeRuneInString(fieldName); unicode.IsUpper(first) {
+			return titleCase(value)
+		}
+	}
+	return value
+}
+
+// Values of FieldFormat.TextTransform applied to string fields
+const (
+	TextTransformUppercase = "uppercase"
+	TextTransformLowercase = "lowercase"
+	TextTransformTitle     = "title"
+)
+
+// transformText applies the TextTransform of a string field's Format to its
+// value. It runs after MatchPlaceholderCase, so the field's own format wins.
+// Unknown transforms and fields without one leave the value unchanged.
+func (r *fieldReplacer) transformText(fieldName, value string) string {
+	if r.opts.FieldSet == nil {
+		return value
+	}
+	field := r.opts.FieldSet.GetFieldByName(fieldName)
+	if field == nil || field.Type != fields.FieldTypeString || field.Format == nil {
+		return value
+	}
+
+	switch strings.ToLower(strings.TrimSpace(field.Format.TextTransform)) {
+	case TextTransformUppercase:
+		return strings.ToUpper(value)
+	case TextTransformLowercase:
+		return strings.ToLower(value)
+	case TextTransformTitle:
+		return titleCase(value)
+	}
+	return value
+}
+
+// affix adds the Prefix and Suffix of a field's Format around its formatted
+// value. Like the \b and \f switches of a Word MERGEFIELD, they are left out
+// when the value is empty, so a field merging to nothing leaves no stray
+// text; a skipped field is never resolved and gets neither.
+func (r *fieldReplacer) affix(fieldName, value string) string {
+	if value == "" || r.opts.FieldSet == nil {
+		return value
+	}
+	field := r.opts.FieldSet.GetFieldByName(fieldName)
+	if field == nil || field.Format == nil {
+		return value
+	}
+	return field.Format.Prefix + value + field.Format.Suffix
+}
+
+// titleCase uppercases the first letter of each word and lowercases the rest
+func titleCase(s string) string {
+	var b strings.Builder
+	startOfWord := true
+	for _, r := range s {
+		if startOfWord {
+			b.WriteRune(unicode.ToUpper(r))
+		} else {
+			b.WriteRune(unicode.ToLower(r))
+		}
+		startOfWord = unicode.IsSpace(r) || r == '-'
+	}
+	return b.String()
+}
+
+// tabText ends the text element of a run, adds a tab and opens a new text
+// element in the same run, keeping its formatting
+const tabText = `</w:t><w:tab/><w:t xml:space="preserve">`
+
+// runTabs renders the tab characters of an escaped value as tabs within the
+// run holding it; Word collapses a tab character inside <w:t>
+func runTabs(escaped string) string {
+	return strings.ReplaceAll(escaped, "\t", tabText)
 }
 
 // escapeXML escapes special XML characters in text content
@@ -157,49 +795,31 @@ func escapeXML(s string) string {
 	return s
 }
 
-// rebuildDocxArchive rebuilds the DOCX file as a ZIP archive
-func rebuildDocxArchive(doc *docx.DocxFile) ([]byte, error) {
-	var buf bytes.Buffer
-
-	logging.Debug("Creating ZIP writer for DOCX archive")
-	// Create a new ZIP writer
-	zipWriter := zip.NewWriter(&buf)
-
-	logging.Debug("Adding %d files to ZIP archive", len(doc.Files))
-	// Add all files to the ZIP archive
-	fileIndex := 0
-	for filename, content := range doc.Files {
-		fileIndex++
-		logging.Debug("Adding file %d/%d: %s (%d bytes)", fileIndex, len(doc.Files), filename, len(content))
+// unescapeXML decodes the predefined XML entities in attribute values
+func unescapeXML(s string) string {
+	return xmlUnescaper.Replace(s)
+}
 
-		// Create a file in the ZIP archive
-		fileWriter, err := zipWriter.Create(filename)
-		if err != nil {
-			logging.Error("Failed to create file %s in ZIP: %v", filename, err)
-			zipWriter.Close()
-			return nil, fmt.Errorf("failed to create file %s in ZIP: %w", filename, err)
-		}
+var xmlUnescaper = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&quot;", "\"", "&apos;", "'", "&#39;", "'", "&amp;", "&")
 
-		// Write the file content
-		_, err = fileWriter.Write(content)
-		if err != nil {
-			logging.Error("Failed to write content for file %s: %v", filename, err)
-			zipWriter.Close()
-			return nil, fmt.Errorf("failed to write content for file %s: %w", filename, err)
-		}
-		logging.Debug("Successfully added file: %s", filename)
-	}
+// escapeCDATA makes text safe for use inside a CDATA section by splitting any
+// "]]>" terminator across two adjacent sections
+func escapeCDATA(s string) string {
+	return strings.ReplaceAll(s, "]]>", "]]]]><![CDATA[>")
+}
 
-	logging.Debug("Closing ZIP writer")
-	// Close the ZIP writer
-	err := zipWriter.Close()
+// rebuildDocxArchive rebuilds the DOCX file as a ZIP archive, keeping the
+// entry order and compression of the template
+func rebuildDocxArchive(doc *docx.DocxFile, log *logging.Logger) ([]byte, error) {
+	log.Debug("Adding %d files to ZIP archive", len(doc.Files))
+	archive, err := doc.Rebuild()
 	if err != nil {
-		logging.Error("Failed to close ZIP writer: %v", err)
-		return nil, fmt.Errorf("failed to close ZIP writer: %w", err)
+		log.Error("Failed to rebuild ZIP archive: %v", err)
+		return nil, err
 	}
 
-	logging.Debug("ZIP archive successfully created (%d bytes)", buf.Len())
-	return buf.Bytes(), nil
+	log.Debug("ZIP archive successfully created (%d bytes)", len(archive))
+	return archive, nil
 }
 
 
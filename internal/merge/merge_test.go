@@ -1,13 +1,26 @@
 package merge
 
 import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"com/lifenture/flash-mail-merge/internal/docx"
 	"com/lifenture/flash-mail-merge/internal/fields"
+	"com/lifenture/flash-mail-merge/internal/logging"
+	"com/lifenture/flash-mail-merge/internal/testutil"
 )
 
 func TestReplaceFieldValues(t *testing.T) {
@@ -81,6 +94,172 @@ func TestReplaceFieldValuesWithMultipleRuns(t *testing.T) {
 	}
 }
 
+func TestReplaceFieldValuesSplitAcrossRuns(t *testing.T) {
+	tests := []struct {
+		name      string
+		paragraph string
+		data      fields.MergeData
+		expected  []string
+		skipped   []string
+	}{
+		{
+			name:      "two runs",
+			paragraph: `<w:p><w:r><w:rPr><w:b/></w:rPr><w:t>«First</w:t></w:r><w:r><w:t>Name»</w:t></w:r></w:p>`,
+			data:      fields.MergeData{"FirstName": "Jane"},
+			expected:  []string{`<w:r><w:rPr><w:b/></w:rPr><w:t>Jane</w:t></w:r><w:r><w:t></w:t></w:r>`},
+		},
+		{
+			name: "three runs",
+			paragraph: `<w:p><w:r><w:rPr><w:i/></w:rPr><w:t>«</w:t></w:r>` +
+				`<w:proofErr w:type="spellStart"/><w:r><w:t>Last</w:t></w:r><w:proofErr w:type="spellEnd"/>` +
+				`<w:r><w:rPr><w:b/></w:rPr><w:t>Name»</w:t></w:r></w:p>`,
+			data:     fields.MergeData{"LastName": "Doe"},
+			expected: []string{`<w:rPr><w:i/></w:rPr><w:t>Doe</w:t></w:r>`, `<w:r><w:t></w:t></w:r>`, `<w:r><w:rPr><w:b/></w:rPr><w:t></w:t></w:r>`},
+		},
+		{
+			name:      "text around the placeholder is kept",
+			paragraph: `<w:p><w:r><w:t xml:space="preserve">Dear «First</w:t></w:r><w:r><w:t xml:space="preserve">Name», welcome</w:t></w:r></w:p>`,
+			data:      fields.MergeData{"FirstName": "Jane"},
+			expected:  []string{`<w:t xml:space="preserve">Dear </w:t><w:t xml:space="preserve">Jane</w:t></w:r>`, `<w:r><w:t xml:space="preserve">, welcome</w:t></w:r>`},
+		},
+		{
+			name:      "two split placeholders sharing a run",
+			paragraph: `<w:p><w:r><w:t>«First</w:t></w:r><w:r><w:t>Name» «Last</w:t></w:r><w:r><w:t>Name»</w:t></w:r></w:p>`,
+			data:      fields.MergeData{"FirstName": "Jane", "LastName": "Doe"},
+			expected:  []string{`<w:r><w:t>Jane</w:t></w:r><w:r><w:t xml:space="preserve"> </w:t><w:t>Doe</w:t></w:r><w:r><w:t></w:t></w:r>`},
+		},
+		{
+			name:      "split placeholder without data",
+			paragraph: `<w:p><w:r><w:t>«Middle</w:t></w:r><w:r><w:t>Name»</w:t></w:r></w:p>`,
+			data:      fields.MergeData{},
+			expected:  []string{`<w:r><w:t>«MiddleName»</w:t></w:r><w:r><w:t></w:t></w:r>`},
+			skipped:   []string{"MiddleName"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, skipped, err := replaceFieldValues(`<w:document><w:body>`+tt.paragraph+`</w:body></w:document>`, tt.data)
+			if err != nil {
+				t.Fatalf("replaceFieldValues failed: %v", err)
+			}
+			for _, expected := range tt.expected {
+				if !strings.Contains(result, expected) {
+					t.Errorf("Expected %s in result: %s", expected, result)
+				}
+			}
+			if len(skipped) != len(tt.skipped) || (len(skipped) > 0 && skipped[0] != tt.skipped[0]) {
+				t.Errorf("Expected skipped %v, got %v", tt.skipped, skipped)
+			}
+		})
+	}
+}
+
+func TestReplaceFieldValuesComplexFields(t *testing.T) {
+	complexField := func(instr, result string) string {
+		return `<w:p><w:r><w:fldChar w:fldCharType="begin"/></w:r><w:r><w:instrText xml:space="preserve">` + instr + `</w:instrText></w:r>` +
+			`<w:r><w:fldChar w:fldCharType="separate"/></w:r>` + result + `<w:r><w:fldChar w:fldCharType="end"/></w:r></w:p>`
+	}
+	tests := []struct {
+		name      string
+		paragraph string
+		data      fields.MergeData
+		expected  []string
+		skipped   []string
+	}{
+		{
+			name:      "result text other than the placeholder",
+			paragraph: complexField(" MERGEFIELD City ", `<w:r><w:rPr><w:b/></w:rPr><w:t>Old city</w:t></w:r>`),
+			data:      fields.MergeData{"City": "Springfield"},
+			expected:  []string{`<w:r><w:rPr><w:b/></w:rPr><w:t>Springfield</w:t></w:r>`},
+		},
+		{
+			name:      "result over several runs",
+			paragraph: complexField(` MERGEFIELD  FirstName \* MERGEFORMAT `, `<w:r><w:rPr><w:i/></w:rPr><w:t>«First</w:t></w:r><w:r><w:t>Name»</w:t></w:r>`),
+			data:      fields.MergeData{"FirstName": "Jane"},
+			expected:  []string{`<w:r><w:rPr><w:i/></w:rPr><w:t>Jane</w:t></w:r><w:r><w:t></w:t></w:r>`},
+		},
+		{
+			name: "instruction split over several runs",
+			paragraph: `<w:p><w:r><w:fldChar w:fldCharType="begin"/></w:r><w:r><w:instrText xml:space="preserve"> MERGE</w:instrText></w:r>` +
+				`<w:r><w:instrText xml:space="preserve">FIELD Last</w:instrText></w:r><w:r><w:instrText>Name </w:instrText></w:r>` +
+				`<w:r><w:fldChar w:fldCharType="separate"/></w:r><w:r><w:t>Smith</w:t></w:r><w:r><w:fldChar w:fldCharType="end"/></w:r></w:p>`,
+			data:     fields.MergeData{"LastName": "Doe"},
+			expected: []string{`<w:r><w:t>Doe</w:t></w:r>`},
+		},
+		{
+			name:      "result without text",
+			paragraph: complexField(" MERGEFIELD City ", ""),
+			data:      fields.MergeData{"City": "Springfield"},
+			expected:  []string{`<w:r><w:fldChar w:fldCharType="separate"/></w:r><w:r><w:t>Springfield</w:t></w:r><w:r><w:fldChar w:fldCharType="end"/></w:r>`},
+		},
+		{
+			name: "field without separate marker",
+			paragraph: `<w:p><w:r><w:fldChar w:fldCharType="begin"/></w:r><w:r><w:instrText> MERGEFIELD City </w:instrText></w:r>` +
+				`<w:r><w:fldChar w:fldCharType="end"/></w:r></w:p>`,
+			data:     fields.MergeData{"City": "Springfield"},
+			expected: []string{`<w:r><w:fldChar w:fldCharType="separate"/></w:r><w:r><w:t>Springfield</w:t></w:r><w:r><w:fldChar w:fldCharType="end"/></w:r>`},
+		},
+		{
+			name:      "missing data",
+			paragraph: complexField(" MERGEFIELD Region ", `<w:r><w:t>Old region</w:t></w:r>`),
+			data:      fields.MergeData{},
+			expected:  []string{`<w:r><w:t>Old region</w:t></w:r>`},
+			skipped:   []string{"Region"},
+		},
+		{
+			name: "MERGEFIELD nested in an IF instruction",
+			paragraph: `<w:p><w:r><w:fldChar w:fldCharType="begin"/></w:r><w:r><w:instrText xml:space="preserve"> IF </w:instrText></w:r>` +
+				`<w:r><w:fldChar w:fldCharType="begin"/></w:r><w:r><w:instrText> MERGEFIELD Status </w:instrText></w:r>` +
+				`<w:r><w:fldChar w:fldCharType="separate"/></w:r><w:r><w:t>«Status»</w:t></w:r><w:r><w:fldChar w:fldCharType="end"/></w:r>` +
+				`<w:r><w:instrText xml:space="preserve"> = "paid" "Thank you" "Please pay" </w:instrText></w:r>` +
+				`<w:r><w:fldChar w:fldCharType="separate"/></w:r><w:r><w:t>Please pay</w:t></w:r><w:r><w:fldChar w:fldCharType="end"/></w:r></w:p>`,
+			data:     fields.MergeData{"Status": "paid"},
+			expected: []string{`<w:r><w:t>paid</w:t></w:r>`, `<w:r><w:t>Please pay</w:t></w:r>`},
+		},
+		{
+			name: "FORMTEXT form field",
+			paragraph: `<w:p><w:bookmarkStart w:id="0" w:name="Comments"/><w:r><w:fldChar w:fldCharType="begin"><w:ffData><w:name w:val="Comments"/><w:enabled/>` +
+				`<w:textInput><w:default w:val="No comments"/></w:textInput></w:ffData></w:fldChar></w:r><w:r><w:instrText xml:space="preserve"> FORMTEXT </w:instrText></w:r>` +
+				`<w:r><w:fldChar w:fldCharType="separate"/></w:r><w:r><w:rPr><w:noProof/></w:rPr><w:t>No comments</w:t></w:r><w:r><w:fldChar w:fldCharType="end"/></w:r><w:bookmarkEnd w:id="0"/></w:p>`,
+			data:     fields.MergeData{"comments": "Delivered on time"},
+			expected: []string{`<w:r><w:rPr><w:noProof/></w:rPr><w:t>Delivered on time</w:t></w:r>`},
+		},
+		{
+			name: "FORMTEXT form field without data",
+			paragraph: `<w:p><w:r><w:fldChar w:fldCharType="begin"><w:ffData><w:name w:val="Comments"/></w:ffData></w:fldChar></w:r>` +
+				`<w:r><w:instrText> FORMTEXT </w:instrText></w:r><w:r><w:fldChar w:fldCharType="separate"/></w:r><w:r><w:t>No comments</w:t></w:r>` +
+				`<w:r><w:fldChar w:fldCharType="end"/></w:r></w:p>`,
+			data:     fields.MergeData{},
+			expected: []string{`<w:r><w:t>No comments</w:t></w:r>`},
+			skipped:  []string{"Comments"},
+		},
+		{
+			name:      "field that is not a MERGEFIELD",
+			paragraph: complexField(" PAGE ", `<w:r><w:t>1</w:t></w:r>`),
+			data:      fields.MergeData{"PAGE": "2"},
+			expected:  []string{`<w:r><w:t>1</w:t></w:r>`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, skipped, err := replaceFieldValues(`<w:document><w:body>`+tt.paragraph+`</w:body></w:document>`, tt.data)
+			if err != nil {
+				t.Fatalf("replaceFieldValues failed: %v", err)
+			}
+			for _, expected := range tt.expected {
+				if !strings.Contains(result, expected) {
+					t.Errorf("Expected %s in result: %s", expected, result)
+				}
+			}
+			if !reflect.DeepEqual(skipped, tt.skipped) {
+				t.Errorf("Expected skipped %v, got %v", tt.skipped, skipped)
+			}
+		})
+	}
+}
+
 func TestReplaceFieldValuesWithSkipped(t *testing.T) {
 	// Test XML with merge fields, one missing
 	xml := `<w:document>
@@ -120,6 +299,168 @@ func TestReplaceFieldValuesWithSkipped(t *testing.T) {
 }
 
 
+func TestReplaceFieldValuesInNestedTables(t *testing.T) {
+	// Placeholders inside a table nested in another table's cell
+	xml := `<w:document>
+		<w:body>
+			<w:tbl>
+				<w:tr>
+					<w:tc>
+						<w:p><w:r><w:t>«outer»</w:t></w:r></w:p>
+						<w:tbl>
+							<w:tr>
+								<w:tc><w:p><w:r><w:t>«inner»</w:t></w:r></w:p></w:tc>
+								<w:tc><w:p><w:r><w:rPr><w:i/></w:rPr><w:t>«missing»</w:t></w:r></w:p></w:tc>
+							</w:tr>
+						</w:tbl>
+					</w:tc>
+				</w:tr>
+			</w:tbl>
+		</w:body>
+	</w:document>`
+
+	data := fields.MergeData{
+		"outer": "Outer Value",
+		"inner": "Inner Value",
+	}
+
+	result, skipped, err := replaceFieldValues(xml, data)
+	if err != nil {
+		t.Fatalf("replaceFieldValues failed: %v", err)
+	}
+
+	if !strings.Contains(result, "<w:t>Outer Value</w:t>") {
+		t.Error("Outer table field was not replaced")
+	}
+	if !strings.Contains(result, "<w:t>Inner Value</w:t>") {
+		t.Error("Nested table field was not replaced")
+	}
+	if !strings.Contains(result, "«missing»") {
+		t.Error("Missing nested field should remain as placeholder")
+	}
+	if len(skipped) != 1 || skipped[0] != "missing" {
+		t.Errorf("Expected skipped fields [missing], got %v", skipped)
+	}
+
+	// The nested table structure must be left untouched
+	if strings.Count(result, "<w:tbl>") != 2 || strings.Count(result, "</w:tbl>") != 2 {
+		t.Errorf("Nested table structure was altered: %s", result)
+	}
+}
+
+func TestReplaceFieldValuesWithCDATA(t *testing.T) {
+	// Some generators wrap run text in CDATA sections
+	xml := `<w:document>
+		<w:body>
+			<w:p>
+				<w:r><w:t><![CDATA[«name»]]></w:t></w:r>
+				<w:r><w:t xml:space="preserve"><![CDATA[«company»]]></w:t></w:r>
+				<w:r><w:t><![CDATA[«tricky»]]></w:t></w:r>
+				<w:r><w:t><![CDATA[«missing»]]></w:t></w:r>
+			</w:p>
+		</w:body>
+	</w:document>`
+
+	data := fields.MergeData{
+		"name":    "John Doe",
+		"company": "Smith & <Sons>",
+		"tricky":  "a]]>b",
+	}
+
+	result, skipped, err := replaceFieldValues(xml, data)
+	if err != nil {
+		t.Fatalf("replaceFieldValues failed: %v", err)
+	}
+
+	if !strings.Contains(result, "<w:t><![CDATA[John Doe]]></w:t>") {
+		t.Errorf("CDATA-wrapped field was not replaced: %s", result)
+	}
+
+	// Inside CDATA the value is kept literal rather than entity-escaped
+	if !strings.Contains(result, `<w:t xml:space="preserve"><![CDATA[Smith & <Sons>]]></w:t>`) {
+		t.Errorf("CDATA value should not be entity-escaped: %s", result)
+	}
+
+	// A CDATA terminator inside the value must be split across sections
+	if !strings.Contains(result, "<w:t><![CDATA[a]]]]><![CDATA[>b]]></w:t>") {
+		t.Errorf("CDATA terminator in value was not escaped: %s", result)
+	}
+
+	if !strings.Contains(result, "<![CDATA[«missing»]]>") {
+		t.Error("Missing CDATA field should remain as placeholder")
+	}
+	if len(skipped) != 1 || skipped[0] != "missing" {
+		t.Errorf("Expected skipped fields [missing], got %v", skipped)
+	}
+}
+
+func TestReplaceFieldValuesSimpleAndTextForms(t *testing.T) {
+	// The same field appears inside a fldSimple and as bare text placeholders
+	xml := `<w:document>
+		<w:body>
+			<w:p>
+				<w:fldSimple w:instr=" MERGEFIELD Name \* MERGEFORMAT "><w:r><w:rPr><w:b/></w:rPr><w:t>«Name»</w:t></w:r></w:fldSimple>
+			</w:p>
+			<w:p>
+				<w:r><w:t>Dear </w:t></w:r>
+				<w:r><w:t>«Name»</w:t></w:r>
+				<w:r><w:t>, signed </w:t></w:r>
+				<w:r><w:t>«Name»</w:t></w:r>
+			</w:p>
+			<w:p>
+				<w:fldSimple w:instr=" MERGEFIELD City "/>
+				<w:fldSimple w:instr=" MERGEFIELD Phone "><w:r><w:t>«Phone»</w:t></w:r></w:fldSimple>
+			</w:p>
+		</w:body>
+	</w:document>`
+
+	data := fields.MergeData{
+		"Name": "Alice",
+		"City": "Springfield",
+	}
+
+	replacer := newFieldReplacer(data, Options{})
+	result := replacer.replaceAll(xml)
+
+	if strings.Contains(result, "«Name»") {
+		t.Errorf("All occurrences of Name should be replaced: %s", result)
+	}
+	if strings.Count(result, ">Alice</w:t>") != 3 {
+		t.Errorf("Expected 3 replaced Name occurrences, got: %s", result)
+	}
+
+	// The fldSimple run keeps its formatting
+	if !strings.Contains(result, "<w:r><w:rPr><w:b/></w:rPr><w:t>Alice</w:t></w:r></w:fldSimple>") {
+		t.Errorf("fldSimple result was not replaced in place: %s", result)
+	}
+
+	// A fldSimple without cached result gets a run with the value
+	if !strings.Contains(result, `<w:fldSimple w:instr=" MERGEFIELD City "><w:r><w:t>Springfield</w:t></w:r></w:fldSimple>`) {
+		t.Errorf("Self-closing fldSimple was not filled: %s", result)
+	}
+
+	// Each occurrence is counted exactly once across the passes
+	if replacer.replacedCounts["Name"] != 3 {
+		t.Errorf("Expected Name to be counted 3 times, got %d", replacer.replacedCounts["Name"])
+	}
+	if replacer.replacedCounts["City"] != 1 {
+		t.Errorf("Expected City to be counted once, got %d", replacer.replacedCounts["City"])
+	}
+	if _, ok := replacer.replacedCounts["Phone"]; ok {
+		t.Error("Skipped field Phone should not be counted")
+	}
+
+	if len(replacer.resolved) != 2 {
+		t.Errorf("Expected 2 resolved fields, got %v", replacer.resolved)
+	}
+	if len(replacer.skipped) != 1 || replacer.skipped[0] != "Phone" {
+		t.Errorf("Expected skipped fields [Phone], got %v", replacer.skipped)
+	}
+	if !strings.Contains(result, "<w:t>«Phone»</w:t>") {
+		t.Error("Skipped fldSimple should keep its placeholder")
+	}
+}
+
 func TestPerformMerge(t *testing.T) {
 	// Create a minimal DOCX structure
 	doc := &docx.DocxFile{
@@ -173,6 +514,149 @@ func TestPerformMerge(t *testing.T) {
 	}
 }
 
+// TestPerformMergeRemoveEmptyParagraphs tests removal of paragraphs blanked by the merge
+func TestPerformMergeRemoveEmptyParagraphs(t *testing.T) {
+	documentXML := `<?xml version="1.0"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+	<w:body>
+		<w:p><w:r><w:t>«greeting»</w:t></w:r></w:p>
+		<w:p><w:pPr><w:pStyle w:val="Promo"/></w:pPr><w:r><w:t>«promo»</w:t></w:r></w:p>
+		<w:p><w:pPr><w:spacing w:after="240"/></w:pPr></w:p>
+		<w:p><w:pPr><w:pStyle w:val="Blank"/></w:pPr><w:r><w:t xml:space="preserve"> </w:t></w:r></w:p>
+		<w:p><w:r><w:t>Regards</w:t></w:r></w:p>
+		<w:tbl><w:tr><w:tc><w:p><w:r><w:t>«note»</w:t></w:r></w:p></w:tc></w:tr></w:tbl>
+		<w:sectPr/>
+	</w:body>
+</w:document>`
+
+	data := fields.MergeData{
+		"greeting": "Hello",
+		"promo":    "",
+		"note":     "",
+	}
+
+	mergeAndGetXML := func(opts Options) string {
+		result, err := PerformMergeWithOptions(createSampleDocx(documentXML), data, opts)
+		if err != nil {
+			t.Fatalf("PerformMergeWithOptions failed: %v", err)
+		}
+		mergedDocx, err := docx.UnzipDocx(result.Document)
+		if err != nil {
+			t.Fatalf("Failed to unzip merged document: %v", err)
+		}
+		mergedXML, err := mergedDocx.GetDocumentXML()
+		if err != nil {
+			t.Fatalf("Failed to get merged document XML: %v", err)
+		}
+		return string(mergedXML)
+	}
+
+	t.Run("disabled by default", func(t *testing.T) {
+		mergedContent := mergeAndGetXML(Options{})
+		if !strings.Contains(mergedContent, `<w:pStyle w:val="Promo"/>`) {
+			t.Errorf("Blanked paragraph should be kept when option is off: %s", mergedContent)
+		}
+	})
+
+	t.Run("removes blanked paragraph", func(t *testing.T) {
+		mergedContent := mergeAndGetXML(Options{RemoveEmptyParagraphs: true})
+
+		if strings.Contains(mergedContent, `<w:pStyle w:val="Promo"/>`) {
+			t.Errorf("Blanked paragraph should have been removed: %s", mergedContent)
+		}
+		if !strings.Contains(mergedContent, "<w:t>Hello</w:t>") {
+			t.Error("Paragraph with merged text should be kept")
+		}
+		if !strings.Contains(mergedContent, "<w:t>Regards</w:t>") {
+			t.Error("Paragraph with literal text should be kept")
+		}
+
+		// Intentionally empty spacing paragraphs have properties but no text runs
+		if !strings.Contains(mergedContent, `<w:p><w:pPr><w:spacing w:after="240"/></w:pPr></w:p>`) {
+			t.Error("Empty spacing paragraph should be kept")
+		}
+
+		// Blank paragraphs of the template held no field and are kept
+		if !strings.Contains(mergedContent, `<w:p><w:pPr><w:pStyle w:val="Blank"/></w:pPr><w:r><w:t xml:space="preserve"> </w:t></w:r></w:p>`) {
+			t.Errorf("Originally blank paragraph should be kept: %s", mergedContent)
+		}
+		if strings.Contains(mergedContent, replacedMarker) {
+			t.Errorf("Replaced field tags should be removed: %q", mergedContent)
+		}
+
+		// A table cell must keep its last paragraph
+		if !strings.Contains(mergedContent, "<w:tc><w:p><w:r><w:t></w:t></w:r></w:p></w:tc>") {
+			t.Errorf("Last paragraph of a table cell should be kept: %s", mergedContent)
+		}
+	})
+}
+
+// TestPerformMergeRemoveMailMergeSettings tests stripping of <w:mailMerge> settings
+func TestPerformMergeRemoveMailMergeSettings(t *testing.T) {
+	settingsXML := `<?xml version="1.0"?>
+<w:settings xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+	<w:zoom w:percent="100"/>
+	<w:mailMerge>
+		<w:mainDocumentType w:val="formLetters"/>
+		<w:linkToQuery/>
+		<w:dataType w:val="native"/>
+		<w:connectString w:val="Provider=Microsoft.ACE.OLEDB.12.0;Data Source=C:\recipients.xlsx"/>
+		<w:query w:val="SELECT * FROM &quot;Sheet1$&quot;"/>
+		<w:dataSource r:id="rId1"/>
+	</w:mailMerge>
+	<w:defaultTabStop w:val="720"/>
+</w:settings>`
+	settingsRels := `<?xml version="1.0"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/mailMergeSource" Target="file:///C:\recipients.xlsx" TargetMode="External"/><Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/attachedTemplate" Target="Normal.dotm" TargetMode="External"/></Relationships>`
+
+	newDoc := func() *docx.DocxFile {
+		doc := createSampleDocx(`<w:document><w:body><w:p><w:r><w:t>«name»</w:t></w:r></w:p></w:body></w:document>`)
+		doc.Files["word/settings.xml"] = []byte(settingsXML)
+		doc.Files["word/_rels/settings.xml.rels"] = []byte(settingsRels)
+		return doc
+	}
+
+	mergeAndUnzip := func(opts Options) *docx.DocxFile {
+		result, err := PerformMergeWithOptions(newDoc(), fields.MergeData{"name": "Alice"}, opts)
+		if err != nil {
+			t.Fatalf("PerformMergeWithOptions failed: %v", err)
+		}
+		mergedDocx, err := docx.UnzipDocx(result.Document)
+		if err != nil {
+			t.Fatalf("Failed to unzip merged document: %v", err)
+		}
+		return mergedDocx
+	}
+
+	t.Run("kept by default", func(t *testing.T) {
+		mergedDocx := mergeAndUnzip(Options{})
+		if !mergedDocx.HasMailMergeSettings() {
+			t.Error("Mail merge settings should be kept when option is off")
+		}
+	})
+
+	t.Run("removed when flagged", func(t *testing.T) {
+		mergedDocx := mergeAndUnzip(Options{RemoveMailMergeSettings: true})
+		if mergedDocx.HasMailMergeSettings() {
+			t.Errorf("Mail merge settings should have been removed: %s", mergedDocx.Files["word/settings.xml"])
+		}
+
+		settings := string(mergedDocx.Files["word/settings.xml"])
+		if !strings.Contains(settings, `<w:zoom w:percent="100"/>`) || !strings.Contains(settings, `<w:defaultTabStop w:val="720"/>`) {
+			t.Errorf("Other settings should be preserved: %s", settings)
+		}
+
+		// The data source relationship goes, unrelated relationships stay
+		rels := string(mergedDocx.Files["word/_rels/settings.xml.rels"])
+		if strings.Contains(rels, "mailMergeSource") {
+			t.Errorf("Data source relationship should have been removed: %s", rels)
+		}
+		if !strings.Contains(rels, `Id="rId2"`) {
+			t.Errorf("Unrelated relationship should be preserved: %s", rels)
+		}
+	})
+}
+
 // Helper function to create a valid DOCX file with specified merge fields
 func createSampleDocx(documentXML string) *docx.DocxFile {
 	return &docx.DocxFile{
@@ -198,7 +682,7 @@ func createSampleDocx(documentXML string) *docx.DocxFile {
 // Helper function to create a DOCX as bytes
 func createSampleDocxBytes(documentXML string) []byte {
 	doc := createSampleDocx(documentXML)
-	mergedBytes, err := rebuildDocxArchive(doc)
+	mergedBytes, err := rebuildDocxArchive(doc, logging.Default())
 	if err != nil {
 		panic(err)
 	}
@@ -392,6 +876,92 @@ func TestPerformMergeSomeFieldsMissing(t *testing.T) {
 	}
 }
 
+func TestMergeLogsWithOptionsLogger(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	xml := `<w:document><w:body><w:p><w:r><w:t>«Address»</w:t></w:r></w:p></w:body></w:document>`
+	replacer := newFieldReplacer(fields.MergeData{"Address": map[string]interface{}{"city": "Springfield"}}, Options{Logger: logging.WithCorrelationID("req-7")})
+	replacer.replaceAll(xml)
+
+	if !strings.Contains(logs.String(), "[WARN] [req-7] Field 'Address' not merged") {
+		t.Errorf("Expected the merge to log with the options logger, got:\n%s", logs.String())
+	}
+}
+
+func TestPDFConverters(t *testing.T) {
+	if _, err := (UnconfiguredConverter{}).ConvertToPDF([]byte("docx")); !errors.Is(err, ErrConversionNotConfigured) {
+		t.Errorf("Expected ErrConversionNotConfigured, got %v", err)
+	}
+
+	// A stand-in soffice copies its input, the seventh argument, to the PDF
+	// in the output directory, the sixth
+	soffice := filepath.Join(t.TempDir(), "soffice")
+	script := "#!/bin/sh\ncat \"$7\" > \"$6/document.pdf\"\n"
+	if err := os.WriteFile(soffice, []byte(script), 0o755); err != nil {
+		t.Fatalf("Failed to write soffice stand-in: %v", err)
+	}
+	pdf, err := LibreOfficeConverter{Path: soffice}.ConvertToPDF([]byte("merged"))
+	if err != nil {
+		t.Fatalf("ConvertToPDF failed: %v", err)
+	}
+	if string(pdf) != "merged" {
+		t.Errorf("Expected the converted output, got %q", pdf)
+	}
+
+	if _, err := (LibreOfficeConverter{Path: filepath.Join(t.TempDir(), "missing")}).ConvertToPDF([]byte("merged")); err == nil {
+		t.Error("Expected an error without soffice")
+	}
+}
+
+func TestPerformMergeStrict(t *testing.T) {
+	doc := createSampleDocx(testutil.DocumentXML(`<w:p><w:r><w:t>«firstname»</w:t></w:r><w:r><w:t xml:space="preserve"> </w:t></w:r><w:r><w:t>«lastname»</w:t></w:r></w:p><w:p><w:r><w:t>«age»</w:t></w:r></w:p><w:p><w:r><w:t>«department»</w:t></w:r></w:p>`))
+
+	// A fully filled document merges as in the lenient mode
+	mergedDoc, err := PerformMergeStrict(doc, fields.MergeData{
+		"firstname":  "Bob",
+		"lastname":   "Smith",
+		"age":        "42",
+		"department": "Sales",
+	})
+	if err != nil {
+		t.Fatalf("PerformMergeStrict failed: %v", err)
+	}
+	mergedDocx, err := docx.UnzipDocx(mergedDoc)
+	if err != nil {
+		t.Fatalf("Failed to unzip merged document: %v", err)
+	}
+	mergedXML, err := mergedDocx.GetDocumentXML()
+	if err != nil {
+		t.Fatalf("Failed to get merged document XML: %v", err)
+	}
+	if !strings.Contains(string(mergedXML), "Sales") || strings.Contains(string(mergedXML), "«") {
+		t.Errorf("Expected every field to be merged, got %s", mergedXML)
+	}
+
+	// A partially filled one fails, listing the fields without data
+	mergedDoc, err = PerformMergeStrict(doc, fields.MergeData{"firstname": "Bob", "lastname": "Smith"})
+	if mergedDoc != nil {
+		t.Error("Expected no document from a failed strict merge")
+	}
+	var unfilled *UnfilledFieldsError
+	if !errors.As(err, &unfilled) {
+		t.Fatalf("Expected an UnfilledFieldsError, got %v", err)
+	}
+	if want := []string{"age", "department"}; !reflect.DeepEqual(unfilled.Fields, want) {
+		t.Errorf("Fields = %v, want %v", unfilled.Fields, want)
+	}
+	if !errors.Is(err, ErrUnfilledFields) {
+		t.Error("Expected the error to match ErrUnfilledFields")
+	}
+
+	// The default stays lenient
+	if _, skipped, err := PerformMerge(doc, fields.MergeData{"firstname": "Bob"}); err != nil || len(skipped) != 3 {
+		t.Errorf("PerformMerge = %v, %v; want 3 skipped fields and no error", skipped, err)
+	}
+}
+
 // TestPerformMergeInvalidDocxStructure tests the scenario with invalid DOCX structure
 func TestPerformMergeInvalidDocxStructure(t *testing.T) {
 	tests := []struct {
@@ -668,3 +1238,2122 @@ func TestPerformMergeWithSpecialCharacters(t *testing.T) {
 		t.Error("Merged document should not contain unescaped quotes")
 	}
 }
+
+func TestPerformMergeFieldOutcomes(t *testing.T) {
+	documentXML := `<w:document><w:body>` +
+		`<w:p><w:r><w:t>«name»</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>«city»</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>«phone»</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>«name»</w:t></w:r></w:p>` +
+		`</w:body></w:document>`
+	fieldSet := &fields.MergeFieldSet{
+		Fields: []fields.MergeField{
+			{Name: "name", Type: fields.FieldTypeString},
+			{Name: "city", Type: fields.FieldTypeString, DefaultValue: "Springfield"},
+			{Name: "phone", Type: fields.FieldTypeString},
+		},
+	}
+
+	result, err := PerformMergeWithOptions(createSampleDocx(documentXML), fields.MergeData{"name": "Alice"}, Options{FieldSet: fieldSet})
+	if err != nil {
+		t.Fatalf("PerformMergeWithOptions failed: %v", err)
+	}
+
+	expected := []FieldOutcome{
+		{Name: "name", Status: FieldStatusResolved, Value: "Alice"},
+		{Name: "city", Status: FieldStatusDefault, Value: "Springfield", Reason: "no data provided, default value used"},
+		{Name: "phone", Status: FieldStatusSkipped, Reason: "no data available"},
+	}
+	if !reflect.DeepEqual(result.Outcomes, expected) {
+		t.Errorf("Outcomes = %+v, want %+v", result.Outcomes, expected)
+	}
+	if !reflect.DeepEqual(result.Defaulted, []string{"city"}) {
+		t.Errorf("Defaulted = %v, want [city]", result.Defaulted)
+	}
+
+	mergedDocx, err := docx.UnzipDocx(result.Document)
+	if err != nil {
+		t.Fatalf("Failed to unzip merged document: %v", err)
+	}
+	if !strings.Contains(string(mergedDocx.Files["word/document.xml"]), "<w:t>Springfield</w:t>") {
+		t.Errorf("Default value was not merged: %s", mergedDocx.Files["word/document.xml"])
+	}
+
+	// Without a field set there are no defaults to fall back to
+	result, err = PerformMergeWithOptions(createSampleDocx(documentXML), fields.MergeData{"name": "Alice"}, Options{})
+	if err != nil {
+		t.Fatalf("PerformMergeWithOptions failed: %v", err)
+	}
+	if !reflect.DeepEqual(result.Skipped, []string{"city", "phone"}) {
+		t.Errorf("Skipped = %v, want [city phone]", result.Skipped)
+	}
+}
+
+func TestPerformMergeDefaultValues(t *testing.T) {
+	documentXML := `<w:document><w:body>` +
+		`<w:p><w:r><w:t>«name»</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>«city»</w:t></w:r></w:p>` +
+		`<w:p><w:fldSimple w:instr=" MERGEFIELD quantity "><w:r><w:t>«quantity»</w:t></w:r></w:fldSimple></w:p>` +
+		`<w:p><w:r><w:t>«note»</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>«phone»</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>«email»</w:t></w:r></w:p>` +
+		`</w:body></w:document>`
+	fieldSet := &fields.MergeFieldSet{
+		Fields: []fields.MergeField{
+			{Name: "name", Type: fields.FieldTypeString, DefaultValue: "Customer"},
+			{Name: "city", Type: fields.FieldTypeString, DefaultValue: "Springfield"},
+			{Name: "quantity", Type: fields.FieldTypeNumber, DefaultValue: float64(1)},
+			// An empty default is still a default
+			{Name: "note", Type: fields.FieldTypeString, DefaultValue: ""},
+			{Name: "phone", Type: fields.FieldTypeString},
+			{Name: "email", Type: fields.FieldTypeString},
+		},
+	}
+
+	// Data wins over the default; fields with neither are skipped
+	result, err := PerformMergeWithOptions(createSampleDocx(documentXML), fields.MergeData{"name": "Alice", "email": "alice@example.com"}, Options{FieldSet: fieldSet})
+	if err != nil {
+		t.Fatalf("PerformMergeWithOptions failed: %v", err)
+	}
+	// Field results are merged before the plain placeholders
+	if expected := []string{"quantity", "city", "note"}; !reflect.DeepEqual(result.Defaulted, expected) {
+		t.Errorf("Defaulted = %v, want %v", result.Defaulted, expected)
+	}
+	if expected := []string{"phone"}; !reflect.DeepEqual(result.Skipped, expected) {
+		t.Errorf("Skipped = %v, want %v", result.Skipped, expected)
+	}
+
+	mergedDocx, err := docx.UnzipDocx(result.Document)
+	if err != nil {
+		t.Fatalf("Failed to unzip merged document: %v", err)
+	}
+	merged := string(mergedDocx.Files["word/document.xml"])
+	for _, expected := range []string{"<w:t>Alice</w:t>", "<w:t>Springfield</w:t>", "<w:t>1</w:t>", "<w:p><w:r><w:t></w:t></w:r></w:p>", "<w:t>«phone»</w:t>", "<w:t>alice@example.com</w:t>"} {
+		if !strings.Contains(merged, expected) {
+			t.Errorf("Expected %s in merged document: %s", expected, merged)
+		}
+	}
+	if strings.Contains(merged, "Customer") {
+		t.Errorf("Default value used although data was provided: %s", merged)
+	}
+}
+
+func TestReplaceFieldValuesRequiredMarker(t *testing.T) {
+	documentXML := `<w:p><w:r><w:t>«Email*»</w:t></w:r></w:p>` +
+		`<w:p><w:fldSimple w:instr=" MERGEFIELD Phone* \req "><w:r><w:t>«Phone*»</w:t></w:r></w:fldSimple></w:p>` +
+		`<w:p><w:r><w:t>«Code*»</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>«Fax!»</w:t></w:r></w:p>`
+	data := fields.MergeData{"Email": "jane@example.com", "Phone": "555-0100", "Code*": "literal", "Code": "stripped", "Fax": "555-0199"}
+
+	replacer := newFieldReplacer(data, Options{})
+	result := replacer.replaceAll(documentXML)
+	for _, expected := range []string{"<w:t>jane@example.com</w:t>", "<w:t>555-0100</w:t>", "<w:t>literal</w:t>", "<w:t>«Fax!»</w:t>"} {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected %s in merged XML: %s", expected, result)
+		}
+	}
+	if !reflect.DeepEqual(replacer.skipped, []string{"Fax!"}) {
+		t.Errorf("Skipped = %v, want [Fax!]", replacer.skipped)
+	}
+
+	// Another marker is dropped instead
+	result = newFieldReplacer(data, Options{RequiredMarker: "!"}).replaceAll(documentXML)
+	if !strings.Contains(result, "<w:t>555-0199</w:t>") || !strings.Contains(result, "<w:t>«Email*»</w:t>") {
+		t.Errorf("Expected only «Fax!» to lose its marker: %s", result)
+	}
+}
+
+func TestReplaceFieldValuesCollapsesWhitespace(t *testing.T) {
+	documentXML := `<w:p><w:r><w:t>«First  Name»</w:t></w:r></w:p>` +
+		`<w:p><w:fldSimple w:instr=" MERGEFIELD &quot;First Name&quot; "><w:r><w:t>«First Name»</w:t></w:r></w:fldSimple></w:p>` +
+		`<w:p><w:r><w:t>«Last` + "\t" + ` Name»</w:t></w:r></w:p>`
+	data := fields.MergeData{"First Name": "Jane", "last   name": "Doe"}
+
+	replacer := newFieldReplacer(data, Options{})
+	result := replacer.replaceAll(documentXML)
+	if strings.Count(result, "<w:t>Jane</w:t>") != 2 || !strings.Contains(result, "<w:t>Doe</w:t>") {
+		t.Errorf("Expected the double-spaced placeholders to merge: %s", result)
+	}
+	if len(replacer.skipped) != 0 {
+		t.Errorf("Expected no skipped fields, got %v", replacer.skipped)
+	}
+	if !reflect.DeepEqual(replacer.resolved, []string{"First Name", "Last Name"}) {
+		t.Errorf("Resolved = %v, want [First Name Last Name]", replacer.resolved)
+	}
+}
+
+func TestReplaceFieldValuesPlaceholderSyntax(t *testing.T) {
+	documentXML := `<w:p><w:r><w:t>«FirstName»</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>{{LastName}}</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t><![CDATA[{{ City }}]]></w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>{{Missing}}</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>Dear {{LastName}}</w:t></w:r></w:p>`
+	data := fields.MergeData{"FirstName": "Jane", "LastName": "Doe & Co", "City": "Springfield"}
+
+	tests := []struct {
+		name       string
+		delimiters []fields.Delimiters
+		expected   []string
+		skipped    []string
+	}{
+		{
+			name:     "chevrons by default",
+			expected: []string{"<w:t>Jane</w:t>", "<w:t>{{LastName}}</w:t>", "<w:t><![CDATA[{{ City }}]]></w:t>"},
+		},
+		{
+			name:       "braces",
+			delimiters: []fields.Delimiters{fields.BraceDelimiters},
+			expected:   []string{"<w:t>«FirstName»</w:t>", "<w:t>Doe &amp; Co</w:t>", "<w:t><![CDATA[Springfield]]></w:t>"},
+			skipped:    []string{"Missing"},
+		},
+		{
+			name:       "both",
+			delimiters: []fields.Delimiters{fields.ChevronDelimiters, fields.BraceDelimiters},
+			expected:   []string{"<w:t>Jane</w:t>", "<w:t>Doe &amp; Co</w:t>", "<w:t><![CDATA[Springfield]]></w:t>"},
+			skipped:    []string{"Missing"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replacer := newFieldReplacer(data, Options{Delimiters: tt.delimiters})
+			result := replacer.replaceAll(documentXML)
+			for _, expected := range tt.expected {
+				if !strings.Contains(result, expected) {
+					t.Errorf("Expected %s in merged XML: %s", expected, result)
+				}
+			}
+			// Only text that is a whole placeholder is replaced
+			if !strings.Contains(result, "<w:t>Dear {{LastName}}</w:t>") || !strings.Contains(result, "<w:t>{{Missing}}</w:t>") {
+				t.Errorf("Expected partial and unknown placeholders to be kept: %s", result)
+			}
+			if !reflect.DeepEqual(replacer.skipped, tt.skipped) {
+				t.Errorf("Skipped = %v, want %v", replacer.skipped, tt.skipped)
+			}
+		})
+	}
+	// The pattern of each syntax is compiled once and reused by every merge
+	if placeholderRegex(fields.BraceDelimiters) != placeholderRegex(fields.Delimiters{Open: "{{", Close: "}}"}) {
+		t.Error("Expected the brace placeholder regex to be cached")
+	}
+}
+
+func TestReplaceFieldValuesTabs(t *testing.T) {
+	tests := []struct {
+		name        string
+		documentXML string
+	}{
+		{name: "placeholder", documentXML: `<w:p><w:r><w:t>«Label»</w:t></w:r></w:p>`},
+		{name: "simple field", documentXML: `<w:p><w:fldSimple w:instr=" MERGEFIELD Label "><w:r><w:t>«Label»</w:t></w:r></w:fldSimple></w:p>`},
+		{
+			name: "complex field",
+			documentXML: `<w:p><w:r><w:fldChar w:fldCharType="begin"/></w:r><w:r><w:instrText> MERGEFIELD Label </w:instrText></w:r>` +
+				`<w:r><w:fldChar w:fldCharType="separate"/></w:r><w:r><w:t>«Label»</w:t></w:r><w:r><w:fldChar w:fldCharType="end"/></w:r></w:p>`,
+		},
+	}
+	data := fields.MergeData{"Label": "Name:\tValue"}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, _, err := replaceFieldValues(tt.documentXML, data)
+			if err != nil {
+				t.Fatalf("replaceFieldValues failed: %v", err)
+			}
+			if !strings.Contains(result, `<w:t>Name:</w:t><w:tab/><w:t xml:space="preserve">Value</w:t>`) {
+				t.Errorf("Expected the tab to become <w:tab/> within the run: %s", result)
+			}
+			if strings.Contains(result, "\t") {
+				t.Errorf("Expected no literal tab in the merged XML: %s", result)
+			}
+		})
+	}
+}
+
+func TestReplaceFieldValuesStripUnresolved(t *testing.T) {
+	tests := []struct {
+		name        string
+		documentXML string
+	}{
+		{
+			name: "placeholder",
+			documentXML: `<w:p><w:r><w:t xml:space="preserve">Use code </w:t></w:r><w:r><w:t>«OptionalPromo»</w:t></w:r>` +
+				`<w:r><w:t xml:space="preserve"> at checkout, </w:t></w:r><w:r><w:t>«FirstName»</w:t></w:r></w:p>`,
+		},
+		{
+			name: "simple field",
+			documentXML: `<w:p><w:r><w:t xml:space="preserve">Use code </w:t></w:r><w:fldSimple w:instr=" MERGEFIELD OptionalPromo "><w:r><w:t>«OptionalPromo»</w:t></w:r></w:fldSimple>` +
+				`<w:r><w:t xml:space="preserve"> at checkout, </w:t></w:r><w:r><w:t>«FirstName»</w:t></w:r></w:p>`,
+		},
+		{
+			name: "complex field",
+			documentXML: `<w:p><w:r><w:t xml:space="preserve">Use code </w:t></w:r><w:r><w:fldChar w:fldCharType="begin"/></w:r><w:r><w:instrText> MERGEFIELD OptionalPromo </w:instrText></w:r>` +
+				`<w:r><w:fldChar w:fldCharType="separate"/></w:r><w:r><w:t>«OptionalPromo»</w:t></w:r><w:r><w:fldChar w:fldCharType="end"/></w:r>` +
+				`<w:r><w:t xml:space="preserve"> at checkout, </w:t></w:r><w:r><w:t>«FirstName»</w:t></w:r></w:p>`,
+		},
+	}
+	data := fields.MergeData{"FirstName": "Jane"}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replacer := newFieldReplacer(data, Options{StripUnresolved: true})
+			result := replacer.replaceAll(tt.documentXML)
+			if strings.Contains(result, "OptionalPromo»") {
+				t.Errorf("Expected the unresolved placeholder to be removed: %s", result)
+			}
+			if !strings.Contains(result, "Use code </w:t>") || !strings.Contains(result, " at checkout, </w:t>") {
+				t.Errorf("Expected the surrounding text to remain: %s", result)
+			}
+			if !strings.Contains(result, "<w:t>Jane</w:t>") {
+				t.Errorf("Expected the resolved field to be merged: %s", result)
+			}
+			if !reflect.DeepEqual(replacer.skipped, []string{"OptionalPromo"}) {
+				t.Errorf("Expected skipped fields [OptionalPromo], got %v", replacer.skipped)
+			}
+		})
+	}
+
+	// Without the option the placeholder is kept
+	result, skipped, err := replaceFieldValues(tests[0].documentXML, data)
+	if err != nil {
+		t.Fatalf("replaceFieldValues failed: %v", err)
+	}
+	if !strings.Contains(result, "<w:t>«OptionalPromo»</w:t>") || len(skipped) != 1 {
+		t.Errorf("Expected the placeholder to be kept and skipped, got %v: %s", skipped, result)
+	}
+}
+
+func TestPerformMergeAltChunks(t *testing.T) {
+	documentXML := `<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><w:body>` +
+		`<w:p><w:r><w:t>«name»</w:t></w:r></w:p>` +
+		`<w:altChunk r:id="rId10"/>` +
+		`<w:altChunk r:id="rId11"/>` +
+		`<w:altChunk r:id="rId12"/>` +
+		`</w:body></w:document>`
+	embeddedDocx := createSampleDocxBytes(`<w:document><w:body><w:p><w:r><w:t>Dear </w:t></w:r><w:r><w:t>«name»</w:t></w:r></w:p><w:p><w:r><w:t>«city»</w:t></w:r></w:p></w:body></w:document>`)
+	chunkXML := `<w:document><w:body><w:p><w:fldSimple w:instr=" MERGEFIELD city "><w:r><w:t>«city»</w:t></w:r></w:fldSimple></w:p></w:body></w:document>`
+	chunkHTML := `<html><body><p>«name»</p></body></html>`
+
+	doc := createSampleDocx(documentXML)
+	doc.Files["word/_rels/document.xml.rels"] = []byte(`<?xml version="1.0"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId10" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/aFChunk" Target="afchunk.docx"/>` +
+		`<Relationship Id="rId11" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/aFChunk" Target="/word/chunk.xml"/>` +
+		`<Relationship Id="rId12" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/aFChunk" Target="chunk.html"/>` +
+		`</Relationships>`)
+	doc.Files["word/afchunk.docx"] = embeddedDocx
+	doc.Files["word/chunk.xml"] = []byte(chunkXML)
+	doc.Files["word/chunk.html"] = []byte(chunkHTML)
+
+	result, err := PerformMergeWithOptions(doc, fields.MergeData{"name": "Alice", "city": "Springfield"}, Options{})
+	if err != nil {
+		t.Fatalf("PerformMergeWithOptions failed: %v", err)
+	}
+
+	mergedDocx, err := docx.UnzipDocx(result.Document)
+	if err != nil {
+		t.Fatalf("Failed to unzip merged document: %v", err)
+	}
+
+	// Embedded .docx package
+	embedded, err := docx.UnzipDocx(mergedDocx.Files["word/afchunk.docx"])
+	if err != nil {
+		t.Fatalf("Failed to unzip merged alt chunk: %v", err)
+	}
+	embeddedXML := string(embedded.Files["word/document.xml"])
+	if !strings.Contains(embeddedXML, "<w:t>Alice</w:t>") || !strings.Contains(embeddedXML, "<w:t>Springfield</w:t>") {
+		t.Errorf("Embedded document placeholders were not merged: %s", embeddedXML)
+	}
+
+	// Embedded WordprocessingML part
+	if merged := string(mergedDocx.Files["word/chunk.xml"]); !strings.Contains(merged, "<w:t>Springfield</w:t>") {
+		t.Errorf("Alt chunk XML part was not merged: %s", merged)
+	}
+
+	// Non-OOXML chunks are left untouched
+	if merged := string(mergedDocx.Files["word/chunk.html"]); merged != chunkHTML {
+		t.Errorf("HTML alt chunk should not be modified, got: %s", merged)
+	}
+
+	if result.ReplacedCounts["city"] != 2 {
+		t.Errorf("Expected city to be replaced 2 times across chunks, got %d", result.ReplacedCounts["city"])
+	}
+	if len(result.Skipped) != 0 {
+		t.Errorf("Expected no skipped fields, got %v", result.Skipped)
+	}
+}
+
+func TestPerformMergeNormalizeLineEndings(t *testing.T) {
+	documentXML := "<?xml version=\"1.0\"?>\r\n<w:document>\r\n<w:body>\r\n<w:p><w:r><w:t>«name»</w:t></w:r></w:p>\r<w:p/>\n</w:body>\r\n</w:document>"
+
+	mergedXML := func(opts Options) string {
+		result, err := PerformMergeWithOptions(createSampleDocx(documentXML), fields.MergeData{"name": "Alice"}, opts)
+		if err != nil {
+			t.Fatalf("PerformMergeWithOptions failed: %v", err)
+		}
+		mergedDocx, err := docx.UnzipDocx(result.Document)
+		if err != nil {
+			t.Fatalf("Failed to unzip merged document: %v", err)
+		}
+		return string(mergedDocx.Files["word/document.xml"])
+	}
+
+	if merged := mergedXML(Options{}); !strings.Contains(merged, "\r\n") {
+		t.Error("Line endings should be kept when option is off")
+	}
+
+	merged := mergedXML(Options{NormalizeLineEndings: true})
+	if strings.Contains(merged, "\r") {
+		t.Errorf("Expected only LF line endings, got: %q", merged)
+	}
+	expected := "<?xml version=\"1.0\"?>\n<w:document>\n<w:body>\n<w:p><w:r><w:t>Alice</w:t></w:r></w:p>\n<w:p/>\n</w:body>\n</w:document>"
+	if merged != expected {
+		t.Errorf("Unexpected normalized XML:\n got: %q\nwant: %q", merged, expected)
+	}
+}
+
+func TestPerformMergeKeepsArchiveLayout(t *testing.T) {
+	template := testutil.StoredDocx(t, testutil.DocumentXML(`<w:p><w:r><w:t>«Name»</w:t></w:r></w:p>`))
+	doc, err := docx.UnzipDocx(template)
+	if err != nil {
+		t.Fatalf("Failed to unzip template: %v", err)
+	}
+
+	result, err := PerformMergeWithOptions(doc, fields.MergeData{"Name": "Alice"}, Options{})
+	if err != nil {
+		t.Fatalf("PerformMergeWithOptions failed: %v", err)
+	}
+	reader, err := zip.NewReader(bytes.NewReader(result.Document), int64(len(result.Document)))
+	if err != nil {
+		t.Fatalf("Failed to read merged archive: %v", err)
+	}
+
+	// The template's parts come first, in their order and still stored;
+	// parts added by the merge follow
+	if len(reader.File) < len(doc.Order) {
+		t.Fatalf("Merged archive has %d entries, want at least %d", len(reader.File), len(doc.Order))
+	}
+	for i, name := range doc.Order {
+		file := reader.File[i]
+		if file.Name != name || file.Method != zip.Store {
+			t.Errorf("Entry %d = %s (method %d), want %s stored", i, file.Name, file.Method, name)
+		}
+	}
+}
+
+func TestPerformMergePreserveBOM(t *testing.T) {
+	documentXML := "\ufeff<?xml version=\"1.0\"?><w:document><w:body><w:p><w:r><w:t>«name»</w:t></w:r></w:p></w:body></w:document>"
+	expected := "<?xml version=\"1.0\"?><w:document><w:body><w:p><w:r><w:t>Alice</w:t></w:r></w:p></w:body></w:document>"
+
+	mergedXML := func(documentXML string, opts Options) string {
+		result, err := PerformMergeWithOptions(createSampleDocx(documentXML), fields.MergeData{"name": "Alice"}, opts)
+		if err != nil {
+			t.Fatalf("PerformMergeWithOptions failed: %v", err)
+		}
+		mergedDocx, err := docx.UnzipDocx(result.Document)
+		if err != nil {
+			t.Fatalf("Failed to unzip merged document: %v", err)
+		}
+		return string(mergedDocx.Files["word/document.xml"])
+	}
+
+	if merged := mergedXML(documentXML, Options{}); merged != expected {
+		t.Errorf("Expected the BOM to be stripped by default:\n got: %q\nwant: %q", merged, expected)
+	}
+	if merged := mergedXML(documentXML, Options{PreserveBOM: true}); merged != "\ufeff"+expected {
+		t.Errorf("Expected the BOM to be preserved:\n got: %q\nwant: %q", merged, "\ufeff"+expected)
+	}
+
+	// Without a BOM in the template, none is added
+	if merged := mergedXML(strings.TrimPrefix(documentXML, "\ufeff"), Options{PreserveBOM: true}); merged != expected {
+		t.Errorf("Expected no BOM to be added:\n got: %q\nwant: %q", merged, expected)
+	}
+}
+
+func TestReplaceFieldValuesWithFallbackChain(t *testing.T) {
+	xml := `<w:document><w:body>` +
+		`<w:p><w:r><w:t>«PreferredName|FirstName»</w:t></w:r></w:p>` +
+		`<w:p><w:fldSimple w:instr=" MERGEFIELD Nickname|Title|Salutation "><w:r><w:t>«Nickname|Title|Salutation»</w:t></w:r></w:fldSimple></w:p>` +
+		`<w:p><w:r><w:t>«Fax|Phone»</w:t></w:r></w:p>` +
+		`</w:body></w:document>`
+
+	t.Run("first missing, second fills", func(t *testing.T) {
+		data := fields.MergeData{"firstname": "Alice", "Salutation": "Ms.", "PreferredName_unused": "x"}
+
+		result, skipped, err := replaceFieldValues(xml, data)
+		if err != nil {
+			t.Fatalf("replaceFieldValues failed: %v", err)
+		}
+		if !strings.Contains(result, "<w:t>Alice</w:t>") {
+			t.Errorf("Expected FirstName fallback to fill the placeholder: %s", result)
+		}
+		if !strings.Contains(result, "<w:t>Ms.</w:t>") {
+			t.Errorf("Expected Salutation fallback to fill the field: %s", result)
+		}
+		if !reflect.DeepEqual(skipped, []string{"Fax|Phone"}) {
+			t.Errorf("Expected only the unresolved chain to be skipped, got %v", skipped)
+		}
+	})
+
+	t.Run("first present wins", func(t *testing.T) {
+		data := fields.MergeData{"PreferredName": "Ali", "FirstName": "Alice"}
+
+		result, _, err := replaceFieldValues(xml, data)
+		if err != nil {
+			t.Fatalf("replaceFieldValues failed: %v", err)
+		}
+		if !strings.Contains(result, "<w:t>Ali</w:t>") || strings.Contains(result, "<w:t>Alice</w:t>") {
+			t.Errorf("Expected PreferredName to take precedence: %s", result)
+		}
+	})
+
+	t.Run("all missing", func(t *testing.T) {
+		result, skipped, err := replaceFieldValues(xml, fields.MergeData{})
+		if err != nil {
+			t.Fatalf("replaceFieldValues failed: %v", err)
+		}
+		if !strings.Contains(result, "«PreferredName|FirstName»") {
+			t.Errorf("Unresolved placeholder should be left in place: %s", result)
+		}
+		expected := []string{"Nickname|Title|Salutation", "PreferredName|FirstName", "Fax|Phone"}
+		if !reflect.DeepEqual(skipped, expected) {
+			t.Errorf("Expected skipped %v, got %v", expected, skipped)
+		}
+	})
+}
+
+func TestBuildBatchArchive(t *testing.T) {
+	entries := []BatchEntry{
+		{Record: 0, Document: createSampleDocxBytes(`<w:document>Alice</w:document>`), Skipped: []string{"phone"}},
+		{Record: 1, Errors: []string{"Required field 'name' is missing"}},
+		{Record: 2, Document: createSampleDocxBytes(`<w:document>Carol</w:document>`)},
+	}
+
+	archive, manifest, err := BuildBatchArchive(entries)
+	if err != nil {
+		t.Fatalf("BuildBatchArchive failed: %v", err)
+	}
+
+	zipReader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("Failed to open batch archive: %v", err)
+	}
+	var names []string
+	for _, file := range zipReader.File {
+		names = append(names, file.Name)
+	}
+	expectedNames := []string{"record_1.docx", "record_3.docx", ManifestFilename}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("Archive entries = %v, want %v", names, expectedNames)
+	}
+
+	archived, err := docx.UnzipDocx(archive)
+	if err != nil {
+		t.Fatalf("Failed to read batch archive: %v", err)
+	}
+	var archivedManifest BatchManifest
+	if err := json.Unmarshal(archived.Files[ManifestFilename], &archivedManifest); err != nil {
+		t.Fatalf("Failed to parse manifest: %v", err)
+	}
+	if !reflect.DeepEqual(&archivedManifest, manifest) {
+		t.Errorf("Archived manifest %+v differs from returned manifest %+v", archivedManifest, manifest)
+	}
+	if len(manifest.Documents) != 3 {
+		t.Fatalf("Expected 3 manifest documents, got %d", len(manifest.Documents))
+	}
+	if manifest.Documents[0].Filename != "record_1.docx" || !reflect.DeepEqual(manifest.Documents[0].Skipped, []string{"phone"}) {
+		t.Errorf("Unexpected manifest entry for merged record: %+v", manifest.Documents[0])
+	}
+	if manifest.Documents[1].Filename != "" || len(manifest.Documents[1].Errors) != 1 {
+		t.Errorf("Unexpected manifest entry for failed record: %+v", manifest.Documents[1])
+	}
+
+	mergedDocx, err := docx.UnzipDocx(archived.Files["record_3.docx"])
+	if err != nil {
+		t.Fatalf("Failed to read archived document: %v", err)
+	}
+	if string(mergedDocx.Files["word/document.xml"]) != "<w:document>Carol</w:document>" {
+		t.Errorf("Unexpected archived document content: %s", mergedDocx.Files["word/document.xml"])
+	}
+}
+
+func TestBuildBatchArchiveDuplicateFilenames(t *testing.T) {
+	document := createSampleDocxBytes(`<w:document>Smith</w:document>`)
+	entries := []BatchEntry{
+		{Record: 0, Filename: "Smith.docx", Document: document},
+		{Record: 1, Filename: "Jones.docx", Document: document},
+		{Record: 2, Filename: "smith.docx", Document: document},
+		{Record: 3, Filename: "Smith.docx", Errors: []string{"Required field 'name' is missing"}},
+		{Record: 4, Filename: "Smith_1.docx", Document: document},
+		{Record: 5, Document: document},
+	}
+
+	archive, manifest, err := BuildBatchArchive(entries)
+	if err != nil {
+		t.Fatalf("BuildBatchArchive failed: %v", err)
+	}
+	if entries[0].Filename != "Smith.docx" {
+		t.Errorf("BuildBatchArchive should not modify its entries, got %+v", entries[0])
+	}
+
+	zipReader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("Failed to open batch archive: %v", err)
+	}
+	var names []string
+	for _, file := range zipReader.File {
+		names = append(names, file.Name)
+	}
+	// Smith_1.docx is taken by record 4, so the shared name continues at 2
+	expectedNames := []string{"Smith_2.docx", "Jones.docx", "smith_3.docx", "Smith_1.docx", "record_6.docx", ManifestFilename}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("Archive entries = %v, want %v", names, expectedNames)
+	}
+
+	requested := []string{"Smith.docx", "", "smith.docx", "", "", ""}
+	for i, entry := range manifest.Documents {
+		if entry.RequestedFilename != requested[i] {
+			t.Errorf("Record %d: requested filename = %q, want %q", i, entry.RequestedFilename, requested[i])
+		}
+	}
+	if manifest.Documents[3].Filename != "" {
+		t.Errorf("Unmerged record should have no filename, got %+v", manifest.Documents[3])
+	}
+}
+
+func TestBatchFilename(t *testing.T) {
+	data := fields.MergeData{"LastName": "Smith", "City": "Berlin", "Path": "../etc/passwd"}
+	tests := []struct {
+		pattern  string
+		expected string
+	}{
+		{"«LastName».docx", "Smith.docx"},
+		{"«lastname»_«City»", "Smith_Berlin.docx"},
+		{"letter-«Missing».docx", "letter-.docx"},
+		{"«Path».docx", "_etc_passwd.docx"},
+		{"«Missing».docx", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := BatchFilename(tt.pattern, data); got != tt.expected {
+			t.Errorf("BatchFilename(%q) = %q, want %q", tt.pattern, got, tt.expected)
+		}
+	}
+}
+
+func TestPerformMergeMatchPlaceholderCase(t *testing.T) {
+	documentXML := `<w:document><w:body>` +
+		`<w:p><w:r><w:t>«NAME»</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>«Name»</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>«name»</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>«nAME»</w:t></w:r></w:p>` +
+		`</w:body></w:document>`
+	data := fields.MergeData{"name": "mary-jane van DYKE"}
+
+	mergedXML := func(opts Options) string {
+		result, err := PerformMergeWithOptions(createSampleDocx(documentXML), data, opts)
+		if err != nil {
+			t.Fatalf("PerformMergeWithOptions failed: %v", err)
+		}
+		mergedDocx, err := docx.UnzipDocx(result.Document)
+		if err != nil {
+			t.Fatalf("Failed to unzip merged document: %v", err)
+		}
+		return string(mergedDocx.Files["word/document.xml"])
+	}
+
+	merged := mergedXML(Options{MatchPlaceholderCase: true})
+	expected := `<w:document><w:body>` +
+		`<w:p><w:r><w:t>MARY-JANE VAN DYKE</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>Mary-Jane Van Dyke</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>mary-jane van dyke</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>mary-jane van DYKE</w:t></w:r></w:p>` +
+		`</w:body></w:document>`
+	if merged != expected {
+		t.Errorf("Unexpected merge result:\n got: %s\nwant: %s", merged, expected)
+	}
+
+	// Values are injected verbatim by default
+	if merged := mergedXML(Options{}); strings.Count(merged, "<w:t>mary-jane van DYKE</w:t>") != 4 {
+		t.Errorf("Expected verbatim values without the option, got: %s", merged)
+	}
+}
+
+func TestSetMaxConcurrent(t *testing.T) {
+	defer SetMaxConcurrent(0)
+	defer SetLimitMode(LimitBlock)
+
+	// Occupy every slot of a small limit
+	SetMaxConcurrent(2)
+	var releases []func()
+	for i := 0; i < 2; i++ {
+		release, err := acquireMergeSlot()
+		if err != nil {
+			t.Fatalf("Slot %d should be available: %v", i+1, err)
+		}
+		releases = append(releases, release)
+	}
+
+	t.Run("fail mode", func(t *testing.T) {
+		SetLimitMode(LimitFail)
+		_, err := PerformMergeWithOptions(createSampleDocx(`<w:document/>`), fields.MergeData{}, Options{})
+		if !errors.Is(err, ErrTooManyConcurrentMerges) {
+			t.Errorf("Expected ErrTooManyConcurrentMerges past the limit, got %v", err)
+		}
+	})
+
+	t.Run("block mode", func(t *testing.T) {
+		SetLimitMode(LimitBlock)
+		done := make(chan error, 1)
+		go func() {
+			_, err := PerformMergeWithOptions(createSampleDocx(`<w:document/>`), fields.MergeData{}, Options{})
+			done <- err
+		}()
+
+		select {
+		case err := <-done:
+			t.Fatalf("Merge past the limit should block, finished with %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		// Freeing a slot lets the blocked merge run
+		releases[0]()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Blocked merge failed: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Blocked merge did not resume after a slot was released")
+		}
+	})
+
+	releases[1]()
+
+	// Removing the limit never blocks
+	SetMaxConcurrent(0)
+	if _, err := PerformMergeWithOptions(createSampleDocx(`<w:document/>`), fields.MergeData{}, Options{}); err != nil {
+		t.Errorf("Unlimited merge failed: %v", err)
+	}
+}
+
+func TestReplaceFieldValuesCheckboxes(t *testing.T) {
+	checkbox := func(tag, checked, glyph string) string {
+		return `<w:sdt><w:sdtPr><w:tag w:val="` + tag + `"/><w14:checkbox>` +
+			`<w14:checked w14:val="` + checked + `"/>` +
+			`<w14:checkedState w14:val="2612" w14:font="MS Gothic"/>` +
+			`<w14:uncheckedState w14:val="2610" w14:font="MS Gothic"/>` +
+			`</w14:checkbox></w:sdtPr><w:sdtContent><w:r><w:rPr><w:rFonts w:ascii="MS Gothic"/></w:rPr><w:t>` + glyph + `</w:t></w:r></w:sdtContent></w:sdt>`
+	}
+	xml := `<w:document><w:body><w:p>` +
+		checkbox("Subscribed", "0", "☐") +
+		checkbox("Member", "1", "☒") +
+		checkbox("Untouched", "0", "☐") +
+		`<w:r><w:t>«Name»</w:t></w:r></w:p></w:body></w:document>`
+
+	data := fields.MergeData{"Subscribed": true, "member": "false", "Name": "Alice"}
+	result, skipped, err := replaceFieldValues(xml, data)
+	if err != nil {
+		t.Fatalf("replaceFieldValues failed: %v", err)
+	}
+
+	expected := `<w:document><w:body><w:p>` +
+		checkbox("Subscribed", "1", "☒") +
+		checkbox("Member", "0", "☐") +
+		checkbox("Untouched", "0", "☐") +
+		`<w:r><w:t>Alice</w:t></w:r></w:p></w:body></w:document>`
+	if result != expected {
+		t.Errorf("Unexpected checkbox merge result:\n got: %s\nwant: %s", result, expected)
+	}
+	if len(skipped) != 0 {
+		t.Errorf("Expected no skipped fields, got %v", skipped)
+	}
+
+	// A non-boolean value leaves the checkbox unchanged
+	result, _, _ = replaceFieldValues(checkbox("Subscribed", "0", "☐"), fields.MergeData{"Subscribed": "maybe"})
+	if result != checkbox("Subscribed", "0", "☐") {
+		t.Errorf("Non-boolean value should not change the checkbox, got: %s", result)
+	}
+}
+
+func TestReplaceFieldValuesNumbers(t *testing.T) {
+	xml := `<w:p><w:r><w:t>«ID»</w:t></w:r><w:r><w:t>«Amount»</w:t></w:r><w:r><w:t>«Big»</w:t></w:r><w:r><w:t>«Exact»</w:t></w:r></w:p>`
+	data := fields.MergeData{
+		"ID":     float64(1234567890123),
+		"Amount": 12.5,
+		"Big":    1e21,
+		"Exact":  json.Number("12345678901234567"),
+	}
+
+	result, _, err := replaceFieldValues(xml, data)
+	if err != nil {
+		t.Fatalf("replaceFieldValues failed: %v", err)
+	}
+	expected := `<w:p><w:r><w:t>1234567890123</w:t></w:r><w:r><w:t>12.5</w:t></w:r><w:r><w:t>1000000000000000000000</w:t></w:r><w:r><w:t>12345678901234567</w:t></w:r></w:p>`
+	if result != expected {
+		t.Errorf("Unexpected number rendering:\n got: %s\nwant: %s", result, expected)
+	}
+}
+
+func TestPerformMergeFallbackSources(t *testing.T) {
+	t.Setenv("MERGE_DEFAULT_SupportEmail", "help@example.com")
+	t.Setenv("MERGE_DEFAULT_city", "Shelbyville")
+
+	documentXML := `<w:document><w:body>` +
+		`<w:p><w:r><w:t>«name»</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>«city»</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>«SupportEmail»</w:t></w:r></w:p>` +
+		`</w:body></w:document>`
+	fieldSet := &fields.MergeFieldSet{
+		Fields: []fields.MergeField{
+			{Name: "city", Type: fields.FieldTypeString, DefaultValue: "Springfield"},
+		},
+	}
+	opts := Options{FieldSet: fieldSet, FallbackSources: []ValueSource{EnvSource{}}}
+
+	// Request data wins over the environment, and template defaults too
+	result, err := PerformMergeWithOptions(createSampleDocx(documentXML), fields.MergeData{"name": "Alice", "SupportEmail": "alice@example.com"}, opts)
+	if err != nil {
+		t.Fatalf("PerformMergeWithOptions failed: %v", err)
+	}
+	expected := []FieldOutcome{
+		{Name: "name", Status: FieldStatusResolved, Value: "Alice"},
+		{Name: "city", Status: FieldStatusDefault, Value: "Springfield", Reason: "no data provided, default value used"},
+		{Name: "SupportEmail", Status: FieldStatusResolved, Value: "alice@example.com"},
+	}
+	if !reflect.DeepEqual(result.Outcomes, expected) {
+		t.Errorf("Outcomes = %+v, want %+v", result.Outcomes, expected)
+	}
+
+	// The environment fills a field missing from data
+	result, err = PerformMergeWithOptions(createSampleDocx(documentXML), fields.MergeData{"name": "Alice"}, opts)
+	if err != nil {
+		t.Fatalf("PerformMergeWithOptions failed: %v", err)
+	}
+	outcome := result.Outcomes[2]
+	if outcome.Status != FieldStatusDefault || outcome.Value != "help@example.com" || outcome.Reason != "no data provided, value from environment used" {
+		t.Errorf("Unexpected outcome for SupportEmail: %+v", outcome)
+	}
+	if !reflect.DeepEqual(result.Defaulted, []string{"city", "SupportEmail"}) {
+		t.Errorf("Defaulted = %v, want [city SupportEmail]", result.Defaulted)
+	}
+	mergedDocx, err := docx.UnzipDocx(result.Document)
+	if err != nil {
+		t.Fatalf("Failed to unzip merged document: %v", err)
+	}
+	if !strings.Contains(string(mergedDocx.Files["word/document.xml"]), "<w:t>help@example.com</w:t>") {
+		t.Errorf("Environment value was not merged: %s", mergedDocx.Files["word/document.xml"])
+	}
+
+	// A custom prefix reads other variables
+	if _, found := (EnvSource{Prefix: "OTHER_"}).Lookup("SupportEmail", nil); found {
+		t.Error("EnvSource with a custom prefix should not read MERGE_DEFAULT_ variables")
+	}
+}
+
+func TestPerformMergeHighlightMerged(t *testing.T) {
+	documentXML := `<w:document><w:body>` +
+		`<w:p><w:r><w:t>«name»</w:t></w:r><w:r><w:t xml:space="preserve"> lives in </w:t></w:r>` +
+		`<w:r><w:rPr><w:b/><w:highlight w:val="green"/><w:u w:val="single"/></w:rPr><w:t>«city»</w:t></w:r></w:p>` +
+		`<w:p><w:fldSimple w:instr=" MERGEFIELD phone "><w:r><w:rPr><w:i/></w:rPr><w:t>«phone»</w:t></w:r></w:fldSimple></w:p>` +
+		`<w:p><w:r><w:t>«missing»</w:t></w:r></w:p>` +
+		`</w:body></w:document>`
+	data := fields.MergeData{"name": "Alice", "city": "Springfield", "phone": "555-0100"}
+
+	mergedXML := func(opts Options) string {
+		result, err := PerformMergeWithOptions(createSampleDocx(documentXML), data, opts)
+		if err != nil {
+			t.Fatalf("PerformMergeWithOptions failed: %v", err)
+		}
+		mergedDocx, err := docx.UnzipDocx(result.Document)
+		if err != nil {
+			t.Fatalf("Failed to unzip merged document: %v", err)
+		}
+		return string(mergedDocx.Files["word/document.xml"])
+	}
+
+	if merged := mergedXML(Options{}); strings.Contains(merged, `w:val="yellow"`) {
+		t.Errorf("Merged runs should not be highlighted when option is off: %s", merged)
+	}
+
+	expected := `<w:document><w:body>` +
+		`<w:p><w:r><w:rPr><w:highlight w:val="yellow"/></w:rPr><w:t>Alice</w:t></w:r><w:r><w:t xml:space="preserve"> lives in </w:t></w:r>` +
+		`<w:r><w:rPr><w:b/><w:highlight w:val="yellow"/><w:u w:val="single"/></w:rPr><w:t>Springfield</w:t></w:r></w:p>` +
+		`<w:p><w:fldSimple w:instr=" MERGEFIELD phone "><w:r><w:rPr><w:i/><w:highlight w:val="yellow"/></w:rPr><w:t>555-0100</w:t></w:r></w:fldSimple></w:p>` +
+		`<w:p><w:r><w:t>«missing»</w:t></w:r></w:p>` +
+		`</w:body></w:document>`
+	if merged := mergedXML(Options{HighlightMerged: true}); merged != expected {
+		t.Errorf("Unexpected highlighted XML:\n got: %s\nwant: %s", merged, expected)
+	}
+}
+
+func TestPerformMergeRemoveFieldShading(t *testing.T) {
+	shading := `<w:shd w:val="clear" w:color="auto" w:fill="D9D9D9"/>`
+	documentXML := `<w:document><w:body>` +
+		`<w:p><w:r><w:rPr><w:b/>` + shading + `</w:rPr><w:t>«name»</w:t></w:r><w:r><w:rPr>` + shading + `</w:rPr><w:t xml:space="preserve"> shaded text</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:fldChar w:fldCharType="begin"/></w:r><w:r><w:instrText> MERGEFIELD city </w:instrText></w:r><w:r><w:fldChar w:fldCharType="separate"/></w:r>` +
+		`<w:r><w:rPr>` + shading + `</w:rPr><w:t>«city»</w:t></w:r><w:r><w:fldChar w:fldCharType="end"/></w:r></w:p>` +
+		`<w:p><w:r><w:rPr>` + shading + `</w:rPr><w:t>«missing»</w:t></w:r></w:p>` +
+		`</w:body></w:document>`
+	data := fields.MergeData{"name": "Alice", "city": "Springfield"}
+
+	mergedXML := func(opts Options) string {
+		result, err := PerformMergeWithOptions(createSampleDocx(documentXML), data, opts)
+		if err != nil {
+			t.Fatalf("PerformMergeWithOptions failed: %v", err)
+		}
+		mergedDocx, err := docx.UnzipDocx(result.Document)
+		if err != nil {
+			t.Fatalf("Failed to unzip merged document: %v", err)
+		}
+		return string(mergedDocx.Files["word/document.xml"])
+	}
+
+	if merged := mergedXML(Options{}); strings.Count(merged, shading) != 4 {
+		t.Errorf("Shading should be kept when option is off: %s", merged)
+	}
+
+	// Only the runs holding merged values lose their shading
+	expected := `<w:document><w:body>` +
+		`<w:p><w:r><w:rPr><w:b/></w:rPr><w:t>Alice</w:t></w:r><w:r><w:rPr>` + shading + `</w:rPr><w:t xml:space="preserve"> shaded text</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:fldChar w:fldCharType="begin"/></w:r><w:r><w:instrText> MERGEFIELD city </w:instrText></w:r><w:r><w:fldChar w:fldCharType="separate"/></w:r>` +
+		`<w:r><w:t>Springfield</w:t></w:r><w:r><w:fldChar w:fldCharType="end"/></w:r></w:p>` +
+		`<w:p><w:r><w:rPr>` + shading + `</w:rPr><w:t>«missing»</w:t></w:r></w:p>` +
+		`</w:body></w:document>`
+	if merged := mergedXML(Options{RemoveFieldShading: true}); merged != expected {
+		t.Errorf("Unexpected XML without shading:\n got: %s\nwant: %s", merged, expected)
+	}
+
+	// Combined with highlighting, the highlight replaces the shading
+	if merged := mergedXML(Options{RemoveFieldShading: true, HighlightMerged: true}); !strings.Contains(merged, `<w:rPr><w:b/><w:highlight w:val="yellow"/></w:rPr><w:t>Alice</w:t>`) {
+		t.Errorf("Expected a highlight without shading: %s", merged)
+	}
+}
+
+func TestClockSource(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skipf("time zone data unavailable: %v", err)
+	}
+	fixed := func() time.Time { return time.Date(2024, 12, 31, 20, 30, 0, 0, time.UTC) }
+	documentXML := `<w:p><w:r><w:t>«Today»</w:t></w:r><w:r><w:t>«now»</w:t></w:r><w:r><w:t>«Year»</w:t></w:r><w:r><w:t>«Tomorrow»</w:t></w:r></w:p>`
+	clock := ClockSource{Location: tokyo, Now: fixed}
+
+	t.Run("server time in the requested zone", func(t *testing.T) {
+		replacer := newFieldReplacer(fields.MergeData{}, Options{FallbackSources: []ValueSource{clock}})
+		result := replacer.replaceAll(documentXML)
+
+		// 20:30 UTC on New Year's Eve is already 2025 in Tokyo
+		expected := `<w:p><w:r><w:t>2025-01-01</w:t></w:r><w:r><w:t>2025-01-01 05:30</w:t></w:r><w:r><w:t>2025</w:t></w:r><w:r><w:t>«Tomorrow»</w:t></w:r></w:p>`
+		if result != expected {
+			t.Errorf("Unexpected clock fields:\n got: %s\nwant: %s", result, expected)
+		}
+		if !reflect.DeepEqual(replacer.skipped, []string{"Tomorrow"}) {
+			t.Errorf("Skipped = %v, want [Tomorrow]", replacer.skipped)
+		}
+	})
+
+	t.Run("field date format and data override", func(t *testing.T) {
+		fieldSet := &fields.MergeFieldSet{
+			Fields: []fields.MergeField{
+				{Name: "Today", Type: fields.FieldTypeDate, Format: &fields.FieldFormat{DateFormat: "January 2, 2006"}},
+			},
+		}
+		opts := Options{FieldSet: fieldSet, FallbackSources: []ValueSource{clock}}
+		result := newFieldReplacer(fields.MergeData{"Year": "1999"}, opts).replaceAll(documentXML)
+
+		expected := `<w:p><w:r><w:t>January 1, 2025</w:t></w:r><w:r><w:t>2025-01-01 05:30</w:t></w:r><w:r><w:t>1999</w:t></w:r><w:r><w:t>«Tomorrow»</w:t></w:r></w:p>`
+		if result != expected {
+			t.Errorf("Unexpected clock fields:\n got: %s\nwant: %s", result, expected)
+		}
+	})
+}
+
+func TestPerformMergeDrawingText(t *testing.T) {
+	documentXML := `<w:document><w:body><w:p><w:r><w:drawing><wpg:wgp><wps:wsp><wps:txbx>` +
+		`<a:p><a:r><a:t>Dear «Name», welcome to «Company»</a:t></a:r></a:p>` +
+		`</wps:txbx></wps:wsp></wpg:wgp></w:drawing></w:r></w:p></w:body></w:document>`
+	doc := createSampleDocx(documentXML)
+	doc.Files["word/diagrams/data1.xml"] = []byte(`<dgm:dataModel><dgm:ptLst><dgm:pt><dgm:t><a:p><a:r><a:t>«Company»</a:t></a:r></a:p><a:p><a:r><a:t>«Missing»</a:t></a:r></a:p></dgm:t></dgm:pt></dgm:ptLst></dgm:dataModel>`)
+	data := fields.MergeData{"Name": "Alice", "Company": "Smith & Sons <UK>"}
+
+	merge := func(opts Options) (*docx.DocxFile, *Result) {
+		result, err := PerformMergeWithOptions(doc, data, opts)
+		if err != nil {
+			t.Fatalf("PerformMergeWithOptions failed: %v", err)
+		}
+		mergedDocx, err := docx.UnzipDocx(result.Document)
+		if err != nil {
+			t.Fatalf("Failed to unzip merged document: %v", err)
+		}
+		return mergedDocx, result
+	}
+
+	// The pass is opt-in
+	if mergedDocx, _ := merge(Options{}); !strings.Contains(string(mergedDocx.Files["word/document.xml"]), "«Name»") {
+		t.Errorf("DrawingML text should be left alone by default: %s", mergedDocx.Files["word/document.xml"])
+	}
+
+	mergedDocx, result := merge(Options{MergeDrawingText: true})
+	if document := string(mergedDocx.Files["word/document.xml"]); !strings.Contains(document, "<a:t>Dear Alice, welcome to Smith &amp; Sons &lt;UK&gt;</a:t>") {
+		t.Errorf("Placeholders in <a:t> were not merged: %s", document)
+	}
+	if diagram := string(mergedDocx.Files["word/diagrams/data1.xml"]); !strings.Contains(diagram, "<a:t>Smith &amp; Sons &lt;UK&gt;</a:t>") || !strings.Contains(diagram, "<a:t>«Missing»</a:t>") {
+		t.Errorf("SmartArt data part not merged as expected: %s", diagram)
+	}
+	if !reflect.DeepEqual(result.Skipped, []string{"Missing"}) {
+		t.Errorf("Skipped = %v, want [Missing]", result.Skipped)
+	}
+}
+
+func TestReplaceFieldValuesRepeatingSection(t *testing.T) {
+	control := func(tag, text string) string {
+		return `<w:sdt><w:sdtPr><w:id w:val="7"/><w:tag w:val="` + tag + `"/><w:showingPlcHdr/></w:sdtPr>` +
+			`<w:sdtContent><w:r><w:t>` + text + `</w:t></w:r></w:sdtContent></w:sdt>`
+	}
+	item := func(product, quantity string) string {
+		return `<w:sdt><w:sdtPr><w:id w:val="5"/><w15:repeatingSectionItem/></w:sdtPr><w:sdtContent>` +
+			`<w:p w14:paraId="1A2B3C4D">` + control("Product", product) + `<w:r><w:t xml:space="preserve"> x </w:t></w:r>` + control("Quantity", quantity) + `</w:p>` +
+			`</w:sdtContent></w:sdt>`
+	}
+	section := func(items string) string {
+		return `<w:sdt><w:sdtPr><w:id w:val="3"/><w:tag w:val="LineItems"/><w15:repeatingSection/></w:sdtPr><w:sdtContent>` +
+			items + `</w:sdtContent></w:sdt>`
+	}
+	xml := `<w:document><w:body>` + section(item("Product name", "Qty")) +
+		`<w:p><w:r><w:t>«Customer»</w:t></w:r></w:p></w:body></w:document>`
+
+	data := fields.MergeData{
+		"Customer": "ACME",
+		"lineItems": []interface{}{
+			map[string]interface{}{"Product": "Widget", "Quantity": float64(2)},
+			map[string]interface{}{"product": "Gadget & Co", "Quantity": float64(10)},
+			map[string]interface{}{"Product": "Gizmo"},
+		},
+	}
+	replacer := newFieldReplacer(data, Options{})
+	result := replacer.replaceAll(xml)
+
+	clonedControl := func(tag, text string) string {
+		return `<w:sdt><w:sdtPr><w:tag w:val="` + tag + `"/></w:sdtPr>` +
+			`<w:sdtContent><w:r><w:t>` + text + `</w:t></w:r></w:sdtContent></w:sdt>`
+	}
+	clonedItem := func(product, quantity string) string {
+		quantityControl := clonedControl("Quantity", quantity)
+		if quantity == "" {
+			// Controls without a value keep their placeholder
+			quantityControl = `<w:sdt><w:sdtPr><w:tag w:val="Quantity"/><w:showingPlcHdr/></w:sdtPr>` +
+				`<w:sdtContent><w:r><w:t>Qty</w:t></w:r></w:sdtContent></w:sdt>`
+		}
+		return `<w:sdt><w:sdtPr><w15:repeatingSectionItem/></w:sdtPr><w:sdtContent>` +
+			`<w:p>` + clonedControl("Product", product) + `<w:r><w:t xml:space="preserve"> x </w:t></w:r>` + quantityControl + `</w:p>` +
+			`</w:sdtContent></w:sdt>`
+	}
+	expected := `<w:document><w:body>` +
+		section(clonedItem("Widget", "2")+clonedItem("Gadget &amp; Co", "10")+clonedItem("Gizmo", "")) +
+		`<w:p><w:r><w:t>ACME</w:t></w:r></w:p></w:body></w:document>`
+	if result != expected {
+		t.Errorf("Unexpected repeating section result:\n got: %s\nwant: %s", result, expected)
+	}
+
+	if !reflect.DeepEqual(replacer.resolved, []string{"LineItems", "Customer"}) {
+		t.Errorf("Expected LineItems and Customer resolved, got %v", replacer.resolved)
+	}
+	if replacer.outcomes[0].Value != "3 items" {
+		t.Errorf("Expected outcome value '3 items', got %+v", replacer.outcomes[0])
+	}
+
+	// A section without array data keeps its template item
+	result, _, _ = replaceFieldValues(section(item("Product name", "Qty")), fields.MergeData{"LineItems": "none"})
+	if result != section(item("Product name", "Qty")) {
+		t.Errorf("Non-array value should not change the section, got: %s", result)
+	}
+}
+
+func TestVerifyComplete(t *testing.T) {
+	documentXML := `<?xml version="1.0"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+	<w:body>
+		<w:p>
+			<w:fldSimple w:instr=" MERGEFIELD FirstName "><w:r><w:t>«FirstName»</w:t></w:r></w:fldSimple>
+			<w:r><w:fldChar w:fldCharType="begin"/></w:r>
+			<w:r><w:instrText xml:space="preserve"> MERGEFIELD City </w:instrText></w:r>
+			<w:r><w:fldChar w:fldCharType="separate"/></w:r>
+			<w:r><w:t>«City»</w:t></w:r>
+			<w:r><w:fldChar w:fldCharType="end"/></w:r>
+			<w:fldSimple w:instr=" MERGEFIELD Amount "><w:r><w:t>«Amount»</w:t></w:r></w:fldSimple>
+		</w:p>
+	</w:body>
+</w:document>`
+	template := createSampleDocx(documentXML)
+	templateBytes := createSampleDocxBytes(documentXML)
+
+	t.Run("fully merged", func(t *testing.T) {
+		merged, _, err := PerformMerge(template, fields.MergeData{"FirstName": "Alice", "City": "Springfield", "Amount": 42})
+		if err != nil {
+			t.Fatalf("PerformMerge failed: %v", err)
+		}
+		remaining, err := VerifyComplete(templateBytes, merged)
+		if err != nil {
+			t.Fatalf("VerifyComplete failed: %v", err)
+		}
+		if len(remaining) != 0 {
+			t.Errorf("Expected no remaining fields, got %v", remaining)
+		}
+	})
+
+	t.Run("partially merged", func(t *testing.T) {
+		merged, _, err := PerformMerge(template, fields.MergeData{"City": "Springfield"})
+		if err != nil {
+			t.Fatalf("PerformMerge failed: %v", err)
+		}
+		remaining, err := VerifyComplete(templateBytes, merged)
+		if err != nil {
+			t.Fatalf("VerifyComplete failed: %v", err)
+		}
+		if !reflect.DeepEqual(remaining, []string{"Amount", "FirstName"}) {
+			t.Errorf("Expected Amount and FirstName remaining, got %v", remaining)
+		}
+	})
+
+	t.Run("invalid merged document", func(t *testing.T) {
+		if _, err := VerifyComplete(templateBytes, []byte("not a docx")); err == nil {
+			t.Error("Expected error for invalid merged document")
+		}
+	})
+}
+
+func TestReplaceFieldValuesLocale(t *testing.T) {
+	fieldSet := &fields.MergeFieldSet{
+		Fields: []fields.MergeField{
+			{Name: "Amount", Type: fields.FieldTypeNumber},
+			{Name: "EuroAmount", Type: fields.FieldTypeNumber, Format: &fields.FieldFormat{Locale: "de-DE"}},
+			{Name: "DueDate", Type: fields.FieldTypeDate},
+			{Name: "Reference", Type: fields.FieldTypeString},
+		},
+	}
+	documentXML := `<w:p><w:r><w:t>«Amount»</w:t></w:r><w:r><w:t>«EuroAmount»</w:t></w:r><w:r><w:t>«DueDate»</w:t></w:r><w:r><w:t>«Reference»</w:t></w:r></w:p>`
+	data := fields.MergeData{"Amount": 9876543, "EuroAmount": 1234567.5, "DueDate": "2024-03-01", "Reference": "1234.5"}
+
+	t.Run("field locale overrides document locale", func(t *testing.T) {
+		result := newFieldReplacer(data, Options{FieldSet: fieldSet, Locale: "en-US"}).replaceAll(documentXML)
+
+		expected := `<w:p><w:r><w:t>9,876,543</w:t></w:r><w:r><w:t>1.234.567,5</w:t></w:r><w:r><w:t>03/01/2024</w:t></w:r><w:r><w:t>1234.5</w:t></w:r></w:p>`
+		if result != expected {
+			t.Errorf("Unexpected localized values:\n got: %s\nwant: %s", result, expected)
+		}
+	})
+
+	t.Run("field locale without document locale", func(t *testing.T) {
+		result := newFieldReplacer(data, Options{FieldSet: fieldSet}).replaceAll(documentXML)
+
+		expected := `<w:p><w:r><w:t>9876543</w:t></w:r><w:r><w:t>1.234.567,5</w:t></w:r><w:r><w:t>2024-03-01</w:t></w:r><w:r><w:t>1234.5</w:t></w:r></w:p>`
+		if result != expected {
+			t.Errorf("Unexpected localized values:\n got: %s\nwant: %s", result, expected)
+		}
+	})
+
+	t.Run("values that are not plain numbers are kept", func(t *testing.T) {
+		result := newFieldReplacer(fields.MergeData{"Amount": "n/a", "EuroAmount": -1000}, Options{FieldSet: fieldSet, Locale: "en-US"}).replaceAll(documentXML)
+		if !strings.Contains(result, "<w:t>n/a</w:t>") || !strings.Contains(result, "<w:t>-1.000</w:t>") {
+			t.Errorf("Unexpected localized values: %s", result)
+		}
+	})
+}
+
+func TestFormatNumberValue(t *testing.T) {
+	currency := &fields.FieldFormat{NumberFormat: NumberFormatCurrency}
+	percentage := &fields.FieldFormat{NumberFormat: NumberFormatPercentage}
+	usLocale, _ := lookupLocale("en-US")
+	deLocale, _ := lookupLocale("de-DE")
+
+	tests := []struct {
+		name     string
+		format   *fields.FieldFormat
+		value    string
+		locale   localeFormat
+		symbol   string
+		expected string
+	}{
+		{"currency float", currency, "123456.5", usLocale, "", "$123,456.50"},
+		{"currency integer", currency, "42", usLocale, "", "$42.00"},
+		{"currency rounding", currency, "1234.567", usLocale, "", "$1,234.57"},
+		{"currency negative", currency, "-1500", usLocale, "", "-$1,500.00"},
+		{"currency symbol and grouping", currency, "1234567.5", deLocale, "€", "€1.234.567,50"},
+		{"currency not a number", currency, "n/a", usLocale, "", "n/a"},
+		{"currency symbol of the format", &fields.FieldFormat{NumberFormat: NumberFormatCurrency, CurrencySymbol: "£"}, "1234.5", usLocale, "", "£1,234.50"},
+		{"currency symbol of the options", &fields.FieldFormat{NumberFormat: NumberFormatCurrency, CurrencySymbol: "£"}, "1234.5", usLocale, "CHF ", "CHF 1,234.50"},
+		{"percentage float", percentage, "0.25", usLocale, "", "25%"},
+		{"percentage fraction", percentage, "0.125", usLocale, "", "12.5%"},
+		{"percentage integer", percentage, "3", usLocale, "", "300%"},
+		{"percentage no float error", percentage, "0.07", usLocale, "", "7%"},
+		{"percentage grouping", percentage, "12.5", usLocale, "", "1,250%"},
+		{"percentage negative", percentage, "-0.5", deLocale, "", "-50%"},
+		{"unknown format", &fields.FieldFormat{NumberFormat: "scientific"}, "1234", usLocale, "", "1,234"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatNumberValue(tt.format, tt.value, tt.locale, tt.symbol); got != tt.expected {
+				t.Errorf("formatNumberValue(%q) = %q, want %q", tt.value, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestReplaceFieldValuesNumberFormat(t *testing.T) {
+	fieldSet := &fields.MergeFieldSet{
+		Fields: []fields.MergeField{
+			{Name: "Total", Type: fields.FieldTypeNumber, Format: &fields.FieldFormat{NumberFormat: NumberFormatCurrency}},
+			{Name: "Rate", Type: fields.FieldTypeNumber, Format: &fields.FieldFormat{NumberFormat: NumberFormatPercentage}},
+			{Name: "Count", Type: fields.FieldTypeNumber, Format: &fields.FieldFormat{NumberFormat: NumberFormatCurrency}},
+		},
+	}
+	documentXML := `<w:p><w:r><w:t>«Total»</w:t></w:r><w:r><w:t>«Rate»</w:t></w:r><w:r><w:t>«Count»</w:t></w:r></w:p>`
+	data := fields.MergeData{"Total": 123456.5, "Rate": 0.25, "Count": 7}
+
+	t.Run("US conventions by default", func(t *testing.T) {
+		result := newFieldReplacer(data, Options{FieldSet: fieldSet}).replaceAll(documentXML)
+		expected := `<w:p><w:r><w:t>$123,456.50</w:t></w:r><w:r><w:t>25%</w:t></w:r><w:r><w:t>$7.00</w:t></w:r></w:p>`
+		if result != expected {
+			t.Errorf("Unexpected formatted values:\n got: %s\nwant: %s", result, expected)
+		}
+	})
+
+	t.Run("currency symbol and locale", func(t *testing.T) {
+		result := newFieldReplacer(data, Options{FieldSet: fieldSet, Locale: "de-DE", CurrencySymbol: "€"}).replaceAll(documentXML)
+		expected := `<w:p><w:r><w:t>€123.456,50</w:t></w:r><w:r><w:t>25%</w:t></w:r><w:r><w:t>€7,00</w:t></w:r></w:p>`
+		if result != expected {
+			t.Errorf("Unexpected formatted values:\n got: %s\nwant: %s", result, expected)
+		}
+	})
+}
+
+func TestReplaceFieldValuesTextTransform(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   *fields.FieldFormat
+		value    string
+		expected string
+	}{
+		{"uppercase", &fields.FieldFormat{TextTransform: TextTransformUppercase}, "ca", "CA"},
+		{"lowercase", &fields.FieldFormat{TextTransform: TextTransformLowercase}, "Jane.DOE@Example.com", "jane.doe@example.com"},
+		{"title", &fields.FieldFormat{TextTransform: TextTransformTitle}, "new YORK city", "New York City"},
+		{"title with hyphen", &fields.FieldFormat{TextTransform: TextTransformTitle}, "mary-jane watson", "Mary-Jane Watson"},
+		{"nil format", nil, "ca", "ca"},
+		{"no transform", &fields.FieldFormat{}, "ca", "ca"},
+		{"unknown transform", &fields.FieldFormat{TextTransform: "reverse"}, "ca", "ca"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fieldSet := &fields.MergeFieldSet{Fields: []fields.MergeField{{Name: "State", Type: fields.FieldTypeString, Format: tt.format}}}
+			result := newFieldReplacer(fields.MergeData{"State": tt.value}, Options{FieldSet: fieldSet}).replaceAll(`<w:p><w:r><w:t>«State»</w:t></w:r></w:p>`)
+			if expected := `<w:p><w:r><w:t>` + escapeXML(tt.expected) + `</w:t></w:r></w:p>`; result != expected {
+				t.Errorf("Unexpected result:\n got: %s\nwant: %s", result, expected)
+			}
+		})
+	}
+
+	t.Run("escaped after the transform", func(t *testing.T) {
+		fieldSet := &fields.MergeFieldSet{Fields: []fields.MergeField{{Name: "Company", Type: fields.FieldTypeString, Format: &fields.FieldFormat{TextTransform: TextTransformUppercase}}}}
+		result := newFieldReplacer(fields.MergeData{"Company": "Smith & Sons"}, Options{FieldSet: fieldSet}).replaceAll(`<w:p><w:r><w:t>«Company»</w:t></w:r></w:p>`)
+		if !strings.Contains(result, "<w:t>SMITH &amp; SONS</w:t>") {
+			t.Errorf("Expected the uppercased value to be escaped: %s", result)
+		}
+	})
+
+	t.Run("overrides placeholder case", func(t *testing.T) {
+		fieldSet := &fields.MergeFieldSet{Fields: []fields.MergeField{{Name: "state", Type: fields.FieldTypeString, Format: &fields.FieldFormat{TextTransform: TextTransformUppercase}}}}
+		result := newFieldReplacer(fields.MergeData{"state": "ca"}, Options{FieldSet: fieldSet, MatchPlaceholderCase: true}).replaceAll(`<w:p><w:r><w:t>«state»</w:t></w:r></w:p>`)
+		if !strings.Contains(result, "<w:t>CA</w:t>") {
+			t.Errorf("Expected the field transform to win: %s", result)
+		}
+	})
+}
+
+func TestReplaceFieldValuesPrefixSuffix(t *testing.T) {
+	fieldSet := &fields.MergeFieldSet{
+		Fields: []fields.MergeField{
+			{Name: "Name", Type: fields.FieldTypeString, Format: &fields.FieldFormat{Prefix: "Dear ", Suffix: ","}},
+			{Name: "Shout", Type: fields.FieldTypeString, Format: &fields.FieldFormat{TextTransform: TextTransformUppercase, Prefix: "Hi ", Suffix: "!"}},
+			{Name: "Total", Type: fields.FieldTypeNumber, Format: &fields.FieldFormat{NumberFormat: NumberFormatCurrency, Prefix: "Total: ", Suffix: " due"}},
+			{Name: "Company", Type: fields.FieldTypeString, Format: &fields.FieldFormat{Prefix: "<", Suffix: "> & Co"}},
+			{Name: "Title", Type: fields.FieldTypeString, Format: &fields.FieldFormat{Prefix: "(", Suffix: ")"}},
+		},
+	}
+	placeholder := func(name string) string { return `<w:r><w:t>«` + name + `»</w:t></w:r>` }
+	documentXML := `<w:p>` + placeholder("Name") + placeholder("Shout") + placeholder("Total") + placeholder("Company") + placeholder("Title") + `</w:p>`
+
+	t.Run("applied around the formatted value", func(t *testing.T) {
+		data := fields.MergeData{"Name": "Alice", "Shout": "alice", "Total": 1234.5, "Company": "Smith", "Title": "Dr."}
+		replacer := newFieldReplacer(data, Options{FieldSet: fieldSet})
+		result := replacer.replaceAll(documentXML)
+
+		for _, expected := range []string{
+			"<w:t>Dear Alice,</w:t>",
+			"<w:t>Hi ALICE!</w:t>",
+			"<w:t>Total: $1,234.50 due</w:t>",
+			"<w:t>&lt;Smith&gt; &amp; Co</w:t>",
+			"<w:t>(Dr.)</w:t>",
+		} {
+			if !strings.Contains(result, expected) {
+				t.Errorf("Expected %s in result: %s", expected, result)
+			}
+		}
+	})
+
+	t.Run("omitted for skipped and empty fields", func(t *testing.T) {
+		replacer := newFieldReplacer(fields.MergeData{"Shout": "", "Total": 5}, Options{FieldSet: fieldSet})
+		result := replacer.replaceAll(documentXML)
+
+		if !strings.Contains(result, placeholder("Name")) || strings.Contains(result, "Dear") {
+			t.Errorf("Expected the skipped field to keep its placeholder without prefix or suffix: %s", result)
+		}
+		if !strings.Contains(result, "<w:r><w:t></w:t></w:r>") || strings.Contains(result, "Hi ") {
+			t.Errorf("Expected the empty field to merge without prefix or suffix: %s", result)
+		}
+		if expected := []string{"Name", "Company", "Title"}; !reflect.DeepEqual(replacer.skipped, expected) {
+			t.Errorf("Expected skipped %v, got %v", expected, replacer.skipped)
+		}
+	})
+}
+
+func TestReplaceFieldValuesChevronEntities(t *testing.T) {
+	xml := `<w:p><w:r><w:t>&#171;Name&#187;</w:t></w:r><w:r><w:t>&#xAB;City&#xbb;</w:t></w:r><w:r><w:t>&#171;Missing&#187;</w:t></w:r><w:r><w:t>&#169; 2024</w:t></w:r></w:p>`
+	data := fields.MergeData{"Name": "Alice", "City": "Springfield"}
+
+	result, skipped, err := replaceFieldValues(xml, data)
+	if err != nil {
+		t.Fatalf("replaceFieldValues failed: %v", err)
+	}
+
+	expected := `<w:p><w:r><w:t>Alice</w:t></w:r><w:r><w:t>Springfield</w:t></w:r><w:r><w:t>«Missing»</w:t></w:r><w:r><w:t>&#169; 2024</w:t></w:r></w:p>`
+	if result != expected {
+		t.Errorf("Unexpected result:\n got: %s\nwant: %s", result, expected)
+	}
+	if !reflect.DeepEqual(skipped, []string{"Missing"}) {
+		t.Errorf("Skipped = %v, want [Missing]", skipped)
+	}
+}
+
+func TestPerformMergeListItems(t *testing.T) {
+	listItem := func(level, content string) string {
+		return `<w:p><w:pPr><w:pStyle w:val="ListParagraph"/><w:numPr><w:ilvl w:val="` + level + `"/><w:numId w:val="1"/></w:numPr>` +
+			`<w:tabs><w:tab w:val="left" w:pos="720"/></w:tabs><w:rPr><w:b/></w:rPr></w:pPr>` + content + `</w:p>`
+	}
+	documentXML := `<w:document><w:body>` +
+		listItem("0", `<w:r><w:rPr><w:b/></w:rPr><w:t>«Item»</w:t></w:r>`) +
+		listItem("1", `<w:r><w:t xml:space="preserve">Due </w:t></w:r><w:fldSimple w:instr=" MERGEFIELD DueDate "><w:r><w:t>«DueDate»</w:t></w:r></w:fldSimple>`) +
+		listItem("1", `<w:r><w:fldChar w:fldCharType="begin"/></w:r><w:r><w:instrText xml:space="preserve"> MERGEFIELD Owner </w:instrText></w:r>`+
+			`<w:r><w:fldChar w:fldCharType="separate"/></w:r><w:r><w:t>«Owner»</w:t></w:r><w:r><w:fldChar w:fldCharType="end"/></w:r>`) +
+		listItem("0", `<w:r><w:tab/><w:t>«Note»</w:t></w:r>`) +
+		listItem("0", `<w:r><w:t>«Optional»</w:t></w:r>`) +
+		`</w:body></w:document>`
+	data := fields.MergeData{"Item": "Review contract", "DueDate": "2024-03-01", "Owner": "Alice", "Note": "Signed copy", "Optional": ""}
+
+	result, err := PerformMergeWithOptions(createSampleDocx(documentXML), data, Options{RemoveEmptyParagraphs: true, HighlightMerged: true})
+	if err != nil {
+		t.Fatalf("PerformMergeWithOptions failed: %v", err)
+	}
+	if len(result.Skipped) != 0 {
+		t.Errorf("Expected no skipped fields, got %v", result.Skipped)
+	}
+	mergedDocx, err := docx.UnzipDocx(result.Document)
+	if err != nil {
+		t.Fatalf("Failed to unzip merged document: %v", err)
+	}
+	merged := string(mergedDocx.Files["word/document.xml"])
+
+	for _, want := range []string{
+		`<w:r><w:rPr><w:b/><w:highlight w:val="yellow"/></w:rPr><w:t>Review contract</w:t></w:r>`,
+		`<w:t>2024-03-01</w:t>`,
+		`<w:t>Alice</w:t>`,
+		`<w:tab/><w:t>Signed copy</w:t>`,
+	} {
+		if !strings.Contains(merged, want) {
+			t.Errorf("Expected merged list to contain %s, got: %s", want, merged)
+		}
+	}
+
+	// The numbering properties are kept, and the list item emptied by the
+	// merge is removed
+	if count := strings.Count(merged, `<w:numPr>`); count != 4 {
+		t.Errorf("Expected 4 numbered paragraphs, got %d: %s", count, merged)
+	}
+	if strings.Contains(merged, "«") {
+		t.Errorf("Expected every placeholder to be merged, got: %s", merged)
+	}
+}
+
+// fakeSecretsClient serves secrets from a map and counts the fetches
+type fakeSecretsClient struct {
+	secrets map[string]string
+	fetched []string
+}
+
+func (c *fakeSecretsClient) GetSecretValue(secretID string) (string, error) {
+	c.fetched = append(c.fetched, secretID)
+	value, ok := c.secrets[secretID]
+	if !ok {
+		return "", fmt.Errorf("secret %s not found", secretID)
+	}
+	return value, nil
+}
+
+func TestSecretsSource(t *testing.T) {
+	client := &fakeSecretsClient{secrets: map[string]string{"billing/api-key": "sk-Live-123"}}
+	source := SecretsSource{Client: client, AllowedPrefixes: []string{"billing/", "missing"}}
+	opts := Options{MatchPlaceholderCase: true, FallbackSources: []ValueSource{source}}
+	documentXML := `<w:p><w:r><w:t>«secret:billing/api-key»</w:t></w:r><w:r><w:t>«secret:missing»</w:t></w:r><w:r><w:t>«ApiKey»</w:t></w:r></w:p>`
+
+	replacer := newFieldReplacer(fields.MergeData{}, opts)
+	result := replacer.replaceAll(documentXML)
+
+	// The secret keeps its casing despite the lowercase placeholder
+	expected := `<w:p><w:r><w:t>sk-Live-123</w:t></w:r><w:r><w:t>«secret:missing»</w:t></w:r><w:r><w:t>«ApiKey»</w:t></w:r></w:p>`
+	if result != expected {
+		t.Errorf("Unexpected secret fields:\n got: %s\nwant: %s", result, expected)
+	}
+	if !reflect.DeepEqual(client.fetched, []string{"billing/api-key", "missing"}) {
+		t.Errorf("Expected only secret: fields to be fetched, got %v", client.fetched)
+	}
+	if !reflect.DeepEqual(replacer.skipped, []string{"secret:missing", "ApiKey"}) {
+		t.Errorf("Skipped = %v, want [secret:missing ApiKey]", replacer.skipped)
+	}
+
+	// The secret value stays out of the field outcomes
+	for _, outcome := range replacer.outcomes {
+		if strings.Contains(outcome.Value, "sk-Live-123") {
+			t.Errorf("Secret value leaked into outcome %+v", outcome)
+		}
+	}
+	if replacer.outcomes[0].Status != FieldStatusDefault || replacer.outcomes[0].Value != redactedValue {
+		t.Errorf("Expected a redacted default outcome, got %+v", replacer.outcomes[0])
+	}
+
+	// Without a client the source resolves nothing
+	if _, found := (SecretsSource{}).Lookup("secret:billing/api-key", nil); found {
+		t.Error("SecretsSource without a client should not resolve fields")
+	}
+
+	// Secrets outside the allowed prefixes are rejected and never fetched
+	client.secrets["prod/db-password"] = "hunter2"
+	client.fetched = nil
+	if _, found := source.Lookup("secret:prod/db-password", nil); found || len(client.fetched) != 0 {
+		t.Errorf("Expected a secret outside the allowed prefixes not to be fetched, fetched %v", client.fetched)
+	}
+	if _, found := (SecretsSource{Client: client}).Lookup("secret:billing/api-key", nil); found {
+		t.Error("SecretsSource without allowed prefixes should not resolve fields")
+	}
+	errs := source.FieldErrors(`<w:p><w:r><w:t>«secret:prod/db-password» «secret:billing/api-key» «Name»</w:t></w:r></w:p>`)
+	if want := map[string]string{"secret:prod/db-password": "secret ID is not allowed"}; !reflect.DeepEqual(errs, want) {
+		t.Errorf("Expected field errors %v, got %v", want, errs)
+	}
+}
+
+func TestExtensionSecretsClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Aws-Parameters-Secrets-Token") != "session-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/secretsmanager/get" || r.URL.Query().Get("secretId") != "billing/api-key" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"Name": "billing/api-key", "SecretString": "sk-Live-123"}`)
+	}))
+	defer server.Close()
+
+	client := ExtensionSecretsClient{Endpoint: server.URL, Token: "session-token"}
+	value, err := client.GetSecretValue("billing/api-key")
+	if err != nil || value != "sk-Live-123" {
+		t.Errorf("Expected the secret value, got %q, %v", value, err)
+	}
+	if _, err := client.GetSecretValue("other"); err == nil {
+		t.Error("Expected an error for an unknown secret")
+	}
+	if _, err := (ExtensionSecretsClient{Endpoint: server.URL, Token: "wrong"}).GetSecretValue("billing/api-key"); err == nil {
+		t.Error("Expected an error for a rejected token")
+	}
+}
+
+func TestPerformMergeMalformedHeader(t *testing.T) {
+	doc := createSampleDocx(`<?xml version="1.0"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+	<w:body><w:p><w:r><w:t>«Name»</w:t></w:r></w:p></w:body>
+</w:document>`)
+	malformedHeader := `<?xml version="1.0"?>
+<w:hdr xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+	<w:p><w:r><w:t>«Company»</w:t></w:r></w:p>
+	<w:p><w:r><w:t>unclosed</w:r></w:p>
+</w:hdr>`
+	doc.Files["word/header1.xml"] = []byte(malformedHeader)
+	doc.Files["word/footer1.xml"] = []byte(`<?xml version="1.0"?>
+<w:ftr xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+	<w:p><w:r><w:t>«Company»</w:t></w:r></w:p>
+</w:ftr>`)
+
+	result, err := PerformMergeWithOptions(doc, fields.MergeData{"Name": "Jane", "Company": "Acme"}, Options{})
+	if err != nil {
+		t.Fatalf("Expected the merge to succeed despite the malformed header, got %v", err)
+	}
+
+	merged, err := docx.UnzipDocx(result.Document)
+	if err != nil {
+		t.Fatalf("Failed to read merged document: %v", err)
+	}
+	if !strings.Contains(string(merged.Files["word/document.xml"]), "<w:t>Jane</w:t>") {
+		t.Error("Expected the body to be merged")
+	}
+	if !strings.Contains(string(merged.Files["word/footer1.xml"]), "<w:t>Acme</w:t>") {
+		t.Error("Expected the well formed footer to be merged")
+	}
+	if string(merged.Files["word/header1.xml"]) != malformedHeader {
+		t.Errorf("Expected the malformed header to be left intact, got %s", merged.Files["word/header1.xml"])
+	}
+
+	if len(result.PartErrors) != 1 {
+		t.Fatalf("Expected 1 part error, got %+v", result.PartErrors)
+	}
+	partError := result.PartErrors[0]
+	if partError.Part != "word/header1.xml" || !strings.Contains(partError.Error, "malformed XML") {
+		t.Errorf("Unexpected part error %+v", partError)
+	}
+	if len(partError.Fields) != 1 || partError.Fields[0] != "Company" {
+		t.Errorf("Expected the header's fields to be reported, got %v", partError.Fields)
+	}
+}
+
+func TestPerformMergeCompact(t *testing.T) {
+	doc := createSampleDocx(`<?xml version="1.0"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships" xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main">
+	<w:body>
+		<w:p><w:r><w:t>«Name»</w:t></w:r></w:p>
+		<w:p><w:r><w:drawing><a:blip r:embed="rId1"/></w:drawing></w:r></w:p>
+	</w:body>
+</w:document>`)
+	doc.Files["word/_rels/document.xml.rels"] = []byte(`<?xml version="1.0"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+	<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/image" Target="media/image1.png"/>
+	<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/image" Target="media/image2.jpeg"/>
+	<Relationship Id="rId3" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>
+</Relationships>`)
+	doc.Files["word/styles.xml"] = []byte(`<w:styles xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"/>`)
+	doc.Files["word/media/image1.png"] = []byte("png")
+	doc.Files["word/media/image2.jpeg"] = []byte("jpeg")
+	doc.Files["word/media/image3.png"] = []byte("orphan")
+	doc.Files["[Content_Types].xml"] = []byte(`<?xml version="1.0"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+	<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+	<Default Extension="xml" ContentType="application/xml"/>
+	<Default Extension="png" ContentType="image/png"/>
+	<Default Extension="jpeg" ContentType="image/jpeg"/>
+	<Override PartName="/word/document.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml"/>
+	<Override PartName="/word/media/image3.png" ContentType="image/png"/>
+</Types>`)
+
+	t.Run("compact off keeps every part", func(t *testing.T) {
+		result, err := PerformMergeWithOptions(doc, fields.MergeData{"Name": "Jane"}, Options{})
+		if err != nil {
+			t.Fatalf("PerformMergeWithOptions failed: %v", err)
+		}
+		merged, err := docx.UnzipDocx(result.Document)
+		if err != nil {
+			t.Fatalf("Failed to read merged document: %v", err)
+		}
+		if !merged.HasFile("word/media/image2.jpeg") || !merged.HasFile("word/media/image3.png") {
+			t.Error("Media parts should be kept when compact is off")
+		}
+	})
+
+	t.Run("compact removes unreferenced media", func(t *testing.T) {
+		result, err := PerformMergeWithOptions(doc, fields.MergeData{"Name": "Jane"}, Options{Compact: true})
+		if err != nil {
+			t.Fatalf("PerformMergeWithOptions failed: %v", err)
+		}
+		merged, err := docx.UnzipDocx(result.Document)
+		if err != nil {
+			t.Fatalf("Failed to read merged document: %v", err)
+		}
+
+		if !merged.HasFile("word/media/image1.png") || !merged.HasFile("word/styles.xml") {
+			t.Error("Referenced parts should be kept")
+		}
+		for _, name := range []string{"word/media/image2.jpeg", "word/media/image3.png"} {
+			if merged.HasFile(name) {
+				t.Errorf("Unreferenced part %s should be removed", name)
+			}
+		}
+
+		rels := string(merged.Files["word/_rels/document.xml.rels"])
+		if strings.Contains(rels, `Id="rId2"`) || !strings.Contains(rels, `Id="rId1"`) || !strings.Contains(rels, `Id="rId3"`) {
+			t.Errorf("Expected only the unreferenced image relationship to be removed, got %s", rels)
+		}
+
+		contentTypes := string(merged.Files["[Content_Types].xml"])
+		if strings.Contains(contentTypes, "image3.png") || strings.Contains(contentTypes, `Extension="jpeg"`) {
+			t.Errorf("Expected the removed parts' content types to be dropped, got %s", contentTypes)
+		}
+		if !strings.Contains(contentTypes, `Extension="png"`) {
+			t.Error("The png default should be kept for the remaining image")
+		}
+
+		if !merged.IsValidDocx() || merged.CheckWordDocument() != nil {
+			t.Error("Compacted document should still be a valid Word document")
+		}
+		if warnings := merged.ValidateRelationships(); len(warnings) > 0 {
+			t.Errorf("Unexpected relationship warnings: %v", warnings)
+		}
+	})
+}
+
+func TestPerformMergePartialOutput(t *testing.T) {
+	doc := createSampleDocx(`<?xml version="1.0"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+	<w:body><w:p><w:r><w:t>«Name»</w:t></w:r></w:p></w:body>
+</w:document>`)
+	doc.Files["word/footer1.xml"] = []byte(`<w:ftr xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:p/></w:ftr>`)
+
+	result, err := PerformMergeWithOptions(doc, fields.MergeData{"Name": "Jane"}, Options{PartialOutput: true})
+	if err != nil {
+		t.Fatalf("PerformMergeWithOptions failed: %v", err)
+	}
+	if result.Document != nil {
+		t.Error("No archive should be built with PartialOutput")
+	}
+	if len(result.ChangedParts) != 1 || !strings.Contains(string(result.ChangedParts["word/document.xml"]), "<w:t>Jane</w:t>") {
+		t.Errorf("Expected only the merged word/document.xml, got parts %v", result.ChangedParts)
+	}
+	if len(result.AddedParts) != 0 || len(result.RemovedParts) != 0 {
+		t.Errorf("Expected no added or removed parts, got %v and %v", result.AddedParts, result.RemovedParts)
+	}
+
+	// Parts removed by the merge options are listed
+	doc.Files["word/media/image1.png"] = []byte("orphan")
+	result, err = PerformMergeWithOptions(doc, fields.MergeData{"Name": "Jane"}, Options{PartialOutput: true, Compact: true})
+	if err != nil {
+		t.Fatalf("PerformMergeWithOptions failed: %v", err)
+	}
+	if len(result.RemovedParts) != 1 || result.RemovedParts[0] != "word/media/image1.png" {
+		t.Errorf("Expected the compacted image to be listed as removed, got %v", result.RemovedParts)
+	}
+}
+
+func TestFallbackChainWarnings(t *testing.T) {
+	xml := `<w:document><w:body>` +
+		`<w:p><w:r><w:t>«A|A»</w:t></w:r></w:p>` +
+		`<w:p><w:fldSimple w:instr=" MERGEFIELD Name|Nick|name "><w:r><w:t>«Name|Nick|name»</w:t></w:r></w:fldSimple></w:p>` +
+		`<w:p><w:r><w:t>«PreferredName|FirstName»</w:t></w:r></w:p>` +
+		`</w:body></w:document>`
+
+	warnings := FallbackChainWarnings(xml)
+	if len(warnings) != 2 {
+		t.Fatalf("Expected 2 warnings, got %v", warnings)
+	}
+	if !strings.Contains(warnings[0], "«Name|Nick|name»") || !strings.Contains(warnings[1], "«A|A»") {
+		t.Errorf("Expected warnings for the repeating chains, got %v", warnings)
+	}
+
+	// A repeated alternative still resolves once, to its value
+	replacer := newFieldReplacer(fields.MergeData{"A": "Alpha"}, Options{})
+	result := replacer.replaceAll(xml)
+	if strings.Count(result, "<w:t>Alpha</w:t>") != 1 || strings.Contains(result, "«A|A»") {
+		t.Errorf("Expected «A|A» to be replaced once with the value of A: %s", result)
+	}
+	if replacer.replacedCounts["A|A"] != 1 || !reflect.DeepEqual(replacer.resolved, []string{"A|A"}) {
+		t.Errorf("Expected a single resolution of «A|A», got counts %v and resolved %v", replacer.replacedCounts, replacer.resolved)
+	}
+}
+
+func TestReplaceFieldValuesExpressions(t *testing.T) {
+	placeholder := func(text string) string {
+		return `<w:p><w:r><w:t>«` + text + `»</w:t></w:r></w:p>`
+	}
+
+	tests := []struct {
+		name        string
+		placeholder string
+		data        fields.MergeData
+		expected    string
+		skipped     bool
+		errorReason string
+	}{
+		{name: "upper", placeholder: "upper(FirstName)", data: fields.MergeData{"FirstName": "Jane"}, expected: "JANE"},
+		{name: "lower with fallback chain", placeholder: "lower(Nickname|FirstName)", data: fields.MergeData{"FirstName": "Jane"}, expected: "jane"},
+		{name: "default with missing field", placeholder: `default(Nickname,"friend")`, data: fields.MergeData{}, expected: "friend"},
+		{name: "default with empty field", placeholder: `default(Nickname, "friend")`, data: fields.MergeData{"Nickname": ""}, expected: "friend"},
+		{name: "default with present field", placeholder: `default(Nickname,"friend")`, data: fields.MergeData{"Nickname": "JJ"}, expected: "JJ"},
+		{name: "curly quotes", placeholder: `default(Nickname,“my friend”)`, data: fields.MergeData{}, expected: "my friend"},
+		{name: "nested calls", placeholder: `upper(default(Nickname, FirstName))`, data: fields.MergeData{"FirstName": "Jane"}, expected: "JANE"},
+		{name: "date", placeholder: `date(StartDate, "January 2, 2006")`, data: fields.MergeData{"StartDate": "2024-03-01"}, expected: "March 1, 2024"},
+		{name: "missing field is skipped", placeholder: "upper(FirstName)", data: fields.MergeData{}, skipped: true},
+		{name: "unknown function", placeholder: "reverse(FirstName)", data: fields.MergeData{"FirstName": "Jane"}, skipped: true, errorReason: "unknown function 'reverse'"},
+		{name: "misspelt function", placeholder: "uper(FirstName)", data: fields.MergeData{"FirstName": "Jane"}, skipped: true, errorReason: "unknown function 'uper'"},
+		{name: "wrong argument count", placeholder: "upper(FirstName, LastName)", data: fields.MergeData{"FirstName": "Jane"}, skipped: true, errorReason: "upper expects 1 argument(s), got 2"},
+		{name: "unterminated literal", placeholder: `default(Nickname, "friend)`, data: fields.MergeData{}, skipped: true, errorReason: "unterminated string literal"},
+		{name: "invalid date", placeholder: `date(StartDate, "2006")`, data: fields.MergeData{"StartDate": "soon"}, skipped: true, errorReason: "date: cannot parse 'soon' as a date"},
+		{name: "object field", placeholder: "upper(Address)", data: fields.MergeData{"Address": map[string]interface{}{"city": "Springfield"}}, skipped: true, errorReason: "field 'Address' is an object, which cannot be used in expressions"},
+		{name: "array field", placeholder: "lower(Tags)", data: fields.MergeData{"Tags": []interface{}{"a", "b"}}, skipped: true, errorReason: "field 'Tags' is an array, which cannot be used in expressions"},
+		{name: "secret field", placeholder: "upper(secret:api-key)", data: fields.MergeData{}, skipped: true, errorReason: "secret field 'secret:api-key' cannot be used in expressions"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			xml := `<w:document><w:body>` + placeholder(tt.placeholder) + placeholder("FirstName") + `</w:body></w:document>`
+			replacer := newFieldReplacer(tt.data, Options{})
+			result := replacer.replaceAll(xml)
+
+			if tt.expected != "" {
+				if !strings.Contains(result, "<w:t>"+tt.expected+"</w:t>") {
+					t.Errorf("Expected %q in result: %s", tt.expected, result)
+				}
+				return
+			}
+			if !strings.Contains(result, "«"+tt.placeholder+"»") {
+				t.Errorf("Expected the placeholder to be left in place: %s", result)
+			}
+			if tt.skipped != contains(replacer.skipped, tt.placeholder) {
+				t.Errorf("Expected skipped %v, got %v", tt.skipped, replacer.skipped)
+			}
+			if tt.errorReason != "" {
+				outcome := replacer.outcomes[0]
+				if outcome.Status != FieldStatusError || outcome.Reason != tt.errorReason {
+					t.Errorf("Expected error outcome %q, got %+v", tt.errorReason, outcome)
+				}
+			}
+		})
+	}
+
+	// Plain field names keep working next to expressions
+	result, skipped, err := replaceFieldValues(`<w:document><w:body>`+placeholder("upper(FirstName)")+placeholder("FirstName")+`</w:body></w:document>`, fields.MergeData{"FirstName": "Jane"})
+	if err != nil || len(skipped) != 0 {
+		t.Fatalf("replaceFieldValues failed: %v, skipped %v", err, skipped)
+	}
+	if !strings.Contains(result, "<w:t>JANE</w:t>") || !strings.Contains(result, "<w:t>Jane</w:t>") {
+		t.Errorf("Expected both the expression and the plain field to merge: %s", result)
+	}
+
+	// Parenthesised field names are not calls of unknown functions, and a
+	// data key named like a call is merged as a field
+	for _, tt := range []struct {
+		placeholder string
+		data        fields.MergeData
+		expected    string
+	}{
+		{placeholder: "Price (USD)", data: fields.MergeData{"Price (USD)": "12"}, expected: "12"},
+		{placeholder: "upper(FirstName)", data: fields.MergeData{"upper(FirstName)": "as is", "FirstName": "Jane"}, expected: "as is"},
+	} {
+		result, skipped, err := replaceFieldValues(`<w:document><w:body>`+placeholder(tt.placeholder)+`</w:body></w:document>`, tt.data)
+		if err != nil || len(skipped) != 0 {
+			t.Fatalf("replaceFieldValues failed for «%s»: %v, skipped %v", tt.placeholder, err, skipped)
+		}
+		if !strings.Contains(result, "<w:t>"+tt.expected+"</w:t>") {
+			t.Errorf("Expected «%s» to merge %q: %s", tt.placeholder, tt.expected, result)
+		}
+	}
+	// Invalid expressions are skipped, so strict merges and stripUnresolved
+	// see them
+	invalid := `<w:document><w:body>` + placeholder("upper(FirstName, LastName)") + `</w:body></w:document>`
+	replacer := newFieldReplacer(fields.MergeData{"FirstName": "Jane"}, Options{StripUnresolved: true})
+	if result := replacer.replaceAll(invalid); strings.Contains(result, "upper(") || !reflect.DeepEqual(replacer.skipped, []string{"upper(FirstName, LastName)"}) {
+		t.Errorf("Expected the invalid expression to be stripped and skipped, got %v: %s", replacer.skipped, result)
+	}
+	doc := &docx.DocxFile{Files: map[string][]byte{"word/document.xml": []byte(invalid)}}
+	if _, err := PerformMergeStrict(doc, fields.MergeData{"FirstName": "Jane"}); !errors.Is(err, ErrUnfilledFields) {
+		t.Errorf("Expected a strict merge to fail on the invalid expression, got %v", err)
+	}
+
+	if _, skipped, _ := replaceFieldValues(`<w:document><w:body>`+placeholder("Price (USD)")+`</w:body></w:document>`, fields.MergeData{}); !reflect.DeepEqual(skipped, []string{"Price (USD)"}) {
+		t.Errorf("Expected a parenthesised field without data to be skipped, got %v", skipped)
+	}
+
+	// Expressions that do not parse are reported before the merge; fields
+	// and data keys named like calls are not parsed
+	document := `<w:document><w:body>` + placeholder("uper(FirstName)") + placeholder("upper(FirstName)") +
+		placeholder("Price (USD)") + placeholder("lower(x)") + placeholder("FirstName") + `</w:body></w:document>`
+	errs := ExpressionErrors(document, fields.MergeData{"lower(x)": "as is"})
+	expected := map[string]string{"uper(FirstName)": "unknown function 'uper'"}
+	if !reflect.DeepEqual(errs, expected) {
+		t.Errorf("Expected expression errors %v, got %v", expected, errs)
+	}
+}
+
+func TestReplaceFieldValuesBlock(t *testing.T) {
+	xml := `<w:document><w:body><w:p><w:r><w:t>«block(Address1,Address2,City)»</w:t></w:r></w:p></w:body></w:document>`
+	lineBreak := `</w:t><w:br/><w:t xml:space="preserve">`
+
+	tests := []struct {
+		name     string
+		data     fields.MergeData
+		expected string
+	}{
+		{
+			name:     "all lines present",
+			data:     fields.MergeData{"Address1": "1 Main St", "Address2": "Suite 5", "City": "Springfield"},
+			expected: "<w:t>1 Main St" + lineBreak + "Suite 5" + lineBreak + "Springfield</w:t>",
+		},
+		{
+			name:     "missing line collapses",
+			data:     fields.MergeData{"Address1": "1 Main St", "City": "Springfield"},
+			expected: "<w:t>1 Main St" + lineBreak + "Springfield</w:t>",
+		},
+		{
+			name:     "blank line collapses",
+			data:     fields.MergeData{"Address1": "1 Main St", "Address2": "  ", "City": "Springfield"},
+			expected: "<w:t>1 Main St" + lineBreak + "Springfield</w:t>",
+		},
+		{
+			name:     "no lines",
+			data:     fields.MergeData{},
+			expected: "<w:t></w:t>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replacer := newFieldReplacer(tt.data, Options{})
+			result := replacer.replaceAll(xml)
+			if !strings.Contains(result, tt.expected) {
+				t.Errorf("Expected %q in result: %s", tt.expected, result)
+			}
+		})
+	}
+
+	replacer := newFieldReplacer(fields.MergeData{}, Options{})
+	replacer.replaceAll(`<w:p><w:r><w:t>«block()»</w:t></w:r></w:p>`)
+	if outcome := replacer.outcomes[0]; outcome.Status != FieldStatusError || outcome.Reason != "block expects at least 1 argument(s), got 0" {
+		t.Errorf("Expected an error outcome for block without arguments, got %+v", outcome)
+	}
+}
+
+func TestReplaceFieldValuesNonFiniteNumbers(t *testing.T) {
+	data := fields.MergeData{"Inf": math.Inf(1), "NaN": math.NaN(), "Huge": json.Number("1e400"), "Backup": 5}
+	xml := `<w:document><w:body>` +
+		`<w:p><w:r><w:t>«Inf»</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>«NaN»</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>«Huge»</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>«Inf|Backup»</w:t></w:r></w:p>` +
+		`</w:body></w:document>`
+
+	replacer := newFieldReplacer(data, Options{})
+	result := replacer.replaceAll(xml)
+
+	for _, unexpected := range []string{">+Inf<", ">NaN<", ">1e400<"} {
+		if strings.Contains(result, unexpected) {
+			t.Errorf("Non-finite number merged into the document: %s", result)
+		}
+	}
+	// A fallback chain moves on to the next alternative
+	if !strings.Contains(result, "<w:t>5</w:t>") {
+		t.Errorf("Expected the fallback chain to use Backup: %s", result)
+	}
+
+	for _, name := range []string{"Inf", "NaN", "Huge"} {
+		var outcome *FieldOutcome
+		for i := range replacer.outcomes {
+			if replacer.outcomes[i].Name == name {
+				outcome = &replacer.outcomes[i]
+			}
+		}
+		if outcome == nil || outcome.Status != FieldStatusError || !strings.Contains(outcome.Reason, "finite") {
+			t.Errorf("Expected an error outcome for %s, got %+v", name, outcome)
+		}
+	}
+}
+
+func TestReplaceFieldValuesObjectValues(t *testing.T) {
+	data := fields.MergeData{"Address": map[string]interface{}{"street": "1 Main St", "city": "Springfield"}}
+	xml := `<w:document><w:body>` +
+		`<w:p><w:r><w:t>«Address.street»</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>«address.City»</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>«Address»</w:t></w:r></w:p>` +
+		`</w:body></w:document>`
+
+	replacer := newFieldReplacer(data, Options{})
+	result := replacer.replaceAll(xml)
+
+	for _, expected := range []string{"<w:t>1 Main St</w:t>", "<w:t>Springfield</w:t>", "<w:t>«Address»</w:t>"} {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected %s in result: %s", expected, result)
+		}
+	}
+	if strings.Contains(result, "map[") {
+		t.Errorf("Object value rendered as Go map syntax: %s", result)
+	}
+
+	var outcome *FieldOutcome
+	for i := range replacer.outcomes {
+		if replacer.outcomes[i].Name == "Address" {
+			outcome = &replacer.outcomes[i]
+		}
+	}
+	if outcome == nil || outcome.Status != FieldStatusError || !strings.Contains(outcome.Reason, "«Address.city»") {
+		t.Errorf("Expected an error outcome naming a sub-field placeholder, got %+v", outcome)
+	}
+}
+
+func TestPerformMergeExpansionLimit(t *testing.T) {
+	item := `<w:sdt><w:sdtPr><w15:repeatingSectionItem/></w:sdtPr><w:sdtContent>` +
+		`<w:tr><w:tc><w:sdt><w:sdtPr><w:tag w:val="Product"/></w:sdtPr><w:sdtContent><w:p><w:r><w:t>Product</w:t></w:r></w:p></w:sdtContent></w:sdt></w:tc></w:tr>` +
+		`</w:sdtContent></w:sdt>`
+	section := func(tag string) string {
+		return `<w:sdt><w:sdtPr><w:tag w:val="` + tag + `"/><w15:repeatingSection/></w:sdtPr><w:sdtContent>` + item + `</w:sdtContent></w:sdt>`
+	}
+	doc := createSampleDocx(`<w:document><w:body><w:tbl>` + section("LineItems") + section("Discounts") + `</w:tbl></w:body></w:document>`)
+	itemsOf := func(n int) []interface{} {
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i] = map[string]interface{}{"Product": fmt.Sprintf("Item %d", i)}
+		}
+		return items
+	}
+
+	t.Run("within limit", func(t *testing.T) {
+		data := fields.MergeData{"LineItems": itemsOf(3), "Discounts": itemsOf(2)}
+		if _, err := PerformMergeWithOptions(doc, data, Options{MaxExpansions: 5}); err != nil {
+			t.Errorf("Expected 5 items to be within the limit, got %v", err)
+		}
+	})
+
+	t.Run("limit counts every section", func(t *testing.T) {
+		data := fields.MergeData{"LineItems": itemsOf(3), "Discounts": itemsOf(3)}
+		_, err := PerformMergeWithOptions(doc, data, Options{MaxExpansions: 5})
+		if !errors.Is(err, ErrTooManyExpansions) {
+			t.Fatalf("Expected ErrTooManyExpansions, got %v", err)
+		}
+		if !strings.Contains(err.Error(), "'Discounts'") || !strings.Contains(err.Error(), "limit is 5") {
+			t.Errorf("Expected the error to name the section and limit, got %v", err)
+		}
+	})
+
+	t.Run("default limit", func(t *testing.T) {
+		data := fields.MergeData{"LineItems": itemsOf(DefaultMaxExpansions + 1)}
+		if _, err := PerformMergeWithOptions(doc, data, Options{}); !errors.Is(err, ErrTooManyExpansions) {
+			t.Errorf("Expected ErrTooManyExpansions past the default limit, got %v", err)
+		}
+	})
+}
+
+func TestPerformMergeOutputSizeLimit(t *testing.T) {
+	doc := createSampleDocx(`<w:document><w:body><w:tbl>` +
+		`<w:sdt><w:sdtPr><w:tag w:val="LineItems"/><w15:repeatingSection/></w:sdtPr><w:sdtContent>` +
+		`<w:sdt><w:sdtPr><w15:repeatingSectionItem/></w:sdtPr><w:sdtContent>` +
+		`<w:tr><w:tc><w:sdt><w:sdtPr><w:tag w:val="Product"/></w:sdtPr><w:sdtContent><w:p><w:r><w:t>Product</w:t></w:r></w:p></w:sdtContent></w:sdt></w:tc></w:tr>` +
+		`</w:sdtContent></w:sdt>` +
+		`</w:sdtContent></w:sdt>` +
+		`</w:tbl></w:body></w:document>`)
+	itemsOf := func(n int) fields.MergeData {
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i] = map[string]interface{}{"Product": fmt.Sprintf("Item %d, serial %x", i, i*7919)}
+		}
+		return fields.MergeData{"LineItems": items}
+	}
+
+	small, err := PerformMergeWithOptions(doc, itemsOf(2), Options{})
+	if err != nil {
+		t.Fatalf("PerformMergeWithOptions failed: %v", err)
+	}
+	limit := len(small.Document) + 256
+
+	if _, err := PerformMergeWithOptions(doc, itemsOf(2), Options{MaxOutputSize: limit}); err != nil {
+		t.Errorf("Expected a document within the limit to merge, got %v", err)
+	}
+
+	// Expanding the section crosses the limit
+	_, err = PerformMergeWithOptions(doc, itemsOf(500), Options{MaxOutputSize: limit})
+	if !errors.Is(err, ErrOutputTooLarge) {
+		t.Fatalf("Expected ErrOutputTooLarge, got %v", err)
+	}
+	if !strings.Contains(err.Error(), fmt.Sprintf("the limit is %d", limit)) {
+		t.Errorf("Expected the error to name the limit, got %v", err)
+	}
+}
+
+func TestPerformMergeText(t *testing.T) {
+	doc := createSampleDocx(testutil.DocumentXML(
+		`<w:p><w:pPr><w:tabs><w:tab w:val="left" w:pos="720"/></w:tabs></w:pPr>` +
+			`<w:r><w:t xml:space="preserve">Dear </w:t></w:r><w:r><w:t>«Name»</w:t></w:r><w:r><w:t>,</w:t></w:r></w:p>` +
+			`<w:p><w:r><w:t>Total:</w:t><w:tab/><w:t>«Total»</w:t></w:r></w:p>` +
+			`<w:p><w:r><w:t>Line one</w:t><w:br/><w:t>Line two</w:t></w:r></w:p>` +
+			`<w:p><w:r><w:t>«Missing»</w:t></w:r></w:p>`))
+
+	text, skipped, err := PerformMergeText(doc, fields.MergeData{"Name": "Smith & Sons <Ltd>", "Total": 12})
+	if err != nil {
+		t.Fatalf("PerformMergeText failed: %v", err)
+	}
+	expected := "Dear Smith & Sons <Ltd>,\nTotal:\t12\nLine one\nLine two\n«Missing»"
+	if text != expected {
+		t.Errorf("Text = %q, want %q", text, expected)
+	}
+	if !reflect.DeepEqual(skipped, []string{"Missing"}) {
+		t.Errorf("Expected skipped [Missing], got %v", skipped)
+	}
+}
+
+func TestPerformMergeBatch(t *testing.T) {
+	doc := createSampleDocx(testutil.DocumentXML(`<w:p><w:r><w:t>«Name»</w:t></w:r></w:p>` +
+		`<w:sdt><w:sdtPr><w:tag w:val="Items"/><w15:repeatingSection/></w:sdtPr><w:sdtContent>` +
+		`<w:sdt><w:sdtPr><w15:repeatingSectionItem/></w:sdtPr><w:sdtContent>` +
+		`<w:sdt><w:sdtPr><w:tag w:val="Item"/></w:sdtPr><w:sdtContent><w:p><w:r><w:t>Item</w:t></w:r></w:p></w:sdtContent></w:sdt>` +
+		`</w:sdtContent></w:sdt>` +
+		`</w:sdtContent></w:sdt>`))
+	itemsOf := func(n int) []interface{} {
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i] = map[string]interface{}{"Item": fmt.Sprintf("item %d", i)}
+		}
+		return items
+	}
+	rows := []fields.MergeData{
+		{"Name": "Jane", "Items": itemsOf(2)},
+		{"Name": "John", "Items": itemsOf(10)},
+		{"Items": itemsOf(1)},
+	}
+
+	results := PerformMergeBatch(doc, rows, Options{MaxExpansions: 5})
+	if len(results) != len(rows) {
+		t.Fatalf("Expected %d results, got %d", len(rows), len(results))
+	}
+
+	// The row over the limit fails alone
+	if !errors.Is(results[1].Err, ErrTooManyExpansions) || results[1].Result != nil {
+		t.Errorf("Expected row 1 to fail with ErrTooManyExpansions, got %+v", results[1])
+	}
+	for _, i := range []int{0, 2} {
+		if results[i].Err != nil || results[i].Result == nil {
+			t.Fatalf("Expected row %d to merge, got %+v", i, results[i])
+		}
+	}
+
+	// Each row merges from the unchanged template
+	documentXMLOf := func(document []byte) string {
+		mergedDocx, err := docx.UnzipDocx(document)
+		if err != nil {
+			t.Fatalf("Failed to unzip merged document: %v", err)
+		}
+		mergedXML, err := mergedDocx.GetDocumentXML()
+		if err != nil {
+			t.Fatalf("Failed to get merged document XML: %v", err)
+		}
+		return string(mergedXML)
+	}
+	first := documentXMLOf(results[0].Result.Document)
+	third := documentXMLOf(results[2].Result.Document)
+	if !strings.Contains(first, "<w:t>Jane</w:t>") || strings.Count(first, "<w:t>item ") != 2 {
+		t.Errorf("Unexpected merge of row 0: %s", first)
+	}
+	if strings.Contains(third, "Jane") || strings.Count(third, "<w:t>item ") != 1 {
+		t.Errorf("Row 2 should not carry values of other rows: %s", third)
+	}
+	if !reflect.DeepEqual(results[2].Result.Skipped, []string{"Name"}) {
+		t.Errorf("Expected row 2 to skip Name, got %v", results[2].Result.Skipped)
+	}
+}
+
+func TestPerformMergeDateFormats(t *testing.T) {
+	doc := createSampleDocx(`<?xml version="1.0"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+	<w:body><w:p><w:r><w:t>«StartDate»</w:t></w:r></w:p></w:body>
+</w:document>`)
+	fieldSetWith := func(dateFormat string) *fields.MergeFieldSet {
+		return &fields.MergeFieldSet{Fields: []fields.MergeField{
+			{Name: "StartDate", Type: fields.FieldTypeDate, Format: &fields.FieldFormat{DateFormat: dateFormat}},
+		}}
+	}
+
+	_, err := PerformMergeWithOptions(doc, fields.MergeData{"StartDate": "2024-03-01"}, Options{FieldSet: fieldSetWith("YYYY-XX"), Locale: "en-US"})
+	if !errors.Is(err, fields.ErrInvalidDateLayout) {
+		t.Errorf("Expected a bad date format to fail the merge, got %v", err)
+	}
+
+	result, err := PerformMergeWithOptions(doc, fields.MergeData{"StartDate": "2024-03-01"}, Options{FieldSet: fieldSetWith("DD.MM.YYYY"), Locale: "en-US"})
+	if err != nil {
+		t.Fatalf("PerformMergeWithOptions failed: %v", err)
+	}
+	merged, err := docx.UnzipDocx(result.Document)
+	if err != nil {
+		t.Fatalf("Failed to read merged document: %v", err)
+	}
+	if !strings.Contains(string(merged.Files["word/document.xml"]), "<w:t>01.03.2024</w:t>") {
+		t.Errorf("Expected the translated DD.MM.YYYY layout to be used: %s", merged.Files["word/document.xml"])
+	}
+}
+
+func TestPerformMergeDataBoundControls(t *testing.T) {
+	doc := createSampleDocx(`<?xml version="1.0"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">
+	<w:body>
+		<w:sdt>
+			<w:sdtPr>
+				<w:alias w:val="Title"/>
+				<w:id w:val="1"/>
+				<w:dataBinding w:prefixMappings="xmlns:ns0='http://purl.org/dc/elements/1.1/' xmlns:ns1='http://schemas.openxmlformats.org/package/2006/metadata/core-properties'" w:xpath="/ns1:coreProperties[1]/ns0:title[1]" w:storeItemID="{6C3C8BC8-F283-45AE-878A-BAB7291924A1}"/>
+				<w:showingPlcHdr/>
+			</w:sdtPr>
+			<w:sdtContent><w:p><w:r><w:t>[Document title]</w:t></w:r></w:p></w:sdtContent>
+		</w:sdt>
+		<w:sdt>
+			<w:sdtPr>
+				<w:tag w:val="Region"/>
+				<w:dataBinding w:prefixMappings="xmlns:ns0='urn:report'" w:xpath="/ns0:report[1]/ns0:region[1]" w:storeItemID="{A1B2C3D4-0000-4000-8000-000000000001}"/>
+			</w:sdtPr>
+			<w:sdtContent><w:p><w:r><w:t>North</w:t></w:r></w:p></w:sdtContent>
+		</w:sdt>
+		<w:p><w:r><w:t>«Name»</w:t></w:r></w:p>
+	</w:body>
+</w:document>`)
+	doc.Files["docProps/core.xml"] = []byte(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<cp:coreProperties xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties" xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:title/><dc:creator>Template</dc:creator></cp:coreProperties>`)
+	doc.Files["customXml/item1.xml"] = []byte(`<report xmlns="urn:report"><region>North</region></report>`)
+	doc.Files["customXml/itemProps1.xml"] = []byte(`<ds:datastoreItem ds:itemID="{A1B2C3D4-0000-4000-8000-000000000001}" xmlns:ds="http://schemas.openxmlformats.org/officeDocument/2006/customXml"/>`)
+	doc.Files["customXml/_rels/item1.xml.rels"] = []byte(`<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/customXmlProps" Target="itemProps1.xml"/></Relationships>`)
+
+	t.Run("bound values are written to their data", func(t *testing.T) {
+		data := fields.MergeData{"title": "Q3 Report & Outlook", "Region": "South", "Name": "Jane"}
+		result, err := PerformMergeWithOptions(doc, data, Options{})
+		if err != nil {
+			t.Fatalf("PerformMergeWithOptions failed: %v", err)
+		}
+		merged, err := docx.UnzipDocx(result.Document)
+		if err != nil {
+			t.Fatalf("Failed to read merged document: %v", err)
+		}
+
+		core := string(merged.Files["docProps/core.xml"])
+		if !strings.Contains(core, "<dc:title>Q3 Report &amp; Outlook</dc:title>") {
+			t.Errorf("Title not written to the core properties: %s", core)
+		}
+		if !strings.Contains(core, "<dc:creator>Template</dc:creator>") {
+			t.Errorf("Other core properties should be kept: %s", core)
+		}
+		if item := string(merged.Files["customXml/item1.xml"]); !strings.Contains(item, "<region>South</region>") {
+			t.Errorf("Region not written to the custom XML data: %s", item)
+		}
+
+		documentXML := string(merged.Files["word/document.xml"])
+		for _, expected := range []string{"<w:t>Q3 Report &amp; Outlook</w:t>", "<w:t>South</w:t>", "<w:t>Jane</w:t>"} {
+			if !strings.Contains(documentXML, expected) {
+				t.Errorf("Expected %s in the document", expected)
+			}
+		}
+		if strings.Contains(documentXML, "showingPlcHdr") {
+			t.Error("Placeholder flag should be removed from filled controls")
+		}
+	})
+
+	t.Run("bound controls without data are kept", func(t *testing.T) {
+		result, err := PerformMergeWithOptions(doc, fields.MergeData{"Name": "Jane"}, Options{})
+		if err != nil {
+			t.Fatalf("PerformMergeWithOptions failed: %v", err)
+		}
+		merged, err := docx.UnzipDocx(result.Document)
+		if err != nil {
+			t.Fatalf("Failed to read merged document: %v", err)
+		}
+		if core := string(merged.Files["docProps/core.xml"]); !strings.Contains(core, "<dc:title/>") {
+			t.Errorf("Title should be unchanged: %s", core)
+		}
+		if item := string(merged.Files["customXml/item1.xml"]); !strings.Contains(item, "<region>North</region>") {
+			t.Errorf("Custom XML data should be unchanged: %s", item)
+		}
+	})
+}
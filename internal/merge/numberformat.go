@@ -0,0 +1,104 @@
+package merge
+
+import (
+	"strconv"
+	"strings"
+
+	"com/lifenture/flash-mail-merge/internal/fields"
+)
+
+// Values of FieldFormat.NumberFormat applied to number fields
+const (
+	NumberFormatCurrency   = "currency"
+	NumberFormatPercentage = "percentage"
+)
+
+const (
+	// DefaultCurrencySymbol is written before currency values when the
+	// options set no CurrencySymbol
+	DefaultCurrencySymbol = "$"
+
+	// defaultNumberLocale provides the grouping of formatted numbers when
+	// neither the field nor the options set a locale
+	defaultNumberLocale = "en-US"
+
+	// currencyDecimals is the number of decimals of currency values
+	currencyDecimals = 2
+)
+
+// formatNumberValue returns the display string of a number field value for
+// the field's NumberFormat: "currency" rounds to two decimals and writes the
+// currency symbol before the amount, as in $123,456.50, and "percentage"
+// scales a fraction such as 0.25 to 25%. Both are grouped with the separators
+// of the locale. The currencySymbol of the options wins over the symbol of
+// the format, such as the € of a Word picture. Values that are not numbers
+// are returned unchanged, and other formats only apply the locale.
+func formatNumberValue(format *fields.FieldFormat, value string, locale localeFormat, currencySymbol string) string {
+	numberFormat := ""
+	if format != nil {
+		numberFormat = strings.ToLower(strings.TrimSpace(format.NumberFormat))
+	}
+
+	switch numberFormat {
+	case NumberFormatCurrency:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return value
+		}
+		if currencySymbol == "" {
+			currencySymbol = format.CurrencySymbol
+		}
+		if currencySymbol == "" {
+			currencySymbol = DefaultCurrencySymbol
+		}
+		amount := strconv.FormatFloat(f, 'f', currencyDecimals, 64)
+		if strings.HasPrefix(amount, "-") {
+			// -$5.00 rather than $-5.00
+			return "-" + currencySymbol + locale.formatNumber(amount[1:])
+		}
+		return currencySymbol + locale.formatNumber(amount)
+
+	case NumberFormatPercentage:
+		if exponentNumberRegex.MatchString(value) {
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return value
+			}
+			value = strconv.FormatFloat(f, 'f', -1, 64)
+		}
+		if !plainNumberRegex.MatchString(value) {
+			return value
+		}
+		return locale.formatNumber(scaleByHundred(value)) + "%"
+	}
+	return locale.formatNumber(value)
+}
+
+// scaleByHundred multiplies a plain decimal number by 100 by moving its
+// decimal point, so 0.07 gives 7 without the rounding error of a float
+// multiplication
+func scaleByHundred(value string) string {
+	sign := ""
+	if strings.HasPrefix(value, "-") || strings.HasPrefix(value, "+") {
+		sign, value = value[:1], value[1:]
+	}
+	if sign == "+" {
+		sign = ""
+	}
+	integer, fraction, _ := strings.Cut(value, ".")
+	fraction += strings.Repeat("0", max(0, 2-len(fraction)))
+	integer, fraction = integer+fraction[:2], fraction[2:]
+
+	integer = strings.TrimLeft(integer, "0")
+	if integer == "" {
+		integer = "0"
+	}
+	fraction = strings.TrimRight(fraction, "0")
+	if fraction != "" {
+		return sign + integer + "." + fraction
+	}
+	if integer == "0" {
+		return integer
+	}
+	return sign + integer
+}
@@ -0,0 +1,174 @@
+package merge
+
+import (
+	"com/lifenture/flash-mail-merge/internal/fields"
+	"com/lifenture/flash-mail-merge/internal/logging"
+)
+
+// Options controls optional merge behavior. The zero value performs a
+// default merge.
+type Options struct {
+	// RemoveEmptyParagraphs deletes paragraphs whose text became empty after
+	// field replacement (e.g. a paragraph holding only a blanked field)
+	RemoveEmptyParagraphs bool
+
+	// StripUnresolved removes the placeholders of fields skipped for lack of
+	// data, as if they merged an empty value, instead of leaving them in the
+	// document; the fields are still reported as skipped
+	StripUnresolved bool
+
+	// RemoveMailMergeSettings strips the <w:mailMerge> data source settings
+	// from word/settings.xml so Word does not prompt to reconnect on open
+	RemoveMailMergeSettings bool
+
+	// NormalizeLineEndings converts CRLF and lone CR line endings of the
+	// merged XML parts to LF
+	NormalizeLineEndings bool
+
+	// MatchPlaceholderCase adjusts the casing of merged values to the casing
+	// of the placeholder: «NAME» uppercases, «name» lowercases and «Name»
+	// title-cases the value
+	MatchPlaceholderCase bool
+
+	// MergeDrawingText also replaces «field» placeholders in DrawingML <a:t>
+	// text of the main document and the SmartArt parts under word/diagrams/
+	MergeDrawingText bool
+
+	// HighlightMerged adds a yellow highlight to the runs holding merged
+	// values so they stand out when proofing; Word removes it with the
+	// "No Color" highlight
+	HighlightMerged bool
+
+	// RemoveFieldShading strips the <w:shd> shading, such as the gray
+	// background of field results, from the runs holding merged values
+	RemoveFieldShading bool
+
+	// Compact removes the image relationships no longer referenced by their
+	// part and the media parts no longer targeted by any relationship,
+	// updating [Content_Types].xml
+	Compact bool
+
+	// PartialOutput returns the parts changed, added and removed by the merge
+	// in Result instead of a rebuilt archive, for clients that patch their own
+	// copy of the template. The merge marker is not written.
+	PartialOutput bool
+
+	// Strict fails the merge with an *UnfilledFieldsError when any field
+	// would be skipped for lack of data, instead of leaving its placeholder
+	Strict bool
+
+	// MaxExpansions bounds the total number of items the repeating sections
+	// of the document are expanded to, including repeated table rows; a merge
+	// exceeding it fails with ErrTooManyExpansions. Zero means
+	// DefaultMaxExpansions.
+	MaxExpansions int
+
+	// MaxOutputSize bounds the size in bytes of the rebuilt document; a
+	// merge producing a larger one fails with ErrOutputTooLarge instead of
+	// returning it. Zero means DefaultMaxOutputSize.
+	MaxOutputSize int
+
+	// FieldSet provides template field metadata; when set, a field missing
+	// from the merge data is filled with its DefaultValue instead of skipped
+	FieldSet *fields.MergeFieldSet
+
+	// Locale formats the values of number and date fields of FieldSet with
+	// the separators and date layout of the locale (e.g. "en-US"); a Locale
+	// in a field's Format takes precedence for that field
+	Locale string
+
+	// PreserveBOM writes the UTF-8 byte order mark of the template's
+	// word/document.xml back to the merged part; by default it is stripped
+	PreserveBOM bool
+
+	// RequiredMarker ends the placeholder names of required fields, as in
+	// «Email*», and is dropped to find their value; empty means
+	// fields.DefaultRequiredMarker
+	RequiredMarker string
+
+	// Delimiters lists the delimiters of the text placeholders replaced
+	// besides the merge fields, such as fields.BraceDelimiters for
+	// {{FirstName}}; empty means fields.ChevronDelimiters
+	Delimiters []fields.Delimiters
+
+	// CurrencySymbol is written before the values of number fields with the
+	// "currency" NumberFormat; empty means the symbol of the field's format,
+	// then DefaultCurrencySymbol
+	CurrencySymbol string
+
+	// FallbackSources are consulted in order for fields that have neither
+	// merge data nor a default value
+	FallbackSources []ValueSource
+
+	// DocumentProperties sets core document properties of the output, keyed
+	// by the names in docx.CoreProperties (e.g. "title", "author")
+	DocumentProperties map[string]string
+
+	// CorrelationID identifies the request in the trace spans of the merge
+	CorrelationID string
+
+	// Logger writes the log lines of the merge, e.g. prefixed with the
+	// request correlation ID; nil means the default logger
+	Logger *logging.Logger
+}
+
+// logger returns the logger of the merge
+func (o Options) logger() *logging.Logger {
+	if o.Logger != nil {
+		return o.Logger
+	}
+	return logging.Default()
+}
+
+// Result holds the output of a merge operation
+type Result struct {
+	// Document is the rebuilt DOCX archive; nil with PartialOutput
+	Document []byte
+
+	// ChangedParts maps the parts whose content differs from the template,
+	// including added parts, to their merged content; set with PartialOutput
+	ChangedParts map[string][]byte
+
+	// AddedParts and RemovedParts list, sorted, the parts added to and
+	// removed from the template; set with PartialOutput
+	AddedParts   []string
+	RemovedParts []string
+
+	// Resolved lists the fields that were filled from the merge data
+	Resolved []string
+
+	// Defaulted lists the fields that were filled with their default value or
+	// from a fallback source
+	Defaulted []string
+
+	// Skipped lists the fields that had no data available
+	Skipped []string
+
+	// ReplacedCounts maps each resolved field to its number of replaced occurrences
+	ReplacedCounts map[string]int
+
+	// Outcomes describes the resolution of each field, in document order
+	Outcomes []FieldOutcome
+
+	// PartErrors lists the header and footer parts that could not be merged
+	// and were left unchanged
+	PartErrors []PartError
+}
+
+// FieldStatus describes how a field was resolved
+type FieldStatus string
+
+const (
+	FieldStatusResolved FieldStatus = "resolved" // filled from the merge data
+	FieldStatusSkipped  FieldStatus = "skipped"  // no data available, placeholder left
+	FieldStatusDefault  FieldStatus = "default"  // filled with the field's default value or from a fallback source
+	FieldStatusError    FieldStatus = "error"    // value could not be used
+)
+
+// FieldOutcome describes the resolution of a single field
+type FieldOutcome struct {
+	Name   string      `json:"name"`
+	Status FieldStatus `json:"status"`
+	Value  string      `json:"value,omitempty"`
+	Reason string      `json:"reason,omitempty"`
+}
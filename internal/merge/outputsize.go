@@ -0,0 +1,28 @@
+package merge
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DefaultMaxOutputSize is the size in bytes a merged document may reach when
+// the options set no limit. Base64-encoded in a JSON body, a document of this
+// size still fits the 6 MB response payload limit of Lambda.
+const DefaultMaxOutputSize = 4 << 20
+
+// ErrOutputTooLarge is returned when the merged document exceeds the output
+// size limit, e.g. after repeating sections expanded to many items
+var ErrOutputTooLarge = errors.New("merged document too large")
+
+// checkOutputSize reports a merged document larger than the limit of the
+// options
+func checkOutputSize(size int, opts Options) error {
+	limit := opts.MaxOutputSize
+	if limit <= 0 {
+		limit = DefaultMaxOutputSize
+	}
+	if size > limit {
+		return fmt.Errorf("%w: the merged document has %d bytes, the limit is %d", ErrOutputTooLarge, size, limit)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package merge
+
+import (
+	"regexp"
+	"strings"
+)
+
+// replacedMarker tags the text of replaced fields until empty paragraphs are
+// removed, so only paragraphs that held a field are. Like mergedMarker, it
+// cannot occur in XML.
+const replacedMarker = "\x01"
+
+var (
+	// paragraphRegex matches a paragraph element; <w:pPr> is excluded by the
+	// character class following "w:p"
+	paragraphRegex = regexp.MustCompile(`(?s)<w:p[ >].*?</w:p>`)
+
+	// nestedParagraphRegex detects a paragraph opening inside a matched paragraph
+	nestedParagraphRegex = regexp.MustCompile(`<w:p[ >]`)
+
+	// textElementRegex captures the content of <w:t> elements
+	textElementRegex = regexp.MustCompile(`(?s)<w:t(?:\s[^>]*)?>(.*?)</w:t>`)
+
+	// tabStopsRegex matches the tab stops of the paragraph properties, which
+	// list paragraphs commonly carry and which are no <w:tab> content
+	tabStopsRegex = regexp.MustCompile(`(?s)<w:tabs>.*?</w:tabs>`)
+
+	// containerEndRegex matches the closing tags of containers that must keep
+	// at least one paragraph
+	containerEndRegex = regexp.MustCompile(`^\s*</w:(?:tc|txbxContent|hdr|ftr)>`)
+)
+
+// keepParagraphMarkers are elements that make a paragraph meaningful (or
+// unsafe to remove) even when it has no text
+var keepParagraphMarkers = []string{
+	"<w:drawing", "<w:pict", "<w:object", "<w:br", "<w:tab", "<w:sym",
+	"<w:sectPr", "<w:bookmarkStart", "<w:bookmarkEnd", "<w:fldChar",
+}
+
+// removeEmptyParagraphs deletes paragraphs whose text content became empty
+// after merge and removes the replacedMarker tags. Only paragraphs holding a
+// field tagged by markMerged are considered, so blank paragraphs of the
+// template are preserved. Paragraphs carrying
+// section properties, drawings, breaks, bookmarks or complex field markers
+// are kept, as is the last paragraph of a table cell, text box, header or
+// footer, which Word requires.
+func removeEmptyParagraphs(documentXML string) (string, int) {
+	var result strings.Builder
+	removed := 0
+	last := 0
+
+	for _, loc := range paragraphRegex.FindAllStringIndex(documentXML, -1) {
+		paragraph := documentXML[loc[0]:loc[1]]
+		if !strings.Contains(paragraph, replacedMarker) || !isRemovableParagraph(strings.ReplaceAll(paragraph, replacedMarker, "")) || containerEndRegex.MatchString(documentXML[loc[1]:]) {
+			continue
+		}
+
+		result.WriteString(documentXML[last:loc[0]])
+		last = loc[1]
+		removed++
+	}
+	result.WriteString(documentXML[last:])
+
+	return strings.ReplaceAll(result.String(), replacedMarker, ""), removed
+}
+
+// isRemovableParagraph reports whether a paragraph has text runs that are all empty
+func isRemovableParagraph(paragraph string) bool {
+	// A nested paragraph means the match ended early; leave it alone
+	if len(nestedParagraphRegex.FindAllStringIndex(paragraph, 2)) > 1 {
+		return false
+	}
+
+	content := tabStopsRegex.ReplaceAllString(paragraph, "")
+	for _, marker := range keepParagraphMarkers {
+		if strings.Contains(content, marker) {
+			return false
+		}
+	}
+
+	texts := textElementRegex.FindAllStringSubmatch(paragraph, -1)
+	if len(texts) == 0 {
+		return false
+	}
+	for _, text := range texts {
+		content := strings.ReplaceAll(text[1], "<![CDATA[", "")
+		content = strings.ReplaceAll(content, "]]>", "")
+		if strings.TrimSpace(content) != "" {
+			return false
+		}
+	}
+	return true
+}
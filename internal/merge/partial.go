@@ -0,0 +1,36 @@
+package merge
+
+import (
+	"bytes"
+	"sort"
+
+	"com/lifenture/flash-mail-merge/internal/docx"
+)
+
+// diffParts compares the merged package with the template. It returns the
+// content of every part that was added or whose bytes changed, and lists,
+// sorted, the added and removed parts.
+func diffParts(template, merged *docx.DocxFile) (changed map[string][]byte, added, removed []string) {
+	changed = make(map[string][]byte)
+	added = []string{}
+	removed = []string{}
+
+	for name, content := range merged.Files {
+		original, exists := template.Files[name]
+		if !exists {
+			added = append(added, name)
+		}
+		if !exists || !bytes.Equal(original, content) {
+			changed[name] = content
+		}
+	}
+	for name := range template.Files {
+		if _, exists := merged.Files[name]; !exists {
+			removed = append(removed, name)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	return changed, added, removed
+}
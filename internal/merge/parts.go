@@ -0,0 +1,100 @@
+package merge
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"com/lifenture/flash-mail-merge/internal/docx"
+	"com/lifenture/flash-mail-merge/internal/fields"
+)
+
+// PartError reports a package part that could not be merged and was left
+// unchanged in the output
+type PartError struct {
+	Part   string   `json:"part"`             // part name, e.g. word/header1.xml
+	Error  string   `json:"error"`            // why the part was not merged
+	Fields []string `json:"fields,omitempty"` // placeholders found in the part, left unmerged
+}
+
+// mergeHeadersFooters merges the header and footer parts of the document.
+// A part that fails to merge is left unchanged and reported in partErrors, so
+// a malformed header does not abort the merge of the rest of the document.
+func (r *fieldReplacer) mergeHeadersFooters(doc *docx.DocxFile) {
+	var parts []string
+	for name := range doc.Files {
+		if docx.IsHeaderFooterPart(name) {
+			parts = append(parts, name)
+		}
+	}
+	sort.Strings(parts)
+
+	for _, part := range parts {
+		content := doc.Files[part]
+		merged, err := r.mergePart(content)
+		if err != nil {
+			r.log.Warn("Failed to merge %s, leaving it unchanged: %v", part, err)
+			r.partErrors = append(r.partErrors, PartError{
+				Part:   part,
+				Error:  err.Error(),
+				Fields: partFieldNames(content),
+			})
+			continue
+		}
+		doc.Files[part] = merged
+		r.log.Debug("Merged %s", part)
+	}
+}
+
+// mergePart merges a single WordprocessingML part. The part must be well
+// formed XML, and a failure while replacing its fields is returned as an
+// error instead of aborting the request.
+func (r *fieldReplacer) mergePart(content []byte) (merged []byte, err error) {
+	if err := checkWellFormed(content); err != nil {
+		return nil, fmt.Errorf("malformed XML: %w", err)
+	}
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			merged, err = nil, fmt.Errorf("merge failed: %v", recovered)
+		}
+	}()
+	return []byte(r.mergeDocumentXML(string(content))), nil
+}
+
+// checkWellFormed reports the first syntax error of an XML part
+func checkWellFormed(content []byte) error {
+	decoder := xml.NewDecoder(strings.NewReader(string(content)))
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// partFieldNames lists the distinct MERGEFIELD names and «placeholders» of a
+// part that could not be merged. A malformed part is scanned as text, as far
+// as it can be read.
+func partFieldNames(content []byte) []string {
+	text := normalizeChevronEntities(string(content))
+	names, _ := fields.Extract(text)
+
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		seen[name] = true
+	}
+	for _, match := range drawingPlaceholderRegex.FindAllStringSubmatch(text, -1) {
+		name := strings.TrimSpace(unescapeXML(match[1]))
+		if name != "" && !strings.ContainsAny(name, "<>") && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
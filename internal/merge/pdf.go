@@ -0,0 +1,85 @@
+package merge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrConversionNotConfigured is returned when a PDF is requested but no
+// converter is configured
+var ErrConversionNotConfigured = errors.New("PDF conversion is not configured")
+
+// PDFConverter converts merged DOCX documents to PDF
+type PDFConverter interface {
+	// ConvertToPDF returns the PDF rendering of the DOCX document
+	ConvertToPDF(document []byte) ([]byte, error)
+}
+
+// UnconfiguredConverter is the PDFConverter of deployments without a
+// converter; every conversion fails with ErrConversionNotConfigured
+type UnconfiguredConverter struct{}
+
+// ConvertToPDF reports that PDF conversion is not configured
+func (UnconfiguredConverter) ConvertToPDF(document []byte) ([]byte, error) {
+	return nil, ErrConversionNotConfigured
+}
+
+// DefaultConversionTimeout bounds a LibreOffice conversion when the
+// converter has no Timeout
+const DefaultConversionTimeout = 60 * time.Second
+
+// LibreOfficeConverter converts documents by running LibreOffice headless,
+// e.g. from a Lambda layer providing soffice
+type LibreOfficeConverter struct {
+	// Path is the soffice executable; empty means soffice from the PATH
+	Path string
+
+	// Timeout bounds a conversion; zero means DefaultConversionTimeout
+	Timeout time.Duration
+}
+
+// ConvertToPDF writes the document to a temporary directory and converts it
+// with soffice --convert-to pdf
+func (c LibreOfficeConverter) ConvertToPDF(document []byte) ([]byte, error) {
+	executable := c.Path
+	if executable == "" {
+		executable = "soffice"
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultConversionTimeout
+	}
+
+	dir, err := os.MkdirTemp("", "merge-pdf-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create conversion directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "document.docx")
+	if err := os.WriteFile(input, document, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write document: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// LibreOffice needs a writable profile, which Lambda only has under /tmp
+	cmd := exec.CommandContext(ctx, executable,
+		"-env:UserInstallation=file://"+filepath.ToSlash(filepath.Join(dir, "profile")),
+		"--headless", "--convert-to", "pdf", "--outdir", dir, input)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("soffice failed: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	pdf, err := os.ReadFile(filepath.Join(dir, "document.pdf"))
+	if err != nil {
+		return nil, fmt.Errorf("soffice produced no PDF: %w", err)
+	}
+	return pdf, nil
+}
@@ -0,0 +1,121 @@
+package merge
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+
+	"com/lifenture/flash-mail-merge/internal/docx"
+	"com/lifenture/flash-mail-merge/internal/fields"
+)
+
+// PerformMergeText merges the data into the main document like PerformMerge
+// and returns the merged body as plain text instead of a DOCX, along with the
+// skipped fields
+func PerformMergeText(doc *docx.DocxFile, data fields.MergeData) (string, []string, error) {
+	return PerformMergeTextWithOptions(doc, data, Options{})
+}
+
+// PerformMergeTextWithOptions is PerformMergeText applying the merge behavior
+// in opts. Only word/document.xml is rendered; headers, footers and the other
+// parts are left out of the preview.
+func PerformMergeTextWithOptions(doc *docx.DocxFile, data fields.MergeData, opts Options) (string, []string, error) {
+	logger := opts.logger()
+	release, err := acquireMergeSlot()
+	if err != nil {
+		return "", nil, err
+	}
+	defer release()
+
+	if opts.FieldSet != nil {
+		if err := opts.FieldSet.NormalizeDateFormats(); err != nil {
+			return "", nil, err
+		}
+	}
+
+	documentXML, err := doc.GetDocumentXML()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get document XML: %w", err)
+	}
+	inputXML, _ := strings.CutPrefix(string(documentXML), utf8BOM)
+
+	// The preview never carries the highlight marker
+	opts.HighlightMerged = false
+	replacer := newFieldReplacer(data, opts)
+	updatedXML := replacer.mergeDocumentXML(inputXML)
+	if replacer.err != nil {
+		return "", nil, replacer.err
+	}
+
+	text, err := documentText(updatedXML)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read merged document text: %w", err)
+	}
+	logger.Debug("Rendered merged document as %d bytes of text", len(text))
+	return text, replacer.skipped, nil
+}
+
+// documentText renders WordprocessingML as plain text: the <w:t> text of the
+// runs is concatenated, each paragraph ends in a newline, and tabs and breaks
+// become their characters; the tab stops of paragraph properties are not
+// tabs. Entities are decoded, and the fallback content of
+// mc:AlternateContent is skipped so text boxes are not rendered twice.
+func documentText(documentXML string) (string, error) {
+	decoder := xml.NewDecoder(strings.NewReader(documentXML))
+	var text strings.Builder
+	inText, inTabStops, fallbackDepth := false, false, 0
+
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch token := tok.(type) {
+		case xml.StartElement:
+			if token.Name.Local == "Fallback" {
+				fallbackDepth++
+			}
+			if fallbackDepth > 0 {
+				continue
+			}
+			switch token.Name.Local {
+			case "t":
+				inText = true
+			case "tabs":
+				inTabStops = true
+			case "tab":
+				if !inTabStops {
+					text.WriteByte('\t')
+				}
+			case "br", "cr":
+				text.WriteByte('\n')
+			}
+		case xml.EndElement:
+			if token.Name.Local == "Fallback" {
+				fallbackDepth--
+				continue
+			}
+			if fallbackDepth > 0 {
+				continue
+			}
+			switch token.Name.Local {
+			case "t":
+				inText = false
+			case "tabs":
+				inTabStops = false
+			case "p":
+				text.WriteByte('\n')
+			}
+		case xml.CharData:
+			if inText && fallbackDepth == 0 {
+				text.Write(token)
+			}
+		}
+	}
+	return strings.TrimSuffix(text.String(), "\n"), nil
+}
@@ -0,0 +1,298 @@
+package merge
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"com/lifenture/flash-mail-merge/internal/fields"
+	"com/lifenture/flash-mail-merge/internal/logging"
+)
+
+// DefaultMaxExpansions is the number of items repeating sections may expand
+// to in one merge when Options.MaxExpansions is not set
+const DefaultMaxExpansions = 10000
+
+// ErrTooManyExpansions is returned when the array data of the repeating
+// sections of a document exceeds the expansion limit
+var ErrTooManyExpansions = errors.New("too many repeating section items")
+
+var (
+	// sdtTokenRegex matches the opening and closing tags of content controls,
+	// but not of their sdtPr/sdtContent children
+	sdtTokenRegex = regexp.MustCompile(`<w:sdt[\s>]|</w:sdt>`)
+
+	// repeatingSectionRegex detects repeating section controls (w15:repeatingSection)
+	repeatingSectionRegex = regexp.MustCompile(`<\w+:repeatingSection[\s/>]`)
+
+	// repeatingItemRegex detects the items of a repeating section
+	repeatingItemRegex = regexp.MustCompile(`<\w+:repeatingSectionItem[\s/>]`)
+
+	// sdtIDRegex and paragraphIDRegex match the identifiers that must stay
+	// unique in the document; cloned items drop them and Word assigns new ones
+	sdtIDRegex       = regexp.MustCompile(`<w:id\s+w:val="[^"]*"\s*/>`)
+	paragraphIDRegex = regexp.MustCompile(`\s+w14:(?:paraId|textId)="[^"]*"`)
+
+	// showingPlaceholderRegex matches the flag rendering a control's
+	// placeholder text
+	showingPlaceholderRegex = regexp.MustCompile(`<w:showingPlcHdr\s*/>`)
+)
+
+// sdtElement locates a content control in the document XML
+type sdtElement struct {
+	start, end int // bounds of the whole <w:sdt> element
+	properties string
+	content    string // inner XML of <w:sdtContent>
+	contentAt  int    // offset of content within the element
+}
+
+// nextSdt returns the first content control starting at or after offset,
+// matching nested controls so the element bounds are balanced
+func nextSdt(documentXML string, offset int) (sdtElement, bool) {
+	depth, start := 0, -1
+	for pos := offset; pos < len(documentXML); {
+		loc := sdtTokenRegex.FindStringIndex(documentXML[pos:])
+		if loc == nil {
+			break
+		}
+		tokenStart, tokenEnd := pos+loc[0], pos+loc[1]
+		pos = tokenEnd
+		if documentXML[tokenStart:tokenEnd] != "</w:sdt>" {
+			if depth == 0 {
+				start = tokenStart
+			}
+			depth++
+			continue
+		}
+		if depth == 0 {
+			continue
+		}
+		depth--
+		if depth == 0 {
+			return parseSdt(documentXML[start:tokenEnd], start), true
+		}
+	}
+	return sdtElement{}, false
+}
+
+// parseSdt splits a content control into its properties and content
+func parseSdt(element string, start int) sdtElement {
+	sdt := sdtElement{start: start, end: start + len(element)}
+	if loc := sdtPropertiesRegex.FindStringIndex(element); loc != nil {
+		sdt.properties = element[loc[0]:loc[1]]
+	}
+	open := strings.Index(element, "<w:sdtContent")
+	closeAt := strings.LastIndex(element, "</w:sdtContent>")
+	if open < 0 || closeAt < open {
+		return sdt
+	}
+	if tagEnd := strings.Index(element[open:], ">"); tagEnd >= 0 && open+tagEnd < closeAt {
+		sdt.contentAt = open + tagEnd + 1
+		sdt.content = element[sdt.contentAt:closeAt]
+	}
+	return sdt
+}
+
+// replaceRepeatingSections expands repeating section content controls whose
+// tag names an array in the merge data: the first item is cloned for every
+// array element and the content controls inside each clone are filled from
+// the element's fields, matched by tag. Sections without array data keep
+// their template items.
+func (r *fieldReplacer) replaceRepeatingSections(documentXML string) string {
+	if !repeatingSectionRegex.MatchString(documentXML) {
+		return documentXML
+	}
+
+	var result strings.Builder
+	last := 0
+	for {
+		sdt, found := nextSdt(documentXML, last)
+		if !found {
+			break
+		}
+		result.WriteString(documentXML[last:sdt.start])
+		element := documentXML[sdt.start:sdt.end]
+		last = sdt.end
+
+		if !repeatingSectionRegex.MatchString(sdt.properties) {
+			// Repeating sections may sit inside other controls
+			if strings.Contains(sdt.content, "repeatingSection") {
+				element = element[:sdt.contentAt] + r.replaceRepeatingSections(sdt.content) + element[sdt.contentAt+len(sdt.content):]
+			}
+			result.WriteString(element)
+			continue
+		}
+		result.WriteString(r.expandRepeatingSection(element, sdt))
+	}
+	result.WriteString(documentXML[last:])
+
+	return result.String()
+}
+
+// expandRepeatingSection renders one repeating section for its array data
+func (r *fieldReplacer) expandRepeatingSection(element string, sdt sdtElement) string {
+	tag := sdtTagRegex.FindStringSubmatch(sdt.properties)
+	if tag == nil {
+		return element
+	}
+	fieldName := unescapeXML(tag[1])
+	raw, found := lookupRawValue(r.data, fieldName)
+	if !found {
+		return element
+	}
+	items, ok := raw.([]interface{})
+	if !ok {
+		r.log.Warn("Repeating section '%s' ignored: value is not an array", fieldName)
+		return element
+	}
+
+	// The first item is the template of all items; the others are dropped
+	var template string
+	for offset := 0; ; {
+		item, found := nextSdt(sdt.content, offset)
+		if !found {
+			break
+		}
+		if repeatingItemRegex.MatchString(item.properties) {
+			template = sdt.content[item.start:item.end]
+			break
+		}
+		offset = item.end
+	}
+	if template == "" {
+		r.log.Warn("Repeating section '%s' ignored: no item found", fieldName)
+		return element
+	}
+
+	// Bound the items of all sections, so oversized arrays cannot blow up
+	// the document; the merge fails once the limit is exceeded
+	if r.err != nil {
+		return element
+	}
+	r.expansions += len(items)
+	if limit := r.maxExpansions(); r.expansions > limit {
+		r.err = fmt.Errorf("%w: '%s' brings the repeating section items to %d, the limit is %d", ErrTooManyExpansions, fieldName, r.expansions, limit)
+		r.log.Warn("Repeating section '%s' not expanded: %v", fieldName, r.err)
+		return element
+	}
+
+	var content strings.Builder
+	for i, item := range items {
+		values, ok := item.(map[string]interface{})
+		if !ok {
+			r.log.Warn("Repeating section '%s': item %d is not an object, skipped", fieldName, i)
+			continue
+		}
+		content.WriteString(bindContentControls(cloneRepeatingItem(template), fields.MergeData(values), r.log))
+	}
+
+	r.resolveRepeatingSection(fieldName, len(items))
+	return element[:sdt.contentAt] + content.String() + element[sdt.contentAt+len(sdt.content):]
+}
+
+// maxExpansions returns the expansion limit of the merge
+func (r *fieldReplacer) maxExpansions() int {
+	if r.opts.MaxExpansions > 0 {
+		return r.opts.MaxExpansions
+	}
+	return DefaultMaxExpansions
+}
+
+// cloneRepeatingItem removes the identifiers of an item that must not be
+// duplicated
+func cloneRepeatingItem(item string) string {
+	item = sdtIDRegex.ReplaceAllString(item, "")
+	return paragraphIDRegex.ReplaceAllString(item, "")
+}
+
+// bindContentControls fills the tagged content controls inside an item with
+// the values of one array element. Checkboxes take boolean values; other
+// controls get the value as their text.
+func bindContentControls(item string, values fields.MergeData, log *logging.Logger) string {
+	sdt := parseSdt(item, 0)
+	if sdt.contentAt == 0 {
+		return item
+	}
+
+	var content strings.Builder
+	last := 0
+	for {
+		inner, found := nextSdt(sdt.content, last)
+		if !found {
+			break
+		}
+		content.WriteString(sdt.content[last:inner.start])
+		content.WriteString(bindContentControl(sdt.content[inner.start:inner.end], inner, values, log))
+		last = inner.end
+	}
+	content.WriteString(sdt.content[last:])
+
+	return item[:sdt.contentAt] + content.String() + item[sdt.contentAt+len(sdt.content):]
+}
+
+// bindContentControl fills one content control from the element values,
+// descending into untagged or unmatched controls
+func bindContentControl(element string, sdt sdtElement, values fields.MergeData, log *logging.Logger) string {
+	tag := sdtTagRegex.FindStringSubmatch(sdt.properties)
+	var value string
+	found := false
+	if tag != nil {
+		value, found = lookupValue(values, unescapeXML(tag[1]))
+	}
+	if !found {
+		return bindContentControls(element, values, log)
+	}
+
+	properties := showingPlaceholderRegex.ReplaceAllString(sdt.properties, "")
+	content := sdt.content
+	if checkboxRegex.MatchString(properties) {
+		checked, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			log.Warn("Checkbox '%s' ignored: value '%s' is not a boolean", tag[1], value)
+			return element
+		}
+		properties = setCheckboxState(properties, checked)
+		content = setCheckboxGlyph(content, properties, checked)
+	} else {
+		content = setContentText(content, value)
+	}
+
+	propsAt := strings.Index(element, sdt.properties)
+	return element[:propsAt] + properties + element[propsAt+len(sdt.properties):sdt.contentAt] + content + element[sdt.contentAt+len(sdt.content):]
+}
+
+// setContentText puts the value into the first text element of a control's
+// content and empties the others, keeping the run formatting
+func setContentText(content, value string) string {
+	if !runTextRegex.MatchString(content) {
+		return content
+	}
+	first := true
+	return runTextRegex.ReplaceAllStringFunc(content, func(text string) string {
+		openTag := runTextRegex.FindStringSubmatch(text)[1]
+		if first {
+			first = false
+			return openTag + runTabs(escapeXML(value)) + "</w:t>"
+		}
+		return openTag + "</w:t>"
+	})
+}
+
+// resolveRepeatingSection records a repeating section filled from array data
+func (r *fieldReplacer) resolveRepeatingSection(fieldName string, count int) {
+	r.processedFields[fieldName] = true
+	if !contains(r.resolved, fieldName) {
+		r.resolved = append(r.resolved, fieldName)
+	}
+	r.recordOutcome(FieldOutcome{Name: fieldName, Status: FieldStatusResolved, Value: fmt.Sprintf("%d items", count)})
+	r.replacedCounts[fieldName]++
+	r.log.Debug("Repeating section '%s' expanded to %d items", fieldName, count)
+}
+
+// lookupRawValue returns the unformatted merge data value of a field,
+// matching the key case-insensitively
+func lookupRawValue(data fields.MergeData, fieldName string) (interface{}, bool) {
+	return data.Lookup(fieldName)
+}
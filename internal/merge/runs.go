@@ -0,0 +1,158 @@
+package merge
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// textPos locates a byte of paragraph text: the index of its <w:t> element
+// within the paragraph and the offset within that element's content
+type textPos struct {
+	element, offset int
+}
+
+// before reports whether p comes before q in the paragraph text
+func (p textPos) before(q textPos) bool {
+	return p.element < q.element || p.element == q.element && p.offset < q.offset
+}
+
+// splitPlaceholder is a «placeholder» whose text spans several <w:t>
+// elements, from its opening chevron to the end of its closing one
+type splitPlaceholder struct {
+	start, end textPos
+}
+
+// coalesceSplitPlaceholders rejoins the «placeholders» Word split over
+// several runs of a paragraph, e.g. after a partial edit or a spelling mark.
+// Each one is moved whole into a text element of its own in the run holding
+// its opening chevron, so it merges with that run's formatting; the text
+// around it stays in place and the emptied text elements are kept.
+func coalesceSplitPlaceholders(documentXML string) string {
+	if !strings.Contains(documentXML, "«") {
+		return documentXML
+	}
+	return paragraphRegex.ReplaceAllStringFunc(documentXML, coalesceParagraph)
+}
+
+// coalesceParagraph rewrites the text elements of one paragraph holding split
+// placeholders
+func coalesceParagraph(paragraph string) string {
+	// A nested paragraph means the match ended early; leave it alone
+	if len(nestedParagraphRegex.FindAllStringIndex(paragraph, 2)) > 1 {
+		return paragraph
+	}
+
+	matches := runTextRegex.FindAllStringSubmatchIndex(paragraph, -1)
+	contents := make([]string, len(matches))
+	for i, match := range matches {
+		contents[i] = paragraph[match[4]:match[5]]
+		if strings.Contains(contents[i], "<![CDATA[") {
+			return paragraph
+		}
+	}
+
+	// Pair the chevrons across the paragraph text, as the lint does
+	var placeholders []splitPlaceholder
+	var open textPos
+	hasOpen := false
+	for i, content := range contents {
+		for offset, r := range content {
+			switch r {
+			case '«':
+				open, hasOpen = textPos{i, offset}, true
+			case '»':
+				if hasOpen && open.element != i {
+					placeholders = append(placeholders, splitPlaceholder{start: open, end: textPos{i, offset + len("»")}})
+				}
+				hasOpen = false
+			}
+		}
+	}
+	if len(placeholders) == 0 {
+		return paragraph
+	}
+
+	var result strings.Builder
+	last := 0
+	for i, match := range matches {
+		result.WriteString(paragraph[last:match[0]])
+		result.WriteString(rewriteTextElement(paragraph[match[2]:match[3]], contents, i, placeholders))
+		last = match[1]
+	}
+	result.WriteString(paragraph[last:])
+	return result.String()
+}
+
+// rewriteTextElement renders one text element with the split placeholders
+// starting in it as text elements of their own, and without the parts of
+// placeholders starting in earlier elements
+func rewriteTextElement(openTag string, contents []string, element int, placeholders []splitPlaceholder) string {
+	content := contents[element]
+	var result, text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			result.WriteString(preserveSpace(openTag) + text.String() + "</w:t>")
+			text.Reset()
+		}
+	}
+
+	for offset := 0; offset < len(content); {
+		pos := textPos{element, offset}
+		if placeholder, inside := placeholderAt(placeholders, pos); inside {
+			if placeholder.start == pos {
+				flush()
+				result.WriteString(openTag + placeholderText(contents, placeholder) + "</w:t>")
+			}
+			if placeholder.end.element == element {
+				offset = placeholder.end.offset
+			} else {
+				offset = len(content)
+			}
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(content[offset:])
+		text.WriteString(content[offset : offset+size])
+		offset += size
+	}
+	flush()
+
+	if result.Len() == 0 {
+		return openTag + "</w:t>"
+	}
+	return result.String()
+}
+
+// placeholderAt returns the split placeholder covering a text position
+func placeholderAt(placeholders []splitPlaceholder, pos textPos) (splitPlaceholder, bool) {
+	for _, placeholder := range placeholders {
+		if !pos.before(placeholder.start) && pos.before(placeholder.end) {
+			return placeholder, true
+		}
+	}
+	return splitPlaceholder{}, false
+}
+
+// placeholderText joins the text of a split placeholder
+func placeholderText(contents []string, placeholder splitPlaceholder) string {
+	start, end := placeholder.start, placeholder.end
+	if start.element == end.element {
+		return contents[start.element][start.offset:end.offset]
+	}
+
+	var text strings.Builder
+	text.WriteString(contents[start.element][start.offset:])
+	for i := start.element + 1; i < end.element; i++ {
+		text.WriteString(contents[i])
+	}
+	text.WriteString(contents[end.element][:end.offset])
+	return text.String()
+}
+
+// preserveSpace adds xml:space="preserve" to a <w:t> opening tag, so the
+// text left around a moved placeholder keeps its leading and trailing spaces
+func preserveSpace(openTag string) string {
+	if strings.Contains(openTag, "xml:space=") {
+		return openTag
+	}
+	return strings.TrimSuffix(openTag, ">") + ` xml:space="preserve">`
+}
@@ -0,0 +1,183 @@
+package merge
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"com/lifenture/flash-mail-merge/internal/fields"
+	"com/lifenture/flash-mail-merge/internal/logging"
+)
+
+// SecretFieldPrefix marks the fields resolved by SecretsSource: the field
+// «secret:billing/api-key» is filled with the secret billing/api-key
+const SecretFieldPrefix = "secret:"
+
+// IsSecretField reports whether a field is resolved from a secret. The values
+// of such fields are kept out of logs and field outcomes.
+func IsSecretField(fieldName string) bool {
+	return len(fieldName) > len(SecretFieldPrefix) && strings.EqualFold(fieldName[:len(SecretFieldPrefix)], SecretFieldPrefix)
+}
+
+// ErrSecretNotAllowed is the reason a secret field is rejected when its
+// secret ID has none of the allowed prefixes
+var ErrSecretNotAllowed = errors.New("secret ID is not allowed")
+
+// SecretsClient fetches secret values, e.g. from AWS Secrets Manager
+type SecretsClient interface {
+	// GetSecretValue returns the string value of the secret
+	GetSecretValue(secretID string) (string, error)
+}
+
+// SecretsSource resolves fields named with SecretFieldPrefix from a secrets
+// store, so values such as API keys need not travel in request bodies
+type SecretsSource struct {
+	// Client fetches the secrets; a nil client resolves no field
+	Client SecretsClient
+
+	// AllowedPrefixes restricts the secrets a template may read to the IDs
+	// starting with one of the prefixes, such as "mail-merge/"; without a
+	// prefix no secret is fetched
+	AllowedPrefixes []string
+
+	// Logger reports the secrets that cannot be fetched; nil means the
+	// default logger
+	Logger *logging.Logger
+}
+
+// logger returns the logger of the secrets source
+func (s SecretsSource) logger() *logging.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return logging.Default()
+}
+
+// secretFieldID returns the secret ID a secret field names
+func secretFieldID(fieldName string) string {
+	return strings.TrimSpace(fieldName[len(SecretFieldPrefix):])
+}
+
+// allows reports whether the secret ID has one of the allowed prefixes
+func (s SecretsSource) allows(secretID string) bool {
+	for _, prefix := range s.AllowedPrefixes {
+		if prefix != "" && strings.HasPrefix(secretID, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// FieldErrors maps each secret field of a document XML whose secret ID is
+// not allowed to the reason, so a request naming such a secret can be
+// rejected before anything is fetched
+func (s SecretsSource) FieldErrors(documentXML string) map[string]string {
+	errs := make(map[string]string)
+	for _, name := range placeholderNames(documentXML) {
+		if IsSecretField(name) && !s.allows(secretFieldID(name)) {
+			errs[name] = ErrSecretNotAllowed.Error()
+		}
+	}
+	return errs
+}
+
+// Lookup fetches the secret named by the field. A secret that is not allowed
+// or cannot be fetched leaves the field without a value.
+func (s SecretsSource) Lookup(fieldName string, field *fields.MergeField) (string, bool) {
+	if s.Client == nil || !IsSecretField(fieldName) {
+		return "", false
+	}
+	secretID := secretFieldID(fieldName)
+	if !s.allows(secretID) {
+		s.logger().Warn("Refusing to fetch secret '%s': %v", secretID, ErrSecretNotAllowed)
+		return "", false
+	}
+	value, err := s.Client.GetSecretValue(secretID)
+	if err != nil {
+		s.logger().Warn("Failed to fetch secret '%s': %v", secretID, err)
+		return "", false
+	}
+	return value, true
+}
+
+// Name describes the secrets source
+func (s SecretsSource) Name() string {
+	return "secrets manager"
+}
+
+// DefaultSecretsExtensionEndpoint is the local endpoint of the AWS Parameters
+// and Secrets Lambda Extension
+const DefaultSecretsExtensionEndpoint = "http://localhost:2773"
+
+// ExtensionSecretsClient reads secrets from AWS Secrets Manager through the
+// AWS Parameters and Secrets Lambda Extension, which caches them and needs no
+// AWS SDK in the function
+type ExtensionSecretsClient struct {
+	// Endpoint is the extension's base URL; empty means
+	// DefaultSecretsExtensionEndpoint
+	Endpoint string
+
+	// Token authenticates with the extension; empty means the
+	// AWS_SESSION_TOKEN of the function
+	Token string
+
+	// HTTPClient performs the requests; nil means a client with a 5 second
+	// timeout
+	HTTPClient *http.Client
+}
+
+// secretsHTTPClient is the default client of ExtensionSecretsClient
+var secretsHTTPClient = &http.Client{Timeout: 5 * time.Second}
+
+// GetSecretValue fetches the SecretString of a secret from the extension
+func (c ExtensionSecretsClient) GetSecretValue(secretID string) (string, error) {
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = DefaultSecretsExtensionEndpoint
+	}
+	token := c.Token
+	if token == "" {
+		token = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = secretsHTTPClient
+	}
+
+	request, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(endpoint, "/")+"/secretsmanager/get?secretId="+url.QueryEscape(secretID), nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("X-Aws-Parameters-Secrets-Token", token)
+
+	response, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("secrets extension returned status %d", response.StatusCode)
+	}
+
+	var secret struct {
+		SecretString *string `json:"SecretString"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", fmt.Errorf("failed to decode secret: %w", err)
+	}
+	if secret.SecretString == nil {
+		return "", fmt.Errorf("secret has no string value")
+	}
+	return *secret.SecretString, nil
+}
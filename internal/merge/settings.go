@@ -0,0 +1,53 @@
+package merge
+
+import (
+	"regexp"
+
+	"com/lifenture/flash-mail-merge/internal/docx"
+)
+
+const (
+	settingsPart     = "word/settings.xml"
+	settingsRelsPart = "word/_rels/settings.xml.rels"
+)
+
+var (
+	// mailMergeRegex matches the <w:mailMerge> block of the settings part
+	mailMergeRegex = regexp.MustCompile(`(?s)<w:mailMerge\b(?:[^>]*/>|.*?</w:mailMerge>)`)
+
+	// relationshipRefRegex captures r:id references
+	relationshipRefRegex = regexp.MustCompile(`r:id="([^"]+)"`)
+)
+
+// removeMailMergeSettings strips the <w:mailMerge> block from the settings
+// part, together with the data source relationships it references, so the
+// merged document no longer prompts to reconnect to a data source. It reports
+// whether anything was removed.
+func removeMailMergeSettings(doc *docx.DocxFile) bool {
+	settings, exists := doc.Files[settingsPart]
+	if !exists {
+		return false
+	}
+
+	block := mailMergeRegex.Find(settings)
+	if block == nil {
+		return false
+	}
+
+	var referencedIDs []string
+	for _, ref := range relationshipRefRegex.FindAllSubmatch(block, -1) {
+		referencedIDs = append(referencedIDs, string(ref[1]))
+	}
+
+	doc.Files[settingsPart] = mailMergeRegex.ReplaceAll(settings, nil)
+
+	if rels, exists := doc.Files[settingsRelsPart]; exists {
+		for _, id := range referencedIDs {
+			relRegex := regexp.MustCompile(`<Relationship\b[^>]*\bId="` + regexp.QuoteMeta(id) + `"[^>]*/>`)
+			rels = relRegex.ReplaceAll(rels, nil)
+		}
+		doc.Files[settingsRelsPart] = rels
+	}
+
+	return true
+}
@@ -0,0 +1,91 @@
+package merge
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"com/lifenture/flash-mail-merge/internal/fields"
+)
+
+// DefaultEnvPrefix is the prefix of the environment variables read by
+// EnvSource when no prefix is configured
+const DefaultEnvPrefix = "MERGE_DEFAULT_"
+
+// ValueSource supplies values for fields that have neither merge data nor a
+// template default, such as system fields shared by every merge
+type ValueSource interface {
+	// Lookup returns the value for the field, if the source has one. field
+	// holds the template metadata of the field and may be nil.
+	Lookup(fieldName string, field *fields.MergeField) (string, bool)
+
+	// Name describes the source in field outcomes
+	Name() string
+}
+
+// EnvSource reads field values from environment variables named by the
+// prefix followed by the field name, e.g. MERGE_DEFAULT_SupportEmail
+type EnvSource struct {
+	// Prefix is prepended to the field name; empty means DefaultEnvPrefix
+	Prefix string
+}
+
+// Lookup returns the value of the field's environment variable. A variable
+// set to the empty string counts as a value.
+func (s EnvSource) Lookup(fieldName string, field *fields.MergeField) (string, bool) {
+	prefix := s.Prefix
+	if prefix == "" {
+		prefix = DefaultEnvPrefix
+	}
+	return os.LookupEnv(prefix + fieldName)
+}
+
+// Name describes the environment source
+func (s EnvSource) Name() string {
+	return "environment"
+}
+
+// Default layouts of the clock fields, used when the template field has no
+// DateFormat
+var clockLayouts = map[string]string{
+	"today": "2006-01-02",
+	"now":   "2006-01-02 15:04",
+	"year":  "2006",
+}
+
+// ClockSource resolves the virtual fields Today, Now and Year from the
+// server clock, so templates need not receive them in the merge data
+type ClockSource struct {
+	// Location is the time zone of the values; nil means UTC
+	Location *time.Location
+
+	// Now returns the current time; nil means time.Now
+	Now func() time.Time
+}
+
+// Lookup formats the current time for a clock field, using the field's
+// DateFormat when the template provides one
+func (s ClockSource) Lookup(fieldName string, field *fields.MergeField) (string, bool) {
+	layout, ok := clockLayouts[strings.ToLower(fieldName)]
+	if !ok {
+		return "", false
+	}
+	if field != nil && field.Format != nil && field.Format.DateFormat != "" {
+		layout = field.Format.DateFormat
+	}
+
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	location := s.Location
+	if location == nil {
+		location = time.UTC
+	}
+	return now().In(location).Format(layout), true
+}
+
+// Name describes the clock source
+func (s ClockSource) Name() string {
+	return "server clock"
+}
@@ -0,0 +1,38 @@
+package merge
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"com/lifenture/flash-mail-merge/internal/docx"
+	"com/lifenture/flash-mail-merge/internal/fields"
+)
+
+// ErrUnfilledFields is returned by a strict merge that would leave fields
+// without a value
+var ErrUnfilledFields = errors.New("fields left unfilled")
+
+// UnfilledFieldsError lists the fields a strict merge would have skipped. It
+// matches ErrUnfilledFields with errors.Is.
+type UnfilledFieldsError struct {
+	Fields []string
+}
+
+func (e *UnfilledFieldsError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrUnfilledFields, strings.Join(e.Fields, ", "))
+}
+
+func (e *UnfilledFieldsError) Unwrap() error {
+	return ErrUnfilledFields
+}
+
+// PerformMergeStrict performs mail merge like PerformMerge but fails with an
+// *UnfilledFieldsError instead of skipping fields that have no data
+func PerformMergeStrict(doc *docx.DocxFile, data fields.MergeData) ([]byte, error) {
+	result, err := PerformMergeWithOptions(doc, data, Options{Strict: true})
+	if err != nil {
+		return nil, err
+	}
+	return result.Document, nil
+}
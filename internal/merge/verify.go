@@ -0,0 +1,51 @@
+package merge
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"com/lifenture/flash-mail-merge/internal/docx"
+	"com/lifenture/flash-mail-merge/internal/fields"
+)
+
+// VerifyComplete compares a merged document against its template and returns
+// the names of the template fields whose «field» placeholder is still present
+// in the merged output, sorted by name. MERGEFIELD instructions survive a
+// merge, so a field counts as filled once its displayed result no longer
+// shows the placeholder.
+func VerifyComplete(templateBytes, mergedBytes []byte) ([]string, error) {
+	template, err := docx.UnzipDocx(templateBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template: %w", err)
+	}
+	merged, err := docx.UnzipDocx(mergedBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read merged document: %w", err)
+	}
+
+	fieldSet, err := fields.ExtractFields(template)
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract template fields: %w", err)
+	}
+	mergedXML, err := merged.GetDocumentXML()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get merged document XML: %w", err)
+	}
+
+	// Join the text of all runs so placeholders split across runs are found
+	var text strings.Builder
+	for _, match := range runTextRegex.FindAllStringSubmatch(normalizeChevronEntities(string(mergedXML)), -1) {
+		text.WriteString(unescapeXML(match[2]))
+	}
+	content := text.String()
+
+	remaining := []string{}
+	for _, field := range fieldSet.Fields {
+		if strings.Contains(content, "«"+field.Name+"»") {
+			remaining = append(remaining, field.Name)
+		}
+	}
+	sort.Strings(remaining)
+	return remaining, nil
+}
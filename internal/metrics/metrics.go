@@ -0,0 +1,130 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Namespace is the CloudWatch namespace of the emitted metrics
+const Namespace = "FlashMailMerge"
+
+// Request collects the metrics of one request until it is emitted
+type Request struct {
+	// Endpoint is the path of the endpoint that handled the request
+	Endpoint string
+
+	// CorrelationID identifies the request in the logs
+	CorrelationID string
+
+	// Status is the HTTP status code of the response
+	Status int
+
+	// InputBytes and OutputBytes are the sizes of the request and response bodies
+	InputBytes  int
+	OutputBytes int
+
+	// Duration is the time spent handling the request
+	Duration time.Duration
+
+	// FieldsResolved and FieldsSkipped count the fields filled from the merge
+	// data and the fields left without data, summed over batch records
+	FieldsResolved int
+	FieldsSkipped  int
+}
+
+// AddFields adds the field counts of one merge to the request. It does
+// nothing on a nil request, so handlers need not check whether metrics are
+// collected.
+func (r *Request) AddFields(resolved, skipped int) {
+	if r == nil {
+		return
+	}
+	r.FieldsResolved += resolved
+	r.FieldsSkipped += skipped
+}
+
+var (
+	outputMu sync.Mutex
+
+	// output receives the metric lines; nil disables emission
+	output io.Writer
+)
+
+// SetOutput installs the writer receiving the metric lines, typically
+// os.Stdout where the Lambda runtime forwards them to CloudWatch. A nil writer
+// disables emission.
+func SetOutput(w io.Writer) {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	output = w
+}
+
+// Enabled reports whether metric lines are emitted
+func Enabled() bool {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	return output != nil
+}
+
+type requestKey struct{}
+
+// WithRequest returns a copy of ctx carrying the metrics of the request
+func WithRequest(ctx context.Context, r *Request) context.Context {
+	return context.WithValue(ctx, requestKey{}, r)
+}
+
+// FromContext returns the request metrics carried by ctx, or nil
+func FromContext(ctx context.Context) *Request {
+	r, _ := ctx.Value(requestKey{}).(*Request)
+	return r
+}
+
+// metricDefinitions declares the metrics of a request line with their units
+var metricDefinitions = []map[string]string{
+	{"Name": "Requests", "Unit": "Count"},
+	{"Name": "InputBytes", "Unit": "Bytes"},
+	{"Name": "OutputBytes", "Unit": "Bytes"},
+	{"Name": "Duration", "Unit": "Milliseconds"},
+	{"Name": "FieldsResolved", "Unit": "Count"},
+	{"Name": "FieldsSkipped", "Unit": "Count"},
+}
+
+// Emit writes the request metrics as a single line in the CloudWatch
+// embedded metric format, with the endpoint as dimension. It does nothing
+// when emission is disabled.
+func Emit(r *Request) error {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	if output == nil || r == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(map[string]interface{}{
+		"_aws": map[string]interface{}{
+			"Timestamp": time.Now().UnixMilli(),
+			"CloudWatchMetrics": []map[string]interface{}{{
+				"Namespace":  Namespace,
+				"Dimensions": [][]string{{"Endpoint"}},
+				"Metrics":    metricDefinitions,
+			}},
+		},
+		"Endpoint":       r.Endpoint,
+		"CorrelationId":  r.CorrelationID,
+		"Status":         r.Status,
+		"Requests":       1,
+		"InputBytes":     r.InputBytes,
+		"OutputBytes":    r.OutputBytes,
+		"Duration":       float64(r.Duration.Microseconds()) / 1000,
+		"FieldsResolved": r.FieldsResolved,
+		"FieldsSkipped":  r.FieldsSkipped,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode metrics: %w", err)
+	}
+	_, err = fmt.Fprintf(output, "%s\n", line)
+	return err
+}
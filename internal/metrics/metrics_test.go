@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestEmit(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	defer SetOutput(nil)
+
+	request := &Request{Endpoint: "/merge", CorrelationID: "req-1", Status: 200, InputBytes: 10, OutputBytes: 20, Duration: 1500 * time.Microsecond}
+	request.AddFields(3, 1)
+	request.AddFields(2, 0)
+	if err := Emit(request); err != nil {
+		t.Fatalf("Emit failed: %v", err)
+	}
+
+	var line struct {
+		AWS struct {
+			Timestamp         int64 `json:"Timestamp"`
+			CloudWatchMetrics []struct {
+				Namespace  string              `json:"Namespace"`
+				Dimensions [][]string          `json:"Dimensions"`
+				Metrics    []map[string]string `json:"Metrics"`
+			} `json:"CloudWatchMetrics"`
+		} `json:"_aws"`
+		Endpoint       string  `json:"Endpoint"`
+		Status         int     `json:"Status"`
+		Duration       float64 `json:"Duration"`
+		FieldsResolved int     `json:"FieldsResolved"`
+		FieldsSkipped  int     `json:"FieldsSkipped"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("Metric line is not JSON: %v: %s", err, buf.String())
+	}
+	if line.AWS.Timestamp == 0 || len(line.AWS.CloudWatchMetrics) != 1 || line.AWS.CloudWatchMetrics[0].Namespace != Namespace {
+		t.Errorf("Unexpected metric directive: %s", buf.String())
+	}
+	if line.Endpoint != "/merge" || line.Status != 200 || line.Duration != 1.5 || line.FieldsResolved != 5 || line.FieldsSkipped != 1 {
+		t.Errorf("Unexpected metric values: %s", buf.String())
+	}
+}
+
+func TestEmitDisabled(t *testing.T) {
+	SetOutput(nil)
+	if Enabled() {
+		t.Error("Expected emission to be disabled")
+	}
+	if err := Emit(&Request{Endpoint: "/merge"}); err != nil {
+		t.Errorf("Expected no error when disabled, got %v", err)
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	if r := FromContext(context.Background()); r != nil {
+		t.Errorf("Expected no request metrics, got %+v", r)
+	}
+
+	// Adding fields without collected metrics is a no-op
+	FromContext(context.Background()).AddFields(1, 1)
+
+	request := &Request{}
+	if r := FromContext(WithRequest(context.Background(), request)); r != request {
+		t.Error("Expected the request metrics carried by the context")
+	}
+}
@@ -0,0 +1,89 @@
+// Package testutil builds test fixtures in memory, so tests do not depend on
+// sample files being present.
+package testutil
+
+import (
+	"archive/zip"
+	"bytes"
+	"sort"
+	"testing"
+)
+
+// Minimal package parts every DOCX needs besides word/document.xml
+const (
+	contentTypesXML = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+	<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+	<Default Extension="xml" ContentType="application/xml"/>
+	<Override PartName="/word/document.xml" ContentType="application/vnd.openxmlformats-officedocument.wordprocessingml.document.main+xml"/>
+</Types>`
+
+	packageRelsXML = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+	<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="word/document.xml"/>
+</Relationships>`
+
+	documentRelsXML = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"></Relationships>`
+)
+
+// DocumentXML wraps body content such as <w:p> paragraphs in a complete
+// word/document.xml
+func DocumentXML(body string) string {
+	return `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>` + body + `</w:body></w:document>`
+}
+
+// Parts returns the parts of a minimal valid DOCX holding the given document
+// XML: the content types, the package and document relationships and
+// word/document.xml. Tests may add or replace parts before building it.
+func Parts(documentXML string) map[string][]byte {
+	return map[string][]byte{
+		"[Content_Types].xml":          []byte(contentTypesXML),
+		"_rels/.rels":                  []byte(packageRelsXML),
+		"word/_rels/document.xml.rels": []byte(documentRelsXML),
+		"word/document.xml":            []byte(documentXML),
+	}
+}
+
+// Docx builds a minimal valid DOCX holding the given document XML, with its
+// parts compressed as Word writes them
+func Docx(t testing.TB, documentXML string) []byte {
+	t.Helper()
+	return Build(t, Parts(documentXML), zip.Deflate)
+}
+
+// StoredDocx builds the same DOCX as Docx with its parts stored uncompressed,
+// as some generators and zip tools write them
+func StoredDocx(t testing.TB, documentXML string) []byte {
+	t.Helper()
+	return Build(t, Parts(documentXML), zip.Store)
+}
+
+// Build zips the parts with the given compression method, in name order so
+// the same parts always yield the same archive. It fails the test on error.
+func Build(t testing.TB, parts map[string][]byte, method uint16) []byte {
+	t.Helper()
+
+	names := make([]string, 0, len(parts))
+	for name := range parts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	for _, name := range names {
+		file, err := writer.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if err != nil {
+			t.Fatalf("Failed to add %s to the test DOCX: %v", name, err)
+		}
+		if _, err := file.Write(parts[name]); err != nil {
+			t.Fatalf("Failed to write %s to the test DOCX: %v", name, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Failed to close the test DOCX: %v", err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,148 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"com/lifenture/flash-mail-merge/internal/logging"
+)
+
+// Span names of the request processing phases
+const (
+	SpanUnzip    = "docx.unzip"
+	SpanExtract  = "fields.extract"
+	SpanValidate = "fields.validate"
+	SpanReplace  = "merge.replace"
+	SpanRebuild  = "merge.rebuild"
+)
+
+// Span is one timed phase of a request. Its shape mirrors the subset of the
+// OpenTelemetry span API the service needs, so an adapter is a thin wrapper.
+type Span interface {
+	// SetAttribute attaches a key/value pair to the span
+	SetAttribute(key string, value interface{})
+
+	// RecordError marks the span as failed
+	RecordError(err error)
+
+	// End completes the span
+	End()
+}
+
+// Tracer starts spans for the phases of a request
+type Tracer interface {
+	// Start begins a span with the given name for the request identified by
+	// correlationID
+	Start(name, correlationID string) Span
+}
+
+var (
+	tracerMu sync.RWMutex
+
+	// tracer receives all spans; the no-op tracer by default
+	tracer Tracer = noopTracer{}
+)
+
+// SetTracer installs the tracer receiving all spans. A nil tracer restores
+// the default no-op tracer.
+func SetTracer(t Tracer) {
+	tracerMu.Lock()
+	defer tracerMu.Unlock()
+
+	if t == nil {
+		t = noopTracer{}
+	}
+	tracer = t
+}
+
+// Start begins a span on the installed tracer
+func Start(name, correlationID string) Span {
+	tracerMu.RLock()
+	t := tracer
+	tracerMu.RUnlock()
+
+	return t.Start(name, correlationID)
+}
+
+type correlationIDKey struct{}
+
+// WithCorrelationID returns a copy of ctx carrying the request correlation ID
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// CorrelationID returns the correlation ID carried by ctx, or an empty string
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+// noopTracer discards all spans
+type noopTracer struct{}
+
+func (noopTracer) Start(string, string) Span { return noopSpan{} }
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, interface{}) {}
+func (noopSpan) RecordError(error)                {}
+func (noopSpan) End()                             {}
+
+// LogTracer writes every completed span as a structured trace log line
+type LogTracer struct{}
+
+// NewLogTracer creates a tracer emitting spans through the logging package
+func NewLogTracer() *LogTracer {
+	return &LogTracer{}
+}
+
+// Start begins a span that is logged when it ends
+func (t *LogTracer) Start(name, correlationID string) Span {
+	return &logSpan{
+		name:          name,
+		correlationID: correlationID,
+		start:         time.Now(),
+		attributes:    make(map[string]interface{}),
+	}
+}
+
+// logSpan collects the attributes of a span until it is logged
+type logSpan struct {
+	name          string
+	correlationID string
+	start         time.Time
+	attributes    map[string]interface{}
+	err           error
+}
+
+func (s *logSpan) SetAttribute(key string, value interface{}) {
+	s.attributes[key] = value
+}
+
+func (s *logSpan) RecordError(err error) {
+	s.err = err
+}
+
+func (s *logSpan) End() {
+	var line strings.Builder
+	fmt.Fprintf(&line, "span=%s correlationId=%s durationMs=%.3f",
+		s.name, s.correlationID, float64(time.Since(s.start).Microseconds())/1000)
+
+	keys := make([]string, 0, len(s.attributes))
+	for key := range s.attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&line, " %s=%v", key, s.attributes[key])
+	}
+	if s.err != nil {
+		fmt.Fprintf(&line, " error=%q", s.err.Error())
+	}
+
+	logging.Info("[TRACE] %s", line.String())
+}
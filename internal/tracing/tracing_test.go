@@ -0,0 +1,48 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogTracer(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	span := NewLogTracer().Start(SpanRebuild, "req-1")
+	span.SetAttribute("bytes", 42)
+	span.RecordError(errors.New("disk full"))
+	span.End()
+
+	output := buf.String()
+	for _, want := range []string{"[TRACE] span=merge.rebuild", "correlationId=req-1", "durationMs=", "bytes=42", `error="disk full"`} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected trace log to contain %q, got: %s", want, output)
+		}
+	}
+}
+
+func TestSetTracerNilRestoresNoop(t *testing.T) {
+	SetTracer(NewLogTracer())
+	SetTracer(nil)
+
+	if _, ok := Start(SpanUnzip, "req-1").(noopSpan); !ok {
+		t.Error("Expected the no-op tracer after SetTracer(nil)")
+	}
+}
+
+func TestCorrelationID(t *testing.T) {
+	if id := CorrelationID(context.Background()); id != "" {
+		t.Errorf("Expected empty correlation ID, got %q", id)
+	}
+	ctx := WithCorrelationID(context.Background(), "req-1")
+	if id := CorrelationID(ctx); id != "req-1" {
+		t.Errorf("Expected correlation ID %q, got %q", "req-1", id)
+	}
+}
@@ -2,278 +2,2200 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // time zones for the timezone option, independent of the host
+	"unicode"
 
+	"github.com/andybalholm/brotli"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
 
 	"com/lifenture/flash-mail-merge/internal/docx"
 	"com/lifenture/flash-mail-merge/internal/fields"
+	"com/lifenture/flash-mail-merge/internal/lint"
 	"com/lifenture/flash-mail-merge/internal/logging"
 	"com/lifenture/flash-mail-merge/internal/merge"
+	"com/lifenture/flash-mail-merge/internal/metrics"
+	"com/lifenture/flash-mail-merge/internal/tracing"
 )
 
+// API versions of the JSON response contract
+const (
+	apiVersionV1 = "v1" // original response shape
+	apiVersionV2 = "v2" // v1 with typed error objects
+
+	defaultAPIVersion = apiVersionV1
+)
+
+// supportedAPIVersions lists the versions a client may request via Accept-Version
+var supportedAPIVersions = []string{apiVersionV1, apiVersionV2}
+
 // Common headers for all responses
 func getCommonHeaders() map[string]string {
 	return map[string]string{"Content-Type": "application/json"}
 }
 
-// Helper function to create error responses
-func createErrorResponse(statusCode int, errorMessage string) events.APIGatewayProxyResponse {
-	return events.APIGatewayProxyResponse{
-		StatusCode: statusCode,
-		Headers:    getCommonHeaders(),
-		Body:       fmt.Sprintf(`{"error": "%s"}`, errorMessage),
+// Helper function to create error responses
+func createErrorResponse(statusCode int, errorMessage string) events.APIGatewayProxyResponse {
+	body, err := json.Marshal(map[string]string{"error": errorMessage})
+	if err != nil {
+		body = []byte(`{"error": "Failed to create response"}`)
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Headers:    getCommonHeaders(),
+		Body:       string(body),
+	}
+}
+
+// createDetailedErrorResponse creates an error response whose body carries
+// details, such as the problems found, next to the error message
+func createDetailedErrorResponse(statusCode int, errorMessage string, details map[string]interface{}) events.APIGatewayProxyResponse {
+	response := map[string]interface{}{"error": errorMessage}
+	for key, value := range details {
+		response[key] = value
+	}
+	body, err := json.Marshal(response)
+	if err != nil {
+		logging.Error("failed to marshal response: %v", err)
+		return createErrorResponse(http.StatusInternalServerError, "Failed to create response")
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Headers:    getCommonHeaders(),
+		Body:       string(body),
+	}
+}
+
+// getHeader returns the value of a request header using case-insensitive matching
+func getHeader(request events.APIGatewayProxyRequest, name string) string {
+	for key, value := range request.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	for key, values := range request.MultiValueHeaders {
+		if strings.EqualFold(key, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// resolveAPIVersion determines the response contract version requested by the
+// client through the Accept-Version header, defaulting to v1 when absent
+func resolveAPIVersion(request events.APIGatewayProxyRequest) (string, error) {
+	requested := strings.ToLower(strings.TrimSpace(getHeader(request, "Accept-Version")))
+	if requested == "" {
+		return defaultAPIVersion, nil
+	}
+	for _, version := range supportedAPIVersions {
+		if requested == version {
+			return version, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported API version '%s'", requested)
+}
+
+// apiError is the typed error object returned by v2 responses
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// errorCode converts an HTTP status code into a snake_case error code
+func errorCode(statusCode int) string {
+	return strings.ToLower(strings.ReplaceAll(http.StatusText(statusCode), " ", "_"))
+}
+
+// withAPIVersion adds the apiVersion field to a JSON response body and applies
+// the response shape of the given version. Non-JSON bodies are left unchanged.
+func withAPIVersion(ctx context.Context, response events.APIGatewayProxyResponse, version string) events.APIGatewayProxyResponse {
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+		return response
+	}
+
+	// v2 replaces the plain error string with a typed error object
+	if version == apiVersionV2 {
+		var message string
+		if raw, ok := body["error"]; ok && json.Unmarshal(raw, &message) == nil {
+			typed, err := json.Marshal(apiError{Code: errorCode(response.StatusCode), Message: message})
+			if err == nil {
+				body["error"] = typed
+			}
+		}
+	}
+
+	versionJSON, err := json.Marshal(version)
+	if err != nil {
+		return response
+	}
+	body["apiVersion"] = versionJSON
+
+	tagged, err := json.Marshal(body)
+	if err != nil {
+		logging.FromContext(ctx).Error("failed to add API version to response: %v", err)
+		return response
+	}
+	response.Body = string(tagged)
+	return response
+}
+
+// Helper function to create successful response
+func createSuccessResponse(data interface{}) (events.APIGatewayProxyResponse, error) {
+	responseBody, err := json.Marshal(data)
+	if err != nil {
+		return events.APIGatewayProxyResponse{}, fmt.Errorf("failed to marshal response: %w", err)
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Headers:    getCommonHeaders(),
+		Body:       string(responseBody),
+	}, nil
+}
+
+// RequestOptions holds optional processing settings shared by the endpoints
+type RequestOptions struct {
+	DefaultFieldType        fields.FieldType  `json:"defaultFieldType,omitempty"`        // type of fields without type information (default "string")
+	RemoveEmptyParagraphs   bool              `json:"removeEmptyParagraphs,omitempty"`   // delete paragraphs left empty by the merge
+	StripUnresolved         bool              `json:"stripUnresolved,omitempty"`         // remove the placeholders of fields without data instead of keeping them
+	RemoveMailMergeSettings bool              `json:"removeMailMergeSettings,omitempty"` // strip stale <w:mailMerge> data source settings
+	NormalizeLineEndings    bool              `json:"normalizeLineEndings,omitempty"`    // convert line endings of the merged XML to LF
+	PreserveBOM             bool              `json:"preserveBOM,omitempty"`             // keep the UTF-8 BOM of document.xml instead of stripping it
+	MatchPlaceholderCase    bool              `json:"matchPlaceholderCase,omitempty"`    // case merged values like their placeholder
+	HighlightMerged         bool              `json:"highlightMerged,omitempty"`         // highlight merged values for proofing
+	RemoveFieldShading      bool              `json:"removeFieldShading,omitempty"`      // strip the shading of runs holding merged values
+	MergeDrawingText        bool              `json:"mergeDrawingText,omitempty"`        // merge placeholders in SmartArt and drawing text
+	Compact                 bool              `json:"compact,omitempty"`                 // remove media and image relationships no longer referenced
+	PartialOutput           bool              `json:"partialOutput,omitempty"`           // return only the parts changed by the merge instead of the document
+	Verbose                 bool              `json:"verbose,omitempty"`                 // include field outcomes, FILLIN prompts and field styles in the response
+	OutputFormat            string            `json:"outputFormat,omitempty"`            // merge output: "json" (default), "zip" for batches or "pdf"; detect output: "json" (default) or "dotenv"
+	OutputFilename          string            `json:"outputFilename,omitempty"`          // batch ZIP entry name with «Field» placeholders, e.g. "«LastName».docx"
+	StrictOptions           bool              `json:"strictOptions,omitempty"`           // reject unknown option keys
+	ValueTransforms         []string          `json:"valueTransforms,omitempty"`         // transforms applied in order to every string value
+	FieldMapping            map[string]string `json:"fieldMapping,omitempty"`            // data key of template fields named differently, e.g. {"FirstName": "cust_first"}
+	NumbersAsStrings        bool              `json:"numbersAsStrings,omitempty"`        // keep JSON numbers as their literal text instead of float64
+	Timezone                string            `json:"timezone,omitempty"`                // IANA time zone of the Today, Now and Year fields (default UTC)
+	RequireAllFields        bool              `json:"requireAllFields,omitempty"`        // treat every detected field as required
+	FailFast                bool              `json:"failFast,omitempty"`                // stop validation at the first error
+	Locale                  string            `json:"locale,omitempty"`                  // locale of number and date field values, e.g. "en-US" (default none)
+	CurrencySymbol          string            `json:"currencySymbol,omitempty"`          // symbol of currency number fields, overriding their \# picture (default the picture's, else "$")
+	LenientBase64           *bool             `json:"lenientBase64,omitempty"`           // ignore whitespace and missing padding in the docx base64 (default true)
+	EchoConfig              bool              `json:"echoConfig,omitempty"`              // include the effective options in the response "config" field
+	GroupByPrefix           bool              `json:"groupByPrefix,omitempty"`           // group detected fields by the prefix before "_" in the response "groups" field
+	IncludePositions        bool              `json:"includePositions,omitempty"`        // report where each detected field appears in the response "positions" field
+	RequiredMarker          string            `json:"requiredMarker,omitempty"`          // suffix marking required fields in the template, e.g. "Email*" (default "*")
+	PlaceholderSyntax       string            `json:"placeholderSyntax,omitempty"`       // text placeholders: "chevrons" for «Field» (default), "braces" for {{Field}} or "both"
+
+	// unknownKeys lists the option keys of the request that are not recognized
+	unknownKeys []string
+}
+
+// knownOptionKeys holds the JSON keys of RequestOptions
+var knownOptionKeys = func() map[string]bool {
+	keys := make(map[string]bool)
+	optionsType := reflect.TypeOf(RequestOptions{})
+	for i := 0; i < optionsType.NumField(); i++ {
+		if name, _, _ := strings.Cut(optionsType.Field(i).Tag.Get("json"), ","); name != "" && name != "-" {
+			keys[name] = true
+		}
+	}
+	return keys
+}()
+
+// UnmarshalJSON decodes the options and records unrecognized keys
+func (o *RequestOptions) UnmarshalJSON(data []byte) error {
+	type plainOptions RequestOptions
+	if err := json.Unmarshal(data, (*plainOptions)(o)); err != nil {
+		return err
+	}
+
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+	o.unknownKeys = nil
+	for key := range keys {
+		if !knownOptionKeys[key] {
+			o.unknownKeys = append(o.unknownKeys, key)
+		}
+	}
+	sort.Strings(o.unknownKeys)
+	return nil
+}
+
+// optionConflicts lists option combinations that cannot be honored together
+var optionConflicts = []struct {
+	conflicts func(RequestOptions) bool
+	message   string
+}{
+	{
+		conflicts: func(o RequestOptions) bool { return o.Verbose && o.OutputFormat == outputFormatZip },
+		message:   "'verbose' cannot be combined with outputFormat 'zip'",
+	},
+	{
+		conflicts: func(o RequestOptions) bool { return o.PartialOutput && o.OutputFormat == outputFormatZip },
+		message:   "'partialOutput' cannot be combined with outputFormat 'zip'",
+	},
+	{
+		conflicts: func(o RequestOptions) bool { return o.PartialOutput && o.OutputFormat == outputFormatPDF },
+		message:   "'partialOutput' cannot be combined with outputFormat 'pdf'",
+	},
+	{
+		conflicts: func(o RequestOptions) bool { return o.EchoConfig && o.OutputFormat == outputFormatDotenv },
+		message:   "'echoConfig' cannot be combined with outputFormat 'dotenv'",
+	},
+	{
+		conflicts: func(o RequestOptions) bool { return o.GroupByPrefix && o.OutputFormat == outputFormatDotenv },
+		message:   "'groupByPrefix' cannot be combined with outputFormat 'dotenv'",
+	},
+	{
+		conflicts: func(o RequestOptions) bool { return o.IncludePositions && o.OutputFormat == outputFormatDotenv },
+		message:   "'includePositions' cannot be combined with outputFormat 'dotenv'",
+	},
+}
+
+// Output formats
+const (
+	outputFormatJSON = "json" // one base64 document per record
+	outputFormatZip  = "zip"  // a single archive with all documents and a manifest
+
+	// outputFormatPDF returns the merged document converted to PDF
+	outputFormatPDF = "pdf"
+
+	// outputFormatDotenv lists the detected fields as FIELD_NAME= lines
+	outputFormatDotenv = "dotenv"
+)
+
+// MergeRequest represents the request payload for merge operations
+type MergeRequest struct {
+	Docx    string            `json:"docx"`              // base64 DOCX (required)
+	Data    json.RawMessage   `json:"data,omitempty"`    // raw map for merge values (optional)
+	Records []json.RawMessage `json:"records,omitempty"` // raw maps for a batch merge, exclusive with data (optional)
+	CSV     string            `json:"csv,omitempty"`     // CSV text with a header row, one batch record per further row (optional)
+	Options RequestOptions    `json:"options,omitempty"` // processing options (optional)
+	Strict  bool              `json:"strict,omitempty"`  // fail with 422 instead of skipping fields without data (optional)
+
+	DocumentProperties map[string]string `json:"documentProperties,omitempty"` // core properties of the output, e.g. title (optional)
+	DocumentName       string            `json:"documentName,omitempty"`       // name of the template for logs and reports (optional)
+}
+
+// MergeBatchRequest represents the request payload of /merge-batch, which
+// merges one template with many rows of data
+type MergeBatchRequest struct {
+	Docx    string            `json:"docx"`              // base64 DOCX (required)
+	Rows    []json.RawMessage `json:"rows"`              // raw maps for merge values, one per document (required)
+	Options RequestOptions    `json:"options,omitempty"` // processing options (optional)
+	Strict  bool              `json:"strict,omitempty"`  // fail rows whose fields would be skipped (optional)
+
+	DocumentProperties map[string]string `json:"documentProperties,omitempty"` // core properties of the outputs, e.g. title (optional)
+	DocumentName       string            `json:"documentName,omitempty"`       // name of the template for logs and reports (optional)
+}
+
+// DetectRequest represents the request payload for detect operations
+type DetectRequest struct {
+	Docx         string         `json:"docx"`                   // base64 DOCX (required)
+	Options      RequestOptions `json:"options,omitempty"`      // processing options (optional)
+	DocumentName string         `json:"documentName,omitempty"` // name of the template for logs and the response (optional)
+}
+
+// DetectResponse represents the response payload for detect operations
+type DetectResponse struct {
+	DocumentName string `json:"documentName"` // name of the template, "document.docx" unless given
+
+	Data    map[string]string              `json:"data"`              // extracted fields data
+	Prompts []fields.FillInPrompt          `json:"prompts,omitempty"` // FILLIN prompts, verbose only
+	Styles  map[string]*fields.FieldStyles `json:"styles,omitempty"`  // styles in effect at each field, verbose only
+	Groups  map[string][]string            `json:"groups,omitempty"`  // field names without their prefix by prefix, groupByPrefix only
+
+	Positions map[string]fields.FieldPosition `json:"positions,omitempty"` // where each field first appears, with its paragraph text, includePositions only
+
+	Instructions map[string]string `json:"instructions,omitempty"` // raw field instruction of each field, verbose only
+
+	SectionCount       int `json:"sectionCount,omitempty"`       // number of document sections, verbose only
+	EstimatedPageCount int `json:"estimatedPageCount,omitempty"` // page count saved by Word, verbose only and when known
+
+	Config *EffectiveConfig `json:"config,omitempty"` // effective options, echoConfig only
+}
+
+// MergeXMLRequest represents the request payload for merging a bare
+// document.xml
+type MergeXMLRequest struct {
+	XML  string          `json:"xml"`            // WordprocessingML part, e.g. word/document.xml (required)
+	Data json.RawMessage `json:"data,omitempty"` // raw map for merge values (optional)
+}
+
+// MergeXMLResponse represents the response payload of /merge/xml
+type MergeXMLResponse struct {
+	XML           string   `json:"xml"`           // merged XML
+	SkippedFields []string `json:"skippedFields"` // fields without data
+}
+
+// ValidateRequest represents the request payload for validating merge data
+// without merging
+type ValidateRequest struct {
+	Docx    string          `json:"docx"`              // base64 DOCX (required)
+	Data    json.RawMessage `json:"data"`              // raw map for merge values (required)
+	Options RequestOptions  `json:"options,omitempty"` // processing options (optional)
+}
+
+// PreviewRequest represents the request payload for previewing a merge as
+// plain text
+type PreviewRequest struct {
+	Docx    string          `json:"docx"`              // base64 DOCX (required)
+	Data    json.RawMessage `json:"data,omitempty"`    // raw map for merge values (optional)
+	Options RequestOptions  `json:"options,omitempty"` // processing options (optional)
+}
+
+// PreviewResponse represents the response payload of /preview
+type PreviewResponse struct {
+	Text          string   `json:"text"`          // merged document body as plain text
+	SkippedFields []string `json:"skippedFields"` // fields without data
+}
+
+// LintRequest represents the request payload for template lint operations
+type LintRequest struct {
+	Docx    string         `json:"docx"`              // base64 DOCX (required)
+	Options RequestOptions `json:"options,omitempty"` // processing options (optional)
+}
+
+// CapabilitiesResponse represents the response payload of /capabilities
+type CapabilitiesResponse struct {
+	Endpoints     []string            `json:"endpoints"`     // supported request paths
+	APIVersions   []string            `json:"apiVersions"`   // versions accepted in Accept-Version
+	Options       []OptionCapability  `json:"options"`       // request options in declaration order
+	FieldTypes    []fields.FieldType  `json:"fieldTypes"`    // known field types
+	OutputFormats map[string][]string `json:"outputFormats"` // outputFormat values by endpoint
+}
+
+// OptionCapability describes one request option
+type OptionCapability struct {
+	Name    string      `json:"name"`    // JSON key in "options"
+	Type    string      `json:"type"`    // JSON type: boolean, string, integer, number, array or object
+	Default interface{} `json:"default"` // value in effect when the option is omitted
+}
+
+// endpoints lists the request paths served by route
+var endpoints = []string{"/merge", "/merge-batch", "/merge/xml", "/preview", "/validate", "/detect", "/template/lint", "/capabilities"}
+
+// validateOptions checks the request options before any document processing
+// and reports every problem found. Unknown keys are rejected only with
+// strictOptions set, and otherwise logged as ignored.
+func validateOptions(ctx context.Context, opts RequestOptions) error {
+	if len(opts.unknownKeys) > 0 && !opts.StrictOptions {
+		logging.FromContext(ctx).Warn("Ignoring unknown options: %v", opts.unknownKeys)
+	}
+	if problems := optionProblems(opts); len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// optionProblems lists the unknown values, conflicting combinations and, with
+// strictOptions, the unknown keys of the request options
+func optionProblems(opts RequestOptions) []string {
+	var problems []string
+	if opts.DefaultFieldType != "" && !opts.DefaultFieldType.IsValid() {
+		problems = append(problems, fmt.Sprintf("unknown defaultFieldType '%s'", opts.DefaultFieldType))
+	}
+	if opts.OutputFormat != "" && opts.OutputFormat != outputFormatJSON && opts.OutputFormat != outputFormatZip && opts.OutputFormat != outputFormatPDF && opts.OutputFormat != outputFormatDotenv {
+		problems = append(problems, fmt.Sprintf("unknown outputFormat '%s'", opts.OutputFormat))
+	}
+	for _, name := range opts.ValueTransforms {
+		if !fields.IsValidTransform(name) {
+			problems = append(problems, fmt.Sprintf("unknown valueTransform '%s'", name))
+		}
+	}
+	mappedFields := make([]string, 0, len(opts.FieldMapping))
+	for field := range opts.FieldMapping {
+		mappedFields = append(mappedFields, field)
+	}
+	sort.Strings(mappedFields)
+	for _, field := range mappedFields {
+		if strings.TrimSpace(field) == "" {
+			problems = append(problems, "fieldMapping has an empty field name")
+		} else if strings.TrimSpace(opts.FieldMapping[field]) == "" {
+			problems = append(problems, fmt.Sprintf("fieldMapping for '%s' has an empty data key", field))
+		}
+	}
+	if opts.Timezone != "" {
+		if _, err := time.LoadLocation(opts.Timezone); err != nil {
+			problems = append(problems, fmt.Sprintf("unknown timezone '%s'", opts.Timezone))
+		}
+	}
+	if opts.Locale != "" && !merge.IsValidLocale(opts.Locale) {
+		problems = append(problems, fmt.Sprintf("unknown locale '%s'", opts.Locale))
+	}
+	if _, ok := fields.SyntaxDelimiters(opts.PlaceholderSyntax); !ok {
+		problems = append(problems, fmt.Sprintf("unknown placeholderSyntax '%s'", opts.PlaceholderSyntax))
+	}
+	for _, conflict := range optionConflicts {
+		if conflict.conflicts(opts) {
+			problems = append(problems, conflict.message)
+		}
+	}
+
+	if opts.StrictOptions {
+		for _, key := range opts.unknownKeys {
+			problems = append(problems, fmt.Sprintf("unknown option '%s'", key))
+		}
+	}
+	return problems
+}
+
+// requestSchema describes the JSON body of an endpoint: the request type it
+// is decoded into, whose fields give the type of each key, and the keys that
+// must be present
+type requestSchema struct {
+	request  reflect.Type
+	required []string
+}
+
+// requestSchemas holds the schema of each endpoint taking a JSON body
+var requestSchemas = map[string]requestSchema{
+	"/merge":         {request: reflect.TypeOf(MergeRequest{}), required: []string{"docx"}},
+	"/merge-batch":   {request: reflect.TypeOf(MergeBatchRequest{}), required: []string{"docx", "rows"}},
+	"/merge/xml":     {request: reflect.TypeOf(MergeXMLRequest{}), required: []string{"xml"}},
+	"/preview":       {request: reflect.TypeOf(PreviewRequest{}), required: []string{"docx"}},
+	"/validate":      {request: reflect.TypeOf(ValidateRequest{}), required: []string{"docx", "data"}},
+	"/detect":        {request: reflect.TypeOf(DetectRequest{}), required: []string{"docx"}},
+	"/template/lint": {request: reflect.TypeOf(LintRequest{}), required: []string{"docx"}},
+}
+
+// rawMessageType is the type of request fields holding merge data, which
+// must be JSON objects
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// requestProblems checks a request body against the schema of its endpoint
+// before anything is decoded, and lists every problem found: missing required
+// keys, values of the wrong JSON type and invalid options. Keys the request
+// type does not know are ignored. A body that is not a JSON object is the only
+// problem reported for it.
+func requestProblems(body string, schema requestSchema) []string {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(body), &object); err != nil || object == nil {
+		return []string{"Invalid input"}
+	}
+
+	var problems []string
+	for _, key := range schema.required {
+		switch raw, present := object[key]; {
+		case !present, jsonValueType(raw) == "null", string(raw) == `""`, string(raw) == "[]":
+			problems = append(problems, fmt.Sprintf("'%s' key missing", key))
+		}
+	}
+
+	for i := 0; i < schema.request.NumField(); i++ {
+		field := schema.request.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if raw, present := object[name]; present {
+			problems = append(problems, typeProblems(name, raw, field.Type)...)
+		}
+	}
+
+	// Check the option values once their types are known to be right
+	if raw, present := object["options"]; present && jsonValueType(raw) == "object" && len(typeProblems("options", raw, reflect.TypeOf(RequestOptions{}))) == 0 {
+		var opts RequestOptions
+		if err := json.Unmarshal(raw, &opts); err == nil {
+			for _, problem := range optionProblems(opts) {
+				problems = append(problems, "Invalid options: "+problem)
+			}
+		}
+	}
+	return problems
+}
+
+// typeProblems checks that a JSON value has the type of the Go type it is
+// decoded into, descending into arrays, option objects and maps. Values are
+// named by their path in the request, such as records[1] or options.locale.
+// Null values are accepted like the decoder does.
+func typeProblems(path string, raw json.RawMessage, t reflect.Type) []string {
+	got := jsonValueType(raw)
+	if got == "null" {
+		return nil
+	}
+	want := "object"
+	if t != rawMessageType {
+		want = jsonTypeName(t)
+	}
+	if want == "integer" && got == "number" {
+		// JSON has one number type; integer fields take whole numbers only
+		var value float64
+		if err := json.Unmarshal(raw, &value); err != nil || value != math.Trunc(value) {
+			return []string{fmt.Sprintf("'%s' must be an integer, got %s", path, bytes.TrimSpace(raw))}
+		}
+		got = want
+	}
+	if got != want {
+		return []string{fmt.Sprintf("'%s' must be %s %s, got %s", path, article(want), want, got)}
+	}
+
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var problems []string
+	switch {
+	case t == rawMessageType:
+		// Merge data may hold any values
+	case want == "array":
+		var items []json.RawMessage
+		json.Unmarshal(raw, &items)
+		for i, item := range items {
+			problems = append(problems, typeProblems(fmt.Sprintf("%s[%d]", path, i), item, t.Elem())...)
+		}
+	case t.Kind() == reflect.Map:
+		var members map[string]json.RawMessage
+		json.Unmarshal(raw, &members)
+		keys := make([]string, 0, len(members))
+		for key := range members {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			problems = append(problems, typeProblems(path+"."+key, members[key], t.Elem())...)
+		}
+	case t.Kind() == reflect.Struct:
+		var members map[string]json.RawMessage
+		json.Unmarshal(raw, &members)
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+			if member, present := members[name]; present && name != "" && name != "-" {
+				problems = append(problems, typeProblems(path+"."+name, member, t.Field(i).Type)...)
+			}
+		}
+	}
+	return problems
+}
+
+// jsonValueType returns the JSON type of a raw value, in the names of
+// jsonTypeName, or "null"
+func jsonValueType(raw json.RawMessage) string {
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) == 0 {
+		return "null"
+	}
+	switch trimmed[0] {
+	case '{':
+		return "object"
+	case '[':
+		return "array"
+	case '"':
+		return "string"
+	case 't', 'f':
+		return "boolean"
+	case 'n':
+		return "null"
+	}
+	return "number"
+}
+
+// article returns the indefinite article of a JSON type name
+func article(typeName string) string {
+	if strings.ContainsRune("aeiou", rune(typeName[0])) {
+		return "an"
+	}
+	return "a"
+}
+
+// schemaErrorResponse answers a request failing schema validation with 400
+// Bad Request, listing every problem; the error message joins them
+func schemaErrorResponse(problems []string) events.APIGatewayProxyResponse {
+	return createDetailedErrorResponse(http.StatusBadRequest, strings.Join(problems, "; "), map[string]interface{}{"problems": problems})
+}
+
+// extractOptions converts the request options into field extraction options.
+// Text placeholders are detected as fields only when the request names their
+// syntax, so templates merged with the default «Field» syntax keep reporting
+// their MERGEFIELDs alone.
+func (o RequestOptions) extractOptions() fields.ExtractOptions {
+	opts := fields.ExtractOptions{DefaultFieldType: o.DefaultFieldType, RequiredMarker: o.RequiredMarker}
+	if o.PlaceholderSyntax != "" {
+		opts.Delimiters = o.delimiters()
+	}
+	return opts
+}
+
+// delimiters returns the delimiters of the placeholderSyntax option
+func (o RequestOptions) delimiters() []fields.Delimiters {
+	delimiters, _ := fields.SyntaxDelimiters(o.PlaceholderSyntax)
+	return delimiters
+}
+
+// mergeOptions converts the request options into merge options, logging and
+// tracing the merge under the request of ctx
+func (o RequestOptions) mergeOptions(ctx context.Context) merge.Options {
+	logger := logging.FromContext(ctx)
+	opts := merge.Options{
+		RemoveEmptyParagraphs:   o.RemoveEmptyParagraphs,
+		StripUnresolved:         o.StripUnresolved,
+		RemoveMailMergeSettings: o.RemoveMailMergeSettings,
+		NormalizeLineEndings:    o.NormalizeLineEndings,
+		PreserveBOM:             o.PreserveBOM,
+		MatchPlaceholderCase:    o.MatchPlaceholderCase,
+		HighlightMerged:         o.HighlightMerged,
+		RemoveFieldShading:      o.RemoveFieldShading,
+		MergeDrawingText:        o.MergeDrawingText,
+		Compact:                 o.Compact,
+		MaxExpansions:           maxExpansions,
+		MaxOutputSize:           maxOutputSize,
+		PartialOutput:           o.PartialOutput,
+		Locale:                  o.Locale,
+		CurrencySymbol:          o.CurrencySymbol,
+		RequiredMarker:          strings.TrimSpace(o.RequiredMarker),
+		Delimiters:              o.delimiters(),
+		CorrelationID:           tracing.CorrelationID(ctx),
+		Logger:                  logger,
+
+		// Service-wide values such as MERGE_DEFAULT_SupportEmail fill
+		// fields missing from the data and the template defaults, then the
+		// Today, Now and Year fields come from the server clock
+		FallbackSources: []merge.ValueSource{
+			merge.EnvSource{},
+			merge.ClockSource{Location: o.location()},
+		},
+	}
+
+	// Fields such as «secret:billing/api-key» come from Secrets Manager
+	// when a secrets client is configured
+	if secretsClient != nil {
+		opts.FallbackSources = append(opts.FallbackSources, secretsSource(logger))
+	}
+	return opts
+}
+
+// secretsClient resolves the secret: fields; nil disables them
+var secretsClient merge.SecretsClient
+
+// secretsAllowedPrefixes are the prefixes of the secret IDs templates may
+// read, from SECRETS_ALLOWED_PREFIX
+var secretsAllowedPrefixes []string
+
+// secretsSource returns the source of the secret: fields
+func secretsSource(logger *logging.Logger) merge.SecretsSource {
+	return merge.SecretsSource{Client: secretsClient, AllowedPrefixes: secretsAllowedPrefixes, Logger: logger}
+}
+
+// pdfConverter renders the merged documents of outputFormat "pdf"
+var pdfConverter merge.PDFConverter = merge.UnconfiguredConverter{}
+
+// maxExpansions bounds the repeating section items of a merge; zero means
+// merge.DefaultMaxExpansions
+var maxExpansions int
+
+// maxOutputSize bounds the size in bytes of a merged document; zero means
+// merge.DefaultMaxOutputSize
+var maxOutputSize int
+
+// lenientBase64 reports whether the docx base64 is decoded leniently, which
+// is the default
+func (o RequestOptions) lenientBase64() bool {
+	return o.LenientBase64 == nil || *o.LenientBase64
+}
+
+// location returns the time zone of the timezone option, UTC by default.
+// The option is checked by validateOptions.
+func (o RequestOptions) location() *time.Location {
+	if o.Timezone == "" {
+		return time.UTC
+	}
+	location, err := time.LoadLocation(o.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+// EffectiveConfig reports the options a request was processed with, after
+// defaults and server settings are applied
+type EffectiveConfig struct {
+	DefaultFieldType        fields.FieldType  `json:"defaultFieldType"`
+	RemoveEmptyParagraphs   bool              `json:"removeEmptyParagraphs"`
+	StripUnresolved         bool              `json:"stripUnresolved"`
+	RemoveMailMergeSettings bool              `json:"removeMailMergeSettings"`
+	NormalizeLineEndings    bool              `json:"normalizeLineEndings"`
+	PreserveBOM             bool              `json:"preserveBOM"`
+	MatchPlaceholderCase    bool              `json:"matchPlaceholderCase"`
+	HighlightMerged         bool              `json:"highlightMerged"`
+	RemoveFieldShading      bool              `json:"removeFieldShading"`
+	MergeDrawingText        bool              `json:"mergeDrawingText"`
+	Compact                 bool              `json:"compact"`
+	PartialOutput           bool              `json:"partialOutput"`
+	Verbose                 bool              `json:"verbose"`
+	OutputFormat            string            `json:"outputFormat"`
+	OutputFilename          string            `json:"outputFilename"`
+	StrictOptions           bool              `json:"strictOptions"`
+	ValueTransforms         []string          `json:"valueTransforms"`
+	FieldMapping            map[string]string `json:"fieldMapping"`
+	NumbersAsStrings        bool              `json:"numbersAsStrings"`
+	Timezone                string            `json:"timezone"`
+	RequireAllFields        bool              `json:"requireAllFields"`
+	FailFast                bool              `json:"failFast"`
+	Locale                  string            `json:"locale"`
+	CurrencySymbol          string            `json:"currencySymbol"`
+	LenientBase64           bool              `json:"lenientBase64"`
+	GroupByPrefix           bool              `json:"groupByPrefix"`
+	IncludePositions        bool              `json:"includePositions"`
+	RequiredMarker          string            `json:"requiredMarker"`
+	PlaceholderSyntax       string            `json:"placeholderSyntax"`
+	MaxRepeatExpansions     int               `json:"maxRepeatExpansions"` // server limit on repeating section items
+	MaxOutputBytes          int               `json:"maxOutputBytes"`      // server limit on the size of a merged document
+	FallbackSources         []string          `json:"fallbackSources"`     // value sources consulted for fields without data, in order
+	IgnoredOptions          []string          `json:"ignoredOptions"`      // unknown option keys that were ignored
+}
+
+// effectiveConfig resolves the request options against their defaults and
+// the server settings
+func (o RequestOptions) effectiveConfig() EffectiveConfig {
+	config := EffectiveConfig{
+		DefaultFieldType:        o.DefaultFieldType,
+		RemoveEmptyParagraphs:   o.RemoveEmptyParagraphs,
+		StripUnresolved:         o.StripUnresolved,
+		RemoveMailMergeSettings: o.RemoveMailMergeSettings,
+		NormalizeLineEndings:    o.NormalizeLineEndings,
+		PreserveBOM:             o.PreserveBOM,
+		MatchPlaceholderCase:    o.MatchPlaceholderCase,
+		HighlightMerged:         o.HighlightMerged,
+		RemoveFieldShading:      o.RemoveFieldShading,
+		MergeDrawingText:        o.MergeDrawingText,
+		Compact:                 o.Compact,
+		PartialOutput:           o.PartialOutput,
+		Verbose:                 o.Verbose,
+		OutputFormat:            o.OutputFormat,
+		OutputFilename:          o.OutputFilename,
+		StrictOptions:           o.StrictOptions,
+		ValueTransforms:         append([]string{}, o.ValueTransforms...),
+		FieldMapping:            make(map[string]string, len(o.FieldMapping)),
+		NumbersAsStrings:        o.NumbersAsStrings,
+		Timezone:                o.location().String(),
+		RequireAllFields:        o.RequireAllFields,
+		FailFast:                o.FailFast,
+		Locale:                  o.Locale,
+		CurrencySymbol:          o.CurrencySymbol,
+		LenientBase64:           o.lenientBase64(),
+		GroupByPrefix:           o.GroupByPrefix,
+		IncludePositions:        o.IncludePositions,
+		RequiredMarker:          o.RequiredMarker,
+		PlaceholderSyntax:       strings.ToLower(strings.TrimSpace(o.PlaceholderSyntax)),
+		MaxRepeatExpansions:     maxExpansions,
+		MaxOutputBytes:          maxOutputSize,
+		FallbackSources:         []string{},
+		IgnoredOptions:          append([]string{}, o.unknownKeys...),
+	}
+	if config.DefaultFieldType == "" {
+		config.DefaultFieldType = fields.FieldTypeString
+	}
+	if config.OutputFormat == "" {
+		config.OutputFormat = outputFormatJSON
+	}
+	if strings.TrimSpace(config.RequiredMarker) == "" {
+		config.RequiredMarker = fields.DefaultRequiredMarker
+	}
+	if config.PlaceholderSyntax == "" {
+		config.PlaceholderSyntax = fields.SyntaxChevrons
+	}
+	if config.CurrencySymbol == "" {
+		config.CurrencySymbol = merge.DefaultCurrencySymbol
+	}
+	if config.MaxRepeatExpansions <= 0 {
+		config.MaxRepeatExpansions = merge.DefaultMaxExpansions
+	}
+	if config.MaxOutputBytes <= 0 {
+		config.MaxOutputBytes = merge.DefaultMaxOutputSize
+	}
+	for field, key := range o.FieldMapping {
+		config.FieldMapping[field] = key
+	}
+	for _, source := range o.mergeOptions(context.Background()).FallbackSources {
+		config.FallbackSources = append(config.FallbackSources, source.Name())
+	}
+	return config
+}
+
+// MergeSummary is a concise machine- and human-readable report of a merge
+type MergeSummary struct {
+	TotalFields         int    `json:"totalFields"`         // fields detected in the template
+	Resolved            int    `json:"resolved"`            // fields filled from the merge data
+	Defaulted           int    `json:"defaulted"`           // fields filled with their default value
+	Skipped             int    `json:"skipped"`             // fields without data
+	HadValidationErrors bool   `json:"hadValidationErrors"` // validation failed, so no merge was performed
+	Message             string `json:"message"`             // one-line description
+}
+
+// buildMergeSummary creates the summary for a merge request. The merge result
+// is nil when validation failed and the merge was not performed.
+func buildMergeSummary(fieldSet *fields.MergeFieldSet, validation fields.ValidationResult, result *merge.Result) MergeSummary {
+	summary := MergeSummary{
+		TotalFields:         fieldSet.TotalFields,
+		HadValidationErrors: !validation.Valid,
+	}
+
+	if result == nil {
+		summary.Message = fmt.Sprintf("Validation failed with %d error(s); document was not merged", len(validation.Errors))
+		return summary
+	}
+
+	summary.Resolved = len(result.Resolved)
+	summary.Defaulted = len(result.Defaulted)
+	summary.Skipped = len(result.Skipped)
+	summary.Message = fmt.Sprintf("Merged %d of %d fields", summary.Resolved+summary.Defaulted, summary.TotalFields)
+	if summary.Defaulted > 0 {
+		summary.Message += fmt.Sprintf("; %d defaulted", summary.Defaulted)
+	}
+	if summary.Skipped > 0 {
+		summary.Message += fmt.Sprintf("; %d skipped: %s", summary.Skipped, strings.Join(result.Skipped, ", "))
+	}
+	return summary
+}
+
+// validationOutcomes reports the fields that failed validation as error
+// outcomes, sorted by field name
+func validationOutcomes(validation fields.ValidationResult) []merge.FieldOutcome {
+	outcomes := []merge.FieldOutcome{}
+	for _, name := range validation.MissingFields {
+		outcomes = append(outcomes, merge.FieldOutcome{Name: name, Status: merge.FieldStatusError, Reason: "required field is missing"})
+	}
+	for name, reason := range validation.FieldErrors {
+		outcomes = append(outcomes, merge.FieldOutcome{Name: name, Status: merge.FieldStatusError, Reason: reason})
+	}
+	sort.Slice(outcomes, func(i, j int) bool { return outcomes[i].Name < outcomes[j].Name })
+	return outcomes
+}
+
+// base64DecodeError marks a failure to decode the base64 DOCX input, as
+// opposed to a failure to read the decoded archive
+type base64DecodeError struct {
+	err error
+}
+
+func (e *base64DecodeError) Error() string { return e.err.Error() }
+
+func (e *base64DecodeError) Unwrap() error { return e.err }
+
+// base64Reader tags the read errors of a base64 decoder as base64DecodeError
+type base64Reader struct {
+	decoder io.Reader
+}
+
+func (r base64Reader) Read(p []byte) (int, error) {
+	n, err := r.decoder.Read(p)
+	if err != nil && err != io.EOF {
+		err = &base64DecodeError{err: err}
+	}
+	return n, err
+}
+
+// lenientBase64Reader drops all whitespace from base64 input, such as the line
+// breaks of PEM-style wrapping, and appends the padding missing at its end
+type lenientBase64Reader struct {
+	src     io.Reader
+	count   int // non-whitespace characters read
+	padding int // padding characters still to emit
+	eof     bool
+}
+
+func (r *lenientBase64Reader) Read(p []byte) (int, error) {
+	if r.eof {
+		n := 0
+		for ; n < len(p) && r.padding > 0; n++ {
+			p[n] = '='
+			r.padding--
+		}
+		if r.padding == 0 {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+
+	n, err := r.src.Read(p)
+	kept := 0
+	for _, c := range p[:n] {
+		switch c {
+		case ' ', '\t', '\r', '\n', '\f', '\v':
+			continue
+		}
+		p[kept] = c
+		kept++
+	}
+	r.count += kept
+
+	if err == io.EOF {
+		r.eof = true
+		// A single character in the last quantum cannot be completed
+		if missing := (4 - r.count%4) % 4; missing < 3 {
+			r.padding = missing
+		}
+		if r.padding > 0 {
+			err = nil
+		}
+	}
+	return kept, err
+}
+
+// decodeDocx decodes a base64 DOCX by streaming it into the unzip path, so the
+// decoded archive is never held alongside a byte copy of the input string.
+// With lenient set, whitespace is ignored and missing padding is added.
+func decodeDocx(encoded string, lenient bool) (*docx.DocxFile, error) {
+	return decodeDocxParts(encoded, lenient, nil)
+}
+
+// decodeDocxParts decodes a base64 DOCX like decodeDocx, keeping only the
+// parts for which keep returns true
+func decodeDocxParts(encoded string, lenient bool, keep func(name string) bool) (*docx.DocxFile, error) {
+	var src io.Reader = strings.NewReader(encoded)
+	if lenient {
+		src = &lenientBase64Reader{src: src}
+	}
+	decoder := base64.NewDecoder(base64.StdEncoding, src)
+	return docx.UnzipDocxPartsReader(base64Reader{decoder: decoder}, base64.StdEncoding.DecodedLen(len(encoded)), keep)
+}
+
+// decodeTemplate decodes the base64 DOCX of a request, keeping only the parts
+// for which keep returns true (all parts when keep is nil), and checks that it
+// is a Word document. When it fails, ok is false and errResponse is the error
+// response for the client.
+func decodeTemplate(ctx context.Context, encoded string, opts RequestOptions, keep func(name string) bool) (docxFile *docx.DocxFile, errResponse events.APIGatewayProxyResponse, ok bool) {
+	logger := logging.FromContext(ctx)
+
+	// Stream the base64 input straight into the unzip path
+	unzipSpan := tracing.Start(tracing.SpanUnzip, tracing.CorrelationID(ctx))
+	docxFile, err := decodeDocxParts(encoded, opts.lenientBase64(), keep)
+	if err != nil {
+		unzipSpan.RecordError(err)
+	}
+	unzipSpan.End()
+	if err != nil {
+		var decodeErr *base64DecodeError
+		if errors.As(err, &decodeErr) {
+			logger.Error("failed to decode base64 string: %v", err)
+			return nil, createErrorResponse(http.StatusBadRequest, "Failed to decode base64 input"), false
+		}
+		if errors.Is(err, docx.ErrEmptyDocument) {
+			logger.Error("decoded docx is empty")
+			return nil, createErrorResponse(http.StatusBadRequest, "Decoded 'docx' is an empty document"), false
+		}
+		logger.Error("failed to create DOCX file: %v", err)
+		return nil, createErrorResponse(http.StatusInternalServerError, "Failed to process document"), false
+	}
+	if err := docxFile.CheckWordDocument(); err != nil {
+		logger.Error("rejected upload: %v", err)
+		return nil, createErrorResponse(http.StatusBadRequest, err.Error()), false
+	}
+	return docxFile, events.APIGatewayProxyResponse{}, true
+}
+
+// parseMergeData parses raw JSON data into MergeData with duplicate-key "first-win" logic.
+// If a key appears multiple times in the JSON object, only the first occurrence is kept.
+// With numbersAsStrings, numbers are decoded as json.Number so large integers keep
+// every digit.
+func parseMergeData(raw json.RawMessage, numbersAsStrings bool) (fields.MergeData, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	if numbersAsStrings {
+		decoder.UseNumber()
+	}
+
+	// Read the opening brace
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read opening token: %w", err)
+	}
+
+	// Expect opening brace
+	if delim, ok := token.(json.Delim); !ok || delim != '{' {
+		return nil, fmt.Errorf("expected opening brace, got %T: %v", token, token)
+	}
+
+	result := make(fields.MergeData)
+
+	// Process key-value pairs
+	for decoder.More() {
+		// Read the key
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key token: %w", err)
+		}
+
+		key, ok := token.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected string key, got %T: %v", token, token)
+		}
+
+		// Check if key already exists (first-win logic)
+		if _, exists := result[key]; exists {
+			// Skip the value for this duplicate key
+			var dummy interface{}
+			if err := decoder.Decode(&dummy); err != nil {
+				return nil, fmt.Errorf("failed to skip duplicate key value: %w", err)
+			}
+		} else {
+			// Decode the value for this new key
+			var value interface{}
+			if err := decoder.Decode(&value); err != nil {
+				return nil, fmt.Errorf("failed to decode value for key %s: %w", key, err)
+			}
+			result[key] = value
+		}
+	}
+
+	// Read the closing brace
+	token, err = decoder.Token()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read closing token: %w", err)
+	}
+
+	// Expect closing brace
+	if delim, ok := token.(json.Delim); !ok || delim != '}' {
+		return nil, fmt.Errorf("expected closing brace, got %T: %v", token, token)
+	}
+
+	return result, nil
+}
+
+// csvRecords converts CSV text into batch records. The first row names the
+// fields; a header matching a template field case-insensitively takes the
+// field's name. Every further row becomes a record of string values, written
+// as a JSON object in column order so repeated headers are reported like
+// duplicate keys.
+func csvRecords(text string, fieldSet *fields.MergeFieldSet) ([]json.RawMessage, error) {
+	rows, err := csv.NewReader(strings.NewReader(strings.TrimPrefix(text, "\ufeff"))).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) < 2 {
+		return nil, errors.New("expected a header row and at least one record")
+	}
+
+	keys := make([][]byte, len(rows[0]))
+	for i, header := range rows[0] {
+		name := strings.TrimSpace(header)
+		if field := fieldSet.GetFieldByName(name); field != nil {
+			name = field.Name
+		}
+		if keys[i], err = json.Marshal(name); err != nil {
+			return nil, err
+		}
+	}
+
+	records := make([]json.RawMessage, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		var record bytes.Buffer
+		record.WriteByte('{')
+		for i, value := range row {
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			if i > 0 {
+				record.WriteByte(',')
+			}
+			record.Write(keys[i])
+			record.WriteByte(':')
+			record.Write(encoded)
+		}
+		record.WriteByte('}')
+		records = append(records, record.Bytes())
+	}
+	return records, nil
+}
+
+// handleMerge handles the /merge endpoint (existing merge functionality)
+func handleMerge(ctx context.Context, req MergeRequest) events.APIGatewayProxyResponse {
+	logger := logging.FromContext(ctx)
+
+	// Check if docx field is present
+	if req.Docx == "" {
+		logger.Error("'docx' field is empty")
+		return createErrorResponse(http.StatusBadRequest, "'docx' key missing")
+	}
+
+	// Reject invalid options before decoding anything
+	if err := validateOptions(ctx, req.Options); err != nil {
+		logger.Error("invalid options: %v", err)
+		return createErrorResponse(http.StatusBadRequest, "Invalid options: "+err.Error())
+	}
+	if req.Options.OutputFormat == outputFormatDotenv {
+		logger.Error("outputFormat 'dotenv' requested on /merge")
+		return createErrorResponse(http.StatusBadRequest, "Invalid options: outputFormat 'dotenv' is only supported by /detect")
+	}
+	if err := docx.ValidateCoreProperties(req.DocumentProperties); err != nil {
+		logger.Error("invalid document properties: %v", err)
+		return createErrorResponse(http.StatusBadRequest, "Invalid documentProperties: "+err.Error())
+	}
+
+	docxFile, errResponse, ok := decodeTemplate(ctx, req.Docx, req.Options, nil)
+	if !ok {
+		return errResponse
+	}
+	correlationID := tracing.CorrelationID(ctx)
+
+	// Extract fields to get MergeFieldSet
+	extractSpan := tracing.Start(tracing.SpanExtract, correlationID)
+	extractOpts := req.Options.extractOptions()
+	extractOpts.DocumentName = req.DocumentName
+	fieldSet, err := fields.ExtractFieldsWithOptions(docxFile, extractOpts)
+	if err != nil {
+		extractSpan.RecordError(err)
+	} else {
+		extractSpan.SetAttribute("fields", fieldSet.TotalFields)
+	}
+	extractSpan.End()
+	if err != nil {
+		logger.Error("failed to extract fields: %v", err)
+		return createErrorResponse(http.StatusInternalServerError, "Failed to extract fields")
+	}
+	logger.Info("Extracted %d field(s) from %q", fieldSet.TotalFields, fieldSet.DocumentName)
+	fieldSet.RequireAll = req.Options.RequireAllFields
+	fieldSet.FailFast = req.Options.FailFast
+
+	// CSV rows become the records of a batch merge
+	if req.CSV != "" {
+		if req.Data != nil || len(req.Records) > 0 {
+			logger.Error("'csv' provided with 'data' or 'records'")
+			return createErrorResponse(http.StatusBadRequest, "'csv' is mutually exclusive with 'data' and 'records'")
+		}
+		records, err := csvRecords(req.CSV, fieldSet)
+		if err != nil {
+			logger.Error("failed to parse CSV: %v", err)
+			return createErrorResponse(http.StatusBadRequest, "Failed to parse CSV: "+err.Error())
+		}
+		req.Records = records
+	}
+
+	// Records switch the request to a batch merge
+	if len(req.Records) > 0 {
+		if req.Data != nil {
+			logger.Error("both 'data' and 'records' provided")
+			return createErrorResponse(http.StatusBadRequest, "'data' and 'records' are mutually exclusive")
+		}
+		if req.Options.PartialOutput {
+			logger.Error("'partialOutput' requested for a batch merge")
+			return createErrorResponse(http.StatusBadRequest, "'partialOutput' is not supported for batch merges")
+		}
+		if req.Options.OutputFormat == outputFormatPDF {
+			logger.Error("outputFormat 'pdf' requested for a batch merge")
+			return createErrorResponse(http.StatusBadRequest, "outputFormat 'pdf' is not supported for batch merges")
+		}
+		return handleMergeBatch(ctx, docxFile, fieldSet, req)
+	}
+
+	// Prepare response structure
+	response := map[string]interface{}{}
+	if req.Options.EchoConfig {
+		response["config"] = req.Options.effectiveConfig()
+	}
+
+	// If req.Data is present, parse merge data and validate
+	if req.Data != nil {
+		mergeData, validationResult, err := prepareMergeData(ctx, docxFile, fieldSet, req.Data, req.Options)
+		if err != nil {
+			logger.Error("failed to parse merge data: %v", err)
+			return createErrorResponse(http.StatusBadRequest, "Failed to parse merge data")
+		}
+
+		// Include validation output in response
+		response["validation"] = validationResult
+		response["unusedDataKeys"] = validationResult.UnusedDataKeys
+
+		// Only execute merge if validation passed
+		if !validationResult.Valid {
+			response["summary"] = buildMergeSummary(fieldSet, validationResult, nil)
+			if req.Options.Verbose {
+				response["fieldOutcomes"] = validationOutcomes(validationResult)
+			}
+
+			// Return validation error with response including validation details
+			responseBody, err := json.Marshal(response)
+			if err != nil {
+				logger.Error("failed to marshal response: %v", err)
+				return createErrorResponse(http.StatusInternalServerError, "Failed to create response")
+			}
+
+			return events.APIGatewayProxyResponse{
+				StatusCode: http.StatusBadRequest,
+				Headers:    getCommonHeaders(),
+				Body:       string(responseBody),
+			}
+		}
+
+		// After successful validation, perform merge
+		mergeOpts := req.Options.mergeOptions(ctx)
+		mergeOpts.FieldSet = fieldSet
+		mergeOpts.DocumentProperties = req.DocumentProperties
+		mergeOpts.Strict = req.Strict
+		mergeResult, err := merge.PerformMergeWithOptions(docxFile, mergeData, mergeOpts)
+		var unfilled *merge.UnfilledFieldsError
+		if errors.As(err, &unfilled) {
+			logger.Error("strict merge would skip fields: %v", unfilled.Fields)
+			return unfilledFieldsResponse(unfilled)
+		}
+		if err != nil {
+			logger.Error("failed to perform merge: %v", err)
+			return mergeErrorResponse(err)
+		}
+
+		metrics.FromContext(ctx).AddFields(len(mergeResult.Resolved), len(mergeResult.Skipped))
+
+		// Add the changed parts, or the whole merged document, to the response
+		if req.Options.OutputFormat == outputFormatPDF {
+			pdf, err := pdfConverter.ConvertToPDF(mergeResult.Document)
+			if err != nil {
+				logger.Error("failed to convert merged document to PDF: %v", err)
+				return conversionErrorResponse(err)
+			}
+			response["mergedPdf"] = base64.StdEncoding.EncodeToString(pdf)
+		} else if req.Options.PartialOutput {
+			response["changedParts"] = encodeParts(mergeResult.ChangedParts)
+			response["addedParts"] = mergeResult.AddedParts
+			response["removedParts"] = mergeResult.RemovedParts
+		} else {
+			response["mergedDocument"] = base64.StdEncoding.EncodeToString(mergeResult.Document)
+		}
+		response["skippedFields"] = mergeResult.Skipped
+		response["summary"] = buildMergeSummary(fieldSet, validationResult, mergeResult)
+		if len(mergeResult.PartErrors) > 0 {
+			response["partErrors"] = mergeResult.PartErrors
+		}
+		if req.Options.Verbose {
+			response["fieldOutcomes"] = mergeResult.Outcomes
+		}
+	}
+
+	// Use helper function to create successful response
+	successResponse, err := createSuccessResponse(response)
+	if err != nil {
+		logger.Error("failed to create success response: %v", err)
+		return createErrorResponse(http.StatusInternalServerError, "Failed to create response")
+	}
+
+	return successResponse
+}
+
+// encodeParts base64-encodes the content of package parts, keyed by part name
+func encodeParts(parts map[string][]byte) map[string]string {
+	encoded := make(map[string]string, len(parts))
+	for name, content := range parts {
+		encoded[name] = base64.StdEncoding.EncodeToString(content)
+	}
+	return encoded
+}
+
+// mergeErrorResponse creates the error response for a failed merge
+func mergeErrorResponse(err error) events.APIGatewayProxyResponse {
+	if errors.Is(err, merge.ErrTooManyConcurrentMerges) {
+		return createErrorResponse(http.StatusServiceUnavailable, "Too many concurrent merges, retry later")
+	}
+	if isMergeInputError(err) {
+		return createErrorResponse(http.StatusBadRequest, mergeErrorMessage(err))
+	}
+	return createErrorResponse(http.StatusInternalServerError, mergeErrorMessage(err))
+}
+
+// conversionErrorResponse creates the error response for a failed PDF
+// conversion: 501 Not Implemented when no converter is configured
+func conversionErrorResponse(err error) events.APIGatewayProxyResponse {
+	if errors.Is(err, merge.ErrConversionNotConfigured) {
+		return createErrorResponse(http.StatusNotImplemented, "PDF conversion is not configured")
+	}
+	return createErrorResponse(http.StatusInternalServerError, "Failed to convert document to PDF")
+}
+
+// unfilledFieldsResponse answers a strict merge that would have skipped
+// fields with 422 Unprocessable Entity, listing the fields without data
+func unfilledFieldsResponse(err *merge.UnfilledFieldsError) events.APIGatewayProxyResponse {
+	return createDetailedErrorResponse(http.StatusUnprocessableEntity, "Strict merge failed: fields without data", map[string]interface{}{"unfilledFields": err.Fields})
+}
+
+// isMergeInputError reports whether a merge failed because of the request
+// rather than the service
+func isMergeInputError(err error) bool {
+	return errors.Is(err, merge.ErrTooManyExpansions) || errors.Is(err, merge.ErrOutputTooLarge) || errors.Is(err, fields.ErrInvalidDateLayout) || errors.Is(err, merge.ErrUnfilledFields)
+}
+
+// mergeErrorMessage describes a failed merge to the client, with the cause
+// only when the request caused it
+func mergeErrorMessage(err error) string {
+	if isMergeInputError(err) {
+		return "Failed to perform merge: " + err.Error()
+	}
+	return "Failed to perform merge"
+}
+
+// prepareMergeData parses one merge data object and validates it against the
+// template, adding duplicate key and document warnings to the result
+func prepareMergeData(ctx context.Context, docxFile *docx.DocxFile, fieldSet *fields.MergeFieldSet, raw json.RawMessage, opts RequestOptions) (fields.MergeData, fields.ValidationResult, error) {
+	logger := logging.FromContext(ctx)
+
+	duplicates := fields.DetectDuplicates(raw)
+	if len(duplicates) > 0 {
+		logger.Warn("Duplicate keys detected: %v", duplicates)
+	}
+
+	mergeData, err := parseMergeData(raw, opts.NumbersAsStrings)
+	if err != nil {
+		return nil, fields.ValidationResult{}, err
+	}
+
+	// Key the values of differently named data by their template fields
+	mergeData = mergeData.ApplyFieldMapping(opts.FieldMapping)
+
+	// Apply the request-wide value transforms before validation and formatting
+	mergeData, err = mergeData.ApplyTransforms(opts.ValueTransforms)
+	if err != nil {
+		return nil, fields.ValidationResult{}, err
+	}
+
+	// Run validation
+	validateSpan := tracing.Start(tracing.SpanValidate, tracing.CorrelationID(ctx))
+	validationResult := fieldSet.Validate(mergeData)
+	validateSpan.SetAttribute("valid", validationResult.Valid)
+	validateSpan.End()
+
+	// Add duplicate key warnings to validation result
+	for _, key := range duplicates {
+		validationResult.Warnings = append(validationResult.Warnings,
+			fmt.Sprintf("Duplicate key '%s' detected in JSON data (first occurrence kept)", key))
+	}
+
+	// Warn about data source settings that will make Word prompt on open
+	if docxFile.HasMailMergeSettings() && !opts.RemoveMailMergeSettings {
+		validationResult.Warnings = append(validationResult.Warnings,
+			"Document contains mail merge data source settings; set 'removeMailMergeSettings' to strip them")
+	}
+
+	// Warn about merging a document this service already produced
+	if merged, mergedAt := docxFile.WasMerged(); merged {
+		warning := "Document was already merged by this service"
+		if !mergedAt.IsZero() {
+			warning += " on " + mergedAt.Format(time.RFC3339)
+		}
+		validationResult.Warnings = append(validationResult.Warnings, warning+"; its fields may already be filled")
+	}
+
+	// Warn about broken relationships that merged content could collide with
+	validationResult.Warnings = append(validationResult.Warnings, docxFile.ValidateRelationships()...)
+
+	if documentXML, err := docxFile.GetDocumentXML(); err == nil {
+		// Warn about fallback chains that repeat an alternative
+		validationResult.Warnings = append(validationResult.Warnings, merge.FallbackChainWarnings(string(documentXML))...)
+
+		// Reject placeholder expressions that do not parse, such as calls
+		// of unknown functions, and secrets templates may not read, before
+		// anything is merged or fetched
+		rejectFields(&validationResult, "expression", merge.ExpressionErrors(string(documentXML), mergeData))
+		if secretsClient != nil {
+			rejectFields(&validationResult, "secret field", secretsSource(logging.FromContext(ctx)).FieldErrors(string(documentXML)))
+		}
+	}
+
+	return mergeData, validationResult, nil
+}
+
+// rejectFields fails validation with an error for each field of errs, in
+// name order
+func rejectFields(result *fields.ValidationResult, kind string, errs map[string]string) {
+	names := make([]string, 0, len(errs))
+	for name := range errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		result.Valid = false
+		result.Errors = append(result.Errors, fmt.Sprintf("Invalid %s '%s': %s", kind, name, errs[name]))
+		result.FieldErrors[name] = errs[name]
+	}
+}
+
+// BatchRecordResult is the outcome of merging one record of a batch
+type BatchRecordResult struct {
+	Record         int                     `json:"record"`                   // zero-based index of the record
+	Validation     fields.ValidationResult `json:"validation"`               // validation output for the record
+	MergedDocument string                  `json:"mergedDocument,omitempty"` // base64 DOCX, absent when validation failed
+	SkippedFields  []string                `json:"skippedFields,omitempty"`  // fields without data
+	UnusedDataKeys []string                `json:"unusedDataKeys,omitempty"` // data keys matching no template field
+	PartErrors     []merge.PartError       `json:"partErrors,omitempty"`     // parts left unchanged because they failed to merge
+	Error          string                  `json:"error,omitempty"`          // why a valid record failed to merge
+}
+
+// handleMergeBatch merges every record of a batch request into the template.
+// A record failing validation or failing to merge is reported without
+// affecting the others.
+func handleMergeBatch(ctx context.Context, docxFile *docx.DocxFile, fieldSet *fields.MergeFieldSet, req MergeRequest) events.APIGatewayProxyResponse {
+	logger := logging.FromContext(ctx)
+
+	mergeOpts := req.Options.mergeOptions(ctx)
+	mergeOpts.FieldSet = fieldSet
+	mergeOpts.DocumentProperties = req.DocumentProperties
+	mergeOpts.Strict = req.Strict
+
+	results := make([]BatchRecordResult, 0, len(req.Records))
+	entries := make([]merge.BatchEntry, 0, len(req.Records))
+	var rows []fields.MergeData
+	var merged []int
+	for i, record := range req.Records {
+		mergeData, validationResult, err := prepareMergeData(ctx, docxFile, fieldSet, record, req.Options)
+		if err != nil {
+			logger.Error("failed to parse merge data of record %d: %v", i, err)
+			return createErrorResponse(http.StatusBadRequest, fmt.Sprintf("Failed to parse merge data of record %d", i))
+		}
+
+		results = append(results, BatchRecordResult{Record: i, Validation: validationResult, UnusedDataKeys: validationResult.UnusedDataKeys})
+		entries = append(entries, merge.BatchEntry{Record: i, Errors: validationResult.Errors})
+		if validationResult.Valid {
+			rows = append(rows, mergeData)
+			merged = append(merged, i)
+		}
+	}
+
+	// Merge the valid records, each independently of the others
+	for j, row := range merge.PerformMergeBatch(docxFile, rows, mergeOpts) {
+		i := merged[j]
+		if row.Err != nil {
+			// Only the concurrency limit fails the whole batch, which is
+			// worth retrying as a unit
+			if errors.Is(row.Err, merge.ErrTooManyConcurrentMerges) {
+				return mergeErrorResponse(row.Err)
+			}
+			logger.Error("failed to perform merge of record %d: %v", i, row.Err)
+			results[i].Error = mergeErrorMessage(row.Err)
+			entries[i].Errors = append(entries[i].Errors, results[i].Error)
+			continue
+		}
+		mergeResult := row.Result
+		metrics.FromContext(ctx).AddFields(len(mergeResult.Resolved), len(mergeResult.Skipped))
+		results[i].MergedDocument = base64.StdEncoding.EncodeToString(mergeResult.Document)
+		results[i].SkippedFields = mergeResult.Skipped
+		results[i].PartErrors = mergeResult.PartErrors
+		entries[i].Document = mergeResult.Document
+		entries[i].Filename = merge.BatchFilename(req.Options.OutputFilename, rows[j])
+		entries[i].Skipped = mergeResult.Skipped
+	}
+
+	response := map[string]interface{}{}
+	if req.Options.EchoConfig {
+		response["config"] = req.Options.effectiveConfig()
+	}
+
+	if req.Options.OutputFormat != outputFormatZip {
+		response["results"] = results
+		return createBatchResponse(ctx, response)
+	}
+
+	// Package all merged documents into a single archive
+	archive, manifest, err := merge.BuildBatchArchive(entries)
+	if err != nil {
+		logger.Error("failed to build batch archive: %v", err)
+		return createErrorResponse(http.StatusInternalServerError, "Failed to create batch archive")
+	}
+	logger.Debug("Built batch archive with %d records (%d bytes)", len(entries), len(archive))
+	response["archive"] = base64.StdEncoding.EncodeToString(archive)
+	response["manifest"] = manifest
+	return createBatchResponse(ctx, response)
+}
+
+// handleMergeRows handles the /merge-batch endpoint. The rows are the records
+// of a /merge batch request, so the template is decoded and its fields are
+// extracted once, and each row is answered as a record.
+func handleMergeRows(ctx context.Context, req MergeBatchRequest) events.APIGatewayProxyResponse {
+	logger := logging.FromContext(ctx)
+
+	if len(req.Rows) == 0 {
+		logger.Error("'rows' field is empty")
+		return createErrorResponse(http.StatusBadRequest, "'rows' key missing")
+	}
+	return handleMerge(ctx, MergeRequest{
+		Docx:               req.Docx,
+		Records:            req.Rows,
+		Options:            req.Options,
+		Strict:             req.Strict,
+		DocumentProperties: req.DocumentProperties,
+		DocumentName:       req.DocumentName,
+	})
+}
+
+// createBatchResponse creates the success response of a batch merge
+func createBatchResponse(ctx context.Context, response map[string]interface{}) events.APIGatewayProxyResponse {
+	successResponse, err := createSuccessResponse(response)
+	if err != nil {
+		logging.FromContext(ctx).Error("failed to create success response: %v", err)
+		return createErrorResponse(http.StatusInternalServerError, "Failed to create response")
+	}
+	return successResponse
+}
+
+// handleDetect handles the /detect endpoint (field extraction only)
+func handleDetect(ctx context.Context, req DetectRequest) events.APIGatewayProxyResponse {
+	logger := logging.FromContext(ctx)
+
+	// Check if docx field is present
+	if req.Docx == "" {
+		logger.Error("'docx' field is empty")
+		return createErrorResponse(http.StatusBadRequest, "'docx' key missing")
+	}
+
+	// Reject invalid options before decoding anything
+	if err := validateOptions(ctx, req.Options); err != nil {
+		logger.Error("invalid options: %v", err)
+		return createErrorResponse(http.StatusBadRequest, "Invalid options: "+err.Error())
+	}
+
+	// Detection reads only the text parts, so media is never unpacked
+	docxFile, errResponse, ok := decodeTemplate(ctx, req.Docx, req.Options, docx.IsDetectPart)
+	if !ok {
+		return errResponse
+	}
+	correlationID := tracing.CorrelationID(ctx)
+
+	// Extract fields to get MergeFieldSet
+	extractSpan := tracing.Start(tracing.SpanExtract, correlationID)
+	extractOpts := req.Options.extractOptions()
+	extractOpts.ResolveStyles = req.Options.Verbose
+	extractOpts.DocumentName = req.DocumentName
+	fieldSet, err := fields.ExtractFieldsWithOptions(docxFile, extractOpts)
+	if err != nil {
+		extractSpan.RecordError(err)
+	} else {
+		extractSpan.SetAttribute("fields", fieldSet.TotalFields)
+	}
+	extractSpan.End()
+	if err != nil {
+		logger.Error("failed to extract fields: %v", err)
+		return createErrorResponse(http.StatusInternalServerError, "Failed to extract fields")
+	}
+	logger.Info("Extracted %d field(s) from %q", fieldSet.TotalFields, fieldSet.DocumentName)
+
+	// Shell scripts get the fields as an environment file
+	if req.Options.OutputFormat == outputFormatDotenv {
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusOK,
+			Headers:    map[string]string{"Content-Type": "text/plain; charset=utf-8"},
+			Body:       formatDotenv(fieldSet),
+		}
+	}
+
+	// Convert fieldSet to map[string]string for the response
+	fieldsData := make(map[string]string)
+	for _, field := range fieldSet.Fields {
+		fieldsData[field.Name] = "" // Empty string as placeholder value
+	}
+
+	// Create the detect response
+	response := DetectResponse{
+		DocumentName: fieldSet.DocumentName,
+		Data:         fieldsData,
+	}
+	if req.Options.Verbose {
+		response.Prompts = fieldSet.Prompts
+		response.Styles = make(map[string]*fields.FieldStyles, len(fieldSet.Fields))
+		response.Instructions = make(map[string]string, len(fieldSet.Fields))
+		for _, field := range fieldSet.Fields {
+			response.Styles[field.Name] = field.Styles
+			response.Instructions[field.Name] = field.Instruction
+		}
+		response.SectionCount = docxFile.SectionCount()
+		response.EstimatedPageCount = docxFile.EstimatedPageCount()
+	}
+	if req.Options.GroupByPrefix {
+		response.Groups = groupFieldsByPrefix(fieldSet)
+	}
+	if req.Options.IncludePositions {
+		response.Positions = make(map[string]fields.FieldPosition, len(fieldSet.Fields))
+		for _, field := range fieldSet.Fields {
+			response.Positions[field.Name] = field.Position
+		}
+	}
+	if req.Options.EchoConfig {
+		config := req.Options.effectiveConfig()
+		response.Config = &config
+	}
+
+	// Use helper function to create successful response
+	successResponse, err := createSuccessResponse(response)
+	if err != nil {
+		logger.Error("failed to create success response: %v", err)
+		return createErrorResponse(http.StatusInternalServerError, "Failed to create response")
+	}
+
+	return successResponse
+}
+
+// fieldPrefixSeparator separates the namespace of a field name from the rest,
+// as in Org_Name
+const fieldPrefixSeparator = "_"
+
+// groupFieldsByPrefix maps the prefix before the first "_" of the detected
+// field names to the rest of the names, sorted, e.g. Org_Name and Org_City
+// give {"Org": ["City", "Name"]}. Fields without a prefix are not grouped.
+func groupFieldsByPrefix(fieldSet *fields.MergeFieldSet) map[string][]string {
+	groups := make(map[string][]string)
+	for _, field := range fieldSet.Fields {
+		prefix, rest, found := strings.Cut(field.Name, fieldPrefixSeparator)
+		if !found || prefix == "" || rest == "" {
+			continue
+		}
+		groups[prefix] = append(groups[prefix], rest)
+	}
+	for _, names := range groups {
+		sort.Strings(names)
+	}
+	return groups
+}
+
+// formatDotenv renders the detected fields as an environment file with one
+// empty FIELD_NAME= assignment per field, sorted by variable name
+func formatDotenv(fieldSet *fields.MergeFieldSet) string {
+	names := make(map[string]bool, len(fieldSet.Fields))
+	for _, field := range fieldSet.Fields {
+		names[envVariableName(field.Name)] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var out strings.Builder
+	for _, name := range sorted {
+		out.WriteString(name + "=\n")
+	}
+	return out.String()
+}
+
+// envVariableName converts a field name into an environment variable name:
+// camelCase words are split, other characters than letters and digits become
+// underscores and the result is uppercased, e.g. "firstName" becomes
+// FIRST_NAME and "Org Name" ORG_NAME
+func envVariableName(fieldName string) string {
+	var name strings.Builder
+	var previous rune
+	for _, r := range fieldName {
+		if r >= unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			name.WriteRune('_')
+		} else {
+			if unicode.IsUpper(r) && (unicode.IsLower(previous) || unicode.IsDigit(previous)) {
+				name.WriteRune('_')
+			}
+			name.WriteRune(unicode.ToUpper(r))
+		}
+		previous = r
+	}
+
+	result := strings.Trim(multipleUnderscoreRegex.ReplaceAllString(name.String(), "_"), "_")
+	if result == "" || unicode.IsDigit(rune(result[0])) {
+		result = "_" + result
+	}
+	return result
+}
+
+// multipleUnderscoreRegex matches runs of underscores in environment names
+var multipleUnderscoreRegex = regexp.MustCompile(`_{2,}`)
+
+// handleLint handles the /template/lint endpoint (report of merge problems)
+func handleLint(ctx context.Context, req LintRequest) events.APIGatewayProxyResponse {
+	logger := logging.FromContext(ctx)
+
+	// Check if docx field is present
+	if req.Docx == "" {
+		logger.Error("'docx' field is empty")
+		return createErrorResponse(http.StatusBadRequest, "'docx' key missing")
+	}
+
+	if err := validateOptions(ctx, req.Options); err != nil {
+		logger.Error("invalid options: %v", err)
+		return createErrorResponse(http.StatusBadRequest, "Invalid options: "+err.Error())
+	}
+
+	docxFile, errResponse, ok := decodeTemplate(ctx, req.Docx, req.Options, nil)
+	if !ok {
+		return errResponse
 	}
-}
 
-// Helper function to create successful response
-func createSuccessResponse(data interface{}) (events.APIGatewayProxyResponse, error) {
-	responseBody, err := json.Marshal(data)
+	// Run all template checks
+	report, err := lint.Template(docxFile)
 	if err != nil {
-		return events.APIGatewayProxyResponse{}, fmt.Errorf("failed to marshal response: %w", err)
+		logger.Error("failed to lint template: %v", err)
+		return createErrorResponse(http.StatusInternalServerError, "Failed to process document")
 	}
+	logger.Info("Template lint found %d error(s) and %d warning(s)", report.Errors, report.Warnings)
 
-	return events.APIGatewayProxyResponse{
-		StatusCode: http.StatusOK,
-		Headers:    getCommonHeaders(),
-		Body:       string(responseBody),
-	}, nil
-}
+	successResponse, err := createSuccessResponse(report)
+	if err != nil {
+		logger.Error("failed to create success response: %v", err)
+		return createErrorResponse(http.StatusInternalServerError, "Failed to create response")
+	}
 
-// MergeRequest represents the request payload for merge operations
-type MergeRequest struct {
-	Docx string          `json:"docx"`            // base64 DOCX (required)
-	Data json.RawMessage `json:"data,omitempty"`  // raw map for merge values (optional)
+	return successResponse
 }
 
-// DetectRequest represents the request payload for detect operations
-type DetectRequest struct {
-	Docx string `json:"docx"` // base64 DOCX (required)
-}
+// handleMergeXML handles the /merge/xml endpoint (merge of a bare
+// document.xml, for quick template iteration without a DOCX package)
+func handleMergeXML(ctx context.Context, req MergeXMLRequest) events.APIGatewayProxyResponse {
+	logger := logging.FromContext(ctx)
 
-// DetectResponse represents the response payload for detect operations
-type DetectResponse struct {
-	Data map[string]string `json:"data"` // extracted fields data
-}
+	// Check if xml field is present
+	if strings.TrimSpace(req.XML) == "" {
+		logger.Error("'xml' field is empty")
+		return createErrorResponse(http.StatusBadRequest, "'xml' key missing")
+	}
 
-// parseMergeData parses raw JSON data into MergeData with duplicate-key "first-win" logic.
-// If a key appears multiple times in the JSON object, only the first occurrence is kept.
-func parseMergeData(raw json.RawMessage) (fields.MergeData, error) {
-	decoder := json.NewDecoder(bytes.NewReader(raw))
+	mergeData := make(fields.MergeData)
+	if len(req.Data) > 0 {
+		var err error
+		if mergeData, err = parseMergeData(req.Data, false); err != nil {
+			logger.Error("failed to parse merge data: %v", err)
+			return createErrorResponse(http.StatusBadRequest, "Failed to parse merge data")
+		}
+	}
 
-	// Read the opening brace
-	token, err := decoder.Token()
+	replaceSpan := tracing.Start(tracing.SpanReplace, tracing.CorrelationID(ctx))
+	mergedXML, skipped, err := merge.ReplaceFieldValues(req.XML, mergeData)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read opening token: %w", err)
+		replaceSpan.RecordError(err)
 	}
+	replaceSpan.End()
+	if err != nil {
+		logger.Error("failed to merge XML: %v", err)
+		return createErrorResponse(http.StatusInternalServerError, "Failed to perform merge")
+	}
+	logger.Info("Merged bare XML with %d skipped field(s)", len(skipped))
 
-	// Expect opening brace
-	if delim, ok := token.(json.Delim); !ok || delim != '{' {
-		return nil, fmt.Errorf("expected opening brace, got %T: %v", token, token)
+	if skipped == nil {
+		skipped = []string{}
+	}
+	successResponse, err := createSuccessResponse(MergeXMLResponse{XML: mergedXML, SkippedFields: skipped})
+	if err != nil {
+		logger.Error("failed to create success response: %v", err)
+		return createErrorResponse(http.StatusInternalServerError, "Failed to create response")
 	}
 
-	result := make(fields.MergeData)
+	return successResponse
+}
 
-	// Process key-value pairs
-	for decoder.More() {
-		// Read the key
-		token, err := decoder.Token()
-		if err != nil {
-			return nil, fmt.Errorf("failed to read key token: %w", err)
-		}
+// handlePreview handles the /preview endpoint, which merges the data into the
+// document body and returns it as plain text for UI previews. The data is not
+// validated: fields without data are reported as skipped.
+func handlePreview(ctx context.Context, req PreviewRequest) events.APIGatewayProxyResponse {
+	logger := logging.FromContext(ctx)
 
-		key, ok := token.(string)
-		if !ok {
-			return nil, fmt.Errorf("expected string key, got %T: %v", token, token)
-		}
+	// Check if docx field is present
+	if req.Docx == "" {
+		logger.Error("'docx' field is empty")
+		return createErrorResponse(http.StatusBadRequest, "'docx' key missing")
+	}
+	if err := validateOptions(ctx, req.Options); err != nil {
+		logger.Error("invalid options: %v", err)
+		return createErrorResponse(http.StatusBadRequest, "Invalid options: "+err.Error())
+	}
 
-		// Check if key already exists (first-win logic)
-		if _, exists := result[key]; exists {
-			// Skip the value for this duplicate key
-			var dummy interface{}
-			if err := decoder.Decode(&dummy); err != nil {
-				return nil, fmt.Errorf("failed to skip duplicate key value: %w", err)
-			}
-		} else {
-			// Decode the value for this new key
-			var value interface{}
-			if err := decoder.Decode(&value); err != nil {
-				return nil, fmt.Errorf("failed to decode value for key %s: %w", key, err)
-			}
-			result[key] = value
+	docxFile, errResponse, ok := decodeTemplate(ctx, req.Docx, req.Options, nil)
+	if !ok {
+		return errResponse
+	}
+
+	fieldSet, err := fields.ExtractFieldsWithOptions(docxFile, req.Options.extractOptions())
+	if err != nil {
+		logger.Error("failed to extract fields: %v", err)
+		return createErrorResponse(http.StatusInternalServerError, "Failed to extract fields")
+	}
+
+	mergeData := make(fields.MergeData)
+	if len(req.Data) > 0 {
+		if mergeData, _, err = prepareMergeData(ctx, docxFile, fieldSet, req.Data, req.Options); err != nil {
+			logger.Error("failed to parse merge data: %v", err)
+			return createErrorResponse(http.StatusBadRequest, "Failed to parse merge data")
 		}
 	}
 
-	// Read the closing brace
-	token, err = decoder.Token()
+	mergeOpts := req.Options.mergeOptions(ctx)
+	mergeOpts.FieldSet = fieldSet
+	text, skipped, err := merge.PerformMergeTextWithOptions(docxFile, mergeData, mergeOpts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read closing token: %w", err)
+		logger.Error("failed to perform merge: %v", err)
+		return mergeErrorResponse(err)
 	}
+	logger.Info("Rendered merge preview with %d skipped field(s)", len(skipped))
 
-	// Expect closing brace
-	if delim, ok := token.(json.Delim); !ok || delim != '}' {
-		return nil, fmt.Errorf("expected closing brace, got %T: %v", token, token)
+	if skipped == nil {
+		skipped = []string{}
+	}
+	successResponse, err := createSuccessResponse(PreviewResponse{Text: text, SkippedFields: skipped})
+	if err != nil {
+		logger.Error("failed to create success response: %v", err)
+		return createErrorResponse(http.StatusInternalServerError, "Failed to create response")
 	}
 
-	return result, nil
+	return successResponse
 }
 
-// handleMerge handles the /merge endpoint (existing merge functionality)
-func handleMerge(ctx context.Context, req MergeRequest) events.APIGatewayProxyResponse {
-	// Check if docx field is present
+// handleValidate handles the /validate endpoint, which validates merge data
+// against the fields of the document as /merge does, without merging. Invalid
+// data is not an error of the request: the validation result is returned with
+// 200 OK either way.
+func handleValidate(ctx context.Context, req ValidateRequest) events.APIGatewayProxyResponse {
+	logger := logging.FromContext(ctx)
+
+	// Check if docx and data fields are present
 	if req.Docx == "" {
-		logging.Error("'docx' field is empty")
+		logger.Error("'docx' field is empty")
 		return createErrorResponse(http.StatusBadRequest, "'docx' key missing")
 	}
+	if len(req.Data) == 0 {
+		logger.Error("'data' field is empty")
+		return createErrorResponse(http.StatusBadRequest, "'data' key missing")
+	}
+	if err := validateOptions(ctx, req.Options); err != nil {
+		logger.Error("invalid options: %v", err)
+		return createErrorResponse(http.StatusBadRequest, "Invalid options: "+err.Error())
+	}
+
+	docxFile, errResponse, ok := decodeTemplate(ctx, req.Docx, req.Options, nil)
+	if !ok {
+		return errResponse
+	}
 
-	// Decode the DOCX exactly as today
-	docxBytes, err := base64.StdEncoding.DecodeString(req.Docx)
+	fieldSet, err := fields.ExtractFieldsWithOptions(docxFile, req.Options.extractOptions())
 	if err != nil {
-		logging.Error("failed to decode base64 string: %v", err)
-		return createErrorResponse(http.StatusBadRequest, "Failed to decode base64 input")
+		logger.Error("failed to extract fields: %v", err)
+		return createErrorResponse(http.StatusInternalServerError, "Failed to extract fields")
 	}
+	fieldSet.RequireAll = req.Options.RequireAllFields
+	fieldSet.FailFast = req.Options.FailFast
 
-	// Create a DocxFile from the bytes to use ExtractFields
-	docxFile, err := docx.UnzipDocx(docxBytes)
+	_, validationResult, err := prepareMergeData(ctx, docxFile, fieldSet, req.Data, req.Options)
 	if err != nil {
-		logging.Error("failed to create DOCX file: %v", err)
-		return createErrorResponse(http.StatusInternalServerError, "Failed to process document")
+		logger.Error("failed to parse merge data: %v", err)
+		return createErrorResponse(http.StatusBadRequest, "Failed to parse merge data")
 	}
+	logger.Info("Validated merge data against %d field(s): valid=%t", fieldSet.TotalFields, validationResult.Valid)
 
-	// Extract fields to get MergeFieldSet
-	fieldSet, err := fields.ExtractFields(docxFile)
+	successResponse, err := createSuccessResponse(validationResult)
 	if err != nil {
-		logging.Error("failed to extract fields: %v", err)
-		return createErrorResponse(http.StatusInternalServerError, "Failed to extract fields")
+		logger.Error("failed to create success response: %v", err)
+		return createErrorResponse(http.StatusInternalServerError, "Failed to create response")
 	}
 
-	// Prepare response structure
-	response := map[string]interface{}{}
+	return successResponse
+}
 
-	// If req.Data is present, parse merge data and validate
-	if req.Data != nil {
-		duplicates := fields.DetectDuplicates(req.Data)
-		if len(duplicates) > 0 {
-			logging.Warn("Duplicate keys detected: %v", duplicates)
-		}
+// handleCapabilities handles the /capabilities endpoint, which describes the
+// request options, field types and output formats the service supports so
+// that clients can discover them. It takes no request body.
+func handleCapabilities(ctx context.Context) events.APIGatewayProxyResponse {
+	successResponse, err := createSuccessResponse(capabilities())
+	if err != nil {
+		logging.FromContext(ctx).Error("failed to create success response: %v", err)
+		return createErrorResponse(http.StatusInternalServerError, "Failed to create response")
+	}
 
-		mergeData, err := parseMergeData(req.Data)
-		if err != nil {
-			logging.Error("failed to parse merge data: %v", err)
-			return createErrorResponse(http.StatusBadRequest, "Failed to parse merge data")
-		}
+	return successResponse
+}
 
-		// Run validation
-		validationResult := fieldSet.Validate(mergeData)
-		
-		// Add duplicate key warnings to validation result
-		if len(duplicates) > 0 {
-			for _, key := range duplicates {
-				validationResult.Warnings = append(validationResult.Warnings, 
-					fmt.Sprintf("Duplicate key '%s' detected in JSON data (first occurrence kept)", key))
-			}
+// capabilities builds the /capabilities response from the request types and
+// constants, so that it follows the options as they are added. Defaults come
+// from the effective configuration of empty options, or the zero value of
+// options it does not report.
+func capabilities() CapabilitiesResponse {
+	var defaults map[string]interface{}
+	if config, err := json.Marshal(RequestOptions{}.effectiveConfig()); err == nil {
+		json.Unmarshal(config, &defaults)
+	}
+
+	var options []OptionCapability
+	optionsType := reflect.TypeOf(RequestOptions{})
+	for i := 0; i < optionsType.NumField(); i++ {
+		field := optionsType.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
 		}
+		option := OptionCapability{Name: name, Type: jsonTypeName(field.Type)}
+		if value, ok := defaults[name]; ok {
+			option.Default = value
+		} else if field.Type.Kind() != reflect.Pointer {
+			option.Default = reflect.Zero(field.Type).Interface()
+		}
+		options = append(options, option)
+	}
 
-		// Include validation output in response
-		response["validation"] = validationResult
+	return CapabilitiesResponse{
+		Endpoints:   endpoints,
+		APIVersions: supportedAPIVersions,
+		Options:     options,
+		FieldTypes:  fields.FieldTypes(),
+		OutputFormats: map[string][]string{
+			"/merge":       {outputFormatJSON, outputFormatZip, outputFormatPDF},
+			"/merge-batch": {outputFormatJSON, outputFormatZip},
+			"/detect":      {outputFormatJSON, outputFormatDotenv},
+		},
+	}
+}
 
-		// Only execute merge if validation passed
-		if !validationResult.Valid {
-			// Return validation error with response including validation details
-			responseBody, err := json.Marshal(response)
-			if err != nil {
-				logging.Error("failed to marshal response: %v", err)
-				return createErrorResponse(http.StatusInternalServerError, "Failed to create response")
-			}
+// jsonTypeName returns the JSON type a Go type is encoded as
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return jsonTypeName(t.Elem())
+	case reflect.Bool:
+		return "boolean"
+	case reflect.String:
+		return "string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	}
+	return "object"
+}
 
-			return events.APIGatewayProxyResponse{
-				StatusCode: http.StatusBadRequest,
-				Headers:    getCommonHeaders(),
-				Body:       string(responseBody),
-			}
-		}
+func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	// Key the logs and trace spans of this request by its correlation ID
+	correlationID, source, ignored := requestCorrelationID(ctx, request)
+	ctx = tracing.WithCorrelationID(ctx, correlationID)
+	ctx = logging.NewContext(ctx, logging.WithCorrelationID(correlationID))
+	logger := logging.FromContext(ctx)
+	for _, header := range ignored {
+		logger.Warn("Ignoring invalid %s header", header)
+	}
+	logger.Info("Correlation ID %s %s", correlationID, source)
 
-		// After successful validation, perform merge
-		mergedBytes, skipped, err := merge.PerformMerge(docxFile, mergeData)
-		if err != nil {
-			logging.Error("failed to perform merge: %v", err)
-			return createErrorResponse(http.StatusInternalServerError, "Failed to perform merge")
-		}
+	// Negotiate the response contract version before doing any work
+	version, err := resolveAPIVersion(request)
+	if err != nil {
+		logger.Error("%v", err)
+		message := fmt.Sprintf("Unsupported API version (supported: %s)", strings.Join(supportedAPIVersions, ", "))
+		response := createErrorResponse(http.StatusBadRequest, message)
+		return withRequestID(withAPIVersion(ctx, response, defaultAPIVersion), correlationID), nil
+	}
 
-		// Base64-encode the merged document
-		mergedDocumentB64 := base64.StdEncoding.EncodeToString(mergedBytes)
+	// Collect the request metrics while the endpoint handles the request
+	start := time.Now()
+	requestMetrics := &metrics.Request{CorrelationID: correlationID, InputBytes: len(request.Body)}
+	ctx = metrics.WithRequest(ctx, requestMetrics)
 
-		// Add merged document and skipped fields to response
-		response["mergedDocument"] = mergedDocumentB64
-		response["skippedFields"] = skipped
+	response := withRequestID(withAPIVersion(ctx, route(ctx, request), version), correlationID)
+	response = withCompression(ctx, response, getHeader(request, "Accept-Encoding"))
+
+	requestMetrics.Status = response.StatusCode
+	requestMetrics.OutputBytes = len(response.Body)
+	requestMetrics.Duration = time.Since(start)
+	if err := metrics.Emit(requestMetrics); err != nil {
+		logger.Warn("failed to emit metrics: %v", err)
 	}
+	return response, nil
+}
 
-	// Use helper function to create successful response
-	successResponse, err := createSuccessResponse(response)
-	if err != nil {
-		logging.Error("failed to create success response: %v", err)
-		return createErrorResponse(http.StatusInternalServerError, "Failed to create response")
+// requestIDHeader carries the correlation ID in requests and responses
+const requestIDHeader = "X-Request-ID"
+
+var (
+	// requestIDRegex restricts caller-supplied request IDs to printable tokens
+	// safe to echo in headers and logs
+	requestIDRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]{0,127}$`)
+
+	// traceparentRegex matches a W3C Trace Context traceparent header and
+	// captures its trace ID
+	traceparentRegex = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+	// amznTraceRootRegex matches the root trace ID of an X-Amzn-Trace-Id
+	// header, e.g. Root=1-5759e988-bd862e3fe1be46a994272793
+	amznTraceRootRegex = regexp.MustCompile(`^1-[0-9a-f]{8}-[0-9a-f]{24}$`)
+)
+
+// amznTraceIDHeader carries the AWS X-Ray trace of requests through API
+// Gateway and load balancers
+const amznTraceIDHeader = "X-Amzn-Trace-Id"
+
+// requestCorrelationID returns the correlation ID of a request, where it was
+// taken from and the headers ignored as invalid, which the caller logs once
+// its logger carries the ID. A valid caller-supplied X-Request-ID header
+// wins, then the trace ID of a valid traceparent header, then the root trace
+// ID of a valid X-Amzn-Trace-Id header, then the API Gateway request ID and
+// the Lambda invocation ID. A random UUID is generated when none is
+// available.
+func requestCorrelationID(ctx context.Context, request events.APIGatewayProxyRequest) (id, source string, ignored []string) {
+	if id := strings.TrimSpace(getHeader(request, requestIDHeader)); id != "" {
+		if requestIDRegex.MatchString(id) {
+			return id, "taken from " + requestIDHeader + " header", ignored
+		}
+		ignored = append(ignored, requestIDHeader)
+	}
+	if header := strings.TrimSpace(getHeader(request, "traceparent")); header != "" {
+		if traceID, ok := parseTraceparent(header); ok {
+			return traceID, "taken from traceparent header", ignored
+		}
+		ignored = append(ignored, "traceparent")
+	}
+	if header := strings.TrimSpace(getHeader(request, amznTraceIDHeader)); header != "" {
+		if root, ok := parseAmznTraceID(header); ok {
+			return root, "taken from " + amznTraceIDHeader + " header", ignored
+		}
+		ignored = append(ignored, amznTraceIDHeader)
 	}
 
-	return successResponse
+	if request.RequestContext.RequestID != "" {
+		return request.RequestContext.RequestID, "taken from the API Gateway request", ignored
+	}
+	if lc, ok := lambdacontext.FromContext(ctx); ok && lc.AwsRequestID != "" {
+		return lc.AwsRequestID, "taken from the Lambda invocation", ignored
+	}
+	return logging.GenerateUUID(), "generated", ignored
 }
 
-// handleDetect handles the /detect endpoint (field extraction only)
-func handleDetect(ctx context.Context, req DetectRequest) events.APIGatewayProxyResponse {
-	// Check if docx field is present
-	if req.Docx == "" {
-		logging.Error("'docx' field is empty")
-		return createErrorResponse(http.StatusBadRequest, "'docx' key missing")
+// parseTraceparent returns the trace ID of a traceparent header. Version ff
+// and all-zero trace or parent IDs are invalid per the W3C specification.
+func parseTraceparent(header string) (string, bool) {
+	match := traceparentRegex.FindStringSubmatch(header)
+	if match == nil || match[1] == "ff" {
+		return "", false
+	}
+	if strings.Trim(match[2], "0") == "" || strings.Trim(match[3], "0") == "" {
+		return "", false
 	}
+	return match[2], true
+}
 
-	// Decode the DOCX
-	docxBytes, err := base64.StdEncoding.DecodeString(req.Docx)
-	if err != nil {
-		logging.Error("failed to decode base64 string: %v", err)
-		return createErrorResponse(http.StatusBadRequest, "Failed to decode base64 input")
+// parseAmznTraceID returns the root trace ID of an X-Amzn-Trace-Id header,
+// whose fields such as Root, Parent and Sampled are separated by semicolons
+func parseAmznTraceID(header string) (string, bool) {
+	for _, field := range strings.Split(header, ";") {
+		key, value, found := strings.Cut(strings.TrimSpace(field), "=")
+		if found && strings.EqualFold(key, "Root") && amznTraceRootRegex.MatchString(value) {
+			return value, true
+		}
 	}
+	return "", false
+}
 
-	// Create a DocxFile from the bytes
-	docxFile, err := docx.UnzipDocx(docxBytes)
-	if err != nil {
-		logging.Error("failed to create DOCX file: %v", err)
-		return createErrorResponse(http.StatusInternalServerError, "Failed to process document")
+// compressionMinBytes is the body size from which JSON responses are
+// compressed; smaller bodies would gain less than the base64 encoding costs
+const compressionMinBytes = 1024
+
+// Content codings of compressed responses
+const (
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+)
+
+// negotiateEncoding picks the content coding of a response from the
+// Accept-Encoding header: the accepted coding with the highest quality among
+// br and gzip, br on a tie, or "" for an uncompressed body. A coding listed
+// with q=0 is refused; "*" stands for any coding not listed.
+func negotiateEncoding(acceptEncoding string) string {
+	qualities := make(map[string]float64)
+	for _, element := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(element, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range params[1:] {
+			if value, found := strings.CutPrefix(strings.TrimSpace(param), "q="); found {
+				if q, err := strconv.ParseFloat(value, 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		qualities[coding] = quality
 	}
 
-	// Extract fields to get MergeFieldSet
-	fieldSet, err := fields.ExtractFields(docxFile)
-	if err != nil {
-		logging.Error("failed to extract fields: %v", err)
-		return createErrorResponse(http.StatusInternalServerError, "Failed to extract fields")
+	best, bestQuality := "", 0.0
+	for _, coding := range []string{encodingBrotli, encodingGzip} {
+		quality, listed := qualities[coding]
+		if !listed {
+			quality = qualities["*"]
+		}
+		if quality > bestQuality {
+			best, bestQuality = coding, quality
+		}
 	}
+	return best
+}
 
-	// Convert fieldSet to map[string]string for the response
-	fieldsData := make(map[string]string)
-	for _, field := range fieldSet.Fields {
-		fieldsData[field.Name] = "" // Empty string as placeholder value
+// withCompression compresses a JSON response body of at least
+// compressionMinBytes with Brotli or gzip, as negotiated from the
+// Accept-Encoding header. The compressed body is returned base64-encoded for
+// API Gateway; responses are left unchanged when the client accepts neither
+// coding or compression fails.
+func withCompression(ctx context.Context, response events.APIGatewayProxyResponse, acceptEncoding string) events.APIGatewayProxyResponse {
+	if response.IsBase64Encoded || len(response.Body) < compressionMinBytes || response.Headers["Content-Type"] != "application/json" {
+		return response
+	}
+	encoding := negotiateEncoding(acceptEncoding)
+	if encoding == "" {
+		return response
 	}
 
-	// Create the detect response
-	response := DetectResponse{
-		Data: fieldsData,
+	logger := logging.FromContext(ctx)
+	var buf bytes.Buffer
+	var writer io.WriteCloser
+	if encoding == encodingBrotli {
+		writer = brotli.NewWriterLevel(&buf, brotli.DefaultCompression)
+	} else {
+		writer = gzip.NewWriter(&buf)
+	}
+	if _, err := io.WriteString(writer, response.Body); err != nil {
+		logger.Warn("failed to compress response with %s: %v", encoding, err)
+		return response
 	}
+	if err := writer.Close(); err != nil {
+		logger.Warn("failed to compress response with %s: %v", encoding, err)
+		return response
+	}
+	logger.Debug("Compressed response with %s from %d to %d bytes", encoding, len(response.Body), buf.Len())
 
-	// Use helper function to create successful response
-	successResponse, err := createSuccessResponse(response)
-	if err != nil {
-		logging.Error("failed to create success response: %v", err)
-		return createErrorResponse(http.StatusInternalServerError, "Failed to create response")
+	headers := make(map[string]string, len(response.Headers)+2)
+	for key, value := range response.Headers {
+		headers[key] = value
 	}
+	headers["Content-Encoding"] = encoding
+	headers["Vary"] = "Accept-Encoding"
+	response.Headers = headers
+	response.Body = base64.StdEncoding.EncodeToString(buf.Bytes())
+	response.IsBase64Encoded = true
+	return response
+}
 
-	return successResponse
+// withRequestID echoes the correlation ID in the X-Request-ID response header
+func withRequestID(response events.APIGatewayProxyResponse, correlationID string) events.APIGatewayProxyResponse {
+	if correlationID == "" {
+		return response
+	}
+	headers := make(map[string]string, len(response.Headers)+1)
+	for key, value := range response.Headers {
+		headers[key] = value
+	}
+	headers[requestIDHeader] = correlationID
+	response.Headers = headers
+	return response
 }
 
-func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+// route dispatches the request to the endpoint handler matching its path
+func route(ctx context.Context, request events.APIGatewayProxyRequest) events.APIGatewayProxyResponse {
+	logger := logging.FromContext(ctx)
+
 	// Determine the endpoint based on request path or resource
 	path := request.Path
 	if path == "" {
@@ -292,12 +2214,23 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 	if path == "" {
 		// If we still don't have a path, default to /merge for backward compatibility
 		path = "/merge"
-		logging.Error("No path found in request, defaulting to /merge")
+		logger.Error("No path found in request, defaulting to /merge")
 	}
 	
 	// Log the detected path for debugging
-	logging.Info("Detected path: %s, Request.Path: %s, Request.Resource: %s, RequestContext.Path: %s", 
+	logger.Info("Detected path: %s, Request.Path: %s, Request.Resource: %s, RequestContext.Path: %s", 
 		path, request.Path, request.Resource, request.RequestContext.Path)
+	if requestMetrics := metrics.FromContext(ctx); requestMetrics != nil {
+		requestMetrics.Endpoint = path
+	}
+
+	// Report every problem of a malformed body before decoding anything
+	if schema, ok := requestSchemas[path]; ok {
+		if problems := requestProblems(request.Body, schema); len(problems) > 0 {
+			logger.Error("invalid request body: %v", problems)
+			return schemaErrorResponse(problems)
+		}
+	}
 
 	// Route to appropriate handler based on path
 	switch path {
@@ -305,27 +2238,118 @@ func handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 		// Unmarshal the body into MergeRequest
 		var req MergeRequest
 		if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
-			logging.Error("failed to unmarshal request body: %v", err)
-			return createErrorResponse(http.StatusBadRequest, "Invalid input"), nil
+			logger.Error("failed to unmarshal request body: %v", err)
+			return createErrorResponse(http.StatusBadRequest, "Invalid input")
+		}
+		return handleMerge(ctx, req)
+
+	case "/merge-batch":
+		// Unmarshal the body into MergeBatchRequest
+		var req MergeBatchRequest
+		if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+			logger.Error("failed to unmarshal request body: %v", err)
+			return createErrorResponse(http.StatusBadRequest, "Invalid input")
+		}
+		return handleMergeRows(ctx, req)
+
+	case "/merge/xml":
+		// Unmarshal the body into MergeXMLRequest
+		var req MergeXMLRequest
+		if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+			logger.Error("failed to unmarshal request body: %v", err)
+			return createErrorResponse(http.StatusBadRequest, "Invalid input")
+		}
+		return handleMergeXML(ctx, req)
+
+	case "/preview":
+		// Unmarshal the body into PreviewRequest
+		var req PreviewRequest
+		if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+			logger.Error("failed to unmarshal request body: %v", err)
+			return createErrorResponse(http.StatusBadRequest, "Invalid input")
+		}
+		return handlePreview(ctx, req)
+
+	case "/validate":
+		// Unmarshal the body into ValidateRequest
+		var req ValidateRequest
+		if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+			logger.Error("failed to unmarshal request body: %v", err)
+			return createErrorResponse(http.StatusBadRequest, "Invalid input")
 		}
-		return handleMerge(ctx, req), nil
+		return handleValidate(ctx, req)
 
 	case "/detect":
 		// Unmarshal the body into DetectRequest
 		var req DetectRequest
 		if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
-			logging.Error("failed to unmarshal request body: %v", err)
-			return createErrorResponse(http.StatusBadRequest, "Invalid input"), nil
+			logger.Error("failed to unmarshal request body: %v", err)
+			return createErrorResponse(http.StatusBadRequest, "Invalid input")
+		}
+		return handleDetect(ctx, req)
+
+	case "/template/lint":
+		// Unmarshal the body into LintRequest
+		var req LintRequest
+		if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+			logger.Error("failed to unmarshal request body: %v", err)
+			return createErrorResponse(http.StatusBadRequest, "Invalid input")
 		}
-		return handleDetect(ctx, req), nil
+		return handleLint(ctx, req)
+
+	case "/capabilities":
+		return handleCapabilities(ctx)
 
 	default:
-		logging.Error("unsupported endpoint: %s", path)
-		return createErrorResponse(http.StatusNotFound, "Endpoint not found"), nil
+		// Keep arbitrary paths out of the metric dimensions
+		if requestMetrics := metrics.FromContext(ctx); requestMetrics != nil {
+			requestMetrics.Endpoint = "unknown"
+		}
+		logger.Error("unsupported endpoint: %s", path)
+		return createErrorResponse(http.StatusNotFound, "Endpoint not found")
 	}
 }
 
 func main() {
+	// Trace spans are discarded unless enabled
+	if strings.EqualFold(os.Getenv("TRACE_SPANS"), "log") {
+		tracing.SetTracer(tracing.NewLogTracer())
+	}
+
+	// Secret fields are resolved through the Parameters and Secrets extension
+	// for the secret IDs starting with a SECRETS_ALLOWED_PREFIX, a
+	// comma-separated list such as "mail-merge/"
+	if strings.EqualFold(os.Getenv("SECRETS_SOURCE"), "extension") {
+		secretsClient = merge.ExtensionSecretsClient{}
+		for _, prefix := range strings.Split(os.Getenv("SECRETS_ALLOWED_PREFIX"), ",") {
+			if prefix = strings.TrimSpace(prefix); prefix != "" {
+				secretsAllowedPrefixes = append(secretsAllowedPrefixes, prefix)
+			}
+		}
+		if len(secretsAllowedPrefixes) == 0 {
+			logging.Warn("SECRETS_SOURCE is set without SECRETS_ALLOWED_PREFIX; no secret fields are resolved")
+		}
+	}
+
+	// Merged documents are converted to PDF by LibreOffice when enabled
+	if strings.EqualFold(os.Getenv("PDF_CONVERTER"), "libreoffice") {
+		pdfConverter = merge.LibreOfficeConverter{Path: os.Getenv("SOFFICE_PATH")}
+	}
+
+	// Repeating sections may expand to at most MAX_REPEAT_EXPANSIONS items
+	if limit, err := strconv.Atoi(os.Getenv("MAX_REPEAT_EXPANSIONS")); err == nil && limit > 0 {
+		maxExpansions = limit
+	}
+
+	// Merged documents may be at most MAX_OUTPUT_BYTES large
+	if limit, err := strconv.Atoi(os.Getenv("MAX_OUTPUT_BYTES")); err == nil && limit > 0 {
+		maxOutputSize = limit
+	}
+
+	// Request metrics are emitted to CloudWatch through stdout when enabled
+	if emit, _ := strconv.ParseBool(os.Getenv("EMIT_METRICS")); emit {
+		metrics.SetOutput(os.Stdout)
+	}
 	lambda.Start(handler)
 }
 
@@ -1,16 +1,37 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/aws/aws-lambda-go/events"
+
+	"com/lifenture/flash-mail-merge/internal/docx"
+	"com/lifenture/flash-mail-merge/internal/fields"
+	"com/lifenture/flash-mail-merge/internal/lint"
+	"com/lifenture/flash-mail-merge/internal/merge"
+	"com/lifenture/flash-mail-merge/internal/metrics"
+	"com/lifenture/flash-mail-merge/internal/testutil"
+	"com/lifenture/flash-mail-merge/internal/tracing"
 )
 
 func TestHandler(t *testing.T) {
@@ -80,9 +101,9 @@ func TestHandler(t *testing.T) {
 		t.Fatalf("Failed to unmarshal response body: %v", err)
 	}
 	
-	// With no data field, the response should be empty
-	if len(responseData) != 0 {
-		t.Errorf("Expected empty response when no data field provided, got %v", responseData)
+	// With no data field, the response should only carry the API version
+	if len(responseData) != 1 || responseData["apiVersion"] != "v1" {
+		t.Errorf("Expected only apiVersion in response when no data field provided, got %v", responseData)
 	}
 }
 
@@ -148,419 +169,788 @@ func TestHandlerErrorCases(t *testing.T) {
 	}
 }
 
-func TestHandlerWithValidDocx(t *testing.T) {
-	// Create a minimal ZIP structure with the test XML
-	// This would need to be a valid ZIP file to pass the tests
-	// For now, we'll skip this test if we can't create a valid DOCX
-	t.Skip("Skipping test - requires creating valid DOCX programmatically")
+func TestHandlerRequestSchema(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		problems []string
+	}{
+		{
+			name: "types of several keys",
+			path: "/merge",
+			body: `{"data": ["ACME"], "records": [{}, 3], "strict": "yes", "options": {"verbose": "true", "locale": 5, "removeEmptyParagraphs": true}}`,
+			problems: []string{
+				"'docx' key missing",
+				"'data' must be an object, got array",
+				"'records[1]' must be an object, got number",
+				"'options.verbose' must be a boolean, got string",
+				"'options.locale' must be a string, got number",
+				"'strict' must be a boolean, got string",
+			},
+		},
+		{
+			name: "option values",
+			path: "/merge",
+			body: `{"docx": "", "options": {"defaultFieldType": "decimal", "timezone": "Mars/Base"}}`,
+			problems: []string{
+				"'docx' key missing",
+				"Invalid options: unknown defaultFieldType 'decimal'",
+				"Invalid options: unknown timezone 'Mars/Base'",
+			},
+		},
+		{
+			// The docx is not decoded while the request has other problems
+			name: "nested values",
+			path: "/merge-batch",
+			body: `{"docx": "invalid_base64!", "rows": [], "documentProperties": {"title": 1}, "options": {"valueTransforms": ["trim", 2]}}`,
+			problems: []string{
+				"'rows' key missing",
+				"'options.valueTransforms[1]' must be a string, got number",
+				"'documentProperties.title' must be a string, got number",
+			},
+		},
+		{
+			name:     "required data",
+			path:     "/validate",
+			body:     `{"data": null, "options": null}`,
+			problems: []string{"'docx' key missing", "'data' key missing"},
+		},
+		{
+			name:     "not an object",
+			path:     "/detect",
+			body:     `["docx"]`,
+			problems: []string{"Invalid input"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := handler(context.Background(), events.APIGatewayProxyRequest{Path: tt.path, Body: tt.body})
+			if err != nil {
+				t.Fatalf("Handler returned error: %v", err)
+			}
+			if response.StatusCode != 400 {
+				t.Fatalf("Expected status code 400, got %d: %s", response.StatusCode, response.Body)
+			}
+
+			var responseData struct {
+				Error    string   `json:"error"`
+				Problems []string `json:"problems"`
+			}
+			if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+				t.Fatalf("Failed to unmarshal response body: %v", err)
+			}
+			if !reflect.DeepEqual(responseData.Problems, tt.problems) {
+				t.Errorf("Problems = %q, want %q", responseData.Problems, tt.problems)
+			}
+			if responseData.Error != strings.Join(tt.problems, "; ") {
+				t.Errorf("Expected the error to join the problems, got %q", responseData.Error)
+			}
+		})
+	}
 }
 
-// TestHandlerWithDuplicateKeys tests the handler with duplicate keys in the data field
-func TestHandlerWithDuplicateKeys(t *testing.T) {
-	// Get the path to the sample DOCX file
-	samplePath := filepath.Join("tests", "data", "sample.docx")
-	
-	// Check if the sample file exists
-	if _, err := os.Stat(samplePath); os.IsNotExist(err) {
-		t.Skip("Sample DOCX file not found, skipping test")
+func TestTypeProblemsIntegers(t *testing.T) {
+	intType := reflect.TypeOf(0)
+	for _, raw := range []string{"12", "12.0", "-3", "1e3"} {
+		if problems := typeProblems("maxExpansions", json.RawMessage(raw), intType); problems != nil {
+			t.Errorf("Expected %s to be accepted, got %v", raw, problems)
+		}
 	}
-	
-	// Read the sample DOCX file
-	file, err := os.Open(samplePath)
-	if err != nil {
-		t.Fatalf("Failed to open sample DOCX file: %v", err)
+	for _, raw := range []string{"12.5", "-0.1"} {
+		problems := typeProblems("maxExpansions", json.RawMessage(raw), intType)
+		expected := []string{"'maxExpansions' must be an integer, got " + raw}
+		if !reflect.DeepEqual(problems, expected) {
+			t.Errorf("Expected %v, got %v", expected, problems)
+		}
 	}
-	defer file.Close()
-	
-	docxBytes, err := io.ReadAll(file)
-	if err != nil {
-		t.Fatalf("Failed to read sample DOCX file: %v", err)
+	if problems := typeProblems("ratio", json.RawMessage("12.5"), reflect.TypeOf(0.0)); problems != nil {
+		t.Errorf("Expected a fractional number field to accept 12.5, got %v", problems)
 	}
-	
-	// Encode the DOCX file as base64
-	encodedDocx := base64.StdEncoding.EncodeToString(docxBytes)
-	
-	// Create request body with duplicate keys in the data field
-	// This JSON intentionally contains duplicate keys to test first-win logic
-	requestBodyJSON := `{
-		"docx": "` + encodedDocx + `",
-		"data": {"Contact_FirstName": "John", "Contact_FullName": "John Doe", "User_Email": "john@example.com", "Contact_FirstName": "Jane", "User_Company": "ACME Corp", "User_Email": "jane@example.com", "User_Phone": "555-0123"}
-	}`
-	
-	// Create the Lambda event
-	request := events.APIGatewayProxyRequest{
-		Path: "/merge",
-		Body: requestBodyJSON,
+}
+
+func TestHandlerWithValidDocx(t *testing.T) {
+	documentXML := testutil.DocumentXML(`<w:p><w:fldSimple w:instr=" MERGEFIELD  FirstName  \* MERGEFORMAT "><w:r><w:t>«FirstName»</w:t></w:r></w:fldSimple></w:p>` +
+		`<w:p><w:r><w:t>«City»</w:t></w:r></w:p>`)
+
+	tests := []struct {
+		name string
+		docx []byte
+	}{
+		{name: "compressed", docx: testutil.Docx(t, documentXML)},
+		{name: "uncompressed", docx: testutil.StoredDocx(t, documentXML)},
 	}
-	
-	// Call the handler
-	ctx := context.Background()
-	response, err := handler(ctx, request)
-	
-	// Check for errors
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := events.APIGatewayProxyRequest{
+				Path: "/merge",
+				Body: `{"docx": "` + base64.StdEncoding.EncodeToString(tt.docx) + `", "data": {"FirstName": "Jane", "City": "Springfield"}}`,
+			}
+
+			response, err := handler(context.Background(), request)
+			if err != nil {
+				t.Fatalf("Handler returned error: %v", err)
+			}
+			if response.StatusCode != 200 {
+				t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+			}
+
+			var responseData struct {
+				MergedDocument string        `json:"mergedDocument"`
+				Summary        *MergeSummary `json:"summary"`
+			}
+			if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+				t.Fatalf("Failed to unmarshal response body: %v", err)
+			}
+			if responseData.Summary == nil || responseData.Summary.Resolved != 2 || responseData.Summary.Skipped != 0 {
+				t.Errorf("Expected 2 resolved and no skipped fields, got %+v", responseData.Summary)
+			}
+
+			mergedBytes, err := base64.StdEncoding.DecodeString(responseData.MergedDocument)
+			if err != nil {
+				t.Fatalf("Failed to decode merged document: %v", err)
+			}
+			merged, err := docx.UnzipDocx(mergedBytes)
+			if err != nil {
+				t.Fatalf("Merged document is not a valid DOCX: %v", err)
+			}
+			mergedXML := string(merged.Files["word/document.xml"])
+			for _, expected := range []string{"<w:t>Jane</w:t>", "<w:t>Springfield</w:t>"} {
+				if !strings.Contains(mergedXML, expected) {
+					t.Errorf("Expected %s in the merged document: %s", expected, mergedXML)
+				}
+			}
+			if strings.Contains(mergedXML, "«") {
+				t.Errorf("Merged document still holds placeholders: %s", mergedXML)
+			}
+		})
+	}
+}
+
+// TestHandlerMergeBatchRows tests merging each row of /merge-batch independently
+func TestHandlerMergeBatchRows(t *testing.T) {
+	documentXML := testutil.DocumentXML(`<w:p><w:r><w:t>«Name»</w:t></w:r></w:p>` +
+		`<w:p><w:fldSimple w:instr=" MERGEFIELD Quantity \# 0 "><w:r><w:t>«Quantity»</w:t></w:r></w:fldSimple></w:p>` +
+		`<w:sdt><w:sdtPr><w:tag w:val="Items"/><w15:repeatingSection/></w:sdtPr><w:sdtContent>` +
+		`<w:sdt><w:sdtPr><w15:repeatingSectionItem/></w:sdtPr><w:sdtContent>` +
+		`<w:sdt><w:sdtPr><w:tag w:val="Item"/></w:sdtPr><w:sdtContent><w:p><w:r><w:t>Item</w:t></w:r></w:p></w:sdtContent></w:sdt>` +
+		`</w:sdtContent></w:sdt>` +
+		`</w:sdtContent></w:sdt>`)
+	encodedDocx := base64.StdEncoding.EncodeToString(testutil.Docx(t, documentXML))
+
+	previous := maxExpansions
+	maxExpansions = 3
+	t.Cleanup(func() { maxExpansions = previous })
+
+	rows := `[` +
+		`{"Name": "Jane", "Quantity": 2, "Items": [{"Item": "pen"}]},` +
+		`{"Name": "John", "Quantity": "many"},` +
+		`{"Name": "Jim", "Quantity": 1, "Items": [{"Item": "a"}, {"Item": "b"}, {"Item": "c"}, {"Item": "d"}]},` +
+		`{"Name": "Joan", "Quantity": 4}` +
+		`]`
+	response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+		Path: "/merge-batch",
+		Body: `{"docx": "` + encodedDocx + `", "rows": ` + rows + `}`,
+	})
 	if err != nil {
 		t.Fatalf("Handler returned error: %v", err)
 	}
-	
-	// Check status code - should be 200 since validation should pass
 	if response.StatusCode != 200 {
-		t.Errorf("Expected status code 200, got %d", response.StatusCode)
-		t.Logf("Response body: %s", response.Body)
+		t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+	}
+
+	var responseData struct {
+		Results []BatchRecordResult `json:"results"`
 	}
-	
-	// Parse response body
-	var responseData map[string]interface{}
 	if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
 		t.Fatalf("Failed to unmarshal response body: %v", err)
 	}
-	
-	// Check that mergedDocument is present
-	if _, ok := responseData["mergedDocument"]; !ok {
-		t.Fatalf("Response does not contain 'mergedDocument' field")
-	}
-	
-	// Check that skippedFields is present
-	if _, ok := responseData["skippedFields"]; !ok {
-		t.Fatalf("Response does not contain 'skippedFields' field")
-	}
-	
-	// Check that validation warnings are present about duplicate keys
-	validationRaw, ok := responseData["validation"]
-	if !ok {
-		t.Fatalf("Response does not contain 'validation' field")
-	}
-	
-	validation, ok := validationRaw.(map[string]interface{})
-	if !ok {
-		t.Fatalf("validation is not a map")
-	}
-	
-	warningsRaw, ok := validation["warnings"]
-	if !ok {
-		t.Fatalf("validation does not contain 'warnings' field")
+	if len(responseData.Results) != 4 {
+		t.Fatalf("Expected 4 results, got %d", len(responseData.Results))
 	}
-	
-	warnings, ok := warningsRaw.([]interface{})
-	if !ok {
-		t.Fatalf("warnings is not an array")
+
+	// A row failing validation or the merge does not affect the others
+	results := responseData.Results
+	if results[1].Validation.Valid || results[1].MergedDocument != "" {
+		t.Errorf("Expected row 1 to fail validation, got %+v", results[1])
 	}
-	
-	// Should have warnings about duplicate keys
-	if len(warnings) == 0 {
-		t.Errorf("Expected duplicate key warnings but found none")
+	if !results[2].Validation.Valid || results[2].MergedDocument != "" || !strings.Contains(results[2].Error, "Failed to perform merge: ") {
+		t.Errorf("Expected row 2 to fail the merge, got %+v", results[2])
 	}
-	
-	// Check that warnings contain mentions of duplicate keys
-	hasFirstNameWarning := false
-	hasEmailWarning := false
-	for _, warning := range warnings {
-		warningStr, ok := warning.(string)
-		if !ok {
-			continue
-		}
-		if strings.Contains(warningStr, "Contact_FirstName") && strings.Contains(strings.ToLower(warningStr), "duplicate") {
-			hasFirstNameWarning = true
-		}
-		if strings.Contains(warningStr, "User_Email") && strings.Contains(strings.ToLower(warningStr), "duplicate") {
-			hasEmailWarning = true
+	for _, i := range []int{0, 3} {
+		if results[i].MergedDocument == "" || results[i].Error != "" {
+			t.Fatalf("Expected row %d to merge, got %+v", i, results[i])
 		}
 	}
-	
-	if !hasFirstNameWarning {
-		t.Errorf("Expected warning about duplicate Contact_FirstName key")
+	merged, err := base64.StdEncoding.DecodeString(results[3].MergedDocument)
+	if err != nil {
+		t.Fatalf("Failed to decode merged document: %v", err)
 	}
-	if !hasEmailWarning {
-		t.Errorf("Expected warning about duplicate User_Email key")
+	mergedDocx, err := docx.UnzipDocx(merged)
+	if err != nil {
+		t.Fatalf("Failed to unzip merged document: %v", err)
 	}
-	
-	// Check that overall validation is still valid despite warnings
-	validRaw, ok := validation["valid"]
-	if !ok {
-		t.Fatalf("validation does not contain 'valid' field")
+	mergedXML, _ := mergedDocx.GetDocumentXML()
+	if !strings.Contains(string(mergedXML), "<w:t>Joan</w:t>") || strings.Contains(string(mergedXML), "Jane") {
+		t.Errorf("Unexpected merge of row 3: %s", mergedXML)
 	}
-	
-	valid, ok := validRaw.(bool)
-	if !ok {
-		t.Fatalf("valid is not a boolean")
+
+	response, err = handler(context.Background(), events.APIGatewayProxyRequest{
+		Path: "/merge-batch",
+		Body: `{"docx": "` + encodedDocx + `", "rows": []}`,
+	})
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
 	}
-	
-	if !valid {
-		t.Errorf("Expected validation to be valid despite duplicate key warnings")
+	if response.StatusCode != 400 || !strings.Contains(response.Body, "'rows' key missing") {
+		t.Errorf("Expected a 400 for empty rows, got %d: %s", response.StatusCode, response.Body)
 	}
 }
 
-// TestHandlerWithDuplicateKeysRawJSON tests the handler with raw JSON string containing duplicates
-func TestHandlerWithDuplicateKeysRawJSON(t *testing.T) {
-	// Get the path to the sample DOCX file
-	samplePath := filepath.Join("tests", "data", "sample.docx")
-	
-	// Check if the sample file exists
-	if _, err := os.Stat(samplePath); os.IsNotExist(err) {
-		t.Skip("Sample DOCX file not found, skipping test")
+func TestHandlerPlaceholderSyntax(t *testing.T) {
+	documentXML := testutil.DocumentXML(`<w:p><w:r><w:t>«FirstName»</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>{{LastName}}</w:t></w:r></w:p>`)
+	encodedDocx := base64.StdEncoding.EncodeToString(testutil.Docx(t, documentXML))
+	call := func(path, body string) events.APIGatewayProxyResponse {
+		response, err := handler(context.Background(), events.APIGatewayProxyRequest{Path: path, Body: body})
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		return response
 	}
-	
-	// Read the sample DOCX file
-	file, err := os.Open(samplePath)
-	if err != nil {
-		t.Fatalf("Failed to open sample DOCX file: %v", err)
+
+	response := call("/detect", `{"docx": "`+encodedDocx+`", "options": {"placeholderSyntax": "both"}}`)
+	if response.StatusCode != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
 	}
-	defer file.Close()
-	
-	docxBytes, err := io.ReadAll(file)
-	if err != nil {
-		t.Fatalf("Failed to read sample DOCX file: %v", err)
+	var detected DetectResponse
+	if err := json.Unmarshal([]byte(response.Body), &detected); err != nil {
+		t.Fatalf("Failed to unmarshal response body: %v", err)
 	}
-	
-	// Encode the DOCX file as base64
-	encodedDocx := base64.StdEncoding.EncodeToString(docxBytes)
-	
-	// Create request body with JSON string that has intentional duplicate keys
-	// This simulates a more realistic scenario where the JSON might come from external sources
-	requestBodyJSON := `{
-		"docx": "` + encodedDocx + `",
-		"data": {"Contact_FirstName": "Alice", "Contact_FullName": "Alice Smith", "User_Email": "alice@test.com", "Contact_FirstName": "Bob", "User_Company": "TestCorp", "User_Email": "bob@test.com", "User_Phone": "555-9999"}
-	}`
-	
-	// Create the Lambda event
-	request := events.APIGatewayProxyRequest{
-		Path: "/merge",
-		Body: requestBodyJSON,
+	if _, found := detected.Data["FirstName"]; !found || len(detected.Data) != 2 {
+		t.Errorf("Expected FirstName and LastName to be detected, got %v", detected.Data)
 	}
-	
-	// Call the handler
-	ctx := context.Background()
-	response, err := handler(ctx, request)
-	
-	// Check for errors
-	if err != nil {
-		t.Fatalf("Handler returned error: %v", err)
+	if _, found := detected.Data["LastName"]; !found {
+		t.Errorf("Expected LastName to be detected, got %v", detected.Data)
 	}
-	
-	// Check status code - should be 200 since validation should pass
+
+	response = call("/merge", `{"docx": "`+encodedDocx+`", "data": {"FirstName": "Jane", "LastName": "Doe"}, "options": {"placeholderSyntax": "both"}}`)
 	if response.StatusCode != 200 {
-		t.Errorf("Expected status code 200, got %d", response.StatusCode)
-		t.Logf("Response body: %s", response.Body)
+		t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
 	}
-	
-	// Parse response body
-	var responseData map[string]interface{}
-	if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+	var merged struct {
+		MergedDocument string   `json:"mergedDocument"`
+		SkippedFields  []string `json:"skippedFields"`
+		UnusedDataKeys []string `json:"unusedDataKeys"`
+	}
+	if err := json.Unmarshal([]byte(response.Body), &merged); err != nil {
 		t.Fatalf("Failed to unmarshal response body: %v", err)
 	}
-	
-	// Check that mergedDocument is present
-	if _, ok := responseData["mergedDocument"]; !ok {
-		t.Fatalf("Response does not contain 'mergedDocument' field")
+	mergedBytes, err := base64.StdEncoding.DecodeString(merged.MergedDocument)
+	if err != nil {
+		t.Fatalf("Failed to decode merged document: %v", err)
 	}
-	
-	// Check that skippedFields is present
-	if _, ok := responseData["skippedFields"]; !ok {
-		t.Fatalf("Response does not contain 'skippedFields' field")
+	mergedDocx, err := docx.UnzipDocx(mergedBytes)
+	if err != nil {
+		t.Fatalf("Failed to unzip merged document: %v", err)
+	}
+	mergedXML, _ := mergedDocx.GetDocumentXML()
+	if !strings.Contains(string(mergedXML), "<w:t>Jane</w:t>") || !strings.Contains(string(mergedXML), "<w:t>Doe</w:t>") {
+		t.Errorf("Expected both placeholders to be merged: %s", mergedXML)
+	}
+	if len(merged.SkippedFields) != 0 || len(merged.UnusedDataKeys) != 0 {
+		t.Errorf("Expected no skipped fields or unused keys, got %v and %v", merged.SkippedFields, merged.UnusedDataKeys)
+	}
+
+	response = call("/detect", `{"docx": "`+encodedDocx+`", "options": {"placeholderSyntax": "angle"}}`)
+	if response.StatusCode != 400 || !strings.Contains(response.Body, "unknown placeholderSyntax 'angle'") {
+		t.Errorf("Expected an unknown syntax to be rejected, got %d: %s", response.StatusCode, response.Body)
 	}
 }
 
-// TestDetectHandler tests the /detect endpoint with valid input
-func TestDetectHandler(t *testing.T) {
-	// Get the path to the sample DOCX file
-	samplePath := filepath.Join("tests", "data", "sample.docx")
-	
-	// Check if the sample file exists
-	if _, err := os.Stat(samplePath); os.IsNotExist(err) {
-		t.Skip("Sample DOCX file not found, skipping test")
+// TestHandlerMergeXML tests merging a bare document.xml through /merge/xml
+func TestHandlerMergeXML(t *testing.T) {
+	fragment := `<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>` +
+		`<w:p><w:fldSimple w:instr=" MERGEFIELD FirstName "><w:r><w:t>«FirstName»</w:t></w:r></w:fldSimple></w:p>` +
+		`<w:p><w:r><w:t>«LastName»</w:t></w:r></w:p>` +
+		`</w:body></w:document>`
+	encodedFragment, _ := json.Marshal(fragment)
+
+	t.Run("merges the fragment", func(t *testing.T) {
+		request := events.APIGatewayProxyRequest{
+			Path: "/merge/xml",
+			Body: `{"xml": ` + string(encodedFragment) + `, "data": {"firstname": "Jane & Co"}}`,
+		}
+
+		response, err := handler(context.Background(), request)
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if response.StatusCode != 200 {
+			t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+		}
+
+		var responseData MergeXMLResponse
+		if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+		if !strings.Contains(responseData.XML, "<w:t>Jane &amp; Co</w:t>") {
+			t.Errorf("Expected the merged value in the XML: %s", responseData.XML)
+		}
+		if !strings.Contains(responseData.XML, "<w:t>«LastName»</w:t>") {
+			t.Errorf("Expected the field without data to be kept: %s", responseData.XML)
+		}
+		if !reflect.DeepEqual(responseData.SkippedFields, []string{"LastName"}) {
+			t.Errorf("Expected skippedFields [LastName], got %v", responseData.SkippedFields)
+		}
+	})
+
+	tests := []struct {
+		name          string
+		body          string
+		expectedError string
+	}{
+		{name: "invalid JSON", body: `{"xml": `, expectedError: "Invalid input"},
+		{name: "missing xml", body: `{"data": {"FirstName": "Jane"}}`, expectedError: "'xml' key missing"},
+		{name: "data is not an object", body: `{"xml": ` + string(encodedFragment) + `, "data": ["Jane"]}`, expectedError: "'data' must be an object"},
 	}
-	
-	// Read the sample DOCX file
-	file, err := os.Open(samplePath)
-	if err != nil {
-		t.Fatalf("Failed to open sample DOCX file: %v", err)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := handler(context.Background(), events.APIGatewayProxyRequest{Path: "/merge/xml", Body: tt.body})
+			if err != nil {
+				t.Fatalf("Handler returned error: %v", err)
+			}
+			if response.StatusCode != 400 {
+				t.Errorf("Expected status code 400, got %d", response.StatusCode)
+			}
+			if !strings.Contains(response.Body, tt.expectedError) {
+				t.Errorf("Expected error message '%s' in response body: %s", tt.expectedError, response.Body)
+			}
+		})
 	}
-	defer file.Close()
-	
-	docxBytes, err := io.ReadAll(file)
+}
+
+func TestHandlerPreview(t *testing.T) {
+	documentXML := testutil.DocumentXML(`<w:p><w:r><w:t>Hello «FirstName» &amp; «LastName»</w:t></w:r></w:p>` +
+		`<w:p><w:fldSimple w:instr=" MERGEFIELD City "><w:r><w:t>«City»</w:t></w:r></w:fldSimple></w:p>`)
+	encodedDocx := base64.StdEncoding.EncodeToString(testutil.Docx(t, documentXML))
+
+	response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+		Path: "/preview",
+		Body: `{"docx": "` + encodedDocx + `", "data": {"City": "Zürich & Bern"}}`,
+	})
 	if err != nil {
-		t.Fatalf("Failed to read sample DOCX file: %v", err)
+		t.Fatalf("Handler returned error: %v", err)
 	}
-	
-	// Encode the DOCX file as base64
-	encodedDocx := base64.StdEncoding.EncodeToString(docxBytes)
-	
-	// Create the request body for /detect endpoint
-	requestBody := map[string]string{
-		"docx": encodedDocx,
+	if response.StatusCode != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
 	}
-	
-	bodyJSON, err := json.Marshal(requestBody)
+
+	var responseData PreviewResponse
+	if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+		t.Fatalf("Failed to unmarshal response body: %v", err)
+	}
+	if expected := "Hello «FirstName» & «LastName»\nZürich & Bern"; responseData.Text != expected {
+		t.Errorf("Expected text %q, got %q", expected, responseData.Text)
+	}
+	if len(responseData.SkippedFields) != 0 {
+		t.Errorf("Expected no skipped fields, got %v", responseData.SkippedFields)
+	}
+
+	response, err = handler(context.Background(), events.APIGatewayProxyRequest{Path: "/preview", Body: `{"data": {}}`})
 	if err != nil {
-		t.Fatalf("Failed to marshal request body: %v", err)
+		t.Fatalf("Handler returned error: %v", err)
 	}
-	
-	// Create the Lambda event with Path set to /detect
-	request := events.APIGatewayProxyRequest{
-		Path: "/detect",
-		Body: string(bodyJSON),
+	if response.StatusCode != 400 || !strings.Contains(response.Body, "'docx' key missing") {
+		t.Errorf("Expected a 400 for the missing docx, got %d: %s", response.StatusCode, response.Body)
 	}
-	
-	// Call the handler
-	ctx := context.Background()
-	response, err := handler(ctx, request)
-	
-	// Check for errors
+}
+
+func TestHandlerMergeStrict(t *testing.T) {
+	encodedDocx := loadSampleDocxBase64(t)
+	body := func(strict bool) string {
+		return fmt.Sprintf(`{"docx": "%s", "data": {"Org_Name": "ACME"}, "strict": %t}`, encodedDocx, strict)
+	}
+
+	// The lenient default merges and reports the skipped fields
+	response, err := handler(context.Background(), events.APIGatewayProxyRequest{Path: "/merge", Body: body(false)})
 	if err != nil {
 		t.Fatalf("Handler returned error: %v", err)
 	}
-	
-	// Check status code
 	if response.StatusCode != 200 {
-		t.Errorf("Expected status code 200, got %d", response.StatusCode)
-		t.Logf("Response body: %s", response.Body)
+		t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
 	}
-	
-	// Check content type
-	expectedContentType := "application/json"
-	if response.Headers["Content-Type"] != expectedContentType {
-		t.Errorf("Expected Content-Type %s, got %s", expectedContentType, response.Headers["Content-Type"])
+
+	// A strict merge refuses to skip them
+	response, err = handler(context.Background(), events.APIGatewayProxyRequest{Path: "/merge", Body: body(true)})
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	if response.StatusCode != 422 {
+		t.Fatalf("Expected status code 422, got %d: %s", response.StatusCode, response.Body)
+	}
+	var responseData struct {
+		Error          string   `json:"error"`
+		UnfilledFields []string `json:"unfilledFields"`
+	}
+	if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+		t.Fatalf("Failed to unmarshal response body: %v", err)
+	}
+	if responseData.Error == "" || len(responseData.UnfilledFields) == 0 {
+		t.Errorf("Expected an error listing the unfilled fields, got %s", response.Body)
+	}
+	if slices.Contains(responseData.UnfilledFields, "Org_Name") {
+		t.Errorf("Expected the filled Org_Name not to be listed, got %v", responseData.UnfilledFields)
+	}
+}
+
+// mockPDFConverter records the documents it converts
+type mockPDFConverter struct {
+	documents [][]byte
+	err       error
+}
+
+func (c *mockPDFConverter) ConvertToPDF(document []byte) ([]byte, error) {
+	c.documents = append(c.documents, document)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return []byte("%PDF-1.7 mock"), nil
+}
+
+func TestHandlerMergePDF(t *testing.T) {
+	encodedDocx := loadSampleDocxBase64(t)
+	body := `{"docx": "` + encodedDocx + `", "data": {"Org_Name": "ACME"}, "options": {"outputFormat": "pdf"}}`
+
+	// Without a converter the request is answered as not implemented
+	response, err := handler(context.Background(), events.APIGatewayProxyRequest{Path: "/merge", Body: body})
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	if response.StatusCode != 501 || !strings.Contains(response.Body, "PDF conversion is not configured") {
+		t.Fatalf("Expected status code 501 without a converter, got %d: %s", response.StatusCode, response.Body)
+	}
+
+	converter := &mockPDFConverter{}
+	previous := pdfConverter
+	pdfConverter = converter
+	t.Cleanup(func() { pdfConverter = previous })
+
+	response, err = handler(context.Background(), events.APIGatewayProxyRequest{Path: "/merge", Body: body})
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
 	}
-	
-	// Parse response body
 	var responseData map[string]interface{}
 	if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
 		t.Fatalf("Failed to unmarshal response body: %v", err)
 	}
-	
-	// Check that response contains 'data' field
-	dataRaw, ok := responseData["data"]
-	if !ok {
-		t.Fatalf("Response does not contain 'data' field")
+	if _, exists := responseData["mergedDocument"]; exists {
+		t.Error("Expected no DOCX in a PDF response")
 	}
-	
-	// Check that 'data' is a map
-	data, ok := dataRaw.(map[string]interface{})
-	if !ok {
-		t.Fatalf("'data' field is not a map, got %T", dataRaw)
+	pdf, err := base64.StdEncoding.DecodeString(fmt.Sprint(responseData["mergedPdf"]))
+	if err != nil || string(pdf) != "%PDF-1.7 mock" {
+		t.Errorf("Expected the converted PDF in mergedPdf, got %v (%v)", responseData["mergedPdf"], err)
 	}
-	
-	// Check that data map contains field names as keys
-	if len(data) == 0 {
-		t.Errorf("Expected data map to contain field names, but it's empty")
+
+	// The converter receives the merged document
+	if len(converter.documents) != 1 {
+		t.Fatalf("Expected one conversion, got %d", len(converter.documents))
 	}
-	
-	// Verify that all values in the data map are empty strings
-	for key, value := range data {
-		valueStr, ok := value.(string)
-		if !ok {
-			t.Errorf("Expected value for key '%s' to be a string, got %T", key, value)
-			continue
-		}
-		if valueStr != "" {
-			t.Errorf("Expected value for key '%s' to be empty string, got '%s'", key, valueStr)
-		}
+	mergedFile, err := docx.UnzipDocx(converter.documents[0])
+	if err != nil {
+		t.Fatalf("Converter did not receive a DOCX: %v", err)
+	}
+	documentXML, err := mergedFile.GetDocumentXML()
+	if err != nil || !strings.Contains(string(documentXML), "ACME") {
+		t.Errorf("Expected the converted document to hold the merged value (%v)", err)
+	}
+
+	// Conversion failures are server errors
+	converter.err = errors.New("soffice crashed")
+	response, err = handler(context.Background(), events.APIGatewayProxyRequest{Path: "/merge", Body: body})
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	if response.StatusCode != 500 {
+		t.Errorf("Expected status code 500 for a failed conversion, got %d: %s", response.StatusCode, response.Body)
+	}
+
+	// Partial output and batches are not converted
+	response, err = handler(context.Background(), events.APIGatewayProxyRequest{
+		Path: "/merge",
+		Body: `{"docx": "` + encodedDocx + `", "data": {"Org_Name": "ACME"}, "options": {"outputFormat": "pdf", "partialOutput": true}}`,
+	})
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	if response.StatusCode != 400 {
+		t.Errorf("Expected status code 400 for partial PDF output, got %d: %s", response.StatusCode, response.Body)
+	}
+	response, err = handler(context.Background(), events.APIGatewayProxyRequest{
+		Path: "/merge",
+		Body: `{"docx": "` + encodedDocx + `", "records": [{"Org_Name": "ACME"}], "options": {"outputFormat": "pdf"}}`,
+	})
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	if response.StatusCode != 400 {
+		t.Errorf("Expected status code 400 for a PDF batch, got %d: %s", response.StatusCode, response.Body)
+	}
+	if len(converter.documents) != 2 {
+		t.Errorf("Expected rejected requests not to be converted, got %d conversions", len(converter.documents))
 	}
-	
-	// Log the extracted fields for debugging
-	t.Logf("Extracted fields from DOCX: %v", data)
 }
 
-// TestDetectHandlerErrorCases tests the /detect endpoint error cases
-func TestDetectHandlerErrorCases(t *testing.T) {
-	ctx := context.Background()
-	
+func TestHandlerValidate(t *testing.T) {
+	encodedDocx := loadSampleDocxBase64(t)
+
 	tests := []struct {
-		name           string
-		requestBody    string
-		expectedStatus int
-		expectedError  string
+		name            string
+		data            string
+		options         string
+		expectedValid   bool
+		expectedError   string
+		expectedWarning string
+		expectedMissing bool
 	}{
 		{
-			name:           "invalid JSON",
-			requestBody:    "{invalid json",
-			expectedStatus: 400,
-			expectedError:  "Invalid input",
-		},
-		{
-			name:           "missing docx field",
-			requestBody:    `{"other": "value"}`,
-			expectedStatus: 400,
-			expectedError:  "'docx' key missing",
-		},
-		{
-			name:           "invalid base64",
-			requestBody:    `{"docx": "invalid_base64!"}`,
-			expectedStatus: 400,
-			expectedError:  "Failed to decode base64 input",
+			name:          "string values pass string validation",
+			data:          `{"Org_Name": "ACME"}`,
+			options:       `{"defaultFieldType": "string"}`,
+			expectedValid: true,
 		},
 		{
-			name:           "empty docx field",
-			requestBody:    `{"docx": ""}`,
-			expectedStatus: 400,
-			expectedError:  "'docx' key missing",
+			name:          "string values fail number validation",
+			data:          `{"Org_Name": "ACME"}`,
+			options:       `{"defaultFieldType": "number"}`,
+			expectedError: "expected number",
 		},
 		{
-			name:           "empty body",
-			requestBody:    "",
-			expectedStatus: 400,
-			expectedError:  "Invalid input",
+			name:            "missing fields with requireAllFields",
+			data:            `{"Org_Name": "ACME"}`,
+			options:         `{"requireAllFields": true}`,
+			expectedMissing: true,
 		},
 		{
-			name:           "null docx field",
-			requestBody:    `{"docx": null}`,
-			expectedStatus: 400,
-			expectedError:  "'docx' key missing",
+			name:            "duplicate keys are warnings",
+			data:            `{"Contact_FirstName": "John", "Contact_FirstName": "Jane"}`,
+			options:         `{}`,
+			expectedValid:   true,
+			expectedWarning: "Duplicate key 'Contact_FirstName' detected in JSON data (first occurrence kept)",
 		},
 	}
-	
+
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			request := events.APIGatewayProxyRequest{
-				Path: "/detect",
-				Body: tt.requestBody,
+				Path: "/validate",
+				Body: `{"docx": "` + encodedDocx + `", "data": ` + tt.data + `, "options": ` + tt.options + `}`,
 			}
-			
-			response, err := handler(ctx, request)
-			
-			// Handler should not return an error (errors are handled internally)
+			response, err := handler(context.Background(), request)
 			if err != nil {
-				t.Errorf("Unexpected error: %v", err)
+				t.Fatalf("Handler returned error: %v", err)
 			}
-			
-			// Check status code
-			if response.StatusCode != tt.expectedStatus {
-				t.Errorf("Expected status code %d, got %d", tt.expectedStatus, response.StatusCode)
+			if response.StatusCode != 200 {
+				t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+			}
+
+			var result fields.ValidationResult
+			if err := json.Unmarshal([]byte(response.Body), &result); err != nil {
+				t.Fatalf("Failed to unmarshal response body: %v", err)
+			}
+			if result.Valid != tt.expectedValid {
+				t.Errorf("Expected valid=%t, got %+v", tt.expectedValid, result)
+			}
+			if tt.expectedError != "" && !strings.Contains(strings.Join(result.Errors, "\n"), tt.expectedError) {
+				t.Errorf("Expected an error containing %q, got %v", tt.expectedError, result.Errors)
+			}
+			if tt.expectedWarning != "" && !slices.Contains(result.Warnings, tt.expectedWarning) {
+				t.Errorf("Expected the warning %q, got %v", tt.expectedWarning, result.Warnings)
+			}
+			if tt.expectedMissing == (len(result.MissingFields) == 0) {
+				t.Errorf("Unexpected missing fields %v", result.MissingFields)
+			}
+			if strings.Contains(response.Body, "mergedDocument") {
+				t.Errorf("Expected no merge output: %s", response.Body)
+			}
+		})
+	}
+
+	errorCases := []struct {
+		name          string
+		body          string
+		expectedError string
+	}{
+		{name: "invalid JSON", body: `{"docx": `, expectedError: "Invalid input"},
+		{name: "missing docx", body: `{"data": {"Org_Name": "ACME"}}`, expectedError: "'docx' key missing"},
+		{name: "missing data", body: `{"docx": "` + encodedDocx + `"}`, expectedError: "'data' key missing"},
+		{name: "data is not an object", body: `{"docx": "` + encodedDocx + `", "data": ["ACME"]}`, expectedError: "'data' must be an object"},
+		{name: "invalid options", body: `{"docx": "` + encodedDocx + `", "data": {}, "options": {"defaultFieldType": "decimal"}}`, expectedError: "Invalid options"},
+	}
+	for _, tt := range errorCases {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := handler(context.Background(), events.APIGatewayProxyRequest{Path: "/validate", Body: tt.body})
+			if err != nil {
+				t.Fatalf("Handler returned error: %v", err)
+			}
+			if response.StatusCode != 400 {
+				t.Errorf("Expected status code 400, got %d", response.StatusCode)
 			}
-			
-			// Check that error message is present in response
 			if !strings.Contains(response.Body, tt.expectedError) {
 				t.Errorf("Expected error message '%s' in response body: %s", tt.expectedError, response.Body)
 			}
-			
-			// Check content type for error responses
-			expectedContentType := "application/json"
-			if response.Headers["Content-Type"] != expectedContentType {
-				t.Errorf("Expected Content-Type %s, got %s", expectedContentType, response.Headers["Content-Type"])
-			}
 		})
 	}
 }
 
-// TestDetectHandlerWithCorruptedDocx tests the /detect endpoint with a corrupted DOCX file
-func TestDetectHandlerWithCorruptedDocx(t *testing.T) {
-	// Create a corrupted DOCX (valid base64 but not a valid DOCX file)
-	corruptedData := "This is not a valid DOCX file"
-	encodedCorrupted := base64.StdEncoding.EncodeToString([]byte(corruptedData))
-	
-	// Create the request body
-	requestBody := map[string]string{
-		"docx": encodedCorrupted,
+// TestNegotiateEncoding tests the choice of the response content coding
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"br", "br"},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"GZIP, BR", "br"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"br;q=0, gzip", "gzip"},
+		{"br;q=0, gzip;q=0", ""},
+		{"*", "br"},
+		{"*;q=0.5, br;q=0", "gzip"},
+		{"deflate", ""},
 	}
-	
-	bodyJSON, err := json.Marshal(requestBody)
-	if err != nil {
-		t.Fatalf("Failed to marshal request body: %v", err)
+
+	for _, tt := range tests {
+		t.Run(tt.acceptEncoding, func(t *testing.T) {
+			if encoding := negotiateEncoding(tt.acceptEncoding); encoding != tt.expected {
+				t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.acceptEncoding, encoding, tt.expected)
+			}
+		})
 	}
-	
-	// Create the Lambda event
-	request := events.APIGatewayProxyRequest{
-		Path: "/detect",
-		Body: string(bodyJSON),
+}
+
+// TestHandlerResponseCompression tests Brotli and gzip compressed responses
+func TestHandlerResponseCompression(t *testing.T) {
+	// A fragment large enough for its merged response to be compressed
+	fragment := testutil.DocumentXML(strings.Repeat(`<w:p><w:r><w:t>«FirstName»</w:t></w:r><w:r><w:t xml:space="preserve"> lives in </w:t></w:r><w:r><w:t>«City»</w:t></w:r></w:p>`, 50))
+	encodedFragment, _ := json.Marshal(fragment)
+	body := `{"xml": ` + string(encodedFragment) + `, "data": {"FirstName": "Jane", "City": "Springfield"}}`
+
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"br": func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+		"gzip": func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		},
+	}
+
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		body           string
+		expected       string
+	}{
+		{name: "brotli", acceptEncoding: "gzip, deflate, br", body: body, expected: "br"},
+		{name: "gzip fallback", acceptEncoding: "gzip, deflate", body: body, expected: "gzip"},
+		{name: "identity", acceptEncoding: "", body: body, expected: ""},
+		{name: "small response", acceptEncoding: "br", body: `{"data": {}}`, expected: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := events.APIGatewayProxyRequest{
+				Path:    "/merge/xml",
+				Body:    tt.body,
+				Headers: map[string]string{"accept-encoding": tt.acceptEncoding},
+			}
+			response, err := handler(context.Background(), request)
+			if err != nil {
+				t.Fatalf("Handler returned error: %v", err)
+			}
+
+			if encoding := response.Headers["Content-Encoding"]; encoding != tt.expected {
+				t.Fatalf("Expected Content-Encoding %q, got %q", tt.expected, encoding)
+			}
+			if tt.expected == "" {
+				if response.IsBase64Encoded || !json.Valid([]byte(response.Body)) {
+					t.Errorf("Expected an uncompressed JSON body, got %q", response.Body)
+				}
+				return
+			}
+
+			if !response.IsBase64Encoded || response.Headers["Vary"] != "Accept-Encoding" {
+				t.Errorf("Expected a base64-encoded body varying on Accept-Encoding, got %+v", response.Headers)
+			}
+			compressed, err := base64.StdEncoding.DecodeString(response.Body)
+			if err != nil {
+				t.Fatalf("Failed to decode base64 body: %v", err)
+			}
+			reader, err := decoders[tt.expected](bytes.NewReader(compressed))
+			if err != nil {
+				t.Fatalf("Failed to open %s body: %v", tt.expected, err)
+			}
+			decompressed, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("Failed to decompress %s body: %v", tt.expected, err)
+			}
+
+			var responseData MergeXMLResponse
+			if err := json.Unmarshal(decompressed, &responseData); err != nil {
+				t.Fatalf("Decompressed body is not JSON: %v", err)
+			}
+			if !strings.Contains(responseData.XML, "<w:t>Jane</w:t>") || strings.Contains(responseData.XML, "«") {
+				t.Errorf("Expected a fully merged XML: %s", responseData.XML)
+			}
+			if len(compressed) >= len(decompressed) {
+				t.Errorf("Expected compression to shrink the body, got %d bytes from %d", len(compressed), len(decompressed))
+			}
+		})
+	}
+}
+
+// TestHandlerWithDuplicateKeys tests the handler with duplicate keys in the data field
+func TestHandlerWithDuplicateKeys(t *testing.T) {
+	// Get the path to the sample DOCX file
+	samplePath := filepath.Join("tests", "data", "sample.docx")
+	
+	// Check if the sample file exists
+	if _, err := os.Stat(samplePath); os.IsNotExist(err) {
+		t.Skip("Sample DOCX file not found, skipping test")
+	}
+	
+	// Read the sample DOCX file
+	file, err := os.Open(samplePath)
+	if err != nil {
+		t.Fatalf("Failed to open sample DOCX file: %v", err)
+	}
+	defer file.Close()
+	
+	docxBytes, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("Failed to read sample DOCX file: %v", err)
+	}
+	
+	// Encode the DOCX file as base64
+	encodedDocx := base64.StdEncoding.EncodeToString(docxBytes)
+	
+	// Create request body with duplicate keys in the data field
+	// This JSON intentionally contains duplicate keys to test first-win logic
+	requestBodyJSON := `{
+		"docx": "` + encodedDocx + `",
+		"data": {"Contact_FirstName": "John", "Contact_FullName": "John Doe", "User_Email": "john@example.com", "Contact_FirstName": "Jane", "User_Company": "ACME Corp", "User_Email": "jane@example.com", "User_Phone": "555-0123"}
+	}`
+	
+	// Create the Lambda event
+	request := events.APIGatewayProxyRequest{
+		Path: "/merge",
+		Body: requestBodyJSON,
 	}
 	
 	// Call the handler
@@ -569,17 +959,2592 @@ func TestDetectHandlerWithCorruptedDocx(t *testing.T) {
 	
 	// Check for errors
 	if err != nil {
-		t.Errorf("Unexpected error: %v", err)
+		t.Fatalf("Handler returned error: %v", err)
 	}
 	
-	// Check status code - should be 500 for processing error
-	if response.StatusCode != 500 {
-		t.Errorf("Expected status code 500, got %d", response.StatusCode)
+	// Check status code - should be 200 since validation should pass
+	if response.StatusCode != 200 {
+		t.Errorf("Expected status code 200, got %d", response.StatusCode)
+		t.Logf("Response body: %s", response.Body)
 	}
 	
-	// Check that error message indicates processing failure
-	expectedError := "Failed to process document"
-	if !strings.Contains(response.Body, expectedError) {
-		t.Errorf("Expected error message '%s' in response body: %s", expectedError, response.Body)
+	// Parse response body
+	var responseData map[string]interface{}
+	if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+		t.Fatalf("Failed to unmarshal response body: %v", err)
+	}
+	
+	// Check that mergedDocument is present
+	if _, ok := responseData["mergedDocument"]; !ok {
+		t.Fatalf("Response does not contain 'mergedDocument' field")
+	}
+	
+	// Check that skippedFields is present
+	if _, ok := responseData["skippedFields"]; !ok {
+		t.Fatalf("Response does not contain 'skippedFields' field")
+	}
+	
+	// Check that validation warnings are present about duplicate keys
+	validationRaw, ok := responseData["validation"]
+	if !ok {
+		t.Fatalf("Response does not contain 'validation' field")
+	}
+	
+	validation, ok := validationRaw.(map[string]interface{})
+	if !ok {
+		t.Fatalf("validation is not a map")
+	}
+	
+	warningsRaw, ok := validation["warnings"]
+	if !ok {
+		t.Fatalf("validation does not contain 'warnings' field")
+	}
+	
+	warnings, ok := warningsRaw.([]interface{})
+	if !ok {
+		t.Fatalf("warnings is not an array")
+	}
+	
+	// Should have warnings about duplicate keys
+	if len(warnings) == 0 {
+		t.Errorf("Expected duplicate key warnings but found none")
+	}
+	
+	// Check that warnings contain mentions of duplicate keys
+	hasFirstNameWarning := false
+	hasEmailWarning := false
+	for _, warning := range warnings {
+		warningStr, ok := warning.(string)
+		if !ok {
+			continue
+		}
+		if strings.Contains(warningStr, "Contact_FirstName") && strings.Contains(strings.ToLower(warningStr), "duplicate") {
+			hasFirstNameWarning = true
+		}
+		if strings.Contains(warningStr, "User_Email") && strings.Contains(strings.ToLower(warningStr), "duplicate") {
+			hasEmailWarning = true
+		}
+	}
+	
+	if !hasFirstNameWarning {
+		t.Errorf("Expected warning about duplicate Contact_FirstName key")
+	}
+	if !hasEmailWarning {
+		t.Errorf("Expected warning about duplicate User_Email key")
+	}
+	
+	// Check that overall validation is still valid despite warnings
+	validRaw, ok := validation["valid"]
+	if !ok {
+		t.Fatalf("validation does not contain 'valid' field")
+	}
+	
+	valid, ok := validRaw.(bool)
+	if !ok {
+		t.Fatalf("valid is not a boolean")
+	}
+	
+	if !valid {
+		t.Errorf("Expected validation to be valid despite duplicate key warnings")
+	}
+}
+
+// TestHandlerWithDuplicateKeysRawJSON tests the handler with raw JSON string containing duplicates
+func TestHandlerWithDuplicateKeysRawJSON(t *testing.T) {
+	// Get the path to the sample DOCX file
+	samplePath := filepath.Join("tests", "data", "sample.docx")
+	
+	// Check if the sample file exists
+	if _, err := os.Stat(samplePath); os.IsNotExist(err) {
+		t.Skip("Sample DOCX file not found, skipping test")
+	}
+	
+	// Read the sample DOCX file
+	file, err := os.Open(samplePath)
+	if err != nil {
+		t.Fatalf("Failed to open sample DOCX file: %v", err)
+	}
+	defer file.Close()
+	
+	docxBytes, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("Failed to read sample DOCX file: %v", err)
+	}
+	
+	// Encode the DOCX file as base64
+	encodedDocx := base64.StdEncoding.EncodeToString(docxBytes)
+	
+	// Create request body with JSON string that has intentional duplicate keys
+	// This simulates a more realistic scenario where the JSON might come from external sources
+	requestBodyJSON := `{
+		"docx": "` + encodedDocx + `",
+		"data": {"Contact_FirstName": "Alice", "Contact_FullName": "Alice Smith", "User_Email": "alice@test.com", "Contact_FirstName": "Bob", "User_Company": "TestCorp", "User_Email": "bob@test.com", "User_Phone": "555-9999"}
+	}`
+	
+	// Create the Lambda event
+	request := events.APIGatewayProxyRequest{
+		Path: "/merge",
+		Body: requestBodyJSON,
+	}
+	
+	// Call the handler
+	ctx := context.Background()
+	response, err := handler(ctx, request)
+	
+	// Check for errors
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	
+	// Check status code - should be 200 since validation should pass
+	if response.StatusCode != 200 {
+		t.Errorf("Expected status code 200, got %d", response.StatusCode)
+		t.Logf("Response body: %s", response.Body)
+	}
+	
+	// Parse response body
+	var responseData map[string]interface{}
+	if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+		t.Fatalf("Failed to unmarshal response body: %v", err)
+	}
+	
+	// Check that mergedDocument is present
+	if _, ok := responseData["mergedDocument"]; !ok {
+		t.Fatalf("Response does not contain 'mergedDocument' field")
+	}
+	
+	// Check that skippedFields is present
+	if _, ok := responseData["skippedFields"]; !ok {
+		t.Fatalf("Response does not contain 'skippedFields' field")
+	}
+}
+
+// TestDetectHandler tests the /detect endpoint with valid input
+func TestDetectHandler(t *testing.T) {
+	// Get the path to the sample DOCX file
+	samplePath := filepath.Join("tests", "data", "sample.docx")
+	
+	// Check if the sample file exists
+	if _, err := os.Stat(samplePath); os.IsNotExist(err) {
+		t.Skip("Sample DOCX file not found, skipping test")
+	}
+	
+	// Read the sample DOCX file
+	file, err := os.Open(samplePath)
+	if err != nil {
+		t.Fatalf("Failed to open sample DOCX file: %v", err)
+	}
+	defer file.Close()
+	
+	docxBytes, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("Failed to read sample DOCX file: %v", err)
+	}
+	
+	// Encode the DOCX file as base64
+	encodedDocx := base64.StdEncoding.EncodeToString(docxBytes)
+	
+	// Create the request body for /detect endpoint
+	requestBody := map[string]string{
+		"docx": encodedDocx,
+	}
+	
+	bodyJSON, err := json.Marshal(requestBody)
+	if err != nil {
+		t.Fatalf("Failed to marshal request body: %v", err)
+	}
+	
+	// Create the Lambda event with Path set to /detect
+	request := events.APIGatewayProxyRequest{
+		Path: "/detect",
+		Body: string(bodyJSON),
+	}
+	
+	// Call the handler
+	ctx := context.Background()
+	response, err := handler(ctx, request)
+	
+	// Check for errors
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	
+	// Check status code
+	if response.StatusCode != 200 {
+		t.Errorf("Expected status code 200, got %d", response.StatusCode)
+		t.Logf("Response body: %s", response.Body)
+	}
+	
+	// Check content type
+	expectedContentType := "application/json"
+	if response.Headers["Content-Type"] != expectedContentType {
+		t.Errorf("Expected Content-Type %s, got %s", expectedContentType, response.Headers["Content-Type"])
+	}
+	
+	// Parse response body
+	var responseData map[string]interface{}
+	if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+		t.Fatalf("Failed to unmarshal response body: %v", err)
+	}
+	
+	// Check that response contains 'data' field
+	dataRaw, ok := responseData["data"]
+	if !ok {
+		t.Fatalf("Response does not contain 'data' field")
+	}
+	
+	// Check that 'data' is a map
+	data, ok := dataRaw.(map[string]interface{})
+	if !ok {
+		t.Fatalf("'data' field is not a map, got %T", dataRaw)
+	}
+	
+	// Check that data map contains field names as keys
+	if len(data) == 0 {
+		t.Errorf("Expected data map to contain field names, but it's empty")
+	}
+	
+	// Verify that all values in the data map are empty strings
+	for key, value := range data {
+		valueStr, ok := value.(string)
+		if !ok {
+			t.Errorf("Expected value for key '%s' to be a string, got %T", key, value)
+			continue
+		}
+		if valueStr != "" {
+			t.Errorf("Expected value for key '%s' to be empty string, got '%s'", key, valueStr)
+		}
+	}
+	
+	// Log the extracted fields for debugging
+	t.Logf("Extracted fields from DOCX: %v", data)
+}
+
+// TestDetectHandlerErrorCases tests the /detect endpoint error cases
+func TestDetectHandlerErrorCases(t *testing.T) {
+	ctx := context.Background()
+	
+	tests := []struct {
+		name           string
+		requestBody    string
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name:           "invalid JSON",
+			requestBody:    "{invalid json",
+			expectedStatus: 400,
+			expectedError:  "Invalid input",
+		},
+		{
+			name:           "missing docx field",
+			requestBody:    `{"other": "value"}`,
+			expectedStatus: 400,
+			expectedError:  "'docx' key missing",
+		},
+		{
+			name:           "invalid base64",
+			requestBody:    `{"docx": "invalid_base64!"}`,
+			expectedStatus: 400,
+			expectedError:  "Failed to decode base64 input",
+		},
+		{
+			name:           "empty docx field",
+			requestBody:    `{"docx": ""}`,
+			expectedStatus: 400,
+			expectedError:  "'docx' key missing",
+		},
+		{
+			name:           "empty body",
+			requestBody:    "",
+			expectedStatus: 400,
+			expectedError:  "Invalid input",
+		},
+		{
+			name:           "null docx field",
+			requestBody:    `{"docx": null}`,
+			expectedStatus: 400,
+			expectedError:  "'docx' key missing",
+		},
+	}
+	
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := events.APIGatewayProxyRequest{
+				Path: "/detect",
+				Body: tt.requestBody,
+			}
+			
+			response, err := handler(ctx, request)
+			
+			// Handler should not return an error (errors are handled internally)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			
+			// Check status code
+			if response.StatusCode != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d", tt.expectedStatus, response.StatusCode)
+			}
+			
+			// Check that error message is present in response
+			if !strings.Contains(response.Body, tt.expectedError) {
+				t.Errorf("Expected error message '%s' in response body: %s", tt.expectedError, response.Body)
+			}
+			
+			// Check content type for error responses
+			expectedContentType := "application/json"
+			if response.Headers["Content-Type"] != expectedContentType {
+				t.Errorf("Expected Content-Type %s, got %s", expectedContentType, response.Headers["Content-Type"])
+			}
+		})
+	}
+}
+
+// TestDetectHandlerWithCorruptedDocx tests the /detect endpoint with a corrupted DOCX file
+func TestDetectHandlerWithCorruptedDocx(t *testing.T) {
+	// Create a corrupted DOCX (valid base64 but not a valid DOCX file)
+	corruptedData := "This is not a valid DOCX file"
+	encodedCorrupted := base64.StdEncoding.EncodeToString([]byte(corruptedData))
+	
+	// Create the request body
+	requestBody := map[string]string{
+		"docx": encodedCorrupted,
+	}
+	
+	bodyJSON, err := json.Marshal(requestBody)
+	if err != nil {
+		t.Fatalf("Failed to marshal request body: %v", err)
+	}
+	
+	// Create the Lambda event
+	request := events.APIGatewayProxyRequest{
+		Path: "/detect",
+		Body: string(bodyJSON),
+	}
+	
+	// Call the handler
+	ctx := context.Background()
+	response, err := handler(ctx, request)
+	
+	// Check for errors
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	
+	// Check status code - should be 500 for processing error
+	if response.StatusCode != 500 {
+		t.Errorf("Expected status code 500, got %d", response.StatusCode)
+	}
+	
+	// Check that error message indicates processing failure
+	expectedError := "Failed to process document"
+	if !strings.Contains(response.Body, expectedError) {
+		t.Errorf("Expected error message '%s' in response body: %s", expectedError, response.Body)
+	}
+}
+
+// TestHandlerWithDefaultFieldType tests the defaultFieldType request option
+func TestHandlerWithDefaultFieldType(t *testing.T) {
+	encodedDocx := loadSampleDocxBase64(t)
+
+	tests := []struct {
+		name           string
+		options        string
+		expectedStatus int
+		expectedError  string
+	}{
+		{
+			name:           "string values fail number validation",
+			options:        `{"defaultFieldType": "number"}`,
+			expectedStatus: 400,
+			expectedError:  "expected number",
+		},
+		{
+			name:           "string values pass string validation",
+			options:        `{"defaultFieldType": "string"}`,
+			expectedStatus: 200,
+		},
+		{
+			name:           "unknown field type",
+			options:        `{"defaultFieldType": "decimal"}`,
+			expectedStatus: 400,
+			expectedError:  "Invalid options",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := events.APIGatewayProxyRequest{
+				Path: "/merge",
+				Body: `{"docx": "` + encodedDocx + `", "data": {"Org_Name": "ACME"}, "options": ` + tt.options + `}`,
+			}
+
+			response, err := handler(context.Background(), request)
+			if err != nil {
+				t.Fatalf("Handler returned error: %v", err)
+			}
+
+			if response.StatusCode != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d", tt.expectedStatus, response.StatusCode)
+				t.Logf("Response body: %s", response.Body)
+			}
+
+			if !json.Valid([]byte(response.Body)) {
+				t.Errorf("Response body is not valid JSON: %s", response.Body)
+			}
+
+			if tt.expectedError != "" && !strings.Contains(response.Body, tt.expectedError) {
+				t.Errorf("Expected '%s' in response body: %s", tt.expectedError, response.Body)
+			}
+		})
+	}
+}
+
+// TestHandlerAPIVersion tests the apiVersion field and Accept-Version negotiation
+func TestHandlerAPIVersion(t *testing.T) {
+	tests := []struct {
+		name            string
+		headers         map[string]string
+		path            string
+		body            string
+		expectedStatus  int
+		expectedVersion string
+	}{
+		{
+			name:            "default version on error response",
+			path:            "/detect",
+			body:            `{"docx": ""}`,
+			expectedStatus:  400,
+			expectedVersion: "v1",
+		},
+		{
+			name:            "default version on unknown endpoint",
+			path:            "/unknown",
+			body:            `{}`,
+			expectedStatus:  404,
+			expectedVersion: "v1",
+		},
+		{
+			name:            "explicit v1",
+			headers:         map[string]string{"Accept-Version": "v1"},
+			path:            "/detect",
+			body:            `{"docx": ""}`,
+			expectedStatus:  400,
+			expectedVersion: "v1",
+		},
+		{
+			name:            "v2 with lowercase header name",
+			headers:         map[string]string{"accept-version": "v2"},
+			path:            "/detect",
+			body:            `{"docx": ""}`,
+			expectedStatus:  400,
+			expectedVersion: "v2",
+		},
+		{
+			name:            "unknown version",
+			headers:         map[string]string{"Accept-Version": "v9"},
+			path:            "/detect",
+			body:            `{"docx": ""}`,
+			expectedStatus:  400,
+			expectedVersion: "v1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := events.APIGatewayProxyRequest{
+				Path:    tt.path,
+				Headers: tt.headers,
+				Body:    tt.body,
+			}
+
+			response, err := handler(context.Background(), request)
+			if err != nil {
+				t.Fatalf("Handler returned error: %v", err)
+			}
+
+			if response.StatusCode != tt.expectedStatus {
+				t.Errorf("Expected status code %d, got %d", tt.expectedStatus, response.StatusCode)
+			}
+
+			var responseData map[string]interface{}
+			if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+				t.Fatalf("Failed to unmarshal response body: %v", err)
+			}
+
+			if responseData["apiVersion"] != tt.expectedVersion {
+				t.Errorf("Expected apiVersion %s, got %v", tt.expectedVersion, responseData["apiVersion"])
+			}
+		})
+	}
+
+	t.Run("unknown version is rejected before routing", func(t *testing.T) {
+		request := events.APIGatewayProxyRequest{
+			Path:    "/unknown",
+			Headers: map[string]string{"Accept-Version": "v9"},
+		}
+
+		response, _ := handler(context.Background(), request)
+		if response.StatusCode != 400 {
+			t.Errorf("Expected status code 400, got %d", response.StatusCode)
+		}
+		if !strings.Contains(response.Body, "Unsupported API version") {
+			t.Errorf("Expected unsupported version error, got: %s", response.Body)
+		}
+	})
+
+	t.Run("v1 error is a string", func(t *testing.T) {
+		request := events.APIGatewayProxyRequest{Path: "/detect", Body: `{"docx": ""}`}
+		response, _ := handler(context.Background(), request)
+
+		var responseData map[string]interface{}
+		if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+		if responseData["error"] != "'docx' key missing" {
+			t.Errorf("Expected v1 string error, got %v", responseData["error"])
+		}
+	})
+
+	t.Run("v2 error is a typed object", func(t *testing.T) {
+		request := events.APIGatewayProxyRequest{
+			Path:    "/detect",
+			Headers: map[string]string{"Accept-Version": "v2"},
+			Body:    `{"docx": ""}`,
+		}
+		response, _ := handler(context.Background(), request)
+
+		var responseData struct {
+			APIVersion string `json:"apiVersion"`
+			Error      struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+		if responseData.Error.Code != "bad_request" {
+			t.Errorf("Expected error code 'bad_request', got '%s'", responseData.Error.Code)
+		}
+		if responseData.Error.Message != "'docx' key missing" {
+			t.Errorf("Expected error message \"'docx' key missing\", got '%s'", responseData.Error.Message)
+		}
+	})
+}
+
+// loadSampleDocxBase64 reads the sample DOCX file and returns it base64-encoded,
+// skipping the test if the file is not available
+func loadSampleDocxBase64(t *testing.T) string {
+	t.Helper()
+
+	samplePath := filepath.Join("tests", "data", "sample.docx")
+	if _, err := os.Stat(samplePath); os.IsNotExist(err) {
+		t.Skip("Sample DOCX file not found, skipping test")
+	}
+
+	docxBytes, err := os.ReadFile(samplePath)
+	if err != nil {
+		t.Fatalf("Failed to read sample DOCX file: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(docxBytes)
+}
+
+// TestHandlerMergeSummary tests the summary object of merge responses
+func TestHandlerMergeSummary(t *testing.T) {
+	encodedDocx := loadSampleDocxBase64(t)
+
+	type summaryResponse struct {
+		Summary *MergeSummary `json:"summary"`
+	}
+
+	t.Run("partial merge", func(t *testing.T) {
+		request := events.APIGatewayProxyRequest{
+			Path: "/merge",
+			Body: `{"docx": "` + encodedDocx + `", "data": {"Org_Name": "ACME", "Org_City": "Springfield", "Contact_FullName": "Jane Doe", "Unrelated": "x"}}`,
+		}
+
+		response, err := handler(context.Background(), request)
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if response.StatusCode != 200 {
+			t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+		}
+
+		var responseData summaryResponse
+		if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+		summary := responseData.Summary
+		if summary == nil {
+			t.Fatalf("Response does not contain 'summary' field: %s", response.Body)
+		}
+
+		if summary.TotalFields != 20 {
+			t.Errorf("Expected totalFields 20, got %d", summary.TotalFields)
+		}
+		if summary.Resolved != 3 {
+			t.Errorf("Expected resolved 3, got %d", summary.Resolved)
+		}
+		// Today is filled from the server clock
+		if summary.Defaulted != 1 {
+			t.Errorf("Expected defaulted 1, got %d", summary.Defaulted)
+		}
+		if summary.Skipped != 16 {
+			t.Errorf("Expected skipped 16, got %d", summary.Skipped)
+		}
+		if summary.HadValidationErrors {
+			t.Error("Expected hadValidationErrors to be false")
+		}
+		if !strings.HasPrefix(summary.Message, "Merged 4 of 20 fields; 1 defaulted; 16 skipped: ") {
+			t.Errorf("Unexpected summary message: %s", summary.Message)
+		}
+		if strings.Contains(summary.Message, "\n") {
+			t.Errorf("Summary message should be a single line: %q", summary.Message)
+		}
+	})
+
+	t.Run("validation errors", func(t *testing.T) {
+		request := events.APIGatewayProxyRequest{
+			Path: "/merge",
+			Body: `{"docx": "` + encodedDocx + `", "data": {"Org_Name": "ACME"}, "options": {"defaultFieldType": "number"}}`,
+		}
+
+		response, err := handler(context.Background(), request)
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if response.StatusCode != 400 {
+			t.Fatalf("Expected status code 400, got %d: %s", response.StatusCode, response.Body)
+		}
+
+		var responseData summaryResponse
+		if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+		summary := responseData.Summary
+		if summary == nil {
+			t.Fatalf("Response does not contain 'summary' field: %s", response.Body)
+		}
+
+		if !summary.HadValidationErrors {
+			t.Error("Expected hadValidationErrors to be true")
+		}
+		if summary.Resolved != 0 || summary.Skipped != 0 {
+			t.Errorf("Expected no resolved or skipped fields, got %d/%d", summary.Resolved, summary.Skipped)
+		}
+		if summary.Message != "Validation failed with 1 error(s); document was not merged" {
+			t.Errorf("Unexpected summary message: %s", summary.Message)
+		}
+	})
+}
+
+func TestHandlerVerboseFieldOutcomes(t *testing.T) {
+	encodedDocx := loadSampleDocxBase64(t)
+
+	type outcomesResponse struct {
+		FieldOutcomes []merge.FieldOutcome `json:"fieldOutcomes"`
+	}
+
+	callMerge := func(body string, expectedStatus int) (outcomesResponse, map[string]interface{}) {
+		response, err := handler(context.Background(), events.APIGatewayProxyRequest{Path: "/merge", Body: body})
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if response.StatusCode != expectedStatus {
+			t.Fatalf("Expected status code %d, got %d: %s", expectedStatus, response.StatusCode, response.Body)
+		}
+		var typed outcomesResponse
+		var raw map[string]interface{}
+		if err := json.Unmarshal([]byte(response.Body), &typed); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+		if err := json.Unmarshal([]byte(response.Body), &raw); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+		return typed, raw
+	}
+
+	t.Run("omitted by default", func(t *testing.T) {
+		_, raw := callMerge(`{"docx": "`+encodedDocx+`", "data": {"Org_Name": "ACME"}}`, 200)
+		if _, exists := raw["fieldOutcomes"]; exists {
+			t.Error("fieldOutcomes should only be included when verbose is set")
+		}
+	})
+
+	t.Run("resolved and skipped", func(t *testing.T) {
+		typed, _ := callMerge(`{"docx": "`+encodedDocx+`", "data": {"Org_Name": "ACME"}, "options": {"verbose": true}}`, 200)
+		if len(typed.FieldOutcomes) != 20 {
+			t.Fatalf("Expected 20 field outcomes, got %d: %+v", len(typed.FieldOutcomes), typed.FieldOutcomes)
+		}
+		for _, outcome := range typed.FieldOutcomes {
+			if outcome.Name == "Org_Name" {
+				if outcome.Status != merge.FieldStatusResolved || outcome.Value != "ACME" {
+					t.Errorf("Unexpected outcome for Org_Name: %+v", outcome)
+				}
+			} else if outcome.Name == "Today" {
+				if outcome.Status != merge.FieldStatusDefault {
+					t.Errorf("Expected Today to come from the server clock, got %+v", outcome)
+				}
+			} else if outcome.Status != merge.FieldStatusSkipped {
+				t.Errorf("Expected %s to be skipped, got %+v", outcome.Name, outcome)
+			}
+		}
+	})
+
+	t.Run("validation errors", func(t *testing.T) {
+		typed, _ := callMerge(`{"docx": "`+encodedDocx+`", "data": {"Org_Name": "ACME"}, "options": {"defaultFieldType": "number", "verbose": true}}`, 400)
+		if len(typed.FieldOutcomes) != 1 {
+			t.Fatalf("Expected 1 field outcome, got %d: %+v", len(typed.FieldOutcomes), typed.FieldOutcomes)
+		}
+		outcome := typed.FieldOutcomes[0]
+		if outcome.Name != "Org_Name" || outcome.Status != merge.FieldStatusError || outcome.Reason == "" {
+			t.Errorf("Unexpected outcome: %+v", outcome)
+		}
+	})
+}
+
+func TestDecodeDocx(t *testing.T) {
+	encodedDocx := loadSampleDocxBase64(t)
+
+	docxFile, err := decodeDocx(encodedDocx, false)
+	if err != nil {
+		t.Fatalf("decodeDocx failed: %v", err)
+	}
+	if !docxFile.IsValidDocx() {
+		t.Error("Decoded document should be a valid DOCX")
+	}
+
+	tests := []struct {
+		name         string
+		input        string
+		decodeFailed bool
+	}{
+		{"illegal character", "invalid_base64!", true},
+		{"truncated input", encodedDocx[:len(encodedDocx)-3], true},
+		{"not a zip archive", base64.StdEncoding.EncodeToString([]byte("not a docx")), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeDocx(tt.input, false)
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			var decodeErr *base64DecodeError
+			if errors.As(err, &decodeErr) != tt.decodeFailed {
+				t.Errorf("Expected base64 decode error=%v, got %v", tt.decodeFailed, err)
+			}
+		})
+	}
+}
+
+// paddedSampleDocxBase64 returns the sample DOCX base64-encoded, rewritten
+// with an archive comment so that the encoding ends with padding
+func paddedSampleDocxBase64(t *testing.T) string {
+	docxBytes, err := base64.StdEncoding.DecodeString(loadSampleDocxBase64(t))
+	if err != nil {
+		t.Fatalf("Failed to decode sample DOCX: %v", err)
+	}
+	zipReader, err := zip.NewReader(bytes.NewReader(docxBytes), int64(len(docxBytes)))
+	if err != nil {
+		t.Fatalf("Failed to read sample DOCX: %v", err)
+	}
+
+	for comment := ""; ; comment += "x" {
+		var buf bytes.Buffer
+		zipWriter := zip.NewWriter(&buf)
+		for _, file := range zipReader.File {
+			if err := zipWriter.Copy(file); err != nil {
+				t.Fatalf("Failed to copy zip entry: %v", err)
+			}
+		}
+		if err := zipWriter.SetComment(comment); err != nil {
+			t.Fatalf("Failed to set zip comment: %v", err)
+		}
+		if err := zipWriter.Close(); err != nil {
+			t.Fatalf("Failed to close zip writer: %v", err)
+		}
+		if buf.Len()%3 != 0 {
+			return base64.StdEncoding.EncodeToString(buf.Bytes())
+		}
+	}
+}
+
+func TestDecodeDocxLenient(t *testing.T) {
+	encodedDocx := paddedSampleDocxBase64(t)
+
+	// PEM-style wrapping at 64 columns, with CRLF line breaks and a trailing newline
+	var wrapped strings.Builder
+	for i := 0; i < len(encodedDocx); i += 64 {
+		wrapped.WriteString(encodedDocx[i:min(i+64, len(encodedDocx))])
+		wrapped.WriteString("\r\n")
+	}
+	unpadded := strings.TrimRight(encodedDocx, "=")
+
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"line-wrapped", wrapped.String()},
+		{"spaces and tabs", strings.Join(strings.SplitAfter(encodedDocx, "AAAA"), " \t")},
+		{"unpadded", unpadded},
+		{"unpadded and line-wrapped", strings.TrimRight(wrapped.String(), "=\r\n") + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docxFile, err := decodeDocx(tt.input, true)
+			if err != nil {
+				t.Fatalf("decodeDocx failed: %v", err)
+			}
+			if !docxFile.IsValidDocx() {
+				t.Error("Decoded document should be a valid DOCX")
+			}
+		})
+	}
+
+	t.Run("strict rejects unpadded", func(t *testing.T) {
+		_, err := decodeDocx(unpadded, false)
+		var decodeErr *base64DecodeError
+		if !errors.As(err, &decodeErr) {
+			t.Errorf("Expected base64 decode error, got %v", err)
+		}
+	})
+
+	t.Run("option disables leniency", func(t *testing.T) {
+		request := events.APIGatewayProxyRequest{
+			Path: "/detect",
+			Body: `{"docx": "` + unpadded + `", "options": {"lenientBase64": false}}`,
+		}
+		response, err := handler(context.Background(), request)
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if response.StatusCode != 400 || !strings.Contains(response.Body, "Failed to decode base64 input") {
+			t.Errorf("Expected 400 base64 error, got %d: %s", response.StatusCode, response.Body)
+		}
+
+		request.Body = `{"docx": "` + unpadded + `"}`
+		response, err = handler(context.Background(), request)
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if response.StatusCode != 200 {
+			t.Errorf("Expected lenient decoding by default, got %d: %s", response.StatusCode, response.Body)
+		}
+	})
+}
+
+// largeDocxBase64 builds a base64 DOCX carrying an uncompressed media part of
+// the given size, mimicking documents with large embedded images
+func largeDocxBase64(b *testing.B, mediaSize int) string {
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	files := map[string][]byte{
+		"word/document.xml":     []byte(`<w:document><w:body><w:p><w:r><w:t>«name»</w:t></w:r></w:p></w:body></w:document>`),
+		"word/media/image1.png": bytes.Repeat([]byte{0x89}, mediaSize),
+	}
+	for name, content := range files {
+		fileWriter, err := zipWriter.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err != nil {
+			b.Fatalf("Failed to create zip entry: %v", err)
+		}
+		fileWriter.Write(content)
+	}
+	if err := zipWriter.Close(); err != nil {
+		b.Fatalf("Failed to close zip writer: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func BenchmarkDecodeDocxStreaming(b *testing.B) {
+	encoded := largeDocxBase64(b, 8<<20)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeDocx(encoded, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDecodeDocxDecodeString measures the previous DecodeString path for comparison
+func BenchmarkDecodeDocxDecodeString(b *testing.B) {
+	encoded := largeDocxBase64(b, 8<<20)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		docxBytes, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := docx.UnzipDocx(docxBytes); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDecodeDocxDetectParts measures the detect path, which skips the
+// media part, against BenchmarkDecodeDocxStreaming
+func BenchmarkDecodeDocxDetectParts(b *testing.B) {
+	encoded := largeDocxBase64(b, 8<<20)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeDocxParts(encoded, false, docx.IsDetectPart); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestHandlerBatchMerge(t *testing.T) {
+	encodedDocx := loadSampleDocxBase64(t)
+	records := `[{"Org_Name": "ACME"}, {"Org_Name": "Globex", "Org_City": "Cypress Creek"}, {"Org_Name": "Initech"}]`
+
+	callMerge := func(body string) events.APIGatewayProxyResponse {
+		response, err := handler(context.Background(), events.APIGatewayProxyRequest{Path: "/merge", Body: body})
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		return response
+	}
+
+	t.Run("json results", func(t *testing.T) {
+		response := callMerge(`{"docx": "` + encodedDocx + `", "records": ` + records + `}`)
+		if response.StatusCode != 200 {
+			t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+		}
+		var responseData struct {
+			Results []BatchRecordResult `json:"results"`
+		}
+		if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+		if len(responseData.Results) != 3 {
+			t.Fatalf("Expected 3 results, got %d", len(responseData.Results))
+		}
+		for i, result := range responseData.Results {
+			if result.Record != i || result.MergedDocument == "" {
+				t.Errorf("Unexpected result for record %d: %+v", i, result)
+			}
+		}
+		if len(responseData.Results[1].SkippedFields) != len(responseData.Results[0].SkippedFields)-1 {
+			t.Errorf("Records should be merged independently: %v vs %v", responseData.Results[0].SkippedFields, responseData.Results[1].SkippedFields)
+		}
+	})
+
+	t.Run("zip archive", func(t *testing.T) {
+		response := callMerge(`{"docx": "` + encodedDocx + `", "records": ` + records + `, "options": {"outputFormat": "zip"}}`)
+		if response.StatusCode != 200 {
+			t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+		}
+		var responseData struct {
+			Archive  string              `json:"archive"`
+			Manifest merge.BatchManifest `json:"manifest"`
+		}
+		if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+		archive, err := decodeDocx(responseData.Archive, false)
+		if err != nil {
+			t.Fatalf("Failed to read archive: %v", err)
+		}
+
+		// One entry per record plus the manifest
+		if len(archive.Files) != 4 {
+			t.Errorf("Expected 4 archive entries, got %d", len(archive.Files))
+		}
+		if !archive.HasFile(merge.ManifestFilename) {
+			t.Error("Archive does not contain the manifest")
+		}
+		for _, entry := range responseData.Manifest.Documents {
+			mergedDocx, err := docx.UnzipDocx(archive.Files[entry.Filename])
+			if err != nil {
+				t.Errorf("Failed to read archived document %s: %v", entry.Filename, err)
+				continue
+			}
+			if !mergedDocx.IsValidDocx() {
+				t.Errorf("Archived document %s is not a valid DOCX", entry.Filename)
+			}
+		}
+	})
+
+	t.Run("zip archive with shared filenames", func(t *testing.T) {
+		records := `[{"Org_Name": "ACME"}, {"Org_Name": "Globex"}, {"Org_Name": "ACME"}]`
+		response := callMerge(`{"docx": "` + encodedDocx + `", "records": ` + records + `, "options": {"outputFormat": "zip", "outputFilename": "«Org_Name».docx"}}`)
+		if response.StatusCode != 200 {
+			t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+		}
+		var responseData struct {
+			Archive  string              `json:"archive"`
+			Manifest merge.BatchManifest `json:"manifest"`
+		}
+		if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+		archive, err := decodeDocx(responseData.Archive, false)
+		if err != nil {
+			t.Fatalf("Failed to read archive: %v", err)
+		}
+
+		expected := []struct{ filename, requested string }{
+			{"ACME_1.docx", "ACME.docx"},
+			{"Globex.docx", ""},
+			{"ACME_2.docx", "ACME.docx"},
+		}
+		if len(responseData.Manifest.Documents) != len(expected) {
+			t.Fatalf("Expected %d manifest documents, got %d", len(expected), len(responseData.Manifest.Documents))
+		}
+		for i, entry := range responseData.Manifest.Documents {
+			if entry.Filename != expected[i].filename || entry.RequestedFilename != expected[i].requested {
+				t.Errorf("Record %d: got filename %q requested %q, want %q and %q", i, entry.Filename, entry.RequestedFilename, expected[i].filename, expected[i].requested)
+			}
+			if !archive.HasFile(entry.Filename) {
+				t.Errorf("Archive does not contain %s", entry.Filename)
+			}
+		}
+	})
+
+	t.Run("data and records", func(t *testing.T) {
+		response := callMerge(`{"docx": "` + encodedDocx + `", "data": {}, "records": ` + records + `}`)
+		if response.StatusCode != 400 {
+			t.Errorf("Expected status code 400, got %d: %s", response.StatusCode, response.Body)
+		}
+	})
+
+	t.Run("csv records", func(t *testing.T) {
+		csvText := "org_name, Org_City\nACME,Springfield\n\"Globex, Inc.\",Cypress Creek\n"
+		body, _ := json.Marshal(map[string]string{"docx": encodedDocx, "csv": csvText})
+		response := callMerge(string(body))
+		if response.StatusCode != 200 {
+			t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+		}
+		var responseData struct {
+			Results []BatchRecordResult `json:"results"`
+		}
+		if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+		if len(responseData.Results) != 2 {
+			t.Fatalf("Expected 2 results, got %d", len(responseData.Results))
+		}
+		for i, result := range responseData.Results {
+			if result.MergedDocument == "" || len(result.UnusedDataKeys) != 0 {
+				t.Errorf("Unexpected result for record %d: %+v", i, result)
+			}
+			mergedDocx, err := decodeDocx(result.MergedDocument, false)
+			if err != nil {
+				t.Fatalf("Failed to read merged document %d: %v", i, err)
+			}
+			documentXML := string(mergedDocx.Files["word/document.xml"])
+			for _, value := range [][]string{{"ACME", "Springfield"}, {"Globex, Inc.", "Cypress Creek"}}[i] {
+				if !strings.Contains(documentXML, value) {
+					t.Errorf("Expected record %d to contain %q", i, value)
+				}
+			}
+		}
+	})
+
+	t.Run("invalid csv", func(t *testing.T) {
+		for _, csvText := range []string{"Org_Name\n", "Org_Name,Org_City\nACME\n"} {
+			body, _ := json.Marshal(map[string]string{"docx": encodedDocx, "csv": csvText})
+			response := callMerge(string(body))
+			if response.StatusCode != 400 || !strings.Contains(response.Body, "Failed to parse CSV") {
+				t.Errorf("Expected 400 for CSV %q, got %d: %s", csvText, response.StatusCode, response.Body)
+			}
+		}
+	})
+
+	t.Run("csv and records", func(t *testing.T) {
+		response := callMerge(`{"docx": "` + encodedDocx + `", "csv": "Org_Name\nACME", "records": ` + records + `}`)
+		if response.StatusCode != 400 {
+			t.Errorf("Expected status code 400, got %d: %s", response.StatusCode, response.Body)
+		}
+	})
+
+	t.Run("unknown output format", func(t *testing.T) {
+		response := callMerge(`{"docx": "` + encodedDocx + `", "records": ` + records + `, "options": {"outputFormat": "tar"}}`)
+		if response.StatusCode != 400 {
+			t.Errorf("Expected status code 400, got %d: %s", response.StatusCode, response.Body)
+		}
+	})
+}
+
+func TestHandlerOptionsValidation(t *testing.T) {
+	encodedDocx := loadSampleDocxBase64(t)
+
+	tests := []struct {
+		name           string
+		options        string
+		expectedStatus int
+		expectedErrors []string
+	}{
+		{
+			name:           "unknown key ignored by default",
+			options:        `{"flaten": true}`,
+			expectedStatus: 200,
+		},
+		{
+			name:           "unknown key rejected when strict",
+			options:        `{"strictOptions": true, "flaten": true, "verbose": true}`,
+			expectedStatus: 400,
+			expectedErrors: []string{"unknown option 'flaten'"},
+		},
+		{
+			name:           "conflicting combination",
+			options:        `{"verbose": true, "outputFormat": "zip"}`,
+			expectedStatus: 400,
+			expectedErrors: []string{"'verbose' cannot be combined with outputFormat 'zip'"},
+		},
+		{
+			name:           "all problems listed",
+			options:        `{"strictOptions": true, "defaultFieldType": "currency", "dryrun": true, "verbose": true, "outputFormat": "zip"}`,
+			expectedStatus: 400,
+			expectedErrors: []string{"unknown defaultFieldType 'currency'", "'verbose' cannot be combined", "unknown option 'dryrun'"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := events.APIGatewayProxyRequest{
+				Path: "/detect",
+				Body: `{"docx": "` + encodedDocx + `", "options": ` + tt.options + `}`,
+			}
+
+			response, err := handler(context.Background(), request)
+			if err != nil {
+				t.Fatalf("Handler returned error: %v", err)
+			}
+			if response.StatusCode != tt.expectedStatus {
+				t.Fatalf("Expected status code %d, got %d: %s", tt.expectedStatus, response.StatusCode, response.Body)
+			}
+			for _, expected := range tt.expectedErrors {
+				if !strings.Contains(response.Body, expected) {
+					t.Errorf("Expected error containing %q, got: %s", expected, response.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlerValueTransforms(t *testing.T) {
+	encodedDocx := loadSampleDocxBase64(t)
+
+	t.Run("trim then uppercase", func(t *testing.T) {
+		request := events.APIGatewayProxyRequest{
+			Path: "/merge",
+			Body: `{"docx": "` + encodedDocx + `", "data": {"Org_Name": "  acme corp "}, "options": {"valueTransforms": ["trim", "uppercase"], "verbose": true}}`,
+		}
+
+		response, err := handler(context.Background(), request)
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if response.StatusCode != 200 {
+			t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+		}
+
+		var responseData struct {
+			FieldOutcomes []merge.FieldOutcome `json:"fieldOutcomes"`
+		}
+		if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+		found := false
+		for _, outcome := range responseData.FieldOutcomes {
+			if outcome.Name == "Org_Name" {
+				found = true
+				if outcome.Value != "ACME CORP" {
+					t.Errorf("Expected transformed value 'ACME CORP', got %q", outcome.Value)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("No outcome reported for Org_Name: %+v", responseData.FieldOutcomes)
+		}
+	})
+
+	t.Run("invalid transform", func(t *testing.T) {
+		request := events.APIGatewayProxyRequest{
+			Path: "/merge",
+			Body: `{"docx": "` + encodedDocx + `", "data": {"Org_Name": "acme"}, "options": {"valueTransforms": ["trim", "shout"]}}`,
+		}
+
+		response, err := handler(context.Background(), request)
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if response.StatusCode != 400 {
+			t.Fatalf("Expected status code 400, got %d: %s", response.StatusCode, response.Body)
+		}
+		if !strings.Contains(response.Body, "unknown valueTransform 'shout'") {
+			t.Errorf("Expected error naming the invalid transform, got: %s", response.Body)
+		}
+	})
+}
+
+func TestHandlerFieldMapping(t *testing.T) {
+	encodedDocx := loadSampleDocxBase64(t)
+
+	t.Run("mapped key fills field", func(t *testing.T) {
+		request := events.APIGatewayProxyRequest{
+			Path: "/merge",
+			Body: `{"docx": "` + encodedDocx + `", "data": {"org": "ACME"}, "options": {"fieldMapping": {"Org_Name": "org"}, "verbose": true}}`,
+		}
+
+		response, err := handler(context.Background(), request)
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if response.StatusCode != 200 {
+			t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+		}
+
+		var responseData struct {
+			SkippedFields  []string             `json:"skippedFields"`
+			UnusedDataKeys []string             `json:"unusedDataKeys"`
+			FieldOutcomes  []merge.FieldOutcome `json:"fieldOutcomes"`
+		}
+		if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+		if slices.Contains(responseData.SkippedFields, "Org_Name") {
+			t.Errorf("Expected Org_Name to be filled, got skipped fields %v", responseData.SkippedFields)
+		}
+		if slices.Contains(responseData.UnusedDataKeys, "org") {
+			t.Errorf("Expected the mapped key to be used, got unused keys %v", responseData.UnusedDataKeys)
+		}
+		found := false
+		for _, outcome := range responseData.FieldOutcomes {
+			if outcome.Name == "Org_Name" {
+				found = true
+				if outcome.Value != "ACME" {
+					t.Errorf("Expected mapped value 'ACME', got %q", outcome.Value)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("No outcome reported for Org_Name: %+v", responseData.FieldOutcomes)
+		}
+	})
+
+	t.Run("empty data key", func(t *testing.T) {
+		request := events.APIGatewayProxyRequest{
+			Path: "/merge",
+			Body: `{"docx": "` + encodedDocx + `", "data": {"org": "ACME"}, "options": {"fieldMapping": {"Org_Name": " "}}}`,
+		}
+
+		response, err := handler(context.Background(), request)
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if response.StatusCode != 400 {
+			t.Fatalf("Expected status code 400, got %d: %s", response.StatusCode, response.Body)
+		}
+		if !strings.Contains(response.Body, "fieldMapping for 'Org_Name' has an empty data key") {
+			t.Errorf("Expected error naming the mapped field, got: %s", response.Body)
+		}
+	})
+}
+
+func TestHandlerWarnsOnRemerge(t *testing.T) {
+	encodedDocx := loadSampleDocxBase64(t)
+
+	mergeOnce := func(docxB64 string) map[string]interface{} {
+		request := events.APIGatewayProxyRequest{
+			Path: "/merge",
+			Body: `{"docx": "` + docxB64 + `", "data": {"Org_Name": "ACME"}}`,
+		}
+		response, err := handler(context.Background(), request)
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if response.StatusCode != 200 {
+			t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+		}
+		var responseData map[string]interface{}
+		if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+		return responseData
+	}
+
+	first := mergeOnce(encodedDocx)
+	if strings.Contains(fmt.Sprint(first["validation"]), "already merged") {
+		t.Errorf("Template should not be reported as merged: %v", first["validation"])
+	}
+
+	mergedDocument, _ := first["mergedDocument"].(string)
+	mergedDocx, err := decodeDocx(mergedDocument, false)
+	if err != nil {
+		t.Fatalf("Failed to decode merged document: %v", err)
+	}
+	if merged, _ := mergedDocx.WasMerged(); !merged {
+		t.Error("Merged document should carry the merge marker")
+	}
+
+	second := mergeOnce(mergedDocument)
+	if !strings.Contains(fmt.Sprint(second["validation"]), "Document was already merged by this service on ") {
+		t.Errorf("Expected a re-merge warning, got: %v", second["validation"])
+	}
+}
+
+// recordingTracer records the spans started during a test
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []recordedSpan
+}
+
+type recordedSpan struct {
+	name          string
+	correlationID string
+}
+
+func (r *recordingTracer) Start(name, correlationID string) tracing.Span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, recordedSpan{name: name, correlationID: correlationID})
+	return nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(string, interface{}) {}
+func (nopSpan) RecordError(error)                {}
+func (nopSpan) End()                             {}
+
+func TestHandlerTraceSpans(t *testing.T) {
+	recorder := &recordingTracer{}
+	tracing.SetTracer(recorder)
+	defer tracing.SetTracer(nil)
+
+	request := events.APIGatewayProxyRequest{
+		Path:           "/merge",
+		Body:           `{"docx": "` + loadSampleDocxBase64(t) + `", "data": {"Org_Name": "ACME"}}`,
+		RequestContext: events.APIGatewayProxyRequestContext{RequestID: "req-1459"},
+	}
+	response, err := handler(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+	}
+
+	var names []string
+	for _, span := range recorder.spans {
+		names = append(names, span.name)
+		if span.correlationID != "req-1459" {
+			t.Errorf("Span %s has correlation ID %q, want %q", span.name, span.correlationID, "req-1459")
+		}
+	}
+	expected := []string{tracing.SpanUnzip, tracing.SpanExtract, tracing.SpanValidate, tracing.SpanReplace, tracing.SpanRebuild}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected spans %v, got %v", expected, names)
+	}
+}
+
+func TestHandlerNumbersAsStrings(t *testing.T) {
+	encodedDocx := loadSampleDocxBase64(t)
+
+	mergedValue := func(options string) string {
+		request := events.APIGatewayProxyRequest{
+			Path: "/merge",
+			Body: `{"docx": "` + encodedDocx + `", "data": {"Org_Name": 12345678901234567}, "options": {"defaultFieldType": "number", "verbose": true` + options + `}}`,
+		}
+		response, err := handler(context.Background(), request)
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if response.StatusCode != 200 {
+			t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+		}
+
+		var responseData struct {
+			FieldOutcomes []merge.FieldOutcome `json:"fieldOutcomes"`
+		}
+		if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+		for _, outcome := range responseData.FieldOutcomes {
+			if outcome.Name == "Org_Name" {
+				return outcome.Value
+			}
+		}
+		t.Fatalf("No outcome reported for Org_Name: %+v", responseData.FieldOutcomes)
+		return ""
+	}
+
+	// float64 cannot hold the value, but it is still rendered without an exponent
+	if value := mergedValue(""); value != "12345678901234568" {
+		t.Errorf("Expected integer rendering of the float64 value, got %q", value)
+	}
+	if value := mergedValue(`, "numbersAsStrings": true`); value != "12345678901234567" {
+		t.Errorf("Expected the exact number with numbersAsStrings, got %q", value)
+	}
+}
+
+func TestHandlerEmptyDocument(t *testing.T) {
+	for _, path := range []string{"/merge", "/detect"} {
+		t.Run(path, func(t *testing.T) {
+			// Line breaks are skipped by the decoder, leaving zero bytes
+			request := events.APIGatewayProxyRequest{
+				Path: path,
+				Body: `{"docx": "\r\n"}`,
+			}
+			response, err := handler(context.Background(), request)
+			if err != nil {
+				t.Fatalf("Handler returned error: %v", err)
+			}
+			if response.StatusCode != 400 {
+				t.Fatalf("Expected status code 400, got %d: %s", response.StatusCode, response.Body)
+			}
+			if !strings.Contains(response.Body, "empty document") {
+				t.Errorf("Expected an empty document error, got: %s", response.Body)
+			}
+		})
+	}
+}
+
+func TestHandlerDocumentProperties(t *testing.T) {
+	encodedDocx := loadSampleDocxBase64(t)
+
+	t.Run("title and author applied", func(t *testing.T) {
+		request := events.APIGatewayProxyRequest{
+			Path: "/merge",
+			Body: `{"docx": "` + encodedDocx + `", "data": {"Org_Name": "ACME"}, "documentProperties": {"title": "Letter for ACME", "author": "Billing"}}`,
+		}
+		response, err := handler(context.Background(), request)
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if response.StatusCode != 200 {
+			t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+		}
+
+		var responseData struct {
+			MergedDocument string `json:"mergedDocument"`
+		}
+		if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+		mergedDocx, err := decodeDocx(responseData.MergedDocument, false)
+		if err != nil {
+			t.Fatalf("Failed to decode merged document: %v", err)
+		}
+		core := string(mergedDocx.Files[docx.CorePropertiesPart])
+		if !strings.Contains(core, "<dc:title>Letter for ACME</dc:title>") || !strings.Contains(core, "<dc:creator>Billing</dc:creator>") {
+			t.Errorf("Expected title and author in core.xml, got: %s", core)
+		}
+	})
+
+	t.Run("unknown property", func(t *testing.T) {
+		request := events.APIGatewayProxyRequest{
+			Path: "/merge",
+			Body: `{"docx": "` + encodedDocx + `", "data": {}, "documentProperties": {"colour": "red"}}`,
+		}
+		response, err := handler(context.Background(), request)
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if response.StatusCode != 400 || !strings.Contains(response.Body, "unknown property 'colour'") {
+			t.Errorf("Expected 400 naming the unknown property, got %d: %s", response.StatusCode, response.Body)
+		}
+	})
+}
+
+func TestHandlerEnvironmentDefaults(t *testing.T) {
+	t.Setenv("MERGE_DEFAULT_Org_City", "Springfield")
+
+	request := events.APIGatewayProxyRequest{
+		Path: "/merge",
+		Body: `{"docx": "` + loadSampleDocxBase64(t) + `", "data": {"Org_Name": "ACME"}, "options": {"verbose": true}}`,
+	}
+	response, err := handler(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+	}
+
+	var responseData struct {
+		SkippedFields []string             `json:"skippedFields"`
+		FieldOutcomes []merge.FieldOutcome `json:"fieldOutcomes"`
+	}
+	if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+		t.Fatalf("Failed to unmarshal response body: %v", err)
+	}
+	for _, name := range responseData.SkippedFields {
+		if name == "Org_City" {
+			t.Error("Org_City should be filled from the environment, not skipped")
+		}
+	}
+	found := false
+	for _, outcome := range responseData.FieldOutcomes {
+		if outcome.Name == "Org_City" {
+			found = true
+			if outcome.Status != merge.FieldStatusDefault || outcome.Value != "Springfield" {
+				t.Errorf("Unexpected outcome for Org_City: %+v", outcome)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("No outcome reported for Org_City: %+v", responseData.FieldOutcomes)
+	}
+}
+
+func TestHandlerDetectDocumentMetadata(t *testing.T) {
+	request := events.APIGatewayProxyRequest{
+		Path: "/detect",
+		Body: `{"docx": "` + loadSampleDocxBase64(t) + `", "options": {"verbose": true}}`,
+	}
+	response, err := handler(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+	}
+
+	var responseData DetectResponse
+	if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+		t.Fatalf("Failed to unmarshal response body: %v", err)
+	}
+	if responseData.SectionCount != 1 || responseData.EstimatedPageCount != 1 {
+		t.Errorf("Expected 1 section and 1 page, got %d and %d", responseData.SectionCount, responseData.EstimatedPageCount)
+	}
+	if len(responseData.Instructions) != len(responseData.Data) {
+		t.Errorf("Expected an instruction for each of the %d fields, got %v", len(responseData.Data), responseData.Instructions)
+	}
+	if instruction := responseData.Instructions["Org_Name"]; !strings.Contains(instruction, "MERGEFIELD") || !strings.Contains(instruction, "Org_Name") {
+		t.Errorf("Expected the MERGEFIELD instruction of Org_Name, got %q", instruction)
+	}
+}
+
+func TestHandlerDetectDocumentName(t *testing.T) {
+	encodedDocx := loadSampleDocxBase64(t)
+
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{"supplied name", `{"docx": "` + encodedDocx + `", "documentName": "offer-letter.docx"}`, "offer-letter.docx"},
+		{"default name", `{"docx": "` + encodedDocx + `"}`, "document.docx"},
+		{"blank name", `{"docx": "` + encodedDocx + `", "documentName": "  "}`, "document.docx"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := handler(context.Background(), events.APIGatewayProxyRequest{Path: "/detect", Body: tt.body})
+			if err != nil {
+				t.Fatalf("Handler returned error: %v", err)
+			}
+			if response.StatusCode != 200 {
+				t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+			}
+
+			var responseData DetectResponse
+			if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+				t.Fatalf("Failed to unmarshal response body: %v", err)
+			}
+			if responseData.DocumentName != tt.expected {
+				t.Errorf("Expected documentName %q, got %q", tt.expected, responseData.DocumentName)
+			}
+		})
+	}
+}
+
+func TestHandlerTodayInTimezone(t *testing.T) {
+	encodedDocx := loadSampleDocxBase64(t)
+
+	t.Run("filled in requested timezone", func(t *testing.T) {
+		location, err := time.LoadLocation("Pacific/Auckland")
+		if err != nil {
+			t.Fatalf("Failed to load time zone: %v", err)
+		}
+		before := time.Now().In(location).Format("2006-01-02")
+
+		request := events.APIGatewayProxyRequest{
+			Path: "/merge",
+			Body: `{"docx": "` + encodedDocx + `", "data": {"Org_Name": "ACME"}, "options": {"timezone": "Pacific/Auckland", "verbose": true}}`,
+		}
+		response, err := handler(context.Background(), request)
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if response.StatusCode != 200 {
+			t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+		}
+		after := time.Now().In(location).Format("2006-01-02")
+
+		var responseData struct {
+			FieldOutcomes []merge.FieldOutcome `json:"fieldOutcomes"`
+		}
+		if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+		found := false
+		for _, outcome := range responseData.FieldOutcomes {
+			if outcome.Name == "Today" {
+				found = true
+				if outcome.Value != before && outcome.Value != after {
+					t.Errorf("Expected Today to be %s in Pacific/Auckland, got %+v", before, outcome)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("No outcome reported for Today: %+v", responseData.FieldOutcomes)
+		}
+	})
+
+	t.Run("unknown timezone", func(t *testing.T) {
+		request := events.APIGatewayProxyRequest{
+			Path: "/merge",
+			Body: `{"docx": "` + encodedDocx + `", "data": {}, "options": {"timezone": "Mars/Olympus"}}`,
+		}
+		response, err := handler(context.Background(), request)
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if response.StatusCode != 400 || !strings.Contains(response.Body, "unknown timezone 'Mars/Olympus'") {
+			t.Errorf("Expected 400 naming the timezone, got %d: %s", response.StatusCode, response.Body)
+		}
+	})
+}
+
+func TestHandlerTemplateLint(t *testing.T) {
+	t.Run("split field and orphan chevron", func(t *testing.T) {
+		var buf bytes.Buffer
+		zipWriter := zip.NewWriter(&buf)
+		fileWriter, err := zipWriter.Create("word/document.xml")
+		if err != nil {
+			t.Fatalf("Failed to create zip entry: %v", err)
+		}
+		fileWriter.Write([]byte(`<w:document><w:body>` +
+			`<w:p><w:r><w:t>Dear «Contact_</w:t></w:r><w:r><w:t>Name»</w:t></w:r></w:p>` +
+			`<w:p><w:r><w:t>Due: Amount»</w:t></w:r></w:p>` +
+			`</w:body></w:document>`))
+		if err := zipWriter.Close(); err != nil {
+			t.Fatalf("Failed to close zip writer: %v", err)
+		}
+
+		request := events.APIGatewayProxyRequest{
+			Path: "/template/lint",
+			Body: `{"docx": "` + base64.StdEncoding.EncodeToString(buf.Bytes()) + `"}`,
+		}
+		response, err := handler(context.Background(), request)
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if response.StatusCode != 200 {
+			t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+		}
+
+		var report lint.Report
+		if err := json.Unmarshal([]byte(response.Body), &report); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+		if report.Mergeable || report.Errors != 1 || report.Warnings != 1 {
+			t.Fatalf("Expected unmergeable report with 1 error and 1 warning, got %+v", report)
+		}
+		if report.Issues[0].Check != lint.CheckSplitField || report.Issues[0].Field != "Contact_Name" {
+			t.Errorf("Expected split field issue for Contact_Name, got %+v", report.Issues[0])
+		}
+		if report.Issues[1].Check != lint.CheckOrphanChevron {
+			t.Errorf("Expected orphan chevron issue, got %+v", report.Issues[1])
+		}
+	})
+
+	t.Run("sample template", func(t *testing.T) {
+		request := events.APIGatewayProxyRequest{
+			Path: "/template/lint",
+			Body: `{"docx": "` + loadSampleDocxBase64(t) + `"}`,
+		}
+		response, err := handler(context.Background(), request)
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if response.StatusCode != 200 {
+			t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+		}
+
+		var report lint.Report
+		if err := json.Unmarshal([]byte(response.Body), &report); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+		if !report.Mergeable {
+			t.Errorf("Expected sample template to be mergeable, got %+v", report)
+		}
+	})
+
+	t.Run("lenientBase64", func(t *testing.T) {
+		unpadded := strings.TrimRight(paddedSampleDocxBase64(t), "=")
+		for _, tt := range []struct {
+			options    string
+			statusCode int
+		}{
+			{options: `{}`, statusCode: 200},
+			{options: `{"lenientBase64": false}`, statusCode: 400},
+		} {
+			request := events.APIGatewayProxyRequest{
+				Path: "/template/lint",
+				Body: `{"docx": "` + unpadded + `", "options": ` + tt.options + `}`,
+			}
+			response, err := handler(context.Background(), request)
+			if err != nil {
+				t.Fatalf("Handler returned error: %v", err)
+			}
+			if response.StatusCode != tt.statusCode {
+				t.Errorf("Expected status code %d with options %s, got %d: %s", tt.statusCode, tt.options, response.StatusCode, response.Body)
+			}
+		}
+	})
+
+	t.Run("missing docx", func(t *testing.T) {
+		request := events.APIGatewayProxyRequest{Path: "/template/lint", Body: `{}`}
+		response, _ := handler(context.Background(), request)
+		if response.StatusCode != 400 {
+			t.Errorf("Expected status code 400, got %d", response.StatusCode)
+		}
+	})
+}
+
+func TestHandlerCorrelationID(t *testing.T) {
+	uuidRegex := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string // expected correlation ID, empty for a generated one
+	}{
+		{
+			name:    "X-Request-ID header",
+			headers: map[string]string{"x-request-id": "client-req-42"},
+			want:    "client-req-42",
+		},
+		{
+			name:    "traceparent header",
+			headers: map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+			want:    "4bf92f3577b34da6a3ce929d0e0e4736",
+		},
+		{
+			name: "X-Request-ID preferred over traceparent",
+			headers: map[string]string{
+				"X-Request-ID": "client-req-43",
+				"traceparent":  "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			},
+			want: "client-req-43",
+		},
+		{
+			name:    "X-Amzn-Trace-Id header",
+			headers: map[string]string{"X-Amzn-Trace-Id": "Self=1-67891234-12456789abcdef012345678;Root=1-5759e988-bd862e3fe1be46a994272793;Sampled=1"},
+			want:    "1-5759e988-bd862e3fe1be46a994272793",
+		},
+		{
+			name: "traceparent preferred over X-Amzn-Trace-Id",
+			headers: map[string]string{
+				"traceparent":     "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+				"X-Amzn-Trace-Id": "Root=1-5759e988-bd862e3fe1be46a994272793",
+			},
+			want: "4bf92f3577b34da6a3ce929d0e0e4736",
+		},
+		{
+			name:    "invalid X-Request-ID",
+			headers: map[string]string{"X-Request-ID": "bad id\r\nX-Injected: 1"},
+		},
+		{
+			name:    "invalid X-Amzn-Trace-Id",
+			headers: map[string]string{"X-Amzn-Trace-Id": "Root=not-a-trace"},
+		},
+		{
+			name:    "invalid traceparent",
+			headers: map[string]string{"traceparent": "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		},
+		{
+			name: "absent",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			request := events.APIGatewayProxyRequest{
+				Path:    "/detect",
+				Headers: tt.headers,
+				Body:    `{}`,
+			}
+			response, err := handler(context.Background(), request)
+			if err != nil {
+				t.Fatalf("Handler returned error: %v", err)
+			}
+
+			id := response.Headers["X-Request-ID"]
+			if tt.want != "" && id != tt.want {
+				t.Errorf("Expected X-Request-ID %q, got %q", tt.want, id)
+			}
+			if tt.want == "" && !uuidRegex.MatchString(id) {
+				t.Errorf("Expected generated UUID, got %q", id)
+			}
+			if !strings.Contains(logs.String(), "["+id+"] Correlation ID "+id) {
+				t.Errorf("Expected correlation ID %q in a prefixed log line, got:\n%s", id, logs.String())
+			}
+
+			// The lines of the request are prefixed with its correlation ID
+			if !strings.Contains(logs.String(), "[ERROR] ["+id+"] ") {
+				t.Errorf("Expected the error of the request prefixed with %q, got:\n%s", id, logs.String())
+			}
+		})
+	}
+}
+
+func TestHandlerUnusedDataKeys(t *testing.T) {
+	encodedDocx := loadSampleDocxBase64(t)
+
+	t.Run("single merge", func(t *testing.T) {
+		request := events.APIGatewayProxyRequest{
+			Path: "/merge",
+			Body: `{"docx": "` + encodedDocx + `", "data": {"Org_Name": "ACME", "zLegacyId": 7, "Obsolete": "x"}}`,
+		}
+		response, err := handler(context.Background(), request)
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if response.StatusCode != 200 {
+			t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+		}
+
+		var responseData struct {
+			MergedDocument string   `json:"mergedDocument"`
+			UnusedDataKeys []string `json:"unusedDataKeys"`
+		}
+		if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+		if responseData.MergedDocument == "" {
+			t.Error("Expected a merged document despite the unused keys")
+		}
+		if !reflect.DeepEqual(responseData.UnusedDataKeys, []string{"Obsolete", "zLegacyId"}) {
+			t.Errorf("Expected unused keys [Obsolete zLegacyId], got %v", responseData.UnusedDataKeys)
+		}
+	})
+
+	t.Run("batch merge", func(t *testing.T) {
+		request := events.APIGatewayProxyRequest{
+			Path: "/merge",
+			Body: `{"docx": "` + encodedDocx + `", "records": [{"Org_Name": "ACME"}, {"Org_Name": "Globex", "Obsolete": "x"}]}`,
+		}
+		response, err := handler(context.Background(), request)
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if response.StatusCode != 200 {
+			t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+		}
+
+		var responseData struct {
+			Results []BatchRecordResult `json:"results"`
+		}
+		if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+		if len(responseData.Results) != 2 {
+			t.Fatalf("Expected 2 results, got %d", len(responseData.Results))
+		}
+		if len(responseData.Results[0].UnusedDataKeys) != 0 {
+			t.Errorf("Expected no unused keys for record 0, got %v", responseData.Results[0].UnusedDataKeys)
+		}
+		if !reflect.DeepEqual(responseData.Results[1].UnusedDataKeys, []string{"Obsolete"}) {
+			t.Errorf("Expected unused key Obsolete for record 1, got %v", responseData.Results[1].UnusedDataKeys)
+		}
+		for _, result := range responseData.Results {
+			if result.MergedDocument == "" {
+				t.Errorf("Expected record %d to be merged", result.Record)
+			}
+		}
+	})
+
+	t.Run("fallback chains and content controls", func(t *testing.T) {
+		documentXML := testutil.DocumentXML(`<w:p><w:fldSimple w:instr=" MERGEFIELD Nickname|FirstName "><w:r><w:t>«Nickname|FirstName»</w:t></w:r></w:fldSimple></w:p>` +
+			`<w:p><w:sdt><w:sdtPr><w:tag w:val="Subscribed"/><w14:checkbox><w14:checked w14:val="0"/></w14:checkbox></w:sdtPr>` +
+			`<w:sdtContent><w:r><w:t>☐</w:t></w:r></w:sdtContent></w:sdt></w:p>` +
+			`<w:sdt><w:sdtPr><w:tag w:val="Items"/><w15:repeatingSection/></w:sdtPr><w:sdtContent>` +
+			`<w:sdt><w:sdtPr><w15:repeatingSectionItem/></w:sdtPr><w:sdtContent>` +
+			`<w:sdt><w:sdtPr><w:tag w:val="Item"/></w:sdtPr><w:sdtContent><w:p><w:r><w:t>Item</w:t></w:r></w:p></w:sdtContent></w:sdt>` +
+			`</w:sdtContent></w:sdt>` +
+			`</w:sdtContent></w:sdt>`)
+		request := events.APIGatewayProxyRequest{
+			Path: "/merge",
+			Body: `{"docx": "` + base64.StdEncoding.EncodeToString(testutil.Docx(t, documentXML)) + `", ` +
+				`"data": {"FirstName": "Jane", "Subscribed": true, "Items": [{"Item": "pen"}], "Extra": "x"}}`,
+		}
+		response, err := handler(context.Background(), request)
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if response.StatusCode != 200 {
+			t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+		}
+
+		var responseData struct {
+			UnusedDataKeys []string `json:"unusedDataKeys"`
+		}
+		if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+		// The fallback alternative and the content control tags are merged
+		if !reflect.DeepEqual(responseData.UnusedDataKeys, []string{"Extra"}) {
+			t.Errorf("Expected unused key Extra, got %v", responseData.UnusedDataKeys)
+		}
+	})
+}
+
+func TestHandlerRejectsSpreadsheet(t *testing.T) {
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	files := map[string]string{
+		"[Content_Types].xml": `<Types><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/></Types>`,
+		"xl/workbook.xml":     `<workbook/>`,
+	}
+	for name, content := range files {
+		fileWriter, err := zipWriter.Create(name)
+		if err != nil {
+			t.Fatalf("Failed to create zip entry: %v", err)
+		}
+		fileWriter.Write([]byte(content))
+	}
+	zipWriter.Close()
+	encoded := base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	for _, path := range []string{"/merge", "/detect", "/template/lint"} {
+		response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+			Path: path,
+			Body: `{"docx": "` + encoded + `", "data": {}}`,
+		})
+		if err != nil {
+			t.Fatalf("Handler returned error for %s: %v", path, err)
+		}
+		if response.StatusCode != 400 || !strings.Contains(response.Body, "uploaded file is a spreadsheet, not a Word document") {
+			t.Errorf("Expected 400 naming the spreadsheet for %s, got %d: %s", path, response.StatusCode, response.Body)
+		}
+	}
+}
+
+func TestHandlerUnknownExpressionFunction(t *testing.T) {
+	documentXML := testutil.DocumentXML(`<w:p><w:r><w:t>Dear «uper(FirstName)»</w:t></w:r></w:p>`)
+	encodedDocx := base64.StdEncoding.EncodeToString(testutil.Docx(t, documentXML))
+
+	for _, path := range []string{"/merge", "/validate"} {
+		response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+			Path: path,
+			Body: `{"docx": "` + encodedDocx + `", "data": {"FirstName": "Jane"}}`,
+		})
+		if err != nil {
+			t.Fatalf("Handler returned error for %s: %v", path, err)
+		}
+		if !strings.Contains(response.Body, `Invalid expression 'uper(FirstName)': unknown function 'uper'`) {
+			t.Errorf("Expected %s to name the unknown function, got %d: %s", path, response.StatusCode, response.Body)
+		}
+		if path == "/merge" && response.StatusCode != 400 {
+			t.Errorf("Expected status code 400, got %d", response.StatusCode)
+		}
+	}
+}
+
+// mockSecretsClient serves secrets from a map and records the fetches
+type mockSecretsClient struct {
+	secrets map[string]string
+	fetched []string
+}
+
+func (c *mockSecretsClient) GetSecretValue(secretID string) (string, error) {
+	c.fetched = append(c.fetched, secretID)
+	value, ok := c.secrets[secretID]
+	if !ok {
+		return "", fmt.Errorf("secret %s not found", secretID)
+	}
+	return value, nil
+}
+
+func TestHandlerSecretAllowedPrefixes(t *testing.T) {
+	client := &mockSecretsClient{secrets: map[string]string{"mail-merge/api-key": "sk-123", "prod/db-password": "hunter2"}}
+	previousClient, previousPrefixes := secretsClient, secretsAllowedPrefixes
+	secretsClient, secretsAllowedPrefixes = client, []string{"mail-merge/"}
+	t.Cleanup(func() { secretsClient, secretsAllowedPrefixes = previousClient, previousPrefixes })
+
+	call := func(placeholder string) events.APIGatewayProxyResponse {
+		documentXML := testutil.DocumentXML(`<w:p><w:r><w:t>«` + placeholder + `»</w:t></w:r></w:p>`)
+		response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+			Path: "/merge",
+			Body: `{"docx": "` + base64.StdEncoding.EncodeToString(testutil.Docx(t, documentXML)) + `", "data": {}}`,
+		})
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		return response
+	}
+
+	response := call("secret:prod/db-password")
+	if response.StatusCode != 400 || !strings.Contains(response.Body, `Invalid secret field 'secret:prod/db-password': secret ID is not allowed`) {
+		t.Errorf("Expected 400 rejecting the secret, got %d: %s", response.StatusCode, response.Body)
+	}
+	if strings.Contains(response.Body, "hunter2") || len(client.fetched) != 0 {
+		t.Errorf("Expected the rejected secret not to be fetched, fetched %v", client.fetched)
+	}
+
+	if response := call("secret:mail-merge/api-key"); response.StatusCode != 200 {
+		t.Errorf("Expected an allowed secret to merge, got %d: %s", response.StatusCode, response.Body)
+	}
+	if !reflect.DeepEqual(client.fetched, []string{"mail-merge/api-key"}) {
+		t.Errorf("Expected the allowed secret to be fetched, fetched %v", client.fetched)
+	}
+}
+
+func TestHandlerCurrencyPictures(t *testing.T) {
+	documentXML := testutil.DocumentXML(
+		`<w:p><w:fldSimple w:instr=" MERGEFIELD Amount \# &quot;€#,##0.00&quot; "><w:r><w:t>«Amount»</w:t></w:r></w:fldSimple></w:p>` +
+			`<w:p><w:fldSimple w:instr=" MERGEFIELD Fee \# &quot;£#,##0.00&quot; "><w:r><w:t>«Fee»</w:t></w:r></w:fldSimple></w:p>`)
+	encodedDocx := base64.StdEncoding.EncodeToString(testutil.Docx(t, documentXML))
+
+	tests := []struct {
+		name     string
+		options  string
+		expected []string
+	}{
+		{name: "symbols of the pictures", options: `{}`, expected: []string{"€1,234.50", "£12.00"}},
+		{name: "currencySymbol option", options: `{"currencySymbol": "CHF "}`, expected: []string{"CHF 1,234.50", "CHF 12.00"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+				Path: "/merge",
+				Body: `{"docx": "` + encodedDocx + `", "data": {"Amount": 1234.5, "Fee": 12}, "options": ` + tt.options + `}`,
+			})
+			if err != nil {
+				t.Fatalf("Handler returned error: %v", err)
+			}
+			if response.StatusCode != 200 {
+				t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+			}
+			var responseData struct {
+				MergedDocument string `json:"mergedDocument"`
+			}
+			if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+				t.Fatalf("Failed to unmarshal response body: %v", err)
+			}
+			mergedDocx, err := decodeDocx(responseData.MergedDocument, false)
+			if err != nil {
+				t.Fatalf("Failed to decode merged document: %v", err)
+			}
+			merged, err := mergedDocx.GetDocumentXML()
+			if err != nil {
+				t.Fatalf("Failed to read merged document: %v", err)
+			}
+			for _, expected := range tt.expected {
+				if !strings.Contains(string(merged), expected) {
+					t.Errorf("Expected %s in the merged document: %s", expected, merged)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlerRequireAllFields(t *testing.T) {
+	encodedDocx := loadSampleDocxBase64(t)
+	request := events.APIGatewayProxyRequest{
+		Path: "/merge",
+		Body: `{"docx": "` + encodedDocx + `", "data": {"Org_Name": "ACME"}, "options": {"requireAllFields": true}}`,
+	}
+	response, err := handler(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	if response.StatusCode != 400 {
+		t.Fatalf("Expected status code 400, got %d: %s", response.StatusCode, response.Body)
+	}
+
+	var responseData struct {
+		Validation struct {
+			MissingFields []string `json:"missing_fields"`
+		} `json:"validation"`
+		Summary MergeSummary `json:"summary"`
+	}
+	if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+		t.Fatalf("Failed to unmarshal response body: %v", err)
+	}
+	if len(responseData.Validation.MissingFields) != responseData.Summary.TotalFields-1 {
+		t.Errorf("Expected every field but Org_Name to be missing, got %v of %d fields", responseData.Validation.MissingFields, responseData.Summary.TotalFields)
+	}
+	for _, name := range responseData.Validation.MissingFields {
+		if name == "Org_Name" {
+			t.Error("Org_Name was provided and should not be missing")
+		}
+	}
+}
+
+// TestHandlerRequireAllFieldsFallbacksAndRepeatingSections tests that
+// requireAllFields accepts a fallback chain filled by any alternative and does
+// not require the fields of repeating sections in the top-level data
+func TestHandlerRequireAllFieldsFallbacksAndRepeatingSections(t *testing.T) {
+	mergeField := func(name string) string {
+		return `<w:p><w:fldSimple w:instr=" MERGEFIELD ` + name + ` "><w:r><w:t>«` + name + `»</w:t></w:r></w:fldSimple></w:p>`
+	}
+	documentXML := testutil.DocumentXML(mergeField("Nickname|FirstName") +
+		`<w:sdt><w:sdtPr><w:tag w:val="Items"/><w15:repeatingSection/></w:sdtPr><w:sdtContent>` +
+		`<w:sdt><w:sdtPr><w15:repeatingSectionItem/></w:sdtPr><w:sdtContent>` +
+		mergeField("Item") +
+		`</w:sdtContent></w:sdt>` +
+		`</w:sdtContent></w:sdt>`)
+	encodedDocx := base64.StdEncoding.EncodeToString(testutil.Docx(t, documentXML))
+
+	response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+		Path: "/validate",
+		Body: `{"docx": "` + encodedDocx + `", "data": {"FirstName": "Jane", "Items": [{"Item": "pen"}]}, "options": {"requireAllFields": true}}`,
+	})
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+	}
+
+	var result fields.ValidationResult
+	if err := json.Unmarshal([]byte(response.Body), &result); err != nil {
+		t.Fatalf("Failed to unmarshal response body: %v", err)
+	}
+	if !result.Valid || len(result.MissingFields) != 0 {
+		t.Errorf("Expected the data to be valid, got missing fields %v and errors %v", result.MissingFields, result.Errors)
+	}
+}
+
+func TestHandlerEmitsMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	metrics.SetOutput(&buf)
+	defer metrics.SetOutput(nil)
+
+	body := `{"docx": "` + loadSampleDocxBase64(t) + `", "data": {"Org_Name": "ACME"}}`
+	response, err := handler(context.Background(), events.APIGatewayProxyRequest{Path: "/merge", Body: body})
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected one metric line, got %d: %s", len(lines), buf.String())
+	}
+	var line map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &line); err != nil {
+		t.Fatalf("Metric line is not JSON: %v: %s", err, lines[0])
+	}
+	if _, ok := line["_aws"]; !ok {
+		t.Errorf("Metric line lacks the _aws directive: %s", lines[0])
+	}
+	expected := map[string]interface{}{
+		"Endpoint":      "/merge",
+		"Status":        float64(200),
+		"InputBytes":    float64(len(body)),
+		"OutputBytes":   float64(len(response.Body)),
+		"CorrelationId": response.Headers[requestIDHeader],
+	}
+	for key, value := range expected {
+		if line[key] != value {
+			t.Errorf("Expected %s %v, got %v", key, value, line[key])
+		}
+	}
+	if line["FieldsResolved"] != float64(1) {
+		t.Errorf("Expected 1 resolved field, got %v", line["FieldsResolved"])
+	}
+	if _, ok := line["FieldsSkipped"].(float64); !ok {
+		t.Errorf("Expected a skipped field count, got %v", line["FieldsSkipped"])
+	}
+	if _, ok := line["Duration"].(float64); !ok {
+		t.Errorf("Expected a duration, got %v", line["Duration"])
+	}
+}
+
+func TestEnvVariableName(t *testing.T) {
+	tests := map[string]string{
+		"Org_Name":      "ORG_NAME",
+		"firstName":     "FIRST_NAME",
+		"first name":    "FIRST_NAME",
+		"Address2Line":  "ADDRESS2_LINE",
+		"e-mail (home)": "E_MAIL_HOME",
+		"2ndContact":    "_2ND_CONTACT",
+		"Größe":         "GR_E",
+	}
+	for fieldName, expected := range tests {
+		if name := envVariableName(fieldName); name != expected {
+			t.Errorf("envVariableName(%q) = %q, want %q", fieldName, name, expected)
+		}
+	}
+}
+
+func TestDetectHandlerDotenv(t *testing.T) {
+	encodedDocx := loadSampleDocxBase64(t)
+
+	response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+		Path: "/detect",
+		Body: `{"docx": "` + encodedDocx + `", "options": {"outputFormat": "dotenv"}}`,
+	})
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+	}
+	if !strings.HasPrefix(response.Headers["Content-Type"], "text/plain") {
+		t.Errorf("Expected a text/plain response, got %q", response.Headers["Content-Type"])
+	}
+
+	lines := strings.Split(strings.TrimSuffix(response.Body, "\n"), "\n")
+	if !sort.StringsAreSorted(lines) {
+		t.Errorf("Expected sorted lines, got: %s", response.Body)
+	}
+	for _, want := range []string{"ORG_NAME=", "ORG_CITY="} {
+		found := false
+		for _, line := range lines {
+			found = found || line == want
+		}
+		if !found {
+			t.Errorf("Expected line %q, got: %s", want, response.Body)
+		}
+	}
+	for _, line := range lines {
+		if !regexp.MustCompile(`^[A-Z_][A-Z0-9_]*=$`).MatchString(line) {
+			t.Errorf("Unexpected dotenv line %q", line)
+		}
+	}
+
+	t.Run("rejected on merge", func(t *testing.T) {
+		response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+			Path: "/merge",
+			Body: `{"docx": "` + encodedDocx + `", "data": {}, "options": {"outputFormat": "dotenv"}}`,
+		})
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if response.StatusCode != 400 || !strings.Contains(response.Body, "only supported by /detect") {
+			t.Errorf("Expected 400 for dotenv on /merge, got %d: %s", response.StatusCode, response.Body)
+		}
+	})
+}
+
+func TestDetectHandlerGroupByPrefix(t *testing.T) {
+	encodedDocx := loadSampleDocxBase64(t)
+
+	response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+		Path: "/detect",
+		Body: `{"docx": "` + encodedDocx + `", "options": {"groupByPrefix": true}}`,
+	})
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+	}
+
+	var responseData DetectResponse
+	if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+		t.Fatalf("Failed to unmarshal response body: %v", err)
+	}
+	expected := map[string][]string{
+		"Org":     {"Address", "City", "Name", "PostalCode", "State"},
+		"Contact": {"FirstName", "FullName", "MailingAddress", "MailingCity", "MailingPostalCode", "MailingState", "Title"},
+	}
+	for prefix, names := range expected {
+		if !reflect.DeepEqual(responseData.Groups[prefix], names) {
+			t.Errorf("Expected group %s to be %v, got %v", prefix, names, responseData.Groups[prefix])
+		}
+	}
+	// Today has no prefix and stays out of the groups
+	prefixes := make([]string, 0, len(responseData.Groups))
+	for prefix := range responseData.Groups {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	if want := []string{"Account", "Contact", "Org", "User"}; !reflect.DeepEqual(prefixes, want) {
+		t.Errorf("Expected prefixes %v, got %v", want, prefixes)
+	}
+	if len(responseData.Data) == 0 {
+		t.Error("Expected the field data to be returned alongside the groups")
+	}
+
+	t.Run("omitted by default", func(t *testing.T) {
+		response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+			Path: "/detect",
+			Body: `{"docx": "` + encodedDocx + `"}`,
+		})
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if strings.Contains(response.Body, `"groups"`) {
+			t.Errorf("Expected no groups without groupByPrefix, got: %s", response.Body)
+		}
+	})
+
+	t.Run("rejected with dotenv", func(t *testing.T) {
+		response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+			Path: "/detect",
+			Body: `{"docx": "` + encodedDocx + `", "options": {"groupByPrefix": true, "outputFormat": "dotenv"}}`,
+		})
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if response.StatusCode != 400 || !strings.Contains(response.Body, "'groupByPrefix' cannot be combined with outputFormat 'dotenv'") {
+			t.Errorf("Expected 400 for groupByPrefix with dotenv, got %d: %s", response.StatusCode, response.Body)
+		}
+	})
+}
+
+func TestDetectHandlerIncludePositions(t *testing.T) {
+	encodedDocx := loadSampleDocxBase64(t)
+
+	response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+		Path: "/detect",
+		Body: `{"docx": "` + encodedDocx + `", "options": {"includePositions": true}}`,
+	})
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+	}
+
+	var responseData DetectResponse
+	if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+		t.Fatalf("Failed to unmarshal response body: %v", err)
+	}
+	if len(responseData.Positions) != len(responseData.Data) {
+		t.Fatalf("Expected a position for each of the %d fields, got %d", len(responseData.Data), len(responseData.Positions))
+	}
+
+	encoded, err := base64.StdEncoding.DecodeString(encodedDocx)
+	if err != nil {
+		t.Fatalf("Failed to decode sample: %v", err)
+	}
+	doc, err := docx.UnzipDocx(encoded)
+	if err != nil {
+		t.Fatalf("Failed to unzip sample: %v", err)
+	}
+	documentXML, err := doc.GetDocumentXML()
+	if err != nil {
+		t.Fatalf("Failed to get document XML: %v", err)
+	}
+
+	// Ordered by offset, the fields follow the paragraphs without overlapping
+	type located struct {
+		name     string
+		position fields.FieldPosition
+	}
+	var positions []located
+	for name, position := range responseData.Positions {
+		positions = append(positions, located{name, position})
+	}
+	sort.Slice(positions, func(i, j int) bool { return positions[i].position.StartOffset < positions[j].position.StartOffset })
+	for i, field := range positions {
+		position := field.position
+		if position.StartOffset >= position.EndOffset || position.EndOffset > len(documentXML) {
+			t.Fatalf("Invalid offsets %d-%d for %s", position.StartOffset, position.EndOffset, field.name)
+		}
+		if i > 0 {
+			previous := positions[i-1].position
+			if position.StartOffset < previous.EndOffset || position.NodeIndex < previous.NodeIndex {
+				t.Errorf("Expected %s to follow %s, got %+v after %+v", field.name, positions[i-1].name, position, previous)
+			}
+		}
+		if span := string(documentXML[position.StartOffset:position.EndOffset]); !strings.Contains(span, field.name) {
+			t.Errorf("Expected the offsets of %s to span the field, got %q", field.name, span)
+		}
+		if !strings.Contains(position.XMLPath, "/w:p[") {
+			t.Errorf("Expected the path of %s to go through its paragraph, got %q", field.name, position.XMLPath)
+		}
+		if position.Context == "" {
+			t.Errorf("Expected the paragraph text of %s as context", field.name)
+		}
+	}
+
+	t.Run("omitted by default", func(t *testing.T) {
+		response, err := handler(context.Background(), events.APIGatewayProxyRequest{
+			Path: "/detect",
+			Body: `{"docx": "` + encodedDocx + `"}`,
+		})
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if strings.Contains(response.Body, `"positions"`) {
+			t.Errorf("Expected no positions without includePositions, got: %s", response.Body)
+		}
+	})
+}
+
+func TestHandlerPartialOutput(t *testing.T) {
+	body := `{"docx": "` + loadSampleDocxBase64(t) + `", "data": {"Org_Name": "ACME", "Org_City": "Springfield"}, "options": {"partialOutput": true}}`
+	response, err := handler(context.Background(), events.APIGatewayProxyRequest{Path: "/merge", Body: body})
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+	}
+
+	var responseData map[string]interface{}
+	if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+		t.Fatalf("Failed to unmarshal response body: %v", err)
+	}
+	if _, exists := responseData["mergedDocument"]; exists {
+		t.Error("mergedDocument should be omitted with partialOutput")
+	}
+
+	changedParts, ok := responseData["changedParts"].(map[string]interface{})
+	if !ok || len(changedParts) != 1 {
+		t.Fatalf("Expected only word/document.xml to change, got %v", responseData["changedParts"])
+	}
+	documentXML, err := base64.StdEncoding.DecodeString(changedParts["word/document.xml"].(string))
+	if err != nil {
+		t.Fatalf("Failed to decode word/document.xml: %v", err)
+	}
+	if !strings.Contains(string(documentXML), "ACME") {
+		t.Error("Expected the merged document.xml to hold the merged value")
+	}
+	if added, _ := responseData["addedParts"].([]interface{}); len(added) != 0 {
+		t.Errorf("Expected no added parts, got %v", added)
+	}
+	if removed, _ := responseData["removedParts"].([]interface{}); len(removed) != 0 {
+		t.Errorf("Expected no removed parts, got %v", removed)
+	}
+
+	// Batch merges return whole documents only
+	body = `{"docx": "` + loadSampleDocxBase64(t) + `", "records": [{"Org_Name": "ACME"}], "options": {"partialOutput": true}}`
+	response, err = handler(context.Background(), events.APIGatewayProxyRequest{Path: "/merge", Body: body})
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	if response.StatusCode != 400 {
+		t.Errorf("Expected status code 400 for a partial batch merge, got %d", response.StatusCode)
+	}
+}
+
+func TestHandlerEchoConfig(t *testing.T) {
+	encodedDocx := loadSampleDocxBase64(t)
+
+	t.Run("merge reports resolved defaults", func(t *testing.T) {
+		body := `{"docx": "` + encodedDocx + `", "data": {"Org_Name": "ACME"}, "options": {"echoConfig": true, "compact": true, "flatten": true}}`
+		response, err := handler(context.Background(), events.APIGatewayProxyRequest{Path: "/merge", Body: body})
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if response.StatusCode != 200 {
+			t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+		}
+
+		var responseData struct {
+			Config *EffectiveConfig `json:"config"`
+		}
+		if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+		config := responseData.Config
+		if config == nil {
+			t.Fatalf("Expected a config field in %s", response.Body)
+		}
+		if config.DefaultFieldType != "string" || config.OutputFormat != "json" || config.Timezone != "UTC" {
+			t.Errorf("Expected resolved defaults, got %+v", config)
+		}
+		if config.CurrencySymbol != "$" {
+			t.Errorf("Expected the default currency symbol, got %q", config.CurrencySymbol)
+		}
+		if !config.LenientBase64 || config.MaxRepeatExpansions != merge.DefaultMaxExpansions {
+			t.Errorf("Expected lenient base64 and the default expansion limit, got %+v", config)
+		}
+		if !config.Compact || config.RemoveEmptyParagraphs {
+			t.Errorf("Expected the requested options to be echoed, got %+v", config)
+		}
+		if !reflect.DeepEqual(config.FallbackSources, []string{"environment", "server clock"}) {
+			t.Errorf("Unexpected fallback sources %v", config.FallbackSources)
+		}
+		if !reflect.DeepEqual(config.IgnoredOptions, []string{"flatten"}) {
+			t.Errorf("Expected the unknown 'flatten' option to be reported as ignored, got %v", config.IgnoredOptions)
+		}
+	})
+
+	t.Run("detect", func(t *testing.T) {
+		body := `{"docx": "` + encodedDocx + `", "options": {"echoConfig": true, "timezone": "Europe/Berlin"}}`
+		response, err := handler(context.Background(), events.APIGatewayProxyRequest{Path: "/detect", Body: body})
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		var detectResponse DetectResponse
+		if err := json.Unmarshal([]byte(response.Body), &detectResponse); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+		if detectResponse.Config == nil || detectResponse.Config.Timezone != "Europe/Berlin" {
+			t.Errorf("Expected the config with the requested timezone, got %+v", detectResponse.Config)
+		}
+	})
+
+	t.Run("omitted by default", func(t *testing.T) {
+		body := `{"docx": "` + encodedDocx + `"}`
+		response, err := handler(context.Background(), events.APIGatewayProxyRequest{Path: "/detect", Body: body})
+		if err != nil {
+			t.Fatalf("Handler returned error: %v", err)
+		}
+		if strings.Contains(response.Body, `"config"`) {
+			t.Errorf("Expected no config without echoConfig, got %s", response.Body)
+		}
+	})
+}
+
+func TestHandlerCapabilities(t *testing.T) {
+	response, err := handler(context.Background(), events.APIGatewayProxyRequest{Path: "/capabilities", HTTPMethod: "GET"})
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	if response.StatusCode != 200 {
+		t.Fatalf("Expected status code 200, got %d: %s", response.StatusCode, response.Body)
+	}
+
+	var responseData struct {
+		CapabilitiesResponse
+		APIVersion string `json:"apiVersion"`
+	}
+	if err := json.Unmarshal([]byte(response.Body), &responseData); err != nil {
+		t.Fatalf("Failed to unmarshal response body: %v", err)
+	}
+	if responseData.APIVersion != defaultAPIVersion || !reflect.DeepEqual(responseData.APIVersions, supportedAPIVersions) {
+		t.Errorf("Unexpected API versions: %s, %v", responseData.APIVersion, responseData.APIVersions)
+	}
+	if !reflect.DeepEqual(responseData.FieldTypes, fields.FieldTypes()) {
+		t.Errorf("Field types = %v, want %v", responseData.FieldTypes, fields.FieldTypes())
+	}
+	if !reflect.DeepEqual(responseData.OutputFormats["/merge"], []string{"json", "zip", "pdf"}) {
+		t.Errorf("Unexpected /merge output formats: %v", responseData.OutputFormats)
+	}
+
+	options := make(map[string]OptionCapability)
+	for _, option := range responseData.Options {
+		options[option.Name] = option
+	}
+	if len(options) != len(knownOptionKeys) {
+		t.Errorf("Expected %d options, got %d", len(knownOptionKeys), len(options))
+	}
+	for _, expected := range []OptionCapability{
+		{Name: "defaultFieldType", Type: "string", Default: "string"},
+		{Name: "failFast", Type: "boolean", Default: false},
+		{Name: "outputFormat", Type: "string", Default: "json"},
+		{Name: "timezone", Type: "string", Default: "UTC"},
+		{Name: "lenientBase64", Type: "boolean", Default: true},
+		{Name: "valueTransforms", Type: "array", Default: []interface{}{}},
+		{Name: "fieldMapping", Type: "object", Default: map[string]interface{}{}},
+	} {
+		if option, ok := options[expected.Name]; !ok || !reflect.DeepEqual(option, expected) {
+			t.Errorf("Option %s = %+v, want %+v", expected.Name, option, expected)
+		}
 	}
 }
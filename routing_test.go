@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+
+	"com/lifenture/flash-mail-merge/internal/testutil"
+)
+
+// gatewayEvent describes where an API Gateway proxy event carries its path;
+// the REST, HTTP and console test events each fill a different field
+type gatewayEvent func(path, body string) events.APIGatewayProxyRequest
+
+var gatewayEvents = map[string]gatewayEvent{
+	"Path": func(path, body string) events.APIGatewayProxyRequest {
+		return events.APIGatewayProxyRequest{HTTPMethod: "POST", Path: path, Body: body}
+	},
+	"Resource": func(path, body string) events.APIGatewayProxyRequest {
+		return events.APIGatewayProxyRequest{HTTPMethod: "POST", Resource: path, Body: body}
+	},
+	"RequestContext.Path": func(path, body string) events.APIGatewayProxyRequest {
+		request := events.APIGatewayProxyRequest{HTTPMethod: "POST", Body: body}
+		request.RequestContext.Path = path
+		return request
+	},
+}
+
+// invoke feeds an event through handler and decodes the JSON response body
+func invoke(t *testing.T, request events.APIGatewayProxyRequest) (int, map[string]json.RawMessage) {
+	t.Helper()
+	response, err := handler(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Handler returned error: %v", err)
+	}
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(response.Body), &body); err != nil {
+		t.Fatalf("Failed to unmarshal response body %q: %v", response.Body, err)
+	}
+	return response.StatusCode, body
+}
+
+// TestHandlerRouting feeds a valid request for every endpoint through handler,
+// with the path in each place API Gateway may put it, and checks that the
+// response comes from the endpoint's handler
+func TestHandlerRouting(t *testing.T) {
+	documentXML := testutil.DocumentXML(`<w:p><w:r><w:t>Dear «FirstName»</w:t></w:r></w:p>`)
+	encodedDocx := base64.StdEncoding.EncodeToString(testutil.Docx(t, documentXML))
+	encodedXML, err := json.Marshal(documentXML)
+	if err != nil {
+		t.Fatalf("Failed to encode document XML: %v", err)
+	}
+
+	routes := []struct {
+		path string
+		body string
+		key  string // response key only this endpoint returns
+	}{
+		{path: "/merge", body: `{"docx": "` + encodedDocx + `", "data": {"FirstName": "Jane"}}`, key: "mergedDocument"},
+		{path: "/merge-batch", body: `{"docx": "` + encodedDocx + `", "rows": [{"FirstName": "Jane"}]}`, key: "results"},
+		{path: "/merge/xml", body: `{"xml": ` + string(encodedXML) + `, "data": {"FirstName": "Jane"}}`, key: "xml"},
+		{path: "/preview", body: `{"docx": "` + encodedDocx + `", "data": {"FirstName": "Jane"}}`, key: "text"},
+		{path: "/validate", body: `{"docx": "` + encodedDocx + `", "data": {"FirstName": "Jane"}}`, key: "valid"},
+		{path: "/detect", body: `{"docx": "` + encodedDocx + `"}`, key: "documentName"},
+		{path: "/template/lint", body: `{"docx": "` + encodedDocx + `"}`, key: "mergeable"},
+		{path: "/capabilities", key: "endpoints"},
+	}
+
+	for source, event := range gatewayEvents {
+		for _, route := range routes {
+			t.Run(source+" "+route.path, func(t *testing.T) {
+				status, body := invoke(t, event(route.path, route.body))
+				if status != 200 {
+					t.Fatalf("Expected status code 200, got %d: %v", status, body)
+				}
+				if _, ok := body[route.key]; !ok {
+					t.Errorf("Expected %q in the response of %s, got %v", route.key, route.path, body)
+				}
+			})
+		}
+	}
+}
+
+// TestHandlerRoutingFallbacks checks the routing of events without a path and
+// with an unknown path
+func TestHandlerRoutingFallbacks(t *testing.T) {
+	encodedDocx := base64.StdEncoding.EncodeToString(testutil.Docx(t, testutil.DocumentXML(`<w:p><w:r><w:t>«FirstName»</w:t></w:r></w:p>`)))
+
+	t.Run("no path merges", func(t *testing.T) {
+		status, body := invoke(t, events.APIGatewayProxyRequest{Body: `{"docx": "` + encodedDocx + `", "data": {"FirstName": "Jane"}}`})
+		if status != 200 {
+			t.Fatalf("Expected status code 200, got %d: %v", status, body)
+		}
+		if _, ok := body["mergedDocument"]; !ok {
+			t.Errorf("Expected a merge response, got %v", body)
+		}
+	})
+
+	t.Run("Path wins over Resource", func(t *testing.T) {
+		request := events.APIGatewayProxyRequest{Path: "/capabilities", Resource: "/detect"}
+		status, body := invoke(t, request)
+		if _, ok := body["endpoints"]; status != 200 || !ok {
+			t.Errorf("Expected the /capabilities response, got %d: %v", status, body)
+		}
+	})
+
+	for source, event := range gatewayEvents {
+		t.Run(source+" unknown endpoint", func(t *testing.T) {
+			status, body := invoke(t, event("/unknown", `{}`))
+			if status != 404 {
+				t.Errorf("Expected status code 404, got %d: %v", status, body)
+			}
+		})
+	}
+}